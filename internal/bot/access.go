@@ -0,0 +1,173 @@
+package bot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+// AccessStore keeps the access decisions made with /allow and /deny. They take
+// precedence over allowed_user_ids from secrets.json.
+type AccessStore interface {
+	// Get returns the decision for the user and whether one was made.
+	Get(userID int64) (allowed, decided bool)
+	// Set records the decision for the user.
+	Set(userID int64, allowed bool)
+	// Range calls fn with every recorded decision.
+	Range(fn func(userID int64, allowed bool))
+}
+
+// isAllowed reports whether the user may use the bot. Administrators always may.
+// Without allowed_user_ids in the configuration the bot is open to everyone
+// who has not been denied.
+func (h *Handler) isAllowed(userID int64) bool {
+	s := h.secrets
+	if s.IsAdmin(userID) {
+		return true
+	}
+	if allowed, decided := h.Access.Get(userID); decided {
+		return allowed
+	}
+	return s.AllowedUserIDs == nil || slices.Contains(s.AllowedUserIDs, userID)
+}
+
+// rejectUnauthorized logs an attempt by a user without access and politely refuses
+// it. Users banned for persistent attempts are ignored.
+func (h *Handler) rejectUnauthorized(user *tgbotapi.User, chatID int64) {
+	bot := h.bot
+	if h.noteTelegramProbe(user, chatID) {
+		return
+	}
+	slog.Warn("Отклонено обращение пользователя без доступа", "user_id", user.ID, "username", user.UserName)
+	text := fmt.Sprintf("Извините, у вас нет доступа к этому боту. Чтобы получить его, передайте администратору ваш ID: %d", user.ID)
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+}
+
+// handleAccessCommand grants (/allow <ID>) or revokes (/deny <ID>) access to the bot.
+func (h *Handler) handleAccessCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	command := message.Command()
+	userID, err := strconv.ParseInt(strings.TrimSpace(message.CommandArguments()), 10, 64)
+	if err != nil {
+		bot.Send(newReply(message, fmt.Sprintf("Использование: /%s <ID пользователя>", command)))
+		return
+	}
+	allowed := command == "allow"
+	if !allowed && secrets.IsAdmin(userID) {
+		bot.Send(newReply(message, "Администраторам нельзя закрыть доступ, уберите их из admin_user_ids."))
+		return
+	}
+
+	h.Access.Set(userID, allowed)
+	if allowed {
+		probes.unban(PROBE_TELEGRAM, strconv.FormatInt(userID, 10))
+	}
+	audit(message.From, "/%s %d", command, userID)
+	if allowed {
+		bot.Send(newReply(message, fmt.Sprintf("Пользователю %d открыт доступ к боту.", userID)))
+	} else {
+		bot.Send(newReply(message, fmt.Sprintf("Пользователю %d закрыт доступ к боту.", userID)))
+	}
+}
+
+// memoryAccessStore is an AccessStore kept in process memory.
+type memoryAccessStore struct {
+	mu        sync.Mutex
+	decisions map[int64]bool
+}
+
+func (m *memoryAccessStore) Get(userID int64) (bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	allowed, decided := m.decisions[userID]
+	return allowed, decided
+}
+
+func (m *memoryAccessStore) Set(userID int64, allowed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decisions[userID] = allowed
+}
+
+func (m *memoryAccessStore) Range(fn func(userID int64, allowed bool)) {
+	m.mu.Lock()
+	copies := maps.Clone(m.decisions)
+	m.mu.Unlock()
+	for userID, allowed := range copies {
+		fn(userID, allowed)
+	}
+}
+
+// accessBucket holds "1" for allowed and "0" for denied users keyed by user ID.
+var accessBucket = []byte("access")
+
+// boltAccessStore is an AccessStore persisted in the bbolt database.
+type boltAccessStore struct {
+	db *bolt.DB
+}
+
+// newBoltAccessStore creates the access bucket in the given database.
+func newBoltAccessStore(db *bolt.DB) (*boltAccessStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accessBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы доступа: %w", err)
+	}
+	return &boltAccessStore{db: db}, nil
+}
+
+func (b *boltAccessStore) Get(userID int64) (bool, bool) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value = slices.Clone(tx.Bucket(accessBucket).Get(state.Int64Key(userID)))
+		return nil
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения доступа пользователя", "user_id", userID, "error", err)
+	}
+	return string(value) == "1", value != nil
+}
+
+func (b *boltAccessStore) Set(userID int64, allowed bool) {
+	value := []byte("0")
+	if allowed {
+		value = []byte("1")
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accessBucket).Put(state.Int64Key(userID), value)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения доступа пользователя", "user_id", userID, "error", err)
+	}
+}
+
+func (b *boltAccessStore) Range(fn func(userID int64, allowed bool)) {
+	decisions := make(map[int64]bool)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accessBucket).ForEach(func(k, v []byte) error {
+			decisions[int64(binary.BigEndian.Uint64(k))] = string(v) == "1"
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения доступа", "error", err)
+	}
+	for userID, allowed := range decisions {
+		fn(userID, allowed)
+	}
+}
@@ -0,0 +1,232 @@
+package bot
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+const (
+	// MAX_MESSAGE_LENGTH is the Telegram limit on the text of a single message.
+	MAX_MESSAGE_LENGTH = 4096
+	// STATS_RECENT_ERRORS is how many of today's failed sends /stats lists.
+	STATS_RECENT_ERRORS = 5
+	// STATS_ERROR_LENGTH caps the error text of each of them.
+	STATS_ERROR_LENGTH = 200
+)
+
+// audit writes an entry about a privileged action to the log.
+func audit(user *tgbotapi.User, action string, args ...any) {
+	slog.Info("[AUDIT] "+fmt.Sprintf(action, args...), "audit", true, "user_id", user.ID, "username", user.UserName)
+}
+
+// auditCLI writes an audit entry about an action run from the command line, naming
+// the operating system user instead of a Telegram one.
+func auditCLI(action string, args ...any) {
+	slog.Info("[AUDIT] "+fmt.Sprintf(action, args...), "audit", true, "os_user", os.Getenv("USER"))
+}
+
+// requireAdmin checks that the command author is an administrator, replying with a denial otherwise.
+// Denials are audited here; a granted command audits what it changes itself.
+func requireAdmin(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) bool {
+	if !secrets.IsAdmin(message.From.ID) {
+		audit(message.From, "отказано в доступе к /%s", message.Command())
+		bot.Send(newReply(message, "Команда доступна только администраторам."))
+		return false
+	}
+	return true
+}
+
+// handleRawCommand performs an arbitrary provider API call for debugging:
+// /raw unisender <method> key=value...
+func handleRawCommand(ctx context.Context, bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) < 2 || fields[0] != "unisender" {
+		bot.Send(newReply(message, "Использование: /raw unisender <метод> ключ=значение..."))
+		return
+	}
+	method := fields[1]
+	params := url.Values{}
+	for _, pair := range fields[2:] {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "api_key" {
+			bot.Send(newReply(message, fmt.Sprintf("Некорректный параметр: %s", pair)))
+			return
+		}
+		params.Add(key, value)
+	}
+	audit(message.From, "/raw unisender %s %s", method, params.Encode())
+
+	var result json.RawMessage
+	if err := mailer.CallUnisender(ctx, secrets.UnisenderAPIKey, method, params, &result); err != nil {
+		audit(message.From, "/raw unisender %s: ошибка: %v", method, err)
+		bot.Send(newReply(message, fmt.Sprintf("Ошибка: %v", err)))
+		return
+	}
+	audit(message.From, "/raw unisender %s: успешно, %d байт", method, len(result))
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, result, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(result)
+	}
+	text := pretty.String()
+	if len(text) > MAX_MESSAGE_LENGTH-100 {
+		// Send oversized responses as a file instead of cutting them off
+		bot.Send(tgbotapi.NewDocument(message.Chat.ID, tgbotapi.FileBytes{Name: method + ".json", Bytes: pretty.Bytes()}))
+		return
+	}
+	bot.Send(newReply(message, text))
+}
+
+// handleMemStatsCommand reports memory use, how well mailer buffers are reused and
+// the disk taken by downloaded attachments (admin only).
+func handleMemStatsCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	buffers := mailer.BufferStats()
+	taken, allocated := buffers.Taken, buffers.Allocated
+	reused := 0.0
+	if taken > 0 {
+		reused = 100 * float64(taken-min(allocated, taken)) / float64(taken)
+	}
+	used, files := tempFiles.usage()
+	const mb = 1 << 20
+	text := fmt.Sprintf("Память: в куче %.1f МБ, выделено всего %.1f МБ (%d объектов), сборок мусора %d, паузы %s.\n"+
+		"Буферы писем: выдано %d, создано %d (повторно использовано %.0f%%), не возвращено из-за размера %d.\n"+
+		"Временные вложения на диске: %d файлов, %.1f из %.0f МБ.",
+		float64(m.HeapAlloc)/mb, float64(m.TotalAlloc)/mb, m.Mallocs, m.NumGC, time.Duration(m.PauseTotalNs).Round(time.Microsecond),
+		taken, allocated, reused, buffers.Dropped,
+		files, float64(used)/mb, float64(tempFiles.quota)/mb)
+	bot.Send(newReply(message, text))
+}
+
+// handleNetStatsCommand reports how requests to the email providers got their
+// connections (admin only).
+func handleNetStatsCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	conns := mailer.ConnStats()
+	opened, reused := conns.Opened, conns.Reused
+	share := 0.0
+	if opened+reused > 0 {
+		share = 100 * float64(reused) / float64(opened+reused)
+	}
+	text := fmt.Sprintf("Соединения с почтовыми API: новых %d, повторно использовано %d (%.0f%% запросов).\n"+
+		"Из новых: с возобновлением TLS-сессии %d, по HTTP/2 %d.",
+		opened, reused, share, conns.Resumed, conns.HTTP2)
+	bot.Send(newReply(message, text))
+}
+
+// handleStatsCommand reports today's sends, counted from midnight in the bot's time
+// zone, with the latest errors, the users and the send limits (admin only).
+func (h *Handler) handleStatsCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	loc := secrets.Location()
+	now := time.Now().In(loc)
+	entries := h.History.Since(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc))
+	counts := make(map[string]int)
+	senders := make(map[int64]bool)
+	var failures []SentEmail
+	for _, e := range entries {
+		// Entries written before attempts were recorded were all sent
+		status := cmp.Or(e.Status, HISTORY_SENT)
+		counts[status]++
+		if e.UserID != 0 {
+			senders[e.UserID] = true
+		}
+		if status != HISTORY_SENT && len(failures) < STATS_RECENT_ERRORS {
+			failures = append(failures, e)
+		}
+	}
+	var known, composing int
+	h.States.Range(func(_ int64, state UserState) {
+		known++
+		if state.State != "" && state.State != "initial" {
+			composing++
+		}
+	})
+
+	text := fmt.Sprintf("Сегодня с 00:00 %s: писем %d — отправлено %d, частично %d, с ошибкой %d. Отправляли %d польз.\n"+
+		"Пользователей бота: %d, заполняют письмо сейчас: %d.\n%s",
+		now.Format("MST"), len(entries), counts[HISTORY_SENT], counts[HISTORY_PARTIAL], counts[HISTORY_FAILED], len(senders),
+		known, composing, describeLimits(sendLimits.current()))
+	if survey := h.describeSurvey(); survey != "" {
+		text += "\n" + survey
+	}
+	if len(failures) > 0 {
+		text += "\n\nПоследние ошибки:"
+		for _, e := range failures {
+			reason := []rune(e.Error)
+			if len(reason) > STATS_ERROR_LENGTH {
+				reason = append(reason[:STATS_ERROR_LENGTH], []rune("…")...)
+			}
+			text += fmt.Sprintf("\n#%d %s — %s", e.ID, e.SentAt.In(loc).Format(SCHEDULE_CLOCK_LAYOUT), string(reason))
+		}
+	}
+	bot.Send(newReply(message, text))
+}
+
+// handleUsersCommand lists the users who are composing a letter right now, with
+// the wizard step and subject of their draft (admin only).
+func (h *Handler) handleUsersCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	type session struct {
+		userID int64
+		state  UserState
+	}
+	var sessions []session
+	known := 0
+	h.States.Range(func(userID int64, state UserState) {
+		known++
+		if state.State != "" && state.State != "initial" {
+			sessions = append(sessions, session{userID, state})
+		}
+	})
+	slices.SortFunc(sessions, func(a, b session) int { return cmp.Compare(a.userID, b.userID) })
+	if len(sessions) == 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Пользователей бота: %d. Сейчас никто не заполняет письмо.", known)))
+		return
+	}
+
+	text := fmt.Sprintf("Пользователей бота: %d. Заполняют письмо: %d.\n", known, len(sessions))
+	for i, s := range sessions {
+		line := fmt.Sprintf("\n%d — шаг %s", s.userID, s.state.State)
+		if s.state.Subject != "" {
+			line += fmt.Sprintf(", тема «%s»", s.state.Subject)
+		}
+		if len(text)+len(line) > MAX_MESSAGE_LENGTH-100 {
+			text += fmt.Sprintf("\n…и ещё %d", len(sessions)-i)
+			break
+		}
+		text += line
+	}
+	bot.Send(newReply(message, text))
+}
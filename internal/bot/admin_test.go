@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// adminBot returns a handler on a fake Telegram with wizardUser as its only
+// administrator and empty stores.
+func adminBot(t *testing.T) (*fakeTelegram, *Handler) {
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", AdminUserIDs: []int64{wizardUser}, Timezone: "UTC"}
+	defaultLimits := sendLimits
+	t.Cleanup(func() { sendLimits = defaultLimits })
+	sendLimits = newRateLimiter(RateLimit{})
+	return telegram, NewHandler(bot, nil, secrets, MemoryStores())
+}
+
+// userMessage is a command sent by a user other than wizardUser in their chat.
+func userMessage(userID int64, text string) tgbotapi.Update {
+	update := textAction(text).update()
+	update.Message.From = &tgbotapi.User{ID: userID, FirstName: "Пользователь"}
+	update.Message.Chat = &tgbotapi.Chat{ID: userID, Type: "private"}
+	return update
+}
+
+func TestAdminCommandsDenied(t *testing.T) {
+	telegram, handler := adminBot(t)
+	for _, command := range []string{"/stats", "/users", "/broadcast привет", "/setlimit per_hour 1"} {
+		handler.HandleUpdate(context.Background(), userMessage(9, command))
+		if _, ok := telegram.find(9, "Команда доступна только администраторам."); !ok {
+			t.Errorf("%s: no denial:\n%s", command, telegram.transcript(9))
+		}
+	}
+	if limit := sendLimits.current(); limit.PerHour != 0 {
+		t.Errorf("limit changed by a non-admin: %+v", limit)
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	telegram, handler := adminBot(t)
+	now := time.Now()
+	for _, entry := range []SentEmail{
+		{UserID: 1, Subject: "Вчера", SentAt: now.Add(-48 * time.Hour), Status: HISTORY_SENT},
+		{UserID: 1, Subject: "Отчёт", SentAt: now, Status: HISTORY_SENT},
+		{UserID: 2, Subject: "Счёт", SentAt: now, Status: HISTORY_PARTIAL, Error: "не принят адрес b@example.com"},
+		{UserID: 2, Subject: "Акт", SentAt: now, Status: HISTORY_FAILED, Error: "сервер недоступен"},
+	} {
+		handler.History.Record(&entry)
+	}
+	handler.States.Update(3, func(s *UserState) { s.State = "await_body" })
+
+	handler.HandleUpdate(context.Background(), textAction("/stats").update())
+
+	transcript := telegram.transcript(wizardUser)
+	for _, want := range []string{"писем 3 — отправлено 1, частично 1, с ошибкой 1. Отправляли 2 польз.",
+		"Пользователей бота: 1, заполняют письмо сейчас: 1.", "— сервер недоступен", "— не принят адрес"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("no %q in:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestUsersCommand(t *testing.T) {
+	telegram, handler := adminBot(t)
+	handler.States.Update(3, func(s *UserState) { *s = UserState{State: "await_body", Subject: "Отчёт"} })
+	handler.States.Update(4, func(s *UserState) { s.State = "initial" })
+
+	handler.HandleUpdate(context.Background(), textAction("/users").update())
+
+	if _, ok := telegram.find(wizardUser, "Пользователей бота: 2. Заполняют письмо: 1.\n\n3 — шаг await_body, тема «Отчёт»"); !ok {
+		t.Errorf("unexpected /users reply:\n%s", telegram.transcript(wizardUser))
+	}
+}
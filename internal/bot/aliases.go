@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"fmt"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MAX_RECIPIENT_SUGGESTIONS is how many contact and alias names are suggested for
+// a name that matched none of them.
+const MAX_RECIPIENT_SUGGESTIONS = 5
+
+// aliasAddresses returns the addresses of the alias from aliases in secrets.json,
+// matched ignoring case, or nil when there is no such alias.
+func aliasAddresses(secrets *Secrets, name string) []string {
+	for alias, list := range secrets.Aliases {
+		if !strings.EqualFold(alias, name) {
+			continue
+		}
+		addresses := make([]string, 0, len(list))
+		for _, entry := range list {
+			// Validate has checked the addresses, the display names are dropped so
+			// that a comma in one does not split the recipient list
+			if address, err := mail.ParseAddress(entry); err == nil {
+				addresses = append(addresses, address.Address)
+			}
+		}
+		return addresses
+	}
+	return nil
+}
+
+// resolveRecipients parses the addresses typed at the recipient or a copy step,
+// expanding contact names and aliases. A name that is neither gets the names it
+// may be a typo of suggested after the error.
+func (h *Handler) resolveRecipients(userID int64, text string) ([]string, error) {
+	recipients, err := parseRecipients(h.expandContacts(userID, text))
+	if err == nil {
+		return recipients, nil
+	}
+	if names := h.recipientSuggestions(userID, text); len(names) > 0 {
+		return nil, fmt.Errorf("%w\nВозможно, вы имели в виду: %s", err, strings.Join(names, ", "))
+	}
+	return nil, err
+}
+
+// recipientSuggestions returns the contact and alias names containing a part of
+// the recipient list that is not an address, ignoring case.
+func (h *Handler) recipientSuggestions(userID int64, text string) []string {
+	var names []string
+	for _, c := range h.Contacts.List(userID) {
+		names = append(names, c.Name)
+	}
+	names = append(names, h.secrets.AliasNames()...)
+
+	var suggestions []string
+	for _, part := range strings.Split(text, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" || strings.Contains(part, "@") {
+			continue
+		}
+		for _, name := range names {
+			if strings.Contains(strings.ToLower(name), part) && !slices.Contains(suggestions, name) {
+				suggestions = append(suggestions, name)
+			}
+		}
+	}
+	return suggestions[:min(len(suggestions), MAX_RECIPIENT_SUGGESTIONS)]
+}
+
+// aliasButtons returns a button for each alias, up to MAX_CONTACT_BUTTONS.
+func aliasButtons(secrets *Secrets) [][]tgbotapi.InlineKeyboardButton {
+	names := secrets.AliasNames()
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, name := range names[:min(len(names), MAX_CONTACT_BUTTONS)] {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(name+" — "+strings.Join(aliasAddresses(secrets, name), ", "), fmt.Sprintf("alias:%d", i)),
+		))
+	}
+	return rows
+}
+
+// handleAliasCallback uses the addresses of the tapped alias as the recipients of
+// the draft.
+func (h *Handler) handleAliasCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	state, exists := h.States.Get(userID)
+	if !exists || state.State != "await_recipient" {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Получатель уже выбран."
+	}
+	names := secrets.AliasNames()
+	i, err := strconv.Atoi(payload)
+	if err != nil || i < 0 || i >= len(names) {
+		return "Псевдоним не найден, введите адрес вручную."
+	}
+	recipients, err := parseRecipients(strings.Join(aliasAddresses(secrets, names[i]), ","))
+	if err != nil {
+		return err.Error()
+	}
+
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	state.Recipients = recipients
+	h.acceptRecipients(query.Message, &state, fmt.Sprintf("Получатели (%s): %s", names[i], strings.Join(recipients, ", ")))
+	h.States.Update(userID, func(s *UserState) { *s = state })
+	return ""
+}
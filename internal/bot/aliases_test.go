@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// aliasSecrets are the wizard settings with two aliases.
+func aliasSecrets() *Secrets {
+	secrets := wizardSecrets()
+	secrets.Aliases = map[string][]string{
+		"бухгалтерия": {"accounting@example.com", "Главбух <chief@example.com>"},
+		"склад":       {"stock@example.com"},
+	}
+	return secrets
+}
+
+func TestResolveRecipientsExpandsAliases(t *testing.T) {
+	var steps []string
+	handler, _, _ := newWizardHandler(t, aliasSecrets(), &steps)
+	handler.Contacts.Add(wizardUser, Contact{Name: "Склад", Email: "my-stock@example.com"})
+
+	got, err := handler.resolveRecipients(wizardUser, "Бухгалтерия, склад, a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user's own contact wins over the alias of the same name
+	want := []string{"accounting@example.com", "chief@example.com", "my-stock@example.com", "a@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveRecipients = %v, want %v", got, want)
+	}
+
+	_, err = handler.resolveRecipients(wizardUser, "бух")
+	if err == nil || !strings.Contains(err.Error(), "Возможно, вы имели в виду: бухгалтерия") {
+		t.Errorf("error = %v, want the alias suggested", err)
+	}
+	_, err = handler.resolveRecipients(wizardUser, "кадры")
+	if err == nil || strings.Contains(err.Error(), "Возможно") {
+		t.Errorf("error = %v, want no suggestions", err)
+	}
+}
+
+func TestWizardOffersAliases(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, aliasSecrets(), &steps)
+	for _, action := range []wizardAction{textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), tapAction("alias:0")} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	if rows := aliasButtons(aliasSecrets()); len(rows) != 2 || rows[0][0].Text != "бухгалтерия — accounting@example.com, chief@example.com" {
+		t.Errorf("alias buttons = %+v", rows)
+	}
+	if want := "Получатели (бухгалтерия): accounting@example.com, chief@example.com"; !strings.Contains(bot.texts(), want) {
+		t.Errorf("bot did not say %q:\n%s", want, bot.texts())
+	}
+	state, _ := handler.States.Get(wizardUser)
+	if state.State != "await_cc" || len(state.Recipients) != 2 {
+		t.Errorf("state = %+v, want both addresses and the copy step", state)
+	}
+}
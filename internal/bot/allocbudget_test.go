@@ -0,0 +1,29 @@
+//go:build !race
+
+// The race detector instruments the handlers with allocations of its own, so the
+// budget is only checked in ordinary builds.
+
+package bot
+
+import (
+	"context"
+	"testing"
+)
+
+// UPDATE_ALLOCATION_BUDGET caps the allocations of handling a wizard step, most of
+// which are made by the Bot API client. A change going over it should say why.
+const UPDATE_ALLOCATION_BUDGET = 80
+
+func TestHandleUpdateAllocationBudget(t *testing.T) {
+	bot := benchmarkBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com"}
+	handler := NewHandler(bot, nil, secrets, MemoryStores())
+	update := textAction("Отчёт за май").update()
+	allocs := testing.AllocsPerRun(100, func() {
+		handler.States.Update(wizardUser, func(s *UserState) { *s = UserState{State: "await_subject"} })
+		handler.HandleUpdate(context.Background(), update)
+	})
+	if allocs > UPDATE_ALLOCATION_BUDGET {
+		t.Errorf("handling a wizard step took %.0f allocations, budget %d", allocs, UPDATE_ALLOCATION_BUDGET)
+	}
+}
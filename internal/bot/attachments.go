@@ -0,0 +1,394 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// DOWNLOAD_CHUNK_SIZE is the size of a single ranged request when downloading files.
+	DOWNLOAD_CHUNK_SIZE = 1024 * 1024
+	// DOWNLOAD_MAX_RETRIES is how many times in a row a failed chunk is retried.
+	DOWNLOAD_MAX_RETRIES = 5
+	// DOWNLOAD_PROGRESS_INTERVAL is the minimal pause between progress message edits.
+	DOWNLOAD_PROGRESS_INTERVAL = 2 * time.Second
+	// MAX_DRAFT_ATTACHMENTS is how many files can be attached to a letter in the wizard.
+	MAX_DRAFT_ATTACHMENTS = 10
+	// FILE_EMAIL_BODY is the standard body of emails sent from a forwarded document.
+	FILE_EMAIL_BODY = "Добрый день!\n\nВо вложении файл «%s».\n\nОтправлено через Telegram."
+	// PENDING_FILE_TTL is how long the button offering to email a document works.
+	PENDING_FILE_TTL = 24 * time.Hour
+)
+
+// releaseAttachments removes the downloaded files of a letter that is done with.
+func releaseAttachments(attachments []Attachment) {
+	for _, a := range attachments {
+		if a.Path != "" {
+			tempFiles.remove(a.Path)
+		}
+	}
+}
+
+// blockedAttachmentExtensions lists executable file types that mail services reject.
+var blockedAttachmentExtensions = []string{".exe", ".bat", ".cmd", ".com", ".scr", ".pif", ".js", ".vbs", ".msi", ".jar"}
+
+// blockedAttachment returns the reply refusing a file of a blocked type, or "".
+func blockedAttachment(name string) string {
+	if ext := filepath.Ext(name); slices.Contains(blockedAttachmentExtensions, strings.ToLower(ext)) {
+		return fmt.Sprintf("Файлы типа %s нельзя отправить по почте.", ext)
+	}
+	return ""
+}
+
+// PendingFile is a document the user sent that awaits a one-tap send confirmation.
+type PendingFile struct {
+	UserID     int64
+	ChatID     int64
+	FileID     string
+	FileName   string
+	FileSize   int
+	Recipient  string
+	Subject    string
+	SenderName string
+	Expires    time.Time // The button stops working after PENDING_FILE_TTL
+	Sending    bool      // A tap is downloading and sending the file right now
+}
+
+// offerFileEmail offers to email a received document to the default recipient,
+// using the caption as the subject.
+func (h *Handler) offerFileEmail(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	doc := message.Document
+	if limit := secrets.AttachmentLimit(); doc.FileSize > limit {
+		bot.Send(newReply(message, fmt.Sprintf("Файл слишком большой: бот может скачивать файлы до %d МБ.", limit/1024/1024)))
+		return
+	}
+	if refusal := blockedAttachment(doc.FileName); refusal != "" {
+		bot.Send(newReply(message, refusal))
+		return
+	}
+
+	subject := strings.TrimSpace(message.Caption)
+	if subject == "" {
+		subject = doc.FileName
+	}
+	if err := validateField(FieldSubject, subject); err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	subject, recipient := routeByLanguage(secrets, subject, "")
+	senderName := strings.TrimSpace(message.From.FirstName + " " + message.From.LastName)
+
+	now := time.Now()
+	h.pendingFilesMu.Lock()
+	// Offers nobody tapped are dropped here, as there is no other moment to notice them
+	for id, file := range h.pendingFiles {
+		if now.After(file.Expires) && !file.Sending {
+			delete(h.pendingFiles, id)
+		}
+	}
+	h.pendingFileSeq++
+	id := h.pendingFileSeq
+	h.pendingFiles[id] = &PendingFile{
+		UserID:     message.From.ID,
+		ChatID:     message.Chat.ID,
+		FileID:     doc.FileID,
+		FileName:   doc.FileName,
+		FileSize:   doc.FileSize,
+		Recipient:  recipient,
+		Subject:    subject,
+		SenderName: senderName,
+		Expires:    now.Add(PENDING_FILE_TTL),
+	}
+	h.pendingFilesMu.Unlock()
+
+	msg := newReply(message, fmt.Sprintf("Тема: %s\nВложение: %s", subject, doc.FileName))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Отправить на "+recipient, fmt.Sprintf("file:%d", id)),
+	))
+	bot.Send(msg)
+}
+
+// addDraftAttachment attaches a document or photo from the message to the letter
+// being composed, checking the type, count and size limits. It reports whether
+// the file was added.
+func addDraftAttachment(bot BotAPI, secrets *Secrets, message *tgbotapi.Message, state *UserState) bool {
+	var attachment DraftAttachment
+	if doc := message.Document; doc != nil {
+		attachment = DraftAttachment{FileID: doc.FileID, FileName: doc.FileName, FileSize: doc.FileSize}
+		if attachment.FileName == "" {
+			attachment.FileName = fmt.Sprintf("file_%d", len(state.Attachments)+1)
+		}
+	} else {
+		// Telegram lists the sizes of a photo from smallest to largest
+		photo := message.Photo[len(message.Photo)-1]
+		attachment = DraftAttachment{FileID: photo.FileID, FileName: fmt.Sprintf("photo_%d.jpg", len(state.Attachments)+1), FileSize: photo.FileSize}
+	}
+
+	if refusal := blockedAttachment(attachment.FileName); refusal != "" {
+		bot.Send(newReply(message, refusal))
+		return false
+	}
+	if len(state.Attachments) >= MAX_DRAFT_ATTACHMENTS {
+		bot.Send(newReply(message, fmt.Sprintf("К письму можно приложить не больше %d файлов.", MAX_DRAFT_ATTACHMENTS)))
+		return false
+	}
+	total := attachment.FileSize
+	for _, a := range state.Attachments {
+		total += a.FileSize
+	}
+	if limit := secrets.AttachmentLimit(); total > limit {
+		bot.Send(newReply(message, fmt.Sprintf("Вложения слишком большие: общий размер не должен превышать %d МБ.", limit/1024/1024)))
+		return false
+	}
+
+	state.Attachments = append(state.Attachments, attachment)
+	bot.Send(newReply(message, fmt.Sprintf("Файл «%s» приложен (%d из %d). Пришлите ещё файлы или текст письма.", attachment.FileName, len(state.Attachments), MAX_DRAFT_ATTACHMENTS)))
+	return true
+}
+
+// downloadDraftAttachments downloads the files attached in the wizard, reporting
+// progress in replies to the given message.
+func (h *Handler) downloadDraftAttachments(ctx context.Context, message *tgbotapi.Message, drafts []DraftAttachment) ([]Attachment, error) {
+	bot, secrets := h.bot, h.secrets
+	attachments := make([]Attachment, 0, len(drafts))
+	for _, draft := range drafts {
+		status, err := h.sendProgress(newReply(message, fmt.Sprintf("Загрузка файла «%s»...", draft.FileName)))
+		var progress func(done, total int)
+		if err == nil {
+			progress = h.progressReporter(message.Chat.ID, status.MessageID, draft.FileName)
+		}
+		attachment, err := downloadTelegramFile(ctx, bot, secrets, draft.FileID, draft.FileName, progress)
+		if err != nil {
+			releaseAttachments(attachments)
+			return nil, fmt.Errorf("файл «%s»: %w", draft.FileName, err)
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// handleFileCallback downloads the pending document and emails it. The offer is
+// only removed once the letter is sent, so after a failed download or send the
+// button can be tapped again.
+func (h *Handler) handleFileCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	id, _ := strconv.ParseInt(payload, 10, 64)
+
+	// Mark the file as being sent so a double tap cannot send it twice
+	h.pendingFilesMu.Lock()
+	pending, exists := h.pendingFiles[id]
+	switch {
+	case !exists || pending.UserID != query.From.ID || time.Now().After(pending.Expires):
+		exists = false
+	case pending.Sending:
+		h.pendingFilesMu.Unlock()
+		return "Файл уже отправляется."
+	default:
+		pending.Sending = true
+	}
+	var file PendingFile
+	if exists {
+		file = *pending
+	}
+	h.pendingFilesMu.Unlock()
+	if !exists {
+		return "Файл уже отправлен или устарел."
+	}
+	sent := false
+	defer func() {
+		h.pendingFilesMu.Lock()
+		defer h.pendingFilesMu.Unlock()
+		if sent {
+			delete(h.pendingFiles, id)
+		} else {
+			pending.Sending = false
+		}
+	}()
+	if !allowSend(bot, secrets, query.Message, query.From) {
+		return ""
+	}
+
+	status, err := h.sendProgress(newReply(query.Message, fmt.Sprintf("Загрузка файла «%s»...", file.FileName)))
+	var progress func(done, total int)
+	if err == nil {
+		progress = h.progressReporter(file.ChatID, status.MessageID, file.FileName)
+	}
+
+	attachment, err := downloadTelegramFile(ctx, bot, secrets, file.FileID, file.FileName, progress)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки файла", "file", file.FileName, "error", err)
+		bot.Send(newReply(query.Message, fmt.Sprintf("Не удалось загрузить файл: %v\nНажмите кнопку ещё раз, чтобы повторить.", err)))
+		return ""
+	}
+
+	h.sendComplianceProgress(newReply(query.Message, "Отправляю письмо..."))
+
+	body := fmt.Sprintf(FILE_EMAIL_BODY, file.FileName)
+	result, err := h.sendEmail(ctx, file.Recipient, secrets.SenderEmail, file.Subject, body, file.SenderName, attachment)
+	text, sent := describeSendResult(ctx, query.From.LanguageCode, result, err)
+	bot.Send(newReply(query.Message, text))
+	attachments := []Attachment{attachment}
+	recordSend(h.History, SentEmail{
+		UserID:     file.UserID,
+		Recipient:  file.Recipient,
+		Subject:    file.Subject,
+		Body:       body,
+		SenderName: file.SenderName,
+	}, attachments, result, err)
+	if !h.offerRetryRejected(file.UserID, file.ChatID, Email{
+		Subject:     file.Subject,
+		Body:        body,
+		SenderName:  file.SenderName,
+		Attachments: attachments,
+	}, result) {
+		releaseAttachments(attachments)
+	}
+	return ""
+}
+
+// downloadTelegramFile fetches a file stored by the Bot API server into tempFiles,
+// so it is never held in memory; the caller releases it with releaseAttachments.
+// Remote files are downloaded in chunks with HTTP range requests, resuming from the
+// last received byte after a network error. progress, if not nil, is called after
+// every chunk.
+func downloadTelegramFile(ctx context.Context, bot BotAPI, secrets *Secrets, fileID, name string, progress func(done, total int)) (Attachment, error) {
+	file, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return Attachment{}, fmt.Errorf("ошибка получения информации о файле: %w", err)
+	}
+	limit := secrets.AttachmentLimit()
+	if file.FileSize > limit {
+		return Attachment{}, fmt.Errorf("файл больше %d байт", limit)
+	}
+
+	// A local Bot API server started with --local returns absolute paths on its own
+	// disk, which can be read in place
+	if filepath.IsAbs(file.FilePath) {
+		return Attachment{Name: name, Path: file.FilePath, FileID: fileID}, nil
+	}
+
+	fileEndpoint := choose(secrets.BotFileEndpoint, tgbotapi.FileEndpoint)
+	fileURL := fmt.Sprintf(fileEndpoint, secrets.BotToken, file.FilePath)
+
+	dst, err := tempFiles.create()
+	if err != nil {
+		return Attachment{}, fmt.Errorf("ошибка создания временного файла: %w", err)
+	}
+	done := 0
+	retries := 0
+	for {
+		n, whole, err := downloadChunk(ctx, fileURL, done, dst, limit+1)
+		if whole {
+			done = n
+		} else {
+			done += n
+		}
+		if errors.Is(err, errTempQuota) {
+			dst.discard()
+			return Attachment{}, err
+		}
+		if err != nil {
+			retries++
+			if retries > DOWNLOAD_MAX_RETRIES {
+				dst.discard()
+				return Attachment{}, err
+			}
+			slog.WarnContext(ctx, "Ошибка загрузки файла", "attempt", retries, "received_bytes", done, "error", err)
+			select {
+			case <-ctx.Done():
+				dst.discard()
+				return Attachment{}, ctx.Err()
+			case <-time.After(time.Duration(retries) * time.Second):
+			}
+			continue
+		}
+		retries = 0
+
+		if done > limit {
+			dst.discard()
+			return Attachment{}, fmt.Errorf("файл больше %d байт", limit)
+		}
+		if progress != nil {
+			progress(done, max(file.FileSize, done))
+		}
+		if whole || n < DOWNLOAD_CHUNK_SIZE || (file.FileSize > 0 && done >= file.FileSize) {
+			break
+		}
+	}
+	if err := dst.Close(); err != nil {
+		tempFiles.remove(dst.Name())
+		return Attachment{}, fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+	return Attachment{Name: name, Path: dst.Name(), FileID: fileID}, nil
+}
+
+// downloadChunk requests up to DOWNLOAD_CHUNK_SIZE bytes of a file starting at offset
+// and appends them to dst, returning how many were written even on error. The boolean
+// result reports that the server answered with the full file instead of a range, in
+// which case dst is rewritten from the start with up to limit bytes.
+func downloadChunk(ctx context.Context, fileURL string, offset int, dst *tempFile, limit int) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+DOWNLOAD_CHUNK_SIZE-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("ошибка HTTP запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		n, err := io.Copy(dst, io.LimitReader(resp.Body, DOWNLOAD_CHUNK_SIZE))
+		if err != nil {
+			return int(n), false, fmt.Errorf("ошибка чтения файла: %w", err)
+		}
+		return int(n), false, nil
+	case http.StatusOK:
+		if err := dst.reset(); err != nil {
+			return 0, false, fmt.Errorf("ошибка записи временного файла: %w", err)
+		}
+		n, err := io.Copy(dst, io.LimitReader(resp.Body, int64(limit)))
+		if err != nil {
+			// dst now holds only the start of this response, the next attempt resumes from it
+			return int(n), true, fmt.Errorf("ошибка чтения файла: %w", err)
+		}
+		return int(n), true, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The offset is already at the end of the file
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("неожиданный статус ответа: %s", resp.Status)
+	}
+}
+
+// progressReporter returns a download progress callback that edits a chat message,
+// at most once per DOWNLOAD_PROGRESS_INTERVAL to stay within Telegram rate limits.
+func (h *Handler) progressReporter(chatID int64, messageID int, fileName string) func(done, total int) {
+	var lastUpdate time.Time
+	return func(done, total int) {
+		if done < total && time.Since(lastUpdate) < DOWNLOAD_PROGRESS_INTERVAL {
+			return
+		}
+		lastUpdate = time.Now()
+		text := fmt.Sprintf("Загрузка файла «%s»: %d%% (%d из %d КБ)", fileName, done*100/max(total, 1), done/1024, total/1024)
+		h.editStatus(chatID, messageID, text)
+	}
+}
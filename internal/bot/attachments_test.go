@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// flakyFileBot serves a file from the disk of a local Bot API server, failing the
+// given number of lookups first.
+type flakyFileBot struct {
+	*fakeBot
+	path     string
+	failures int
+}
+
+func (b *flakyFileBot) GetFile(tgbotapi.FileConfig) (tgbotapi.File, error) {
+	if b.failures > 0 {
+		b.failures--
+		return tgbotapi.File{}, errors.New("сеть недоступна")
+	}
+	return tgbotapi.File{FilePath: b.path, FileSize: 5}, nil
+}
+
+// documentAction is a document named name sent with the caption.
+func documentAction(name, caption string) wizardAction {
+	action := fileAction(caption)
+	update := action.update
+	action.update = func() tgbotapi.Update {
+		u := update()
+		u.Message.Document.FileName = name
+		return u
+	}
+	return action
+}
+
+// lastFileOffer returns the ID of the newest file the handler offered.
+func lastFileOffer(h *Handler) int64 {
+	h.pendingFilesMu.Lock()
+	defer h.pendingFilesMu.Unlock()
+	return h.pendingFileSeq
+}
+
+func TestFileEmailOfferChecks(t *testing.T) {
+	t.Cleanup(func(saved map[Field][]Validator) func() {
+		return func() { ruleValidators = saved }
+	}(ruleValidators))
+	err := registerFieldRules(map[Field][]FieldRule{FieldSubject: {{Pattern: `^[^!]*$`, Message: "Тема без восклицаний."}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	before := lastFileOffer(handler)
+
+	handler.HandleUpdate(context.Background(), documentAction("setup.exe", "Установщик").update())
+	handler.HandleUpdate(context.Background(), documentAction("report.pdf", "Срочно!").update())
+	if lastFileOffer(handler) != before {
+		t.Errorf("a blocked file or an invalid subject was offered:\n%s", bot.texts())
+	}
+	for _, want := range []string{"Файлы типа .exe нельзя отправить по почте.", "Тема без восклицаний."} {
+		if !strings.Contains(bot.texts(), want) {
+			t.Errorf("bot did not say %q:\n%s", want, bot.texts())
+		}
+	}
+}
+
+func TestFileEmailRetriesAfterFailedDownload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(path, []byte("%PDF-"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	wizard, fake, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	bot := &flakyFileBot{fakeBot: fake, path: path, failures: 1}
+	handler := NewHandler(bot, sender, wizardSecrets(), wizard.Stores)
+
+	handler.HandleUpdate(context.Background(), documentAction("report.pdf", "Отчёт").update())
+	tap := tapAction(fmt.Sprintf("file:%d", lastFileOffer(handler)))
+	handler.HandleUpdate(context.Background(), tap.update())
+	if sender.sent != 0 || !strings.Contains(fake.texts(), "Нажмите кнопку ещё раз") {
+		t.Fatalf("failed download:\n%s", fake.texts())
+	}
+	handler.HandleUpdate(context.Background(), tap.update())
+	if sender.sent != 1 || sender.subjects[0] != "Отчёт" {
+		t.Fatalf("the retry did not send the file: %q", sender.subjects)
+	}
+	handler.HandleUpdate(context.Background(), tap.update())
+	if sender.sent != 1 || !strings.Contains(fake.texts(), "Файл уже отправлен или устарел.") {
+		t.Errorf("a sent file was sent again:\n%s", fake.texts())
+	}
+}
+
+func TestFileEmailOfferExpires(t *testing.T) {
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	handler.HandleUpdate(context.Background(), documentAction("report.pdf", "Отчёт").update())
+	id := lastFileOffer(handler)
+	handler.pendingFilesMu.Lock()
+	handler.pendingFiles[id].Expires = time.Now().Add(-time.Second)
+	handler.pendingFilesMu.Unlock()
+
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("file:%d", id)).update())
+	if sender.sent != 0 || !strings.Contains(bot.texts(), "Файл уже отправлен или устарел.") {
+		t.Errorf("an expired offer was sent:\n%s", bot.texts())
+	}
+	// The next offer drops it
+	handler.HandleUpdate(context.Background(), documentAction("report.pdf", "Отчёт").update())
+	handler.pendingFilesMu.Lock()
+	_, kept := handler.pendingFiles[id]
+	handler.pendingFilesMu.Unlock()
+	if kept {
+		t.Error("the expired offer was kept")
+	}
+}
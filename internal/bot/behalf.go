@@ -0,0 +1,196 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// BehalfRequest is a draft waiting for the manager's approval.
+// Requests live in memory only, so pending ones are lost on restart.
+type BehalfRequest struct {
+	Assistant tgbotapi.User
+	ChatID    int64 // Assistant's chat, which gets the send result
+	MessageID int   // Preview the request was made from
+	ManagerID int64
+	Draft     UserState
+	Requested time.Time
+}
+
+// handleOnBehalfCommand replies to /onbehalf [manager ID]: the draft on preview is
+// sent to the manager for approval, or the managers to choose from are shown.
+func (h *Handler) handleOnBehalfCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	managers := secrets.ManagersOf(message.From.ID)
+	if len(managers) == 0 {
+		bot.Send(newReply(message, "Вы не указаны помощником ни у одного руководителя. Доверенных помощников настраивает администратор."))
+		return
+	}
+	if state, _ := h.States.Get(message.From.ID); state.State != "await_confirm" {
+		bot.Send(newReply(message, "Сначала составьте письмо и дойдите до предпросмотра, затем повторите команду."))
+		return
+	}
+
+	if arg := strings.TrimSpace(message.CommandArguments()); arg != "" {
+		id, _ := strconv.ParseInt(arg, 10, 64)
+		i := slices.IndexFunc(managers, func(d Delegation) bool { return d.ManagerID == id })
+		if i < 0 {
+			bot.Send(newReply(message, fmt.Sprintf("Вы не помощник руководителя с ID %s.", arg)))
+			return
+		}
+		managers = managers[i : i+1]
+	}
+	if len(managers) == 1 {
+		h.requestApproval(message, message.From, managers[0])
+		return
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, d := range managers {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(d.ManagerLabel(), fmt.Sprintf("behalf:ask:%d", d.ManagerID)),
+		))
+	}
+	msg := newReply(message, "От чьего имени отправить письмо?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	bot.Send(msg)
+}
+
+// requestApproval takes the draft off the preview and asks the manager to approve it.
+func (h *Handler) requestApproval(message *tgbotapi.Message, from *tgbotapi.User, manager Delegation) {
+	bot := h.bot
+	var draft UserState
+	var current bool
+	h.States.Update(from.ID, func(s *UserState) {
+		if current = s.State == "await_confirm"; current {
+			draft = *s
+			*s = UserState{State: "initial"}
+		}
+	})
+	if !current {
+		bot.Send(newReply(message, "Сначала составьте письмо и дойдите до предпросмотра, затем повторите команду."))
+		return
+	}
+
+	h.behalfMu.Lock()
+	h.behalfSeq++
+	id := h.behalfSeq
+	h.behalfRequests[id] = &BehalfRequest{
+		Assistant: *from,
+		ChatID:    message.Chat.ID,
+		MessageID: message.MessageID,
+		ManagerID: manager.ManagerID,
+		Draft:     draft,
+		Requested: time.Now(),
+	}
+	h.behalfMu.Unlock()
+
+	assistant := strings.TrimSpace(from.FirstName + " " + from.LastName)
+	if from.UserName != "" {
+		assistant += " (@" + from.UserName + ")"
+	}
+	request := tgbotapi.NewMessage(manager.ManagerID, fmt.Sprintf("%s просит отправить письмо от вашего имени.\n\n%s", assistant, previewText(&draft)))
+	request.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Одобрить", fmt.Sprintf("behalf:approve:%d", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Отклонить", fmt.Sprintf("behalf:reject:%d", id)),
+	))
+	if _, err := bot.Send(request); err != nil {
+		// The manager has to start the bot before it can write to them
+		h.takeBehalfRequest(id)
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось отправить запрос руководителю %s: %v. Попросите его начать диалог с ботом.", manager.ManagerLabel(), err)))
+		h.restoreDraft(message, from.ID, draft)
+		return
+	}
+	audit(from, "запросил отправку письма «%s» от имени %d", draft.Subject, manager.ManagerID)
+
+	msg := newReply(message, fmt.Sprintf("Письмо «%s» отправлено на одобрение руководителю %s. Оно уйдёт, когда руководитель его одобрит.", draft.Subject, manager.ManagerLabel()))
+	msg.ReplyMarkup = newInitialKeyboard()
+	bot.Send(msg)
+}
+
+// takeBehalfRequest removes a pending request and returns it.
+func (h *Handler) takeBehalfRequest(id int64) (*BehalfRequest, bool) {
+	h.behalfMu.Lock()
+	defer h.behalfMu.Unlock()
+	request, ok := h.behalfRequests[id]
+	delete(h.behalfRequests, id)
+	return request, ok
+}
+
+// restoreDraft puts a draft back on preview, or an invitation back at its last step,
+// unless the user has started another one.
+func (h *Handler) restoreDraft(message *tgbotapi.Message, userID int64, draft UserState) {
+	bot := h.bot
+	var idle bool
+	h.States.Update(userID, func(s *UserState) { idle = s.State == "" || s.State == "initial" })
+	if !idle {
+		return
+	}
+	if isInviteDraft(&draft) {
+		// An invitation has no preview; it goes out again once the location is sent
+		draft.State = "await_invite_location"
+		bot.Send(newReply(message, invitePreview(&draft)+"\n\nЧтобы отправить приглашение снова, укажите место встречи или «-»."))
+	} else {
+		showPreview(bot, message, &draft)
+	}
+	draft.Touched = time.Now() // The wait for the approval is not idling
+	h.States.Update(userID, func(s *UserState) { *s = draft })
+}
+
+// handleBehalfCallback handles choosing the manager and the manager's decision.
+func (h *Handler) handleBehalfCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	action, arg, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+
+	if action == "ask" {
+		i := slices.IndexFunc(secrets.ManagersOf(query.From.ID), func(d Delegation) bool { return d.ManagerID == id })
+		if i < 0 {
+			return "Кнопка устарела."
+		}
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		h.requestApproval(query.Message, query.From, secrets.ManagersOf(query.From.ID)[i])
+		return ""
+	}
+	if action != "approve" && action != "reject" {
+		return "Кнопка устарела."
+	}
+
+	h.behalfMu.Lock()
+	request, ok := h.behalfRequests[id]
+	if ok && request.ManagerID != query.From.ID {
+		ok = false
+	} else if ok {
+		delete(h.behalfRequests, id)
+	}
+	h.behalfMu.Unlock()
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	if !ok {
+		return "Запрос уже обработан."
+	}
+
+	message := &tgbotapi.Message{MessageID: request.MessageID, Chat: &tgbotapi.Chat{ID: request.ChatID}}
+	draft := request.Draft
+	if action == "reject" {
+		audit(query.From, "отклонил отправку письма «%s» от своего имени пользователем %d", draft.Subject, request.Assistant.ID)
+		bot.Send(newReply(message, fmt.Sprintf("Руководитель отклонил отправку письма «%s» от его имени.", draft.Subject)))
+		h.restoreDraft(message, request.Assistant.ID, draft)
+		return "Отклонено"
+	}
+
+	audit(query.From, "одобрил отправку письма «%s» от своего имени пользователем %d", draft.Subject, request.Assistant.ID)
+	bot.Send(newReply(query.Message, fmt.Sprintf("Письмо «%s» отправляется от вашего имени, результат получит помощник. Письмо есть в вашей /history.", draft.Subject)))
+	draft.OnBehalfOf = request.ManagerID
+	inFlightSends.Add(1)
+	defer inFlightSends.Done()
+	h.sendDraft(ctx, &request.Assistant, message, &draft)
+	return "Одобрено"
+}
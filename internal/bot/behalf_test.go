@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+const behalfManager = 7
+
+// managerTap is a tap on a button by the manager in their own chat.
+func managerTap(data string) wizardAction {
+	return wizardAction{name: "manager tap " + data, update: func() tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "1",
+			From:    &tgbotapi.User{ID: behalfManager, FirstName: "Руководитель"},
+			Message: &tgbotapi.Message{MessageID: 2, Chat: &tgbotapi.Chat{ID: behalfManager, Type: "private"}},
+			Data:    data,
+		}}
+	}}
+}
+
+// runBehalf composes a letter as the assistant, asks the manager to approve it and
+// runs the given actions after that.
+func runBehalf(t *testing.T, after ...wizardAction) (*fakeTelegram, *Handler, *recordingSender) {
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{
+		TargetEmail: "target@example.com", SenderEmail: "sender@example.com", EmailProvider: mailer.EMAIL_PROVIDER_SMTP,
+		Delegations: []Delegation{{ManagerID: behalfManager, ManagerName: "Иван Петрович", Assistants: []int64{wizardUser}}},
+	}
+	var steps []string
+	sender := &recordingSender{t: t, steps: &steps}
+	handler := NewHandler(bot, sender, secrets, MemoryStores())
+
+	actions := []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction(DEFAULT_RECIPIENT_BUTTON_TEXT),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт за месяц."), textAction("Иван Петрович"),
+		textAction("/onbehalf"),
+	}
+	for _, action := range append(actions, after...) {
+		steps = append(steps, action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	return telegram, handler, sender
+}
+
+func TestOnBehalfApprovedByManager(t *testing.T) {
+	telegram, handler, sender := runBehalf(t, tapAction("behalf:approve:1"), managerTap("behalf:approve:1"), managerTap("behalf:approve:1"))
+
+	if _, ok := telegram.find(behalfManager, "Отчёт за месяц."); !ok {
+		t.Errorf("manager got no preview:\n%s", telegram.transcript(behalfManager))
+	}
+	// The assistant's own tap is ignored and the second tap of the manager finds the request gone
+	if want := []string{"Отчёт"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Fatalf("sent %q, want %q", sender.subjects, want)
+	}
+	for _, userID := range []int64{wizardUser, behalfManager} {
+		if sent := handler.History.Recent(userID, 1); len(sent) != 1 || sent[0].UserID != wizardUser || sent[0].OnBehalfOf != behalfManager {
+			t.Errorf("history of %d = %+v, want the letter sent by %d on behalf of %d", userID, sent, wizardUser, behalfManager)
+		}
+	}
+	if _, ok := telegram.find(wizardUser, "Хотите отправить ещё одно письмо"); !ok {
+		t.Errorf("assistant got no send result:\n%s", telegram.transcript(wizardUser))
+	}
+}
+
+func TestOnBehalfRejectedRestoresDraft(t *testing.T) {
+	telegram, handler, sender := runBehalf(t, managerTap("behalf:reject:1"))
+
+	if sender.sent != 0 {
+		t.Fatalf("rejected letter was sent")
+	}
+	if _, ok := telegram.find(wizardUser, "отклонил"); !ok {
+		t.Errorf("assistant was not told about the rejection:\n%s", telegram.transcript(wizardUser))
+	}
+	if state, _ := handler.States.Get(wizardUser); state.State != "await_confirm" || state.Subject != "Отчёт" {
+		t.Errorf("state after rejection = %+v, want the draft on preview", state)
+	}
+}
@@ -0,0 +1,85 @@
+package bot
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// memoryTransport answers Bot API requests from memory, so
+// benchmarks measure the bot rather than the network.
+type memoryTransport struct{}
+
+func (memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	body := `{"ok":true,"result":true}`
+	switch path := req.URL.Path; {
+	case strings.HasSuffix(path, "/getMe"):
+		body = `{"ok":true,"result":{"id":1,"is_bot":true,"username":"test_bot"}}`
+	case strings.HasSuffix(path, "/sendMessage"):
+		body = `{"ok":true,"result":{"message_id":2,"chat":{"id":5},"text":"ok"}}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// benchmarkBot creates a bot talking to memoryTransport, with logging redacted and
+// discarded like in production.
+func benchmarkBot(tb testing.TB) *tgbotapi.BotAPI {
+	tb.Helper()
+	bot, err := tgbotapi.NewBotAPIWithClient("123:TEST", tgbotapi.APIEndpoint, &http.Client{Transport: memoryTransport{}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	output := log.Writer()
+	log.SetOutput(redactingWriter{w: io.Discard, r: NewRedactor([]string{"123:TEST", "api-key"}, true)})
+	tb.Cleanup(func() { log.SetOutput(output) })
+	return bot
+}
+
+func BenchmarkHandleUpdate(b *testing.B) {
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com"}
+	text := func(s string) tgbotapi.Update { return textAction(s).update() }
+	benchmarks := []struct {
+		name   string
+		state  string // Step the user is at before each update
+		update tgbotapi.Update
+	}{
+		{"subject", "await_subject", text("Отчёт за май")},
+		{"recipients", "await_recipient", text("office@example.com, boss@example.com")},
+		{"unexpected text", "initial", text("привет")},
+		{"stale button", "initial", tapAction("confirm:send").update()},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			handler := NewHandler(benchmarkBot(b), nil, secrets, MemoryStores())
+			ctx := context.Background()
+			b.ReportAllocs()
+			for b.Loop() {
+				handler.States.Update(wizardUser, func(s *UserState) { *s = UserState{State: bm.state} })
+				handler.HandleUpdate(ctx, bm.update)
+			}
+		})
+	}
+}
+
+func BenchmarkRedact(b *testing.B) {
+	r := NewRedactor([]string{"123456:ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef", "api-key"}, true)
+	line := "2026/05/01 12:00:00 main.go:314: [ivan] Получено сообщение: Отчёт за май (ID пользователя: 42)\n"
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Redact(line)
+	}
+}
@@ -0,0 +1,339 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// BIMI_SELECTOR is the selector mailbox providers look up: default._bimi.<domain>.
+	BIMI_SELECTOR = "default"
+	// BIMI_LOGO_MAX_BYTES is the largest logo Gmail accepts; the others are no stricter.
+	BIMI_LOGO_MAX_BYTES = 32 * 1024
+	// BIMI_FETCH_TIMEOUT bounds the download of the logo and of the certificate.
+	BIMI_FETCH_TIMEOUT = 15 * time.Second
+)
+
+// bimiExtKeyUsage is the extended key usage of mark certificates (VMC and CMC).
+var bimiExtKeyUsage = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 31}
+
+// bimiProvider is a mailbox provider that shows BIMI logos and what it requires.
+type bimiProvider struct {
+	Name             string
+	NeedsCertificate bool // Shows the logo only with a mark certificate in the a= tag
+}
+
+// bimiProviders lists the providers /checkdomain reports on. Яндекс Почта and
+// Mail.ru do not support BIMI and are only mentioned in the report.
+var bimiProviders = []bimiProvider{
+	{Name: "Gmail", NeedsCertificate: true},
+	{Name: "Apple Mail (iCloud)", NeedsCertificate: true},
+	{Name: "Yahoo и AOL"},
+	{Name: "Fastmail"},
+}
+
+// lookupTXT resolves DNS TXT records; tests replace it.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// bimiHTTPClient downloads the logo and the certificate; tests replace it.
+var bimiHTTPClient = http.DefaultClient
+
+// BIMIReport is the outcome of the BIMI checks of a sending domain. Problems explain
+// why a check failed, Notes what passed or only deserves attention.
+type BIMIReport struct {
+	Domain        string
+	Record        string // TXT record at default._bimi.<domain>, empty when missing
+	Logo          string // l= tag
+	Certificate   string // a= tag
+	DMARC         string // DMARC record that applies to the domain
+	RecordOK      bool
+	DMARCEnforced bool
+	LogoOK        bool
+	CertificateOK bool
+	Problems      []string
+	Notes         []string
+}
+
+// checkBIMI validates the BIMI record of the domain, the DMARC policy BIMI relies on,
+// the logo and the mark certificate.
+func checkBIMI(ctx context.Context, domain string) *BIMIReport {
+	report := &BIMIReport{Domain: domain}
+	report.checkDMARC(ctx)
+
+	name := BIMI_SELECTOR + "._bimi." + domain
+	records, err := lookupTXT(ctx, name)
+	if err != nil && !isNotFound(err) {
+		report.Problems = append(report.Problems, fmt.Sprintf("Не удалось получить запись %s: %v", name, err))
+		return report
+	}
+	for _, record := range records {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(record)), "v=bimi1") {
+			report.Record = record
+			break
+		}
+	}
+	if report.Record == "" {
+		report.Problems = append(report.Problems, fmt.Sprintf("Нет записи BIMI: добавьте TXT %s со значением «v=BIMI1; l=https://…/logo.svg; a=https://…/vmc.pem».", name))
+		return report
+	}
+	tags := parseTagList(report.Record)
+	report.Logo, report.Certificate = tags["l"], tags["a"]
+	report.RecordOK = true
+	if report.Logo == "" {
+		report.RecordOK = false
+		report.Problems = append(report.Problems, "В записи BIMI нет адреса логотипа (тег l=).")
+	} else {
+		report.checkLogo(ctx)
+	}
+	if report.Certificate == "" {
+		report.Notes = append(report.Notes, "Сертификат марки (тег a=) не указан: без него логотип не покажут Gmail и Apple Mail.")
+	} else {
+		report.checkCertificate(ctx)
+	}
+	return report
+}
+
+// isNotFound reports whether a DNS lookup failed because the name has no records.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// parseTagList parses a DNS tag list such as "v=BIMI1; l=https://…", keys lowercased.
+func parseTagList(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(record, ";") {
+		key, value, found := strings.Cut(part, "=")
+		if found {
+			tags[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	return tags
+}
+
+// checkDMARC checks that DMARC is enforced, which every provider requires for BIMI:
+// p=quarantine or p=reject applied to all mail. A subdomain without its own record
+// falls under the sp= policy of its parent domain.
+func (r *BIMIReport) checkDMARC(ctx context.Context) {
+	policyTag := "p"
+	record, err := dmarcRecord(ctx, r.Domain)
+	if record == "" && err == nil {
+		// The last two labels stand in for the organizational domain, which is wrong
+		// for registries such as co.uk but right for the domains the bot sends from
+		labels := strings.Split(r.Domain, ".")
+		if len(labels) > 2 {
+			record, err = dmarcRecord(ctx, strings.Join(labels[len(labels)-2:], "."))
+			policyTag = "sp"
+		}
+	}
+	if err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("Не удалось получить запись DMARC: %v", err))
+		return
+	}
+	if record == "" {
+		r.Problems = append(r.Problems, fmt.Sprintf("Нет записи DMARC: BIMI работает только при политике p=quarantine или p=reject в TXT _dmarc.%s.", r.Domain))
+		return
+	}
+	r.DMARC = record
+	tags := parseTagList(record)
+	policy := strings.ToLower(tags[policyTag])
+	if policyTag == "sp" && policy == "" {
+		policy = strings.ToLower(tags["p"])
+	}
+	pct := 100
+	if value, ok := tags["pct"]; ok {
+		pct, _ = strconv.Atoi(value)
+	}
+	switch {
+	case policy != "quarantine" && policy != "reject":
+		r.Problems = append(r.Problems, fmt.Sprintf("Политика DMARC %s=%s: для BIMI нужна quarantine или reject.", policyTag, choose(policy, "не указана")))
+	case pct != 100:
+		r.Problems = append(r.Problems, fmt.Sprintf("DMARC применяется к %d%% писем (pct=%d): для BIMI нужно 100%%.", pct, pct))
+	default:
+		r.DMARCEnforced = true
+		r.Notes = append(r.Notes, fmt.Sprintf("DMARC: политика %s.", policy))
+	}
+}
+
+// dmarcRecord returns the DMARC record published for the domain, or "" when there is none.
+func dmarcRecord(ctx context.Context, domain string) (string, error) {
+	records, err := lookupTXT(ctx, "_dmarc."+domain)
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	for _, record := range records {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(record)), "v=dmarc1") {
+			return record, nil
+		}
+	}
+	return "", nil
+}
+
+// fetchBIMIFile downloads the logo or the certificate, which must be served over HTTPS,
+// reading at most limit bytes and one more to tell an oversized file.
+func fetchBIMIFile(ctx context.Context, address string, limit int64) ([]byte, string, error) {
+	if u, err := url.Parse(address); err != nil || u.Scheme != "https" {
+		return nil, "", fmt.Errorf("адрес %s должен начинаться с https://", address)
+	}
+	ctx, cancel := context.WithTimeout(ctx, BIMI_FETCH_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := bimiHTTPClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("сервер ответил %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+// checkLogo downloads the logo and checks it against the SVG Tiny Portable/Secure
+// profile that BIMI requires.
+func (r *BIMIReport) checkLogo(ctx context.Context) {
+	data, contentType, err := fetchBIMIFile(ctx, r.Logo, BIMI_LOGO_MAX_BYTES)
+	if err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("Логотип недоступен: %v", err))
+		return
+	}
+	var problems []string
+	if len(data) > BIMI_LOGO_MAX_BYTES {
+		problems = append(problems, fmt.Sprintf("больше %d КБ", BIMI_LOGO_MAX_BYTES/1024))
+	}
+	svg := strings.ToLower(string(data))
+	if !strings.Contains(svg, "<svg") {
+		problems = append(problems, "это не SVG")
+	} else {
+		if !strings.Contains(svg, `baseprofile="tiny-ps"`) && !strings.Contains(svg, `baseprofile='tiny-ps'`) {
+			problems = append(problems, `не указан профиль SVG Tiny PS (baseProfile="tiny-ps")`)
+		}
+		if !strings.Contains(svg, "<title") {
+			problems = append(problems, "нет элемента <title> с названием бренда")
+		}
+		if strings.Contains(svg, "<script") || strings.Contains(svg, "<image") {
+			problems = append(problems, "содержит скрипты или растровые изображения, запрещённые профилем")
+		}
+	}
+	if len(problems) > 0 {
+		r.Problems = append(r.Problems, "Логотип не подходит для BIMI: "+strings.Join(problems, "; ")+".")
+		return
+	}
+	r.LogoOK = true
+	note := fmt.Sprintf("Логотип: SVG Tiny PS, %.1f КБ.", float64(len(data))/1024)
+	if !strings.HasPrefix(contentType, "image/svg+xml") {
+		note += fmt.Sprintf(" Сервер отдаёт его как %q, лучше image/svg+xml.", contentType)
+	}
+	r.Notes = append(r.Notes, note)
+}
+
+// checkCertificate downloads the mark certificate and checks that it is a current
+// BIMI certificate issued for the domain. The chain to the issuer is verified by
+// the providers themselves.
+func (r *BIMIReport) checkCertificate(ctx context.Context) {
+	data, _, err := fetchBIMIFile(ctx, r.Certificate, 1<<20)
+	if err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("Сертификат марки недоступен: %v", err))
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		r.Problems = append(r.Problems, "Файл сертификата марки не в формате PEM.")
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("Не удалось разобрать сертификат марки: %v", err))
+		return
+	}
+	now := time.Now()
+	switch {
+	case !slices.ContainsFunc(cert.UnknownExtKeyUsage, bimiExtKeyUsage.Equal):
+		r.Problems = append(r.Problems, "Сертификат не является сертификатом марки (VMC или CMC): нет назначения BIMI.")
+	case now.Before(cert.NotBefore) || now.After(cert.NotAfter):
+		r.Problems = append(r.Problems, fmt.Sprintf("Сертификат марки действует с %s по %s.", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly)))
+	case cert.VerifyHostname(r.Domain) != nil:
+		r.Problems = append(r.Problems, fmt.Sprintf("Сертификат марки выдан не для %s, а для %s.", r.Domain, strings.Join(cert.DNSNames, ", ")))
+	default:
+		r.CertificateOK = true
+		r.Notes = append(r.Notes, fmt.Sprintf("Сертификат марки: %s, действует до %s.", choose(cert.Subject.CommonName, strings.Join(cert.Subject.Organization, ", ")), cert.NotAfter.Format(time.DateOnly)))
+	}
+}
+
+// shownBy reports whether the provider will show the logo.
+func (r *BIMIReport) shownBy(provider bimiProvider) bool {
+	return r.RecordOK && r.DMARCEnforced && r.LogoOK && (r.CertificateOK || !provider.NeedsCertificate)
+}
+
+// format renders the report for the chat.
+func (r *BIMIReport) format() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BIMI для %s\n", r.Domain)
+	if r.Record != "" {
+		fmt.Fprintf(&b, "Запись: %s\n", r.Record)
+	}
+	if len(r.Problems) > 0 {
+		b.WriteString("\nПроблемы:\n")
+		for _, problem := range r.Problems {
+			fmt.Fprintf(&b, "• %s\n", problem)
+		}
+	}
+	if len(r.Notes) > 0 {
+		b.WriteString("\nПроверено:\n")
+		for _, note := range r.Notes {
+			fmt.Fprintf(&b, "• %s\n", note)
+		}
+	}
+	b.WriteString("\nЛоготип покажут:\n")
+	for _, provider := range bimiProviders {
+		verdict := "нет"
+		if r.shownBy(provider) {
+			verdict = "да"
+		} else if r.RecordOK && r.DMARCEnforced && r.LogoOK {
+			verdict = "нет, нужен сертификат марки"
+		}
+		fmt.Fprintf(&b, "• %s: %s\n", provider.Name, verdict)
+	}
+	b.WriteString("Яндекс Почта и Mail.ru BIMI не поддерживают. Провайдеры показывают логотип только при хорошей репутации отправителя, поэтому он может появиться не сразу.")
+	return b.String()
+}
+
+// handleCheckDomainCommand replies to /checkdomain [domain] with the BIMI checks of
+// the domain, by default the one of sender_email (admin only).
+func (h *Handler) handleCheckDomainCommand(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	domain := strings.ToLower(strings.TrimSpace(message.CommandArguments()))
+	if domain == "" {
+		_, domain, _ = strings.Cut(secrets.SenderEmail, "@")
+	}
+	if domain == "" || strings.ContainsAny(domain, " /@") {
+		bot.Send(newReply(message, "Укажите домен: /checkdomain example.com"))
+		return
+	}
+	h.sendProgress(newReply(message, fmt.Sprintf("Проверяю BIMI для %s...", domain)))
+	report := checkBIMI(ctx, domain)
+	slog.InfoContext(ctx, "Проверка BIMI", "domain", domain, "problems", len(report.Problems))
+	bot.Send(newReply(message, report.format()))
+}
@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLogo = `<svg xmlns="http://www.w3.org/2000/svg" version="1.2" baseProfile="tiny-ps"><title>Пример</title><rect width="10" height="10"/></svg>`
+
+// markCertificate returns a self-signed PEM certificate with the BIMI key usage for the domain.
+func markCertificate(t *testing.T, domain string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "Пример"},
+		DNSNames:           []string{domain},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(24 * time.Hour),
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{bimiExtKeyUsage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCheckBIMI(t *testing.T) {
+	files := map[string][]byte{"/logo.svg": []byte(testLogo), "/raster.svg": []byte(`<svg baseProfile="tiny-ps"><title>x</title><image href="a.png"/></svg>`)}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+	files["/vmc.pem"] = markCertificate(t, "example.com")
+	defaultClient, defaultLookup := bimiHTTPClient, lookupTXT
+	defer func() { bimiHTTPClient, lookupTXT = defaultClient, defaultLookup }()
+	bimiHTTPClient = server.Client()
+
+	tests := []struct {
+		name    string
+		dns     map[string]string
+		gmail   bool
+		yahoo   bool
+		problem string
+	}{
+		{"complete", map[string]string{
+			"_dmarc.example.com":        "v=DMARC1; p=reject",
+			"default._bimi.example.com": "v=BIMI1; l=" + server.URL + "/logo.svg; a=" + server.URL + "/vmc.pem",
+		}, true, true, ""},
+		{"no certificate", map[string]string{
+			"_dmarc.example.com":        "v=DMARC1; p=quarantine",
+			"default._bimi.example.com": "v=BIMI1; l=" + server.URL + "/logo.svg",
+		}, false, true, ""},
+		{"dmarc not enforced", map[string]string{
+			"_dmarc.example.com":        "v=DMARC1; p=quarantine; pct=50",
+			"default._bimi.example.com": "v=BIMI1; l=" + server.URL + "/logo.svg",
+		}, false, false, "pct=50"},
+		{"raster logo", map[string]string{
+			"_dmarc.example.com":        "v=DMARC1; p=reject",
+			"default._bimi.example.com": "v=BIMI1; l=" + server.URL + "/raster.svg",
+		}, false, false, "растровые"},
+		{"missing logo", map[string]string{
+			"_dmarc.example.com":        "v=DMARC1; p=reject",
+			"default._bimi.example.com": "v=BIMI1; l=" + server.URL + "/missing.svg",
+		}, false, false, "404"},
+		{"no record", map[string]string{"_dmarc.example.com": "v=DMARC1; p=reject"}, false, false, "Нет записи BIMI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+				if record, ok := tt.dns[name]; ok {
+					return []string{record}, nil
+				}
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			report := checkBIMI(context.Background(), "example.com")
+			if gmail := report.shownBy(bimiProviders[0]); gmail != tt.gmail {
+				t.Errorf("shown by Gmail = %v, want %v: %+v", gmail, tt.gmail, report)
+			}
+			if yahoo := report.shownBy(bimiProviders[2]); yahoo != tt.yahoo {
+				t.Errorf("shown by Yahoo = %v, want %v: %+v", yahoo, tt.yahoo, report)
+			}
+			problems := strings.Join(report.Problems, "\n")
+			if tt.problem == "" && problems != "" || !strings.Contains(problems, tt.problem) {
+				t.Errorf("problems = %q, want %q", problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestCheckBIMISubdomainUsesParentDMARC(t *testing.T) {
+	defaultLookup := lookupTXT
+	defer func() { lookupTXT = defaultLookup }()
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name == "_dmarc.example.com" {
+			return []string{"v=DMARC1; p=reject; sp=none"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	report := checkBIMI(context.Background(), "mail.example.com")
+	if report.DMARCEnforced || !strings.Contains(strings.Join(report.Problems, "\n"), "sp=none") {
+		t.Errorf("subdomain under sp=none counted as enforced: %+v", report.Problems)
+	}
+}
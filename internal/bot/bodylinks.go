@@ -0,0 +1,170 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// BODY_CHECK_MAX_WARNINGS caps the warnings in the preview, which has to fit
+// within MAX_MESSAGE_LENGTH together with the body.
+const BODY_CHECK_MAX_WARNINGS = 5
+
+var (
+	// linkPattern finds links, including ones with a misspelled scheme or separator
+	// such as "htp://", "http//" or "https:/", so they can be reported.
+	linkPattern = regexp.MustCompile(`(?i)\b(?:(h+t+p+s?)(:?/+)|www\.)[^\s<>"'«»]+`)
+	// emailCandidatePattern finds anything with an @ between word characters, valid or not.
+	emailCandidatePattern = regexp.MustCompile(`[\p{L}\p{N}._%+-]*@+[\p{L}\p{N}.-]*`)
+	// validEmailPattern is what a deliverable address looks like.
+	validEmailPattern = regexp.MustCompile(`^[\p{L}\p{N}_%+-]+(?:\.[\p{L}\p{N}_%+-]+)*@[\p{L}\p{N}-]+(?:\.[\p{L}\p{N}-]+)*\.\p{L}{2,}$`)
+	// phonePattern finds runs of digits with the usual separators long enough to be a phone.
+	phonePattern = regexp.MustCompile(`\+?\d[\d ()-]{5,}\d`)
+	// mailboxDomainPattern finds the domains of popular mailboxes, to spot addresses
+	// whose @ is missing, such as "ivanov.gmail.com".
+	mailboxDomainPattern = regexp.MustCompile(`(?i)([\p{L}\p{N}._+-]*)\b(?:gmail\.com|yandex\.ru|ya\.ru|mail\.ru|bk\.ru|list\.ru|inbox\.ru|rambler\.ru|outlook\.com|hotmail\.com|yahoo\.com|icloud\.com)\b`)
+)
+
+// BodyCheck lists the links, addresses and phones found in a body with the
+// mistakes spotted in them.
+type BodyCheck struct {
+	Links    []string
+	Emails   []string
+	Phones   []string
+	Warnings []string
+}
+
+// checkBody finds the links, email addresses and phone numbers in the body and
+// warns about broken links, addresses without an @ and incomplete numbers.
+func checkBody(body string) BodyCheck {
+	var check BodyCheck
+	// Matched parts are blanked out, so digits of a link are not taken for a phone
+	rest := []byte(body)
+	blank := func(loc []int) {
+		for i := loc[0]; i < loc[1]; i++ {
+			rest[i] = ' '
+		}
+	}
+
+	for _, loc := range linkPattern.FindAllSubmatchIndex(rest, -1) {
+		link := strings.TrimRight(body[loc[0]:loc[1]], ".,;:!?)")
+		blank(loc)
+		if problem := linkProblem(link, loc, body); problem != "" {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("«%s» — %s", link, problem))
+			continue
+		}
+		check.Links = append(check.Links, link)
+	}
+
+	for _, loc := range emailCandidatePattern.FindAllIndex(rest, -1) {
+		address := strings.TrimRight(string(rest[loc[0]:loc[1]]), ".-")
+		blank(loc)
+		if validEmailPattern.MatchString(address) && !strings.Contains(address, "..") {
+			check.Emails = append(check.Emails, address)
+		} else {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("«%s» — адрес почты с ошибкой", address))
+		}
+	}
+	for _, loc := range mailboxDomainPattern.FindAllSubmatchIndex(rest, -1) {
+		// A bare domain is just the name of the service
+		if mailbox := strings.ToLower(string(rest[loc[2]:loc[3]])); mailbox != "" && mailbox != "www." {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("«%s» — похоже на адрес почты без @", rest[loc[0]:loc[1]]))
+		}
+		blank(loc[:2])
+	}
+
+	for _, match := range phonePattern.FindAllString(string(rest), -1) {
+		match = strings.TrimSpace(match)
+		digits := strings.Count(strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return 'd'
+			}
+			return -1
+		}, match), "d")
+		international := strings.HasPrefix(match, "+")
+		switch {
+		case digits >= 10 && digits <= 15 && (international || digits <= 11):
+			check.Phones = append(check.Phones, match)
+		case international || strings.ContainsAny(match, "()"):
+			check.Warnings = append(check.Warnings, fmt.Sprintf("«%s» — в номере телефона %d цифр, проверьте его", match, digits))
+		}
+		// Shorter runs without a + or brackets are dates, sums and the like
+	}
+	return check
+}
+
+// linkProblem explains what is wrong with a link, or returns "" for a good one.
+// loc holds the submatch indexes of linkPattern within the body.
+func linkProblem(link string, loc []int, body string) string {
+	address := link
+	if loc[2] >= 0 {
+		scheme, separator := strings.ToLower(body[loc[2]:loc[3]]), body[loc[4]:loc[5]]
+		if scheme != "http" && scheme != "https" || separator != "://" {
+			return "ошибка в начале ссылки, должно быть http:// или https://"
+		}
+	} else {
+		address = "http://" + link
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "ссылка не открывается"
+	}
+	host := u.Hostname()
+	if isIPv4(host) {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	tld := labels[len(labels)-1]
+	if len(labels) < 2 || strings.Contains(host, "..") || len([]rune(tld)) < 2 || strings.ContainsFunc(tld, unicode.IsDigit) {
+		return "в ссылке нет правильного домена"
+	}
+	return ""
+}
+
+// isIPv4 reports whether the host is a dotted IPv4 address.
+func isIPv4(host string) bool {
+	parts := strings.Split(host, ".")
+	return len(parts) == 4 && !strings.ContainsFunc(host, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) })
+}
+
+// pluralRU picks the Russian noun form for the number: 1 ссылка, 2 ссылки, 5 ссылок.
+func pluralRU(n int, one, few, many string) string {
+	switch {
+	case n%100 >= 11 && n%100 <= 14:
+		return many
+	case n%10 == 1:
+		return one
+	case n%10 >= 2 && n%10 <= 4:
+		return few
+	}
+	return many
+}
+
+// format renders the check for the preview: what was found and what to fix,
+// or "" when the body has no links, addresses or phones.
+func (c BodyCheck) format() string {
+	var found []string
+	if n := len(c.Links); n > 0 {
+		found = append(found, fmt.Sprintf("%d %s", n, pluralRU(n, "ссылка", "ссылки", "ссылок")))
+	}
+	if n := len(c.Phones); n > 0 {
+		found = append(found, fmt.Sprintf("%d %s", n, pluralRU(n, "телефон", "телефона", "телефонов")))
+	}
+	if n := len(c.Emails); n > 0 {
+		found = append(found, fmt.Sprintf("%d %s почты", n, pluralRU(n, "адрес", "адреса", "адресов")))
+	}
+	if len(found) == 0 && len(c.Warnings) == 0 {
+		return ""
+	}
+	text := "В тексте: " + choose(strings.Join(found, ", "), "ссылок и контактов нет") + "\n"
+	for i, warning := range c.Warnings {
+		if i == BODY_CHECK_MAX_WARNINGS {
+			text += fmt.Sprintf("Проверьте ещё %d.\n", len(c.Warnings)-i)
+			break
+		}
+		text += "Проверьте: " + warning + "\n"
+	}
+	return text
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		links    []string
+		emails   []string
+		phones   []string
+		warnings int
+	}{
+		{"plain text", "Добрый день, встреча 12.05.2024 в 15:00, сумма 150 000 руб.", nil, nil, nil, 0},
+		{"links", "Сайт: https://example.com/a?b=1, зеркало www.example.org.", []string{"https://example.com/a?b=1", "www.example.org"}, nil, nil, 0},
+		{"broken scheme", "См. htp://example.com и http//example.com", nil, nil, nil, 2},
+		{"link without domain", "Ссылка http://localhost/page", nil, nil, nil, 1},
+		{"ip link", "Панель http://10.0.0.1:8080/", []string{"http://10.0.0.1:8080/"}, nil, nil, 0},
+		{"emails", "Пишите на ivanov@example.com или Петров@пример.рф.", nil, []string{"ivanov@example.com", "Петров@пример.рф"}, nil, 0},
+		{"email with mistakes", "Пишите на ivanov@example или a@@example.com", nil, nil, nil, 2},
+		{"email without @", "Пишите на ivanov.gmail.com", nil, nil, nil, 1},
+		{"bare mailbox domain", "Регистрация на gmail.com", nil, nil, nil, 0},
+		{"phones", "Тел. +7 (495) 123-45-67, 8 800 555 35 35", nil, nil, []string{"+7 (495) 123-45-67", "8 800 555 35 35"}, 0},
+		{"short phone", "Тел. +7 123-45", nil, nil, nil, 1},
+		{"digits in a link are not a phone", "https://example.com/orders/8800555353512", []string{"https://example.com/orders/8800555353512"}, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkBody(tt.body)
+			if !slices.Equal(got.Links, tt.links) {
+				t.Errorf("links = %q, want %q", got.Links, tt.links)
+			}
+			if !slices.Equal(got.Emails, tt.emails) {
+				t.Errorf("emails = %q, want %q", got.Emails, tt.emails)
+			}
+			if !slices.Equal(got.Phones, tt.phones) {
+				t.Errorf("phones = %q, want %q", got.Phones, tt.phones)
+			}
+			if len(got.Warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", got.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestPluralRU(t *testing.T) {
+	for n, want := range map[int]string{1: "ссылка", 2: "ссылки", 4: "ссылки", 5: "ссылок", 11: "ссылок", 12: "ссылок", 21: "ссылка", 22: "ссылки", 111: "ссылок"} {
+		if got := pluralRU(n, "ссылка", "ссылки", "ссылок"); got != want {
+			t.Errorf("pluralRU(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestBodyCheckFormat(t *testing.T) {
+	if got := (BodyCheck{}).format(); got != "" {
+		t.Errorf("empty check: got %q", got)
+	}
+
+	got := checkBody("https://a.example.com https://b.example.com https://c.example.com +7 495 123-45-67 htp://x.ru").format()
+	if !strings.HasPrefix(got, "В тексте: 3 ссылки, 1 телефон\n") {
+		t.Errorf("got %q", got)
+	}
+	if !strings.Contains(got, "Проверьте: «htp://x.ru»") {
+		t.Errorf("warning missing: %q", got)
+	}
+
+	var check BodyCheck
+	for range BODY_CHECK_MAX_WARNINGS + 2 {
+		check.Warnings = append(check.Warnings, "ошибка")
+	}
+	got = check.format()
+	if !strings.HasPrefix(got, "В тексте: ссылок и контактов нет\n") || strings.Count(got, "Проверьте: ") != BODY_CHECK_MAX_WARNINGS || !strings.Contains(got, "Проверьте ещё 2.") {
+		t.Errorf("got %q", got)
+	}
+}
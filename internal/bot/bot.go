@@ -0,0 +1,392 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"flag" // Импортируем пакет для работы с аргументами командной строки
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/mailer"
+)
+
+const (
+	// Define the text for the "New Letter" button
+	NEW_LETTER_BUTTON_TEXT = "Новое Письмо"
+	// Define the text for the button that aborts the current draft
+	CANCEL_BUTTON_TEXT = "Отмена"
+	// Define the text for the button that keeps the configured recipient
+	DEFAULT_RECIPIENT_BUTTON_TEXT = "Получатель по умолчанию"
+	// SHUTDOWN_DRAIN_TIMEOUT is how long a stopping bot waits for emails being sent
+	SHUTDOWN_DRAIN_TIMEOUT = 30 * time.Second
+)
+
+// setupLogging configures logging to append JSON entries at or above level to a file,
+// rotated by the given settings. The Telegram library output goes to the same file,
+// as entries at their own level. Secrets are masked by the redactor both in our logs
+// and in the library output.
+func setupLogging(filename string, rotation LogRotation, redactor *Redactor, level, telegramLevel slog.Level) io.Closer {
+	file, err := openRotatingFile(filename, rotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The log package, still used by libraries, is routed to the same logger
+	slog.SetDefault(newLogger(redactingWriter{w: file, r: redactor}, level))
+
+	tgbotapi.SetLogger(newTelegramLogger(redactingWriter{w: file, r: redactor}, telegramLevel))
+	return file
+}
+
+// inFlightSends counts emails being sent, so shutdown can wait for them.
+var inFlightSends sync.WaitGroup
+
+// ServeOptions are what the serve subcommand runs with: the settings from
+// secrets.json with the command-line overrides and the way updates arrive.
+type ServeOptions struct {
+	Secrets    *Secrets
+	WebhookURL string // Without it updates are received by long polling
+	ListenAddr string
+	TLSCert    string
+	TLSKey     string
+	SelfSigned bool
+	reread     func() (*Secrets, error) // Reads the settings again for /reload
+}
+
+// ParseServeFlags reads the command line of the serve subcommand and the settings
+// it points to, stopping the process if they are invalid.
+func ParseServeFlags(args []string) *ServeOptions {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags := config.AddFlags(fs)
+	options := &ServeOptions{reread: flags.Resolve}
+	fs.StringVar(&options.WebhookURL, "webhook-url", "", "Публичный адрес вебхука; без него используется long polling")
+	fs.StringVar(&options.ListenAddr, "listen-addr", ":8443", "Адрес, на котором принимаются запросы вебхука")
+	fs.StringVar(&options.TLSCert, "tls-cert", "", "Сертификат TLS для сервера вебхука")
+	fs.StringVar(&options.TLSKey, "tls-key", "", "Ключ сертификата TLS")
+	fs.BoolVar(&options.SelfSigned, "webhook-self-signed", false, "Передать сертификат Telegram, если он самоподписанный")
+	fs.Parse(args)
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		log.Fatal("Флаги --tls-cert и --tls-key указываются вместе")
+	}
+
+	secrets, err := flags.Resolve()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := secrets.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	options.Secrets = secrets
+	return options
+}
+
+// Setup prepares the process to serve: it starts the log and applies the
+// settings that are kept process-wide, such as the validation rules and the
+// reply templates. The returned function closes the log.
+func Setup(options *ServeOptions) (closeLog func()) {
+	secrets := options.Secrets
+	// Setup logging to a file using the filename from secrets
+	redactor := NewRedactor(secretValues(secrets), !secrets.LogEmails)
+	logRedactor = redactor
+	level, _ := config.ParseLogLevel(secrets.LogLevel) // Checked by validate
+	telegramLevel, _ := secrets.TelegramLevel()        // Checked by validate
+	logFile := setupLogging(secrets.LogFile, secrets.LogRotation, redactor, level, telegramLevel)
+	slog.Info("Бот запущен", "version", version)
+
+	if err := registerFieldRules(secrets.FieldRules); err != nil {
+		fatal("Ошибка загрузки правил проверки", "error", err)
+	}
+	normalization = secrets.Normalize
+	configSource = options.reread
+	probes.configure(secrets.Probes)
+	if err := loadReplyTemplates(secrets.ReplyTemplates); err != nil {
+		fatal("Ошибка загрузки шаблонов ответов", "error", err)
+	}
+	if err := mailer.ConfigureRetry(secrets.SendRetry); err != nil {
+		fatal("Ошибка запуска бота", "error", err)
+	}
+	if err := configureTempStore(secrets); err != nil {
+		fatal("Ошибка запуска бота", "error", err)
+	}
+	configureRateLimits(secrets)
+	configureSendConcurrency(secrets)
+	mailer.ConfigureHTTPTransport()
+	go tempFiles.expireEvery(TEMP_SWEEP_INTERVAL, TEMP_FILE_TTL)
+	if secrets.FailureInjection {
+		enableFailureInjection(secrets)
+	}
+	return func() { logFile.Close() }
+}
+
+// Serve runs the bot until SIGINT or SIGTERM, or until the memory watchdog stops
+// it, and reports whether the watchdog asked for a restart. api is the Telegram
+// connection the handler was created with.
+func (h *Handler) Serve(api *tgbotapi.BotAPI, options *ServeOptions) (restart bool) {
+	secrets := h.secrets
+	if debugServer := startDebugServer(secrets); debugServer != nil {
+		defer debugServer.Close()
+	}
+	slog.Info("Авторизация в аккаунте Telegram", "bot", api.Self.UserName)
+
+	notifyAdminChat(api, secrets, startupBanner(api, secrets))
+
+	var source UpdateSource = &pollingSource{bot: api}
+	if options.WebhookURL != "" {
+		source = &webhookSource{
+			bot:        api,
+			webhookURL: options.WebhookURL,
+			listenAddr: options.ListenAddr,
+			certFile:   options.TLSCert,
+			keyFile:    options.TLSKey,
+			selfSigned: options.SelfSigned,
+		}
+	}
+	if secrets.FailureInjection {
+		active := func() bool { return faults.Active(FAULT_UPDATE_CHAOS) }
+		source = newChaosSource(source, active, DEFAULT_CHAOS_RATES, uint64(time.Now().UnixNano()))
+	}
+	// SIGINT/SIGTERM stop the bot, and so does the memory watchdog to restart it
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	stopCtx, stop := context.WithCancelCause(signalCtx)
+	defer stop(nil)
+	if secrets.Watchdog.Enabled() {
+		interval, _ := secrets.Watchdog.CheckInterval() // Checked by validate
+		watchdog := newWatchdog(secrets.Watchdog,
+			func(text string) { notifyAdminChat(api, secrets, text) },
+			func() { stop(errWatchdogRestart) })
+		go watchdog.run(stopCtx.Done(), interval)
+	}
+	if err := h.serveUpdates(stopCtx, api, source); err != nil {
+		fatal("Ошибка запуска бота", "error", err)
+	}
+	if restart = errors.Is(context.Cause(stopCtx), errWatchdogRestart); restart {
+		slog.Warn("Бот перезапускается по сигналу сторожа памяти")
+	}
+	return restart
+}
+
+// Restart replaces the process with a fresh one, for the restart the memory
+// watchdog asks for. It is called once everything serve opened is closed and
+// only returns by exiting on failure.
+func Restart() {
+	if err := restartProcess(); err != nil {
+		fmt.Fprintf(os.Stderr, "Не удалось перезапустить бота: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// serveUpdates handles updates from the source until stopCtx is done, then shuts
+// down gracefully. Sends and downloads run under their own context, which is only
+// cancelled once they had SHUTDOWN_DRAIN_TIMEOUT to finish.
+func (h *Handler) serveUpdates(stopCtx context.Context, bot *tgbotapi.BotAPI, source UpdateSource) error {
+	secrets := h.secrets
+	updates, err := source.Updates()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	workers := newDispatcher(func(update tgbotapi.Update) {
+		h.HandleUpdate(ctx, update)
+	})
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		h.runScheduler(ctx, stopCtx.Done())
+	}()
+	go runProbeSummaries(stopCtx.Done(), bot, secrets)
+	go h.runSessionJanitor(stopCtx.Done())
+	go h.runReconciliation(ctx, stopCtx.Done())
+	// The board outlives the update loop to show the drain, then says the bot stopped
+	boardStop, boardDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(boardDone)
+		if secrets.StatusBoardChatID != 0 {
+			h.runStatusBoard(boardStop, bot, workers.Pending, STATUS_BOARD_INTERVAL)
+		}
+	}()
+
+updateLoop:
+	for {
+		select {
+		case <-stopCtx.Done():
+			break updateLoop
+		case update, ok := <-updates:
+			if !ok {
+				break updateLoop
+			}
+			if !workers.Dispatch(update) {
+				refuseBusy(bot, update)
+			}
+		}
+	}
+
+	slog.Info("Бот останавливается")
+	source.Stop()
+	workers.Close()
+	<-schedulerDone
+	deadline := time.Now().Add(SHUTDOWN_DRAIN_TIMEOUT)
+	if !workers.Wait(time.Until(deadline)) || !waitGroupTimeout(&inFlightSends, time.Until(deadline)) {
+		slog.Warn("Отправки не завершились вовремя и будут прерваны", "timeout", SHUTDOWN_DRAIN_TIMEOUT)
+	}
+	cancel()
+	// Broadcasts stop at the cancellation and report how far they got
+	h.runningBroadcasts.Wait()
+	close(boardStop)
+	<-boardDone
+	h.notifyPendingDrafts()
+	notifyAdminChat(bot, secrets, fmt.Sprintf("Бот @%s остановлен, версия %s", bot.Self.UserName, version))
+	slog.Info("Бот остановлен")
+	return nil
+}
+
+// describeSendResult turns the outcome of a send into a message for the user,
+// worded by the reply templates for the given locale.
+// The second return value reports whether the email was accepted for at least one recipient.
+func describeSendResult(ctx context.Context, locale string, result SendEmailResponse, err error) (string, bool) {
+	var apiErr mailer.ProviderError
+	if errors.As(err, &apiErr) {
+		// Handle API-level errors, the provider refused the letter
+		slog.ErrorContext(ctx, "Ошибка API", "provider", apiErr.Provider(), "error", err)
+		return renderReply(locale, REPLY_API_ERROR, ReplyData{Error: err.Error(), Provider: apiErr.Provider()}), false
+	}
+	if err != nil {
+		// Handle errors during the HTTP request or response decoding
+		slog.ErrorContext(ctx, "Ошибка отправки письма", "error", err)
+		return renderReply(locale, REPLY_SEND_ERROR, ReplyData{Error: err.Error()}), false
+	}
+
+	accepted, rejected := result.Split()
+	if len(accepted) == 0 {
+		if len(rejected) == 0 {
+			// Unisender reported no error but returned no results either, so the email was likely sent
+			slog.WarnContext(ctx, "Пустой результат отправки письма")
+			return renderReply(locale, REPLY_SEND_SUCCESS_NO_ID, ReplyData{}), true
+		}
+		slog.ErrorContext(ctx, "Все получатели отклонены", "rejected", mailer.DescribeRejected(rejected))
+		return renderReply(locale, REPLY_API_ERROR, ReplyData{Error: mailer.DescribeRejected(rejected)}), false
+	}
+
+	var text string
+	if id := accepted[0].ID; id != "" {
+		slog.InfoContext(ctx, "Письмо успешно отправлено", "email_id", id)
+		text = renderReply(locale, REPLY_SEND_SUCCESS, ReplyData{EmailID: string(id)})
+	} else {
+		text = renderReply(locale, REPLY_SEND_SUCCESS_NO_ID, ReplyData{})
+	}
+	if len(rejected) > 0 {
+		// Some recipients were rejected while others were accepted
+		slog.WarnContext(ctx, "Часть получателей отклонена", "rejected", mailer.DescribeRejected(rejected))
+		text += "\nНе приняты:\n" + mailer.DescribeRejected(rejected)
+	}
+	return text, true
+}
+
+// newInitialKeyboard builds the main keyboard with the "New Letter" and invitation buttons.
+func newInitialKeyboard() tgbotapi.ReplyKeyboardMarkup {
+	keyboard := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(NEW_LETTER_BUTTON_TEXT),
+			tgbotapi.NewKeyboardButton(NEW_INVITE_BUTTON_TEXT),
+		),
+	)
+	keyboard.OneTimeKeyboard = false // Keep the keyboard visible
+	return keyboard
+}
+
+// acceptRecipients confirms the chosen recipients and moves the wizard on to the
+// copies.
+func (h *Handler) acceptRecipients(message *tgbotapi.Message, state *UserState, reply string) {
+	bot := h.bot
+	msg := newReply(message, reply)
+	msg.ReplyMarkup = newCancelKeyboard() // Keep only the cancel button while composing
+	bot.Send(msg)
+	h.promptCopies(message, state, "await_cc", "")
+}
+
+// finishRecipients moves the wizard on once the recipients and copies are set: to
+// the subject, to the sender for a letter from a template, or back to the preview
+// when they were changed from there. lead, if any, goes before the prompt.
+func (h *Handler) finishRecipients(message *tgbotapi.Message, userID int64, state *UserState, lead string) {
+	bot := h.bot
+	if state.Editing {
+		if lead != "" {
+			bot.Send(newReply(message, lead))
+		}
+		showPreview(bot, message, state)
+		return
+	}
+	if lead != "" {
+		lead += "\n"
+	}
+	if state.Template != "" {
+		// Subject and body came from the template
+		state.State = "await_sender"
+		bot.Send(newReply(message, lead+"Укажите имя отправителя."))
+		return
+	}
+	state.State = "await_subject"
+	bot.Send(newReply(message, lead+"Введите тему письма."))
+	h.offerSubjects(message.Chat.ID, userID)
+}
+
+// acceptSubject moves the wizard on once the subject is set: to the body, or back
+// to the preview when it was changed from there.
+func acceptSubject(bot BotAPI, message *tgbotapi.Message, state *UserState) {
+	if state.Editing {
+		showPreview(bot, message, state)
+		return
+	}
+	state.State = "await_body"
+	msg := newReply(message, "Введите текст письма. К письму можно приложить файлы и фото.\n"+
+		"Жирный, курсив и ссылки из Telegram сохранятся в письме. Чтобы отправить свою HTML-вёрстку как есть, сначала нажмите «HTML».")
+	msg.ReplyMarkup = bodyFormatKeyboard()
+	bot.Send(msg)
+}
+
+// newRecipientKeyboard builds the keyboard shown while the recipient is being entered.
+func newRecipientKeyboard() tgbotapi.ReplyKeyboardMarkup {
+	keyboard := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(DEFAULT_RECIPIENT_BUTTON_TEXT)),
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(CANCEL_BUTTON_TEXT)),
+	)
+	keyboard.ResizeKeyboard = true
+	return keyboard
+}
+
+// newCancelKeyboard builds the keyboard shown while a draft is being composed.
+func newCancelKeyboard() tgbotapi.ReplyKeyboardMarkup {
+	keyboard := tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButton(CANCEL_BUTTON_TEXT),
+	))
+	keyboard.ResizeKeyboard = true
+	return keyboard
+}
+
+// newReply creates a message that quotes the given message in the same chat.
+func newReply(to *tgbotapi.Message, text string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(to.Chat.ID, text)
+	msg.ReplyToMessageID = to.MessageID
+	msg.AllowSendingWithoutReply = true // The quoted message may have been deleted meanwhile
+	return msg
+}
+
+// choose returns the first string if it's not empty, otherwise returns the fallback.
+func choose(arg, fallback string) string {
+	if arg != "" {
+		return arg
+	}
+	return fallback
+}
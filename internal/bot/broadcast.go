@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// BROADCAST_INTERVAL spaces the messages of a broadcast to stay well within the
+	// Telegram limit of 30 messages a second.
+	BROADCAST_INTERVAL = 50 * time.Millisecond
+	// BROADCAST_CONFIRM_TTL is how long a broadcast waits for its confirmation.
+	BROADCAST_CONFIRM_TTL = 10 * time.Minute
+)
+
+// pendingBroadcast is a broadcast waiting for the administrator to confirm it.
+type pendingBroadcast struct {
+	AdminID int64
+	Text    string
+	Expires time.Time
+}
+
+// sweepBroadcasts forgets the broadcasts whose confirmation has expired and
+// returns how many there were.
+func (h *Handler) sweepBroadcasts(now time.Time) int {
+	h.broadcastMu.Lock()
+	defer h.broadcastMu.Unlock()
+	expired := 0
+	for id, pending := range h.broadcasts {
+		if now.After(pending.Expires) {
+			delete(h.broadcasts, id)
+			expired++
+		}
+	}
+	return expired
+}
+
+// knownUsers returns the IDs of everyone who has talked to the bot, in order.
+// Conversations are private chats, so they are also the chat IDs.
+func (h *Handler) knownUsers() []int64 {
+	var users []int64
+	h.States.Range(func(userID int64, _ UserState) {
+		users = append(users, userID)
+	})
+	slices.SortFunc(users, cmp.Compare[int64])
+	return users
+}
+
+// handleBroadcastCommand replies to /broadcast <текст> with the message and the
+// number of recipients, asking the administrator to confirm.
+func (h *Handler) handleBroadcastCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	text := strings.TrimSpace(message.CommandArguments())
+	if text == "" {
+		bot.Send(newReply(message, "Использование: /broadcast <текст сообщения>. Бот покажет сообщение и число получателей и попросит подтвердить рассылку."))
+		return
+	}
+	users := len(h.knownUsers())
+
+	h.broadcastMu.Lock()
+	h.broadcastSeq++
+	id := h.broadcastSeq
+	h.broadcasts[id] = &pendingBroadcast{AdminID: message.From.ID, Text: text, Expires: time.Now().Add(BROADCAST_CONFIRM_TTL)}
+	h.broadcastMu.Unlock()
+	audit(message.From, "запросил рассылку сообщения %d пользователям", users)
+
+	msg := newReply(message, fmt.Sprintf("Сообщение получат все пользователи бота (%d):\n\n%s\n\nПодтвердите в течение %d минут.",
+		users, text, int(BROADCAST_CONFIRM_TTL.Minutes())))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Разослать", fmt.Sprintf("broadcast:send:%d", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("broadcast:cancel:%d", id)),
+	))
+	bot.Send(msg)
+}
+
+// handleBroadcastCallback sends or cancels a broadcast; only its administrator may do it.
+func (h *Handler) handleBroadcastCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	action, arg, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	h.broadcastMu.Lock()
+	pending, ok := h.broadcasts[id]
+	if ok && pending.AdminID == query.From.ID {
+		delete(h.broadcasts, id)
+	} else {
+		ok = false
+	}
+	h.broadcastMu.Unlock()
+	if !ok || !secrets.IsAdmin(query.From.ID) {
+		return "Кнопка устарела."
+	}
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+
+	if action != "send" {
+		audit(query.From, "отменил рассылку сообщения")
+		bot.Send(newReply(query.Message, "Рассылка отменена."))
+		return "Отменено"
+	}
+	if time.Now().After(pending.Expires) {
+		bot.Send(newReply(query.Message, "Подтверждение истекло. Повторите команду /broadcast."))
+		return "Подтверждение истекло"
+	}
+
+	users := h.knownUsers()
+	h.sendProgress(newReply(query.Message, fmt.Sprintf("Рассылаю сообщение %d пользователям...", len(users))))
+	// The broadcast takes BROADCAST_INTERVAL per user, so it runs on its own rather
+	// than holding up the administrator's other updates
+	h.runningBroadcasts.Add(1)
+	go func() {
+		defer h.runningBroadcasts.Done()
+		delivered, failed := broadcast(ctx, bot, pending.Text, users)
+		audit(query.From, "разослал сообщение: доставлено %d, не доставлено %d", delivered, failed)
+		text := fmt.Sprintf("Рассылка завершена: доставлено %d из %d.", delivered, len(users))
+		if failed > 0 {
+			text += fmt.Sprintf(" Не доставлено %d — эти пользователи, скорее всего, остановили бота.", failed)
+		}
+		if skipped := len(users) - delivered - failed; skipped > 0 {
+			text += fmt.Sprintf(" Бот остановился, не отправив %d.", skipped)
+		}
+		bot.Send(newReply(query.Message, text))
+	}()
+	return ""
+}
+
+// broadcast sends the text to each user in turn until ctx is done and returns how
+// many messages were delivered and how many failed.
+func broadcast(ctx context.Context, bot BotAPI, text string, users []int64) (delivered, failed int) {
+	for i, userID := range users {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return delivered, failed
+			case <-time.After(BROADCAST_INTERVAL):
+			}
+		}
+		if _, err := bot.Send(tgbotapi.NewMessage(userID, text)); err != nil {
+			slog.WarnContext(ctx, "Ошибка отправки рассылки", "user_id", userID, "error", err)
+			failed++
+			continue
+		}
+		delivered++
+	}
+	return delivered, failed
+}
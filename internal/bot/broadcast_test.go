@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	telegram, handler := adminBot(t)
+	for _, userID := range []int64{3, 4} {
+		handler.States.Update(userID, func(s *UserState) { s.State = "initial" })
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/broadcast Бот будет недоступен с 22:00.").update())
+	if _, ok := telegram.find(wizardUser, "Сообщение получат все пользователи бота (2)"); !ok {
+		t.Fatalf("no confirmation:\n%s", telegram.transcript(wizardUser))
+	}
+	// Only the administrator who asked may confirm
+	tap := tapAction("broadcast:send:1").update()
+	tap.CallbackQuery.From.ID = 3
+	handler.HandleUpdate(context.Background(), tap)
+	if _, ok := telegram.find(3, "Бот будет недоступен"); ok {
+		t.Fatal("broadcast sent by another user's tap")
+	}
+
+	handler.HandleUpdate(context.Background(), tapAction("broadcast:send:1").update())
+	handler.runningBroadcasts.Wait()
+	for _, userID := range []int64{3, 4} {
+		if _, ok := telegram.find(userID, "Бот будет недоступен с 22:00."); !ok {
+			t.Errorf("user %d got no broadcast:\n%s", userID, telegram.transcript(userID))
+		}
+	}
+	if _, ok := telegram.find(wizardUser, "Рассылка завершена: доставлено 2 из 2."); !ok {
+		t.Errorf("no broadcast report:\n%s", telegram.transcript(wizardUser))
+	}
+
+	// A second tap finds the broadcast gone
+	handler.HandleUpdate(context.Background(), tapAction("broadcast:send:1").update())
+	handler.runningBroadcasts.Wait()
+	if _, ok := telegram.find(3, "Бот будет недоступен"); ok {
+		t.Error("broadcast sent twice")
+	}
+}
+
+func TestBroadcastCancelled(t *testing.T) {
+	telegram, handler := adminBot(t)
+	handler.States.Update(3, func(s *UserState) { s.State = "initial" })
+
+	handler.HandleUpdate(context.Background(), textAction("/broadcast Привет").update())
+	handler.HandleUpdate(context.Background(), tapAction("broadcast:cancel:1").update())
+	if _, ok := telegram.find(wizardUser, "Рассылка отменена."); !ok {
+		t.Errorf("no cancellation:\n%s", telegram.transcript(wizardUser))
+	}
+	if _, ok := telegram.find(3, "Привет"); ok {
+		t.Error("cancelled broadcast was sent")
+	}
+}
+
+func TestSweepBroadcasts(t *testing.T) {
+	handler := NewHandler(&fakeBot{}, nil, &Secrets{}, MemoryStores())
+	now := time.Now()
+	handler.broadcasts = map[int64]*pendingBroadcast{
+		1: {AdminID: 1, Text: "Старое", Expires: now.Add(-time.Second)},
+		2: {AdminID: 1, Text: "Новое", Expires: now.Add(time.Minute)},
+	}
+	if n := handler.sweepBroadcasts(now); n != 1 || len(handler.broadcasts) != 1 || handler.broadcasts[2] == nil {
+		t.Errorf("swept %d, left %v, want only the expired one gone", n, handler.broadcasts)
+	}
+}
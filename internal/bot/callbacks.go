@@ -0,0 +1,143 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// handleCallback dispatches an inline keyboard button press by the prefix of its data.
+func (h *Handler) handleCallback(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	bot, secrets := h.bot, h.secrets
+	var chatID int64 // Buttons of inline mode messages have no chat
+	if query.Message != nil {
+		chatID = query.Message.Chat.ID
+	}
+	ctx = h.updateLogAttrs(ctx, query.From.ID, chatID)
+	slog.InfoContext(ctx, "Нажата кнопка", "data", query.Data, "username", query.From.UserName)
+
+	prefix, payload, _ := strings.Cut(query.Data, ":")
+	var reply string
+	switch prefix {
+	case "remind":
+		reply = h.handleRemindCallback(query, payload)
+	case "followup":
+		reply = h.handleFollowUpCallback(ctx, query, payload)
+	case "file":
+		reply = h.handleFileCallback(ctx, query, payload)
+	case "campaign":
+		reply = handleCampaignCallback(ctx, bot, secrets, query, payload)
+	case "retry":
+		reply = h.handleRetryCallback(ctx, query, payload)
+	case "queue":
+		reply = h.handleQueueCallback(ctx, query, payload)
+	case "pin":
+		reply = h.handlePinCallback(query, payload)
+	case "confirm":
+		reply = h.handleConfirmCallback(ctx, query, payload)
+	case "contact":
+		reply = h.handleContactCallback(query, payload)
+	case "alias":
+		reply = h.handleAliasCallback(query, payload)
+	case "copies":
+		reply = h.handleCopiesCallback(query, payload)
+	case "subject":
+		reply = h.handleSubjectCallback(query, payload)
+	case "template":
+		reply = h.handleTemplateCallback(query, payload)
+	case "tplimport":
+		reply = h.handleTemplateImportCallback(query, payload)
+	case "dataimport":
+		reply = h.handleDataImportCallback(query, payload)
+	case "format":
+		reply = h.handleFormatCallback(query, payload)
+	case "status":
+		reply = h.handleStatusCallback(ctx, query, payload)
+	case "tags":
+		reply = h.handleTagsCallback(query, payload)
+	case "history":
+		reply = h.handleHistoryCallback(query, payload)
+	case "schedule":
+		reply = h.handleScheduleCallback(query, payload)
+	case "behalf":
+		reply = h.handleBehalfCallback(ctx, query, payload)
+	case "guest":
+		reply = h.handleGuestCallback(ctx, query, payload)
+	case "survey":
+		reply = h.handleSurveyCallback(query, payload)
+	case "broadcast":
+		reply = h.handleBroadcastCallback(ctx, query, payload)
+	default:
+		slog.WarnContext(ctx, "Неизвестная кнопка", "data", query.Data)
+		reply = "Кнопка устарела."
+	}
+
+	// Telegram shows a loading indicator on the button until the callback is answered
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, reply)); err != nil {
+		slog.WarnContext(ctx, "Ошибка ответа на нажатие кнопки", "error", err)
+	}
+}
+
+// pinKeyboard builds the inline button that pins the send confirmation of a history entry.
+func pinKeyboard(historyID uint64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Закрепить", fmt.Sprintf("pin:%d", historyID)),
+	))
+}
+
+// handlePinCallback pins the message the button is attached to, marks its letter
+// important in the history and removes the button. Buttons sent before letters were
+// marked carry no history ID and only pin.
+func (h *Handler) handlePinCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	pin := tgbotapi.PinChatMessageConfig{ChatID: chatID, MessageID: messageID, DisableNotification: true}
+	if _, err := bot.Request(pin); err != nil {
+		// In groups the bot needs the right to pin messages
+		slog.Warn("Ошибка закрепления сообщения", "chat_id", chatID, "message_id", messageID, "error", err)
+		return "Не удалось закрепить: у бота нет прав на закрепление сообщений."
+	}
+	if id, err := strconv.ParseUint(payload, 10, 64); err == nil {
+		if entry, found := h.History.Get(id); found && entry.involves(query.From.ID) {
+			h.History.MarkImportant(id)
+		}
+	}
+
+	// Other buttons, such as the status check, stay usable on the pinned message
+	if query.Message.ReplyMarkup != nil {
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for _, row := range query.Message.ReplyMarkup.InlineKeyboard {
+			row = slices.DeleteFunc(slices.Clone(row), func(b tgbotapi.InlineKeyboardButton) bool {
+				return b.CallbackData != nil && strings.HasPrefix(*b.CallbackData, "pin:")
+			})
+			if len(row) > 0 {
+				rows = append(rows, row)
+			}
+		}
+		if len(rows) > 0 {
+			bot.Request(tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, tgbotapi.NewInlineKeyboardMarkup(rows...)))
+			return "Сообщение закреплено"
+		}
+	}
+	removeInlineKeyboard(bot, chatID, messageID)
+	return "Сообщение закреплено"
+}
+
+// removeInlineKeyboard strips the inline buttons from a message.
+func removeInlineKeyboard(bot BotAPI, chatID int64, messageID int) {
+	// An empty (not nil) keyboard is required, Telegram rejects a null one
+	empty := tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+	if _, err := bot.Request(tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, empty)); err != nil {
+		slog.Warn("Ошибка удаления кнопок сообщения", "chat_id", chatID, "message_id", messageID, "error", err)
+	}
+}
@@ -0,0 +1,177 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// CampaignStatus is the result of the Unisender getCampaignStatus method.
+type CampaignStatus struct {
+	Status       string `json:"status"`
+	CreationTime string `json:"creation_time"`
+	StartTime    string `json:"start_time"`
+}
+
+// CampaignStats is the result of the Unisender getCampaignCommonStats method.
+type CampaignStats struct {
+	Total         int `json:"total"`
+	Sent          int `json:"sent"`
+	Delivered     int `json:"delivered"`
+	ReadUnique    int `json:"read_unique"`
+	ReadAll       int `json:"read_all"`
+	ClickedUnique int `json:"clicked_unique"`
+	ClickedAll    int `json:"clicked_all"`
+	Unsubscribed  int `json:"unsubscribed"`
+	Spam          int `json:"spam"`
+}
+
+// campaignStatusNames translates Unisender campaign statuses for users.
+var campaignStatusNames = map[string]string{
+	"waits_censor":   "ожидает модерации",
+	"censor_hold":    "на модерации",
+	"declined":       "отклонена модератором",
+	"waits_schedule": "ожидает планирования",
+	"scheduled":      "запланирована",
+	"in_progress":    "отправляется",
+	"analysed":       "анализируется",
+	"completed":      "завершена",
+	"stopped":        "приостановлена",
+	"canceled":       "отменена",
+}
+
+// fetchCampaignReport loads the status and aggregate statistics of a campaign.
+func fetchCampaignReport(ctx context.Context, apiKey string, campaignID int64) (*CampaignStatus, *CampaignStats, error) {
+	id := strconv.FormatInt(campaignID, 10)
+
+	var status CampaignStatus
+	if err := mailer.CallUnisender(ctx, apiKey, "getCampaignStatus", url.Values{"campaign_id": {id}}, &status); err != nil {
+		return nil, nil, err
+	}
+	var stats CampaignStats
+	if err := mailer.CallUnisender(ctx, apiKey, "getCampaignCommonStats", url.Values{"campaign_id": {id}}, &stats); err != nil {
+		return nil, nil, err
+	}
+	return &status, &stats, nil
+}
+
+// formatCampaignReport renders a campaign summary for a chat message.
+func formatCampaignReport(campaignID int64, status *CampaignStatus, stats *CampaignStats) string {
+	statusName, known := campaignStatusNames[status.Status]
+	if !known {
+		statusName = status.Status
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Рассылка %d: %s\n", campaignID, statusName)
+	fmt.Fprintf(&sb, "Создана: %s\n", status.CreationTime)
+	if status.StartTime != "" {
+		fmt.Fprintf(&sb, "Запущена: %s\n", status.StartTime)
+	}
+	fmt.Fprintf(&sb, "\nВсего адресов: %d\n", stats.Total)
+	fmt.Fprintf(&sb, "Отправлено: %d\n", stats.Sent)
+	fmt.Fprintf(&sb, "Доставлено: %d (%s)\n", stats.Delivered, percent(stats.Delivered, stats.Sent))
+	fmt.Fprintf(&sb, "Открыли: %d (%s)\n", stats.ReadUnique, percent(stats.ReadUnique, stats.Delivered))
+	fmt.Fprintf(&sb, "Перешли по ссылкам: %d (%s)\n", stats.ClickedUnique, percent(stats.ClickedUnique, stats.Delivered))
+	fmt.Fprintf(&sb, "Отписались: %d\n", stats.Unsubscribed)
+	fmt.Fprintf(&sb, "Пожаловались на спам: %d", stats.Spam)
+	return sb.String()
+}
+
+// percent formats part as a percentage of total.
+func percent(part, total int) string {
+	if total == 0 {
+		return "—"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
+
+// campaignKeyboard builds the refresh and CSV export buttons for a campaign report.
+func campaignKeyboard(campaignID int64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Обновить", fmt.Sprintf("campaign:refresh:%d", campaignID)),
+		tgbotapi.NewInlineKeyboardButtonData("Экспорт CSV", fmt.Sprintf("campaign:csv:%d", campaignID)),
+	))
+}
+
+// handleCampaignCommand replies to /campaign <id> with the campaign report.
+func handleCampaignCommand(ctx context.Context, bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	campaignID, err := strconv.ParseInt(strings.TrimSpace(message.CommandArguments()), 10, 64)
+	if err != nil {
+		bot.Send(newReply(message, "Укажите ID рассылки: /campaign <id>"))
+		return
+	}
+
+	status, stats, err := fetchCampaignReport(ctx, secrets.UnisenderAPIKey, campaignID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка получения статистики рассылки", "campaign_id", campaignID, "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось получить статистику рассылки: %v", err)))
+		return
+	}
+
+	msg := newReply(message, formatCampaignReport(campaignID, status, stats))
+	msg.ReplyMarkup = campaignKeyboard(campaignID)
+	bot.Send(msg)
+}
+
+// handleCampaignCallback refreshes a campaign report in place or exports it as CSV.
+func handleCampaignCallback(ctx context.Context, bot BotAPI, secrets *Secrets, query *tgbotapi.CallbackQuery, payload string) string {
+	action, idText, _ := strings.Cut(payload, ":")
+	campaignID, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	chatID := query.Message.Chat.ID
+
+	status, stats, err := fetchCampaignReport(ctx, secrets.UnisenderAPIKey, campaignID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка получения статистики рассылки", "campaign_id", campaignID, "error", err)
+		return "Не удалось получить статистику"
+	}
+
+	switch action {
+	case "refresh":
+		edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID,
+			formatCampaignReport(campaignID, status, stats), campaignKeyboard(campaignID))
+		bot.Send(edit)
+		return "Обновлено"
+	case "csv":
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+			Name:  fmt.Sprintf("campaign_%d.csv", campaignID),
+			Bytes: campaignCSV(campaignID, status, stats),
+		})
+		if _, err := bot.Send(doc); err != nil {
+			slog.ErrorContext(ctx, "Ошибка отправки CSV рассылки", "campaign_id", campaignID, "error", err)
+			return "Не удалось отправить файл"
+		}
+		return ""
+	default:
+		return "Кнопка устарела."
+	}
+}
+
+// campaignCSV renders the campaign report as a single-row CSV file with a header.
+func campaignCSV(campaignID int64, status *CampaignStatus, stats *CampaignStats) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"campaign_id", "status", "creation_time", "start_time", "total", "sent", "delivered",
+		"read_unique", "read_all", "clicked_unique", "clicked_all", "unsubscribed", "spam"})
+	w.Write([]string{
+		strconv.FormatInt(campaignID, 10), status.Status, status.CreationTime, status.StartTime,
+		strconv.Itoa(stats.Total), strconv.Itoa(stats.Sent), strconv.Itoa(stats.Delivered),
+		strconv.Itoa(stats.ReadUnique), strconv.Itoa(stats.ReadAll),
+		strconv.Itoa(stats.ClickedUnique), strconv.Itoa(stats.ClickedAll),
+		strconv.Itoa(stats.Unsubscribed), strconv.Itoa(stats.Spam),
+	})
+	w.Flush()
+	return buf.Bytes()
+}
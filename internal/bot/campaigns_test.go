@@ -0,0 +1,43 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/testutil"
+)
+
+func TestFetchCampaignReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := "campaign_status.json"
+		if strings.HasSuffix(r.URL.Path, "/getCampaignCommonStats") {
+			payload = "campaign_common_stats.json"
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", "unisender", payload))
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	testutil.Reroute(t, mailer.UNISENDER_API_URL, server.URL+"/")
+
+	status, stats, err := fetchCampaignReport(context.Background(), "key", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStatus := CampaignStatus{Status: "completed", CreationTime: "2024-03-12 10:15:00", StartTime: "2024-03-12 10:20:00"}
+	if *status != wantStatus {
+		t.Errorf("status = %+v, want %+v", *status, wantStatus)
+	}
+	wantStats := CampaignStats{Total: 120, Sent: 118, Delivered: 115, ReadUnique: 64, ReadAll: 90, ClickedUnique: 12, ClickedAll: 15, Unsubscribed: 1}
+	if *stats != wantStats {
+		t.Errorf("stats = %+v, want %+v", *stats, wantStats)
+	}
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// chaosRates are the shares of updates chaosSource drops, duplicates and delays,
+// each 0..1, and the longest delay.
+type chaosRates struct {
+	Drop      float64
+	Duplicate float64
+	Delay     float64
+	MaxDelay  time.Duration
+}
+
+// DEFAULT_CHAOS_RATES are the rates of /fail update_chaos: about one update in
+// three is dropped, duplicated or delayed, which reorders it after later ones.
+var DEFAULT_CHAOS_RATES = chaosRates{Drop: 0.1, Duplicate: 0.1, Delay: 0.15, MaxDelay: 3 * time.Second}
+
+// chaosSource drops, duplicates and delays the updates of the source it wraps
+// while active reports true, so a staging bot or a test can check that handling
+// an update twice, out of order or never leaves the user in a sane state.
+type chaosSource struct {
+	next   UpdateSource
+	active func() bool
+	rates  chaosRates
+	random *rand.Rand // Only used by the forwarding goroutine
+
+	stopped chan struct{}
+	delayed sync.WaitGroup
+}
+
+// newChaosSource wraps the source, taking random decisions from seed.
+func newChaosSource(next UpdateSource, active func() bool, rates chaosRates, seed uint64) *chaosSource {
+	return &chaosSource{
+		next:    next,
+		active:  active,
+		rates:   rates,
+		random:  rand.New(rand.NewPCG(seed, 0)),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (c *chaosSource) Updates() (tgbotapi.UpdatesChannel, error) {
+	updates, err := c.next.Updates()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan tgbotapi.Update, cap(updates))
+	go func() {
+		for update := range updates {
+			c.forward(out, update)
+		}
+		// Delayed updates still arrive, or are dropped once the bot stops
+		c.delayed.Wait()
+		close(out)
+	}()
+	return out, nil
+}
+
+// forward passes the update on, or drops, duplicates or delays it while active.
+func (c *chaosSource) forward(out chan<- tgbotapi.Update, update tgbotapi.Update) {
+	if !c.active() {
+		c.deliver(out, update)
+		return
+	}
+	switch r := c.random.Float64(); {
+	case r < c.rates.Drop:
+		slog.Warn("Хаос: обновление отброшено", "update_id", update.UpdateID)
+	case r < c.rates.Drop+c.rates.Duplicate:
+		slog.Warn("Хаос: обновление продублировано", "update_id", update.UpdateID)
+		c.deliver(out, update)
+		c.deliver(out, update)
+	case r < c.rates.Drop+c.rates.Duplicate+c.rates.Delay:
+		delay := time.Duration(c.random.Int64N(int64(c.rates.MaxDelay) + 1))
+		slog.Warn("Хаос: обновление задержано", "update_id", update.UpdateID, "delay", delay)
+		c.delayed.Add(1)
+		time.AfterFunc(delay, func() {
+			defer c.delayed.Done()
+			c.deliver(out, update)
+		})
+	default:
+		c.deliver(out, update)
+	}
+}
+
+// deliver sends the update on unless the source was stopped, when nobody reads
+// the channel any more.
+func (c *chaosSource) deliver(out chan<- tgbotapi.Update, update tgbotapi.Update) {
+	select {
+	case out <- update:
+	case <-c.stopped:
+	}
+}
+
+func (c *chaosSource) Stop() {
+	close(c.stopped)
+	c.next.Stop()
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// channelSource is an UpdateSource over a prepared channel.
+type channelSource struct {
+	updates chan tgbotapi.Update
+}
+
+func (s *channelSource) Updates() (tgbotapi.UpdatesChannel, error) { return s.updates, nil }
+func (s *channelSource) Stop()                                     {}
+
+// chaosRun passes updates 1..n through a chaosSource and returns the IDs that came out.
+func chaosRun(t *testing.T, n int, active bool) []int {
+	t.Helper()
+	in := make(chan tgbotapi.Update, n)
+	for id := 1; id <= n; id++ {
+		in <- tgbotapi.Update{UpdateID: id}
+	}
+	close(in)
+	rates := chaosRates{Drop: 0.2, Duplicate: 0.2, Delay: 0.2, MaxDelay: 10 * time.Millisecond}
+	source := newChaosSource(&channelSource{updates: in}, func() bool { return active }, rates, 1)
+	out, err := source.Updates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for update := range out {
+		ids = append(ids, update.UpdateID)
+	}
+	return ids
+}
+
+func TestChaosSource(t *testing.T) {
+	const n = 200
+	if ids := chaosRun(t, n, false); len(ids) != n || !slices.IsSorted(ids) {
+		t.Errorf("inactive chaos changed the updates: %v", ids)
+	}
+
+	ids := chaosRun(t, n, true)
+	seen := make(map[int]int)
+	for _, id := range ids {
+		seen[id]++
+	}
+	var dropped, duplicated int
+	for id := 1; id <= n; id++ {
+		switch seen[id] {
+		case 0:
+			dropped++
+		case 2:
+			duplicated++
+		}
+	}
+	if dropped == 0 || duplicated == 0 || slices.IsSorted(ids) {
+		t.Errorf("dropped %d, duplicated %d, sorted %v: chaos did nothing", dropped, duplicated, slices.IsSorted(ids))
+	}
+	if len(seen) > n || len(ids) != n-dropped+duplicated {
+		t.Errorf("got %d updates for %d, want only drops and duplicates", len(ids), n)
+	}
+}
+
+func TestChaosDuplicateSendTap(t *testing.T) {
+	var duplicate atomic.Bool
+	h := newHarnessWith(t, func(source UpdateSource) UpdateSource {
+		return newChaosSource(source, duplicate.Load, chaosRates{Duplicate: 1}, 1)
+	})
+	const user = 42
+	h.provider.respond("sendEmail", `{"result":[{"index":0,"email":"a@example.com","id":"101"}]}`)
+
+	h.send(user, "/start")
+	h.waitForMessage(user, "Привет")
+	h.send(user, NEW_LETTER_BUTTON_TEXT)
+	h.waitForMessage(user, "адрес получателя")
+	h.send(user, "a@example.com")
+	h.tap(user, h.waitForMessage(user, "Кому отправить копию"), "Пропустить")
+	h.tap(user, h.waitForMessage(user, "Кому отправить скрытую копию"), "Пропустить")
+	h.waitForMessage(user, "Введите тему")
+	h.send(user, "Отчёт")
+	h.waitForMessage(user, "Введите текст")
+	h.send(user, "Отчёт во вложении.")
+	h.waitForMessage(user, "имя отправителя")
+	h.send(user, "Иван")
+
+	// The tap arrives twice, as after a retried webhook delivery
+	duplicate.Store(true)
+	h.tap(user, h.waitForMessage(user, "Проверьте письмо"), "Отправить")
+	h.waitForMessage(user, "Хотите отправить ещё одно письмо")
+	// The user's updates are handled in order, so the answer to /start comes
+	// after the second tap is handled
+	duplicate.Store(false)
+	h.send(user, "/start")
+	h.waitForMessage(user, "Привет")
+
+	if calls := h.provider.requests(); len(calls) != 1 {
+		t.Errorf("provider called %d times for a duplicated tap, want 1:\n%s", len(calls), h.telegram.transcript(user))
+	}
+}
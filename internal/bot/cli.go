@@ -0,0 +1,264 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/state"
+)
+
+// RunSend implements the send subcommand: it emails a message from the shell
+// using the same configuration and Unisender pipeline as the bot. It returns the
+// process exit code.
+func RunSend(args []string) int {
+	// Ctrl+C cancels requests in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	to := fs.String("to", "", "Email получателя (по умолчанию target_email из secrets.json)")
+	subject := fs.String("subject", "", "Тема письма")
+	body := fs.String("body", "", "Текст письма")
+	bodyFile := fs.String("body-file", "", "Файл с текстом письма, \"-\" для стандартного ввода")
+	senderName := fs.String("sender-name", "", "Имя отправителя (по умолчанию email отправителя)")
+	flags := config.AddFlags(fs)
+	var attachPaths []string
+	fs.Func("attach", "Файл вложения (можно указать несколько раз)", func(path string) error {
+		attachPaths = append(attachPaths, path)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	secrets, err := flags.Resolve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Diagnostics go to stderr, masked the same way as the bot log
+	redactor := NewRedactor(secretValues(secrets), !secrets.LogEmails)
+	level, err := config.ParseLogLevel(secrets.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	handler := slog.NewTextHandler(redactingWriter{w: os.Stderr, r: redactor}, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	if err := secrets.ValidateProvider(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if secrets.SenderEmail == "" {
+		fmt.Fprintln(os.Stderr, "Не указан email отправителя. Используйте аргумент --sender-email или файл secrets.json.")
+		return 1
+	}
+
+	if *subject == "" {
+		fmt.Fprintln(os.Stderr, "Не указана тема письма. Используйте аргумент --subject.")
+		return 1
+	}
+	text, err := readBody(*body, *bodyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := registerFieldRules(secrets.FieldRules); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fields := map[Field]string{FieldSubject: *subject, FieldBody: text}
+	if *senderName != "" {
+		// Without a name the sender email is shown, which the name rules are not about
+		fields[FieldSenderName] = *senderName
+	}
+	for field, value := range fields {
+		if err := validateField(field, value); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", field, err)
+			return 1
+		}
+	}
+
+	// The mailer streams the files as it sends, so only check they can be read
+	var attachments []Attachment
+	for _, path := range attachPaths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка чтения вложения: %v\n", err)
+			return 1
+		}
+		file.Close()
+		attachments = append(attachments, Attachment{Name: filepath.Base(path), Path: path})
+	}
+
+	// Language rules only pick the recipient when none was given explicitly
+	finalSubject, recipient := routeByLanguage(secrets, *subject, text)
+	recipient = choose(*to, recipient)
+	if recipient == "" {
+		fmt.Fprintln(os.Stderr, "Не указан email получателя. Используйте аргумент --to или файл secrets.json.")
+		return 1
+	}
+
+	if err := loadReplyTemplates(secrets.ReplyTemplates); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := mailer.ConfigureRetry(secrets.SendRetry); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sender, err := mailer.New(secrets.EmailProvider, secrets.UnisenderAPIKey, secrets.SMTP, secrets.Mailgun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	history, closeHistory := openCLIHistory(secrets)
+	defer closeHistory()
+	name := choose(*senderName, secrets.SenderEmail)
+	result, _, err := sendThrough(ctx, sender, recipient, Copies{}, secrets.SenderEmail, finalSubject, text, name, attachments...)
+	message, sent := describeSendResult(ctx, "", result, err)
+	recordSend(history, SentEmail{
+		Recipient:  recipient,
+		Subject:    finalSubject,
+		Body:       text,
+		SenderName: name,
+	}, attachments, result, err)
+	fmt.Println(message)
+	if !sent {
+		return 1
+	}
+	return 0
+}
+
+// openCLIHistory opens the history in the bot database so letters sent from the
+// shell are listed with the others. While the bot is running it holds the database,
+// and the letter is recorded in a history kept in memory, which is then lost. It
+// also returns a function closing the database.
+func openCLIHistory(secrets *Secrets) (HistoryStore, func()) {
+	if choose(secrets.StorageBackend, STORAGE_BOLT) != STORAGE_BOLT {
+		return &memoryHistoryStore{}, func() {}
+	}
+	db, err := state.Open(choose(secrets.StorageFile, DEFAULT_STORAGE_FILE), secrets.StorageOptions)
+	if err != nil {
+		slog.Warn("История недоступна, письмо не попадёт в неё", "error", err)
+		return &memoryHistoryStore{}, func() {}
+	}
+	store, err := newBoltHistoryStore(db)
+	if err != nil {
+		slog.Warn("История недоступна, письмо не попадёт в неё", "error", err)
+		db.Close()
+		return &memoryHistoryStore{}, func() {}
+	}
+	return store, func() { db.Close() }
+}
+
+// readBody returns the email body given inline or read from a file ("-" means stdin).
+func readBody(body, bodyFile string) (string, error) {
+	switch bodyFile {
+	case "":
+		return body, nil
+	case "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("ошибка чтения стандартного ввода: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return "", fmt.Errorf("ошибка чтения файла с текстом письма: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// RunCheckConfig implements the check-config subcommand: it validates the
+// configuration and, with --online, verifies the credentials against Telegram and
+// Unisender. It returns the process exit code.
+func RunCheckConfig(args []string) int {
+	// Ctrl+C cancels requests in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	online := fs.Bool("online", false, "Проверить токен Telegram и API ключ Unisender запросами к сервисам")
+	flags := config.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	secrets, err := flags.Resolve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var problems []error
+	problems = append(problems, secrets.Validate())
+	problems = append(problems, registerFieldRules(secrets.FieldRules))
+	problems = append(problems, loadReplyTemplates(secrets.ReplyTemplates))
+	problems = append(problems, mailer.ConfigureRetry(secrets.SendRetry))
+	if backend := choose(secrets.StorageBackend, STORAGE_BOLT); backend != STORAGE_BOLT && backend != STORAGE_MEMORY {
+		problems = append(problems, fmt.Errorf("неизвестное хранилище %q, допустимы %s и %s", backend, STORAGE_BOLT, STORAGE_MEMORY))
+	}
+	if err := secrets.StorageOptions.Validate(); err != nil {
+		problems = append(problems, err)
+	}
+	if secrets.Timezone != "" {
+		if _, err := time.LoadLocation(secrets.Timezone); err != nil {
+			problems = append(problems, fmt.Errorf("неизвестный часовой пояс %s: %w", secrets.Timezone, err))
+		}
+	}
+	if *online && secrets.BotToken != "" {
+		bot, err := tgbotapi.NewBotAPIWithAPIEndpoint(secrets.BotToken, choose(secrets.BotAPIEndpoint, tgbotapi.APIEndpoint))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("токен Telegram не принят: %w", err))
+		} else {
+			fmt.Printf("Telegram: бот @%s\n", bot.Self.UserName)
+		}
+	}
+	if *online && secrets.UnisenderAPIKey != "" {
+		var lists []mailer.UnisenderList
+		if err := mailer.CallUnisender(ctx, secrets.UnisenderAPIKey, "getLists", url.Values{}, &lists); err != nil {
+			problems = append(problems, fmt.Errorf("API ключ Unisender не принят: %w", err))
+		} else {
+			fmt.Printf("Unisender: ключ принят, списков рассылки: %d\n", len(lists))
+		}
+	}
+
+	if *online && secrets.EmailProvider == mailer.EMAIL_PROVIDER_SMTP {
+		// Invalid settings were already reported by validate
+		if sender, err := mailer.NewSMTPSender(secrets.SMTP); err == nil {
+			if err := sender.Check(ctx); err != nil {
+				problems = append(problems, fmt.Errorf("SMTP сервер недоступен: %w", err))
+			} else {
+				fmt.Printf("SMTP: подключение к %s установлено\n", secrets.SMTP.Host)
+			}
+		}
+	}
+
+	if err := errors.Join(problems...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Конфигурация в порядке.")
+	return 0
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CONCURRENCY_USAGE explains the arguments of /concurrency.
+const CONCURRENCY_USAGE = "Одновременные отправки (только администраторы):\n" +
+	"/concurrency — показать лимит и очередь\n" +
+	"/concurrency 4 — передавать почтовому сервису не больше 4 писем сразу\n\n" +
+	"Значение 0 снимает ограничение. Изменение действует до перезапуска бота, постоянный лимит задаётся в send_concurrency в secrets.json."
+
+// sendSlots limits how many letters are handed to the email provider at once.
+// The users' workers and the scheduler send in parallel, and a provider with a
+// connection or request limit of its own fails the letters beyond it, so the
+// extra ones wait here instead.
+type sendSlots struct {
+	mu      sync.Mutex
+	limit   int           // Letters at once, unlimited when 0
+	active  int           // Letters being sent
+	waiting int           // Letters waiting for a slot
+	wake    chan struct{} // Closed when a slot may have become free
+	waited  int           // Letters that waited since the start
+	longest time.Duration // Longest wait since the start
+}
+
+// slotStats is what /concurrency and the status board show of sendSlots.
+type slotStats struct {
+	Limit, Active, Waiting, Waited int
+	Longest                        time.Duration
+}
+
+// providerSlots limits the sends of all users; it has no limit until configureSendConcurrency.
+var providerSlots = newSendSlots(0)
+
+func newSendSlots(limit int) *sendSlots {
+	return &sendSlots{limit: limit, wake: make(chan struct{})}
+}
+
+// configureSendConcurrency applies send_concurrency from secrets.json.
+func configureSendConcurrency(secrets *Secrets) {
+	providerSlots.set(secrets.SendConcurrency)
+	if secrets.SendConcurrency > 0 {
+		slog.Info("Ограничено число одновременных отправок", "send_concurrency", secrets.SendConcurrency)
+	}
+}
+
+// acquire takes a slot, waiting for one while the limit is reached. It gives up
+// when ctx is done, and the letter is not sent then.
+func (s *sendSlots) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	var started time.Time
+	for s.limit > 0 && s.active >= s.limit {
+		if started.IsZero() {
+			started = time.Now()
+		}
+		wake := s.wake
+		s.waiting++
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.waiting--
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+		s.mu.Lock()
+		s.waiting--
+	}
+	if !started.IsZero() {
+		wait := time.Since(started)
+		s.waited++
+		s.longest = max(s.longest, wait)
+		slog.InfoContext(ctx, "Письмо ждало очереди к почтовому сервису", "wait", wait.Round(time.Millisecond))
+	}
+	s.active++
+	s.mu.Unlock()
+	return nil
+}
+
+// release frees the slot of a letter that was sent or failed.
+func (s *sendSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.wakeWaiting()
+}
+
+// set changes the limit; letters already being sent are not interrupted.
+func (s *sendSlots) set(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.wakeWaiting()
+}
+
+// wakeWaiting lets the waiting letters check for a free slot again. The caller
+// holds mu.
+func (s *sendSlots) wakeWaiting() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *sendSlots) stats() slotStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slotStats{Limit: s.limit, Active: s.active, Waiting: s.waiting, Waited: s.waited, Longest: s.longest}
+}
+
+// describeSlots tells the limit and what is going on under it, for /concurrency.
+func describeSlots(stats slotStats) string {
+	limit := "нет"
+	if stats.Limit > 0 {
+		limit = fmt.Sprintf("%d писем сразу", stats.Limit)
+	}
+	text := fmt.Sprintf("Ограничение одновременных отправок: %s.\nОтправляется сейчас: %d, ждут очереди: %d.", limit, stats.Active, stats.Waiting)
+	if stats.Waited > 0 {
+		text += fmt.Sprintf("\nС запуска бота ждали очереди %d писем, дольше всего %.1f с.", stats.Waited, stats.Longest.Seconds())
+	}
+	return text
+}
+
+// handleConcurrencyCommand shows or changes the limit of letters sent at once
+// until the bot restarts: /concurrency <число> (admin only).
+func handleConcurrencyCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) == 0 {
+		bot.Send(newReply(message, describeSlots(providerSlots.stats())+"\n\n"+CONCURRENCY_USAGE))
+		return
+	}
+	limit, err := strconv.Atoi(fields[0])
+	if len(fields) != 1 || err != nil || limit < 0 {
+		bot.Send(newReply(message, CONCURRENCY_USAGE))
+		return
+	}
+	providerSlots.set(limit)
+	audit(message.From, "изменил лимит одновременных отправок на %d", limit)
+	bot.Send(newReply(message, "Лимит изменён до перезапуска бота.\n"+describeSlots(providerSlots.stats())))
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// acquired starts taking a slot and returns the channel its result arrives on.
+func acquired(ctx context.Context, slots *sendSlots) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- slots.acquire(ctx) }()
+	return done
+}
+
+// waitForWaiting waits until n letters wait for a slot.
+func waitForWaiting(t *testing.T, slots *sendSlots, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for slots.stats().Waiting != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting = %d, want %d", slots.stats().Waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendSlots(t *testing.T) {
+	slots := newSendSlots(1)
+	if err := slots.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	second := acquired(context.Background(), slots)
+	waitForWaiting(t, slots, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	third := acquired(ctx, slots)
+	waitForWaiting(t, slots, 2)
+	cancel()
+	if err := <-third; err != context.Canceled {
+		t.Errorf("cancelled acquire = %v, want context.Canceled", err)
+	}
+
+	slots.release()
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if stats := slots.stats(); stats.Active != 1 || stats.Waiting != 0 || stats.Waited != 1 {
+		t.Errorf("stats = %+v, want one letter sending after one wait", stats)
+	}
+
+	// Raising the limit lets a waiting letter through at once
+	fourth := acquired(context.Background(), slots)
+	waitForWaiting(t, slots, 1)
+	slots.set(2)
+	if err := <-fourth; err != nil {
+		t.Fatal(err)
+	}
+	slots.set(0)
+	if err := slots.acquire(context.Background()); err != nil || slots.stats().Active != 3 {
+		t.Errorf("unlimited acquire = %v, active %d", err, slots.stats().Active)
+	}
+}
+
+func TestConcurrencyCommand(t *testing.T) {
+	defaultSlots := providerSlots
+	t.Cleanup(func() { providerSlots = defaultSlots })
+	providerSlots = newSendSlots(0)
+
+	telegram, handler := adminBot(t)
+	for _, command := range []string{"/concurrency 3", "/concurrency -1", "/concurrency"} {
+		handler.HandleUpdate(context.Background(), textAction(command).update())
+	}
+	if limit := providerSlots.stats().Limit; limit != 3 {
+		t.Errorf("limit = %d, want 3", limit)
+	}
+	for _, want := range []string{"Лимит изменён до перезапуска бота.", "Ограничение одновременных отправок: 3 писем сразу.", "Значение 0 снимает ограничение"} {
+		if _, ok := telegram.find(wizardUser, want); !ok {
+			t.Errorf("no %q in:\n%s", want, telegram.transcript(wizardUser))
+		}
+	}
+}
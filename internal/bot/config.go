@@ -0,0 +1,20 @@
+package bot
+
+import "botmailtest/internal/config"
+
+// The settings are loaded and checked by the config package; the handlers use
+// its types under their own names.
+type (
+	Secrets          = config.Secrets
+	LogRotation      = config.LogRotation
+	WatchdogSettings = config.WatchdogSettings
+	Field            = config.Field
+	FieldRule        = config.FieldRule
+	LanguageRule     = config.LanguageRule
+	TagRule          = config.TagRule
+	Delegation       = config.Delegation
+	RateLimit        = config.RateLimit
+	NormalizeRules   = config.NormalizeRules
+	GuestMode        = config.GuestMode
+	ProbeSettings    = config.ProbeSettings
+)
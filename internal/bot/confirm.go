@@ -0,0 +1,361 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// PREVIEW_BODY_LIMIT caps the body shown in the preview, leaving room for the headers
+// within MAX_MESSAGE_LENGTH.
+const PREVIEW_BODY_LIMIT = 3500
+
+// showPreview moves the draft to the confirmation step and shows it with the
+// send, edit and cancel buttons.
+func showPreview(bot BotAPI, message *tgbotapi.Message, state *UserState) {
+	state.State = "await_confirm"
+	state.Editing = false
+
+	msg := newReply(message, "Проверьте письмо перед отправкой.\n\n"+previewText(state))
+	msg.ReplyMarkup = previewKeyboard(state)
+	bot.Send(msg)
+}
+
+// previewText describes the draft as it will be sent: its headers, inbox line and
+// body, and what the normalize rules changed in it.
+func previewText(typed *UserState) string {
+	var notes string
+	if changes := pendingNormalization(typed); changes != "" && typed.KeepAsTyped {
+		notes = "Исправления отключены, письмо уйдёт как введено.\n"
+	} else if changes != "" {
+		notes = "Исправлено перед отправкой:\n" + changes
+	}
+	sent := normalizeDraft(normalizeRules(), *typed)
+	state := &sent
+
+	body := []rune(state.Body)
+	// The list of changes takes its room from the body
+	if limit := max(PREVIEW_BODY_LIMIT-utf8.RuneCountInString(notes), PREVIEW_BODY_LIMIT/4); len(body) > limit {
+		body = append(body[:limit], []rune("…")...)
+	}
+	recipients := "по умолчанию"
+	if len(state.Recipients) > 0 {
+		recipients = strings.Join(state.Recipients, ", ")
+	}
+	format := "текст"
+	if state.BodyFormat == BODY_FORMAT_HTML {
+		format = "HTML"
+	}
+	text := "Получатели: " + recipients + "\n"
+	if len(state.CC) > 0 {
+		text += "Копия: " + strings.Join(state.CC, ", ") + "\n"
+	}
+	if len(state.BCC) > 0 {
+		text += "Скрытая копия: " + strings.Join(state.BCC, ", ") + "\n"
+	}
+	text += fmt.Sprintf("Отправитель: %s\nТема: %s\nФормат: %s\n", state.SenderName, state.Subject, format)
+	if len(state.Attachments) > 0 {
+		names := make([]string, len(state.Attachments))
+		for i, a := range state.Attachments {
+			names[i] = a.FileName
+		}
+		text += "Вложения: " + strings.Join(names, ", ") + "\n"
+	}
+	if len(state.Tags) > 0 {
+		text += "Метки: " + strings.Join(state.Tags, ", ") + "\n"
+	}
+	text += checkBody(state.Body).format()
+	if notes != "" {
+		text += "\n" + notes
+	}
+	text += "\nВ списке писем:\n" + inboxPreview(state) + "\n"
+	text += "\n" + string(body)
+	return text
+}
+
+// previewKeyboard builds the inline buttons under the draft preview. The button
+// turning the normalize rules off or back on is only shown when they change something.
+func previewKeyboard(state *UserState) tgbotapi.InlineKeyboardMarkup {
+	second := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Отправить позже", "confirm:later"),
+		tgbotapi.NewInlineKeyboardButtonData("Проверить на спам", "confirm:spamcheck"),
+	)
+	if pendingNormalization(state) != "" {
+		label := "Не исправлять"
+		if state.KeepAsTyped {
+			label = "Исправить"
+		}
+		second = append(second, tgbotapi.NewInlineKeyboardButtonData(label, "confirm:normalize"))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Отправить", "confirm:send"),
+			tgbotapi.NewInlineKeyboardButtonData("Редактировать", "confirm:edit"),
+			tgbotapi.NewInlineKeyboardButtonData("Отмена", "confirm:cancel"),
+		),
+		second,
+	)
+}
+
+// editKeyboard builds the inline buttons that choose which field to change. The
+// tags button is only offered when tag_rules are configured.
+func editKeyboard(secrets *Secrets) tgbotapi.InlineKeyboardMarkup {
+	second := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Текст", "confirm:edit_body"),
+		tgbotapi.NewInlineKeyboardButtonData("Отправитель", "confirm:edit_sender"),
+	)
+	if len(secrets.TagRules) > 0 {
+		second = append(second, tgbotapi.NewInlineKeyboardButtonData("Метки", "confirm:edit_tags"))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Получатели", "confirm:edit_recipient"),
+			tgbotapi.NewInlineKeyboardButtonData("Тема", "confirm:edit_subject"),
+			tgbotapi.NewInlineKeyboardButtonData("Прехедер", "confirm:edit_preheader"),
+		),
+		second,
+	)
+}
+
+// editSteps maps an edit button to the wizard step and prompt for its field.
+var editSteps = map[string][2]string{
+	"edit_recipient": {"await_recipient", "Введите новый адрес получателя. Несколько адресов укажите через запятую."},
+	"edit_subject":   {"await_subject", "Введите новую тему письма."},
+	"edit_preheader": {"await_preheader", "Введите прехедер — короткий текст, который почтовые клиенты показывают после темы. Отправьте «-», чтобы убрать его."},
+	"edit_body":      {"await_body", "Введите новый текст письма."},
+	"edit_sender":    {"await_sender", "Укажите новое имя отправителя."},
+}
+
+// handleConfirmCallback handles the buttons under the draft preview.
+func (h *Handler) handleConfirmCallback(ctx context.Context, query *tgbotapi.CallbackQuery, action string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	chatID := query.Message.Chat.ID
+
+	// The step check and transition happen in one update, so a double tap cannot send twice
+	var state UserState
+	var current bool
+	h.States.Update(userID, func(s *UserState) {
+		if s.State != "await_confirm" {
+			return
+		}
+		current = true
+		state = *s
+		switch action {
+		case "send", "cancel":
+			*s = UserState{State: "initial"}
+		case "later":
+			s.State = "await_schedule"
+		case "normalize":
+			s.KeepAsTyped = !s.KeepAsTyped
+			state = *s
+		case "edit_tags":
+			if len(secrets.TagRules) > 0 {
+				s.State = "await_tags"
+				s.Editing = true
+			}
+		default:
+			if step, ok := editSteps[action]; ok {
+				s.State = step[0]
+				s.Editing = true
+			}
+		}
+	})
+	if !current {
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		return "Это письмо уже отправлено или отменено."
+	}
+
+	switch action {
+	case "send":
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		if h.isGuest(userID) {
+			h.requestGuestApproval(query.Message, query.From, state)
+			return ""
+		}
+		h.sendDraft(ctx, query.From, query.Message, &state)
+		return ""
+	case "cancel":
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		msg := newReply(query.Message, "Письмо отменено. Нажмите 'Новое Письмо', чтобы начать заново.")
+		msg.ReplyMarkup = newInitialKeyboard()
+		bot.Send(msg)
+		return "Письмо отменено"
+	case "later":
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		msg := newReply(query.Message, schedulePrompt(secrets))
+		msg.ReplyMarkup = scheduleKeyboard()
+		bot.Send(msg)
+		return ""
+	case "normalize":
+		edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID,
+			"Проверьте письмо перед отправкой.\n\n"+previewText(&state), previewKeyboard(&state))
+		if _, err := bot.Send(edit); err != nil {
+			slog.WarnContext(ctx, "Ошибка обновления предпросмотра", "error", err)
+		}
+		if state.KeepAsTyped {
+			return "Письмо уйдёт как введено"
+		}
+		return "Исправления включены"
+	case "edit":
+		edit := tgbotapi.NewEditMessageReplyMarkup(chatID, query.Message.MessageID, editKeyboard(secrets))
+		if _, err := bot.Request(edit); err != nil {
+			slog.WarnContext(ctx, "Ошибка показа кнопок редактирования", "error", err)
+		}
+		return "Что изменить?"
+	case "spamcheck":
+		// Replies go to the preview, but the user's name and language come from the button press
+		message := *query.Message
+		message.From = query.From
+		h.startSpamCheck(ctx, &message, state)
+		return ""
+	case "edit_tags":
+		if len(secrets.TagRules) == 0 {
+			return "Метки не настроены."
+		}
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		promptTags(bot, secrets, query.Message, &state)
+		return ""
+	}
+	if step, ok := editSteps[action]; ok {
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		msg := newReply(query.Message, step[1])
+		switch step[0] {
+		case "await_recipient":
+			msg.ReplyMarkup = newRecipientKeyboard()
+		case "await_body":
+			msg.ReplyMarkup = bodyFormatKeyboard()
+		}
+		bot.Send(msg)
+		switch step[0] {
+		case "await_recipient":
+			h.offerContacts(query.Message, userID)
+		case "await_subject":
+			h.offerSubjects(chatID, userID)
+		}
+		return ""
+	}
+	slog.WarnContext(ctx, "Неизвестное действие предпросмотра", "action", action)
+	return "Кнопка устарела."
+}
+
+// sendDraft downloads the attachments of a confirmed draft and sends it, returning
+// to the preview if the send limit is used up or a download fails. Replies quote
+// the given message.
+func (h *Handler) sendDraft(ctx context.Context, from *tgbotapi.User, message *tgbotapi.Message, state *UserState) {
+	bot, secrets := h.bot, h.secrets
+	// Return to the preview so the letter can be sent again or edited
+	backToPreview := func() {
+		draft := *state
+		showPreview(bot, message, &draft)
+		h.States.Update(from.ID, func(s *UserState) { *s = draft })
+	}
+	if !allowSend(bot, secrets, message, from) {
+		backToPreview()
+		return
+	}
+	attachments, err := h.downloadDraftAttachments(ctx, message, state.Attachments)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки вложений", "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось загрузить вложение: %v", err)))
+		backToPreview()
+		return
+	}
+
+	h.deliverDraft(ctx, from, message, state, attachments)
+}
+
+// deliverDraft sends a draft whose attachments are downloaded and reports the result,
+// offering retries and a follow-up reminder as appropriate. Replies quote the given message.
+func (h *Handler) deliverDraft(ctx context.Context, from *tgbotapi.User, message *tgbotapi.Message, state *UserState, attachments []Attachment) {
+	bot, secrets := h.bot, h.secrets
+	userID := from.ID
+	chatID := message.Chat.ID
+
+	h.sendComplianceProgress(newReply(message, "Отправляю письмо..."))
+	// The letter goes out as the preview showed it, with the normalize rules applied
+	draft := normalizeDraft(normalizeRules(), *state)
+	state = &draft
+
+	subject, recipient := routeByLanguage(secrets, state.Subject, state.Body)
+	recipients := []string{recipient}
+	if len(state.Recipients) > 0 {
+		recipients = state.Recipients
+	}
+	subject, recipients, tagCopies := routeByTags(secrets, state.Tags, subject, recipients, len(state.Recipients) > 0)
+	copies := letterCopies(recipients, slices.Concat(state.CC, tagCopies), state.BCC)
+	// Unisender takes several recipients as a comma-separated list and reports each one
+	recipient = strings.Join(recipients, ",")
+	body, fingerprint := h.fingerprinted(state.EmailBody())
+	body = withPreheader(body, state.Preheader)
+	result, attempts, err := h.sendEmailCountingAttempts(ctx, recipient, copies, secrets.SenderEmail, subject, body, state.SenderName, attachments...)
+	finalMsgText, sent := describeSendResult(ctx, from.LanguageCode, result, err)
+	entry := recordSend(h.History, SentEmail{
+		UserID:      userID,
+		Recipient:   recipient,
+		CC:          copies.CC,
+		BCC:         copies.BCC,
+		Subject:     subject,
+		Body:        body,
+		SenderName:  state.SenderName,
+		OnBehalfOf:  state.OnBehalfOf,
+		ApprovedBy:  state.ApprovedBy,
+		Username:    from.UserName,
+		Fingerprint: fingerprint,
+	}, attachments, result, err)
+	if addresses := describeRecipients(result, copies); addresses != "" {
+		finalMsgText += "\n" + addresses
+	}
+	if sent && attempts > 1 {
+		// Failures carry the attempt count in the error, successes get it here
+		finalMsgText += fmt.Sprintf("\nОтправлено с попытки %d.", attempts)
+	}
+
+	if sent {
+		// A successful confirmation gets its own message so it can be pinned
+		confirmation := newReply(message, finalMsgText)
+		markup := pinKeyboard(entry.ID)
+		if statusTrackable(secrets, entry) {
+			markup.InlineKeyboard[0] = append(markup.InlineKeyboard[0], statusButton(entry.ID))
+		}
+		confirmation.ReplyMarkup = markup
+		bot.Send(confirmation)
+		finalMsgText = ""
+	} else {
+		finalMsgText += "\n"
+	}
+
+	// Send the final message with the initial keyboard attached
+	msg := newReply(message, finalMsgText+"Хотите отправить ещё одно письмо? Нажмите 'Новое Письмо'.")
+	msg.ReplyMarkup = newInitialKeyboard()
+	bot.Send(msg)
+
+	if !h.offerRetryRejected(userID, chatID, Email{
+		Subject:     subject,
+		Body:        body,
+		SenderName:  state.SenderName,
+		Attachments: attachments,
+	}, result) {
+		releaseAttachments(attachments)
+	}
+	if sent {
+		h.rememberComposed(userID, state)
+		h.offerFollowUpReminder(&FollowUp{
+			UserID:     userID,
+			ChatID:     chatID,
+			Recipient:  recipient,
+			Subject:    subject,
+			Body:       state.Body,
+			SenderName: state.SenderName,
+		})
+		maybeAskSatisfaction(bot, secrets, chatID)
+	}
+}
@@ -0,0 +1,320 @@
+package bot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+// MAX_CONTACT_BUTTONS is how many saved contacts are offered as buttons at the recipient step.
+const MAX_CONTACT_BUTTONS = 20
+
+// Contact is a saved recipient in a user's address book.
+type Contact struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// ContactStore keeps the address book of every user.
+type ContactStore interface {
+	// List returns the user's contacts sorted by name.
+	List(userID int64) []Contact
+	// Add saves a contact, replacing one with the same name.
+	Add(userID int64, contact Contact)
+	// Remove deletes the contact with the given name and reports whether it existed.
+	Remove(userID int64, name string) bool
+	// Range calls fn with the contacts of every user who has any.
+	Range(fn func(userID int64, contacts []Contact))
+}
+
+// addContact inserts or replaces a contact, keeping the list sorted by name.
+func addContact(list []Contact, contact Contact) []Contact {
+	list = slices.DeleteFunc(list, func(c Contact) bool { return strings.EqualFold(c.Name, contact.Name) })
+	list = append(list, contact)
+	slices.SortFunc(list, func(a, b Contact) int { return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) })
+	return list
+}
+
+// removeContact deletes a contact by name and reports whether it was found.
+func removeContact(list []Contact, name string) ([]Contact, bool) {
+	n := len(list)
+	list = slices.DeleteFunc(list, func(c Contact) bool { return strings.EqualFold(c.Name, name) })
+	return list, len(list) < n
+}
+
+// memoryContactStore is a ContactStore kept in process memory.
+type memoryContactStore struct {
+	mu       sync.Mutex
+	contacts map[int64][]Contact
+}
+
+func (m *memoryContactStore) List(userID int64) []Contact {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.contacts[userID])
+}
+
+func (m *memoryContactStore) Add(userID int64, contact Contact) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.contacts[userID] = addContact(m.contacts[userID], contact)
+}
+
+func (m *memoryContactStore) Remove(userID int64, name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list, removed := removeContact(m.contacts[userID], name)
+	m.contacts[userID] = list
+	return removed
+}
+
+func (m *memoryContactStore) Range(fn func(userID int64, contacts []Contact)) {
+	m.mu.Lock()
+	copies := make(map[int64][]Contact, len(m.contacts))
+	for userID, list := range m.contacts {
+		if len(list) > 0 {
+			copies[userID] = slices.Clone(list)
+		}
+	}
+	m.mu.Unlock()
+	// fn runs without the lock, so it may use the store
+	for userID, list := range copies {
+		fn(userID, list)
+	}
+}
+
+// contactsBucket holds each user's JSON-encoded contact list keyed by user ID.
+var contactsBucket = []byte("contacts")
+
+// boltContactStore is a ContactStore persisted in the bbolt database.
+type boltContactStore struct {
+	db *bolt.DB
+}
+
+// newBoltContactStore creates the contacts bucket in the given database.
+func newBoltContactStore(db *bolt.DB) (*boltContactStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(contactsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы контактов: %w", err)
+	}
+	return &boltContactStore{db: db}, nil
+}
+
+func (b *boltContactStore) List(userID int64) []Contact {
+	var list []Contact
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(contactsBucket).Get(state.Int64Key(userID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &list)
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения контактов пользователя", "user_id", userID, "error", err)
+	}
+	return list
+}
+
+// update rewrites the user's contact list inside a write transaction.
+func (b *boltContactStore) update(userID int64, fn func([]Contact) []Contact) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(contactsBucket)
+		key := state.Int64Key(userID)
+		var list []Contact
+		if data := bucket.Get(key); data != nil {
+			if err := json.Unmarshal(data, &list); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(fn(list))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения контактов пользователя", "user_id", userID, "error", err)
+	}
+}
+
+func (b *boltContactStore) Add(userID int64, contact Contact) {
+	b.update(userID, func(list []Contact) []Contact { return addContact(list, contact) })
+}
+
+func (b *boltContactStore) Remove(userID int64, name string) bool {
+	var removed bool
+	b.update(userID, func(list []Contact) []Contact {
+		list, removed = removeContact(list, name)
+		return list
+	})
+	return removed
+}
+
+// Range calls fn with every stored address book. Lists that cannot be decoded are skipped.
+func (b *boltContactStore) Range(fn func(userID int64, contacts []Contact)) {
+	books := make(map[int64][]Contact)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(contactsBucket).ForEach(func(k, v []byte) error {
+			var list []Contact
+			if err := json.Unmarshal(v, &list); err != nil {
+				slog.Error("Ошибка чтения контактов", "key", fmt.Sprintf("%x", k), "error", err)
+				return nil
+			}
+			if len(list) > 0 {
+				books[int64(binary.BigEndian.Uint64(k))] = list
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения контактов", "error", err)
+	}
+	// fn runs outside the transaction, so it may use the store
+	for userID, list := range books {
+		fn(userID, list)
+	}
+}
+
+// expandContacts replaces contact names in a comma-separated recipient list with
+// their addresses, and aliases from secrets.json with all of theirs. The user's own
+// contact wins over an alias of the same name.
+func (h *Handler) expandContacts(userID int64, text string) string {
+	list := h.Contacts.List(userID)
+	if len(list) == 0 && len(h.secrets.Aliases) == 0 {
+		return text
+	}
+	parts := strings.Split(text, ",")
+	for i, part := range parts {
+		name := strings.TrimSpace(part)
+		if j := slices.IndexFunc(list, func(c Contact) bool { return strings.EqualFold(c.Name, name) }); j >= 0 {
+			parts[i] = list[j].Email
+		} else if addresses := aliasAddresses(h.secrets, name); addresses != nil {
+			parts[i] = strings.Join(addresses, ",")
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// handleAddContactCommand saves a contact given as "/addcontact Имя email@example.com".
+func (h *Handler) handleAddContactCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	args := strings.Fields(message.CommandArguments())
+	if len(args) < 2 {
+		bot.Send(newReply(message, "Использование: /addcontact Имя email@example.com"))
+		return
+	}
+	name := strings.Join(args[:len(args)-1], " ")
+	address, err := mail.ParseAddress(args[len(args)-1])
+	if err != nil {
+		bot.Send(newReply(message, "Некорректный адрес: "+args[len(args)-1]))
+		return
+	}
+	if err := validateField(FieldRecipient, address.Address); err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	h.Contacts.Add(message.From.ID, Contact{Name: name, Email: address.Address})
+	bot.Send(newReply(message, fmt.Sprintf("Контакт «%s» сохранён: %s", name, address.Address)))
+}
+
+// handleDeleteContactCommand removes a contact given as "/delcontact Имя".
+func (h *Handler) handleDeleteContactCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	name := strings.TrimSpace(message.CommandArguments())
+	if name == "" {
+		bot.Send(newReply(message, "Использование: /delcontact Имя"))
+		return
+	}
+	if !h.Contacts.Remove(message.From.ID, name) {
+		bot.Send(newReply(message, fmt.Sprintf("Контакт «%s» не найден.", name)))
+		return
+	}
+	bot.Send(newReply(message, fmt.Sprintf("Контакт «%s» удалён.", name)))
+}
+
+// handleContactsCommand lists the user's saved contacts, followed by the aliases
+// every user shares.
+func (h *Handler) handleContactsCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	list := h.Contacts.List(message.From.ID)
+	var text string
+	if len(list) == 0 {
+		text = "Контактов пока нет. Добавьте: /addcontact Имя email@example.com"
+	} else {
+		lines := make([]string, len(list))
+		for i, c := range list {
+			lines[i] = fmt.Sprintf("%s — %s", c.Name, c.Email)
+		}
+		text = "Ваши контакты:\n" + strings.Join(lines, "\n") + "\n\nУдалить: /delcontact Имя"
+	}
+	if names := secrets.AliasNames(); len(names) > 0 {
+		lines := make([]string, len(names))
+		for i, name := range names {
+			lines[i] = fmt.Sprintf("%s — %s", name, strings.Join(aliasAddresses(secrets, name), ", "))
+		}
+		text += "\n\nОбщие адреса:\n" + strings.Join(lines, "\n")
+	}
+	bot.Send(newReply(message, text))
+}
+
+// offerContacts shows the user's contacts and the aliases as buttons at the
+// recipient step.
+func (h *Handler) offerContacts(message *tgbotapi.Message, userID int64) {
+	bot, secrets := h.bot, h.secrets
+	list := h.Contacts.List(userID)
+	if len(list) == 0 && len(secrets.Aliases) == 0 {
+		return
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, c := range list[:min(len(list), MAX_CONTACT_BUTTONS)] {
+		// An index keeps the data within Telegram's 64-byte limit, addresses may be longer
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(c.Name+" — "+c.Email, fmt.Sprintf("contact:%d", i)),
+		))
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Или выберите из контактов (имена контактов можно вводить вместо адресов):")
+	if len(secrets.Aliases) > 0 {
+		msg.Text = "Или выберите из контактов и общих адресов (их имена можно вводить вместо адресов):"
+	}
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(append(rows, aliasButtons(secrets)...)...)
+	bot.Send(msg)
+}
+
+// handleContactCallback uses the tapped contact as the recipient of the draft.
+func (h *Handler) handleContactCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	state, exists := h.States.Get(userID)
+	if !exists || state.State != "await_recipient" {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Получатель уже выбран."
+	}
+	list := h.Contacts.List(userID)
+	i, err := strconv.Atoi(payload)
+	if err != nil || i < 0 || i >= len(list) {
+		return "Контакт не найден, введите адрес вручную."
+	}
+
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	state.Recipients = []string{list[i].Email}
+	h.acceptRecipients(query.Message, &state, fmt.Sprintf("Получатель: %s <%s>", list[i].Name, list[i].Email))
+	h.States.Update(userID, func(s *UserState) { *s = state })
+	return ""
+}
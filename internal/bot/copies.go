@@ -0,0 +1,159 @@
+package bot
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// UNLISTED_CC_PROMPT replaces the CC question for a provider that sends each copy
+// as a letter of its own, where the recipients never see the CC addresses.
+const UNLISTED_CC_PROMPT = "Кому отправить копию? Почтовый сервис отправит её отдельным письмом, так что адреса копии получатели не увидят."
+
+// copyPrompts are the questions of the optional steps after the recipients, CC
+// then BCC, keyed by the step.
+var copyPrompts = map[string]string{
+	"await_cc":  "Кому отправить копию? Адреса копии увидят все получатели письма.",
+	"await_bcc": "Кому отправить скрытую копию? Её адресатов остальные получатели не увидят.",
+}
+
+// draftCopies returns the addresses of the copy step the draft is at.
+func draftCopies(state *UserState) *[]string {
+	if state.State == "await_bcc" {
+		return &state.BCC
+	}
+	return &state.CC
+}
+
+// promptCopies moves the draft to the copy step and asks for its addresses, with
+// a button skipping it. lead, if any, goes before the question.
+func (h *Handler) promptCopies(message *tgbotapi.Message, state *UserState, step, lead string) {
+	bot, secrets := h.bot, h.secrets
+	state.State = step
+	question := copyPrompts[step]
+	if step == "await_cc" && !mailer.CapabilitiesOf(secrets.EmailProvider).ListedCopies {
+		question = UNLISTED_CC_PROMPT
+	}
+	text := question + " Введите адреса через запятую или нажмите «Пропустить»."
+	if current := *draftCopies(state); len(current) > 0 {
+		text += "\nСейчас: " + strings.Join(current, ", ") + ". Отправьте «-», чтобы убрать их."
+	}
+	if lead != "" {
+		text = lead + "\n" + text
+	}
+	msg := newReply(message, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Пропустить", "copies:"+strings.TrimPrefix(step, "await_")),
+	))
+	bot.Send(msg)
+}
+
+// acceptCopies takes the addresses typed at a copy step, or "-" for none, and
+// moves the wizard on. Copies count towards MAX_RECIPIENTS with the recipients.
+func (h *Handler) acceptCopies(message *tgbotapi.Message, userID int64, state *UserState, text string) {
+	bot := h.bot
+	copies := draftCopies(state)
+	if text == "-" {
+		*copies = nil
+		h.nextCopyStep(message, userID, state, "Без копии.")
+		return
+	}
+	addresses, err := h.resolveRecipients(userID, text)
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	others := len(state.Recipients) + len(state.CC) + len(state.BCC) - len(*copies)
+	if others+len(addresses) > MAX_RECIPIENTS {
+		bot.Send(newReply(message, fmt.Sprintf("Можно указать не больше %d адресов вместе с копиями.", MAX_RECIPIENTS)))
+		return
+	}
+	*copies = addresses
+	label := "Копия"
+	if state.State == "await_bcc" {
+		label = "Скрытая копия"
+	}
+	h.nextCopyStep(message, userID, state, label+": "+strings.Join(addresses, ", "))
+}
+
+// nextCopyStep moves the wizard past a copy step: from CC to BCC, and from BCC on
+// to the rest of the letter.
+func (h *Handler) nextCopyStep(message *tgbotapi.Message, userID int64, state *UserState, lead string) {
+	if state.State == "await_cc" {
+		h.promptCopies(message, state, "await_bcc", lead)
+		return
+	}
+	h.finishRecipients(message, userID, state, lead)
+}
+
+// handleCopiesCallback skips a copy step, leaving its addresses as they are.
+func (h *Handler) handleCopiesCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	step := "await_" + payload
+	if _, ok := copyPrompts[step]; !ok {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	state, exists := h.States.Get(userID)
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	if !exists || state.State != step {
+		return "Этот шаг уже пройден."
+	}
+	h.nextCopyStep(query.Message, userID, &state, "")
+	h.States.Update(userID, func(s *UserState) { *s = state })
+	return ""
+}
+
+// letterCopies returns the copies of a letter to the recipients, without the
+// addresses that already get it: a recipient is not copied, and a CC address
+// gets no blind copy.
+func letterCopies(recipients, cc, bcc []string) Copies {
+	seen := slices.Clone(recipients)
+	unseen := func(addresses []string) []string {
+		var kept []string
+		for _, address := range addresses {
+			if !slices.ContainsFunc(seen, func(a string) bool { return strings.EqualFold(a, address) }) {
+				seen = append(seen, address)
+				kept = append(kept, address)
+			}
+		}
+		return kept
+	}
+	copies := Copies{CC: unseen(cc)}
+	copies.BCC = unseen(bcc)
+	return copies
+}
+
+// describeRecipients lists what became of the letter at each address, the copies
+// marked as such, for letters sent to more than one.
+func describeRecipients(result SendEmailResponse, copies Copies) string {
+	if len(result) < 2 {
+		return ""
+	}
+	lines := []string{"Адреса:"}
+	for _, r := range result {
+		line := "• " + cmp.Or(r.Email, "#"+strconv.Itoa(r.Index))
+		switch {
+		case slices.Contains(copies.CC, r.Email):
+			line += " (копия)"
+		case slices.Contains(copies.BCC, r.Email):
+			line += " (скрытая копия)"
+		}
+		if r.Accepted() {
+			line += " — принято"
+		} else {
+			line += " — не принято"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"botmailtest/internal/mailer"
+)
+
+func TestLetterCopies(t *testing.T) {
+	got := letterCopies(
+		[]string{"a@example.com"},
+		[]string{"A@example.com", "b@example.com", "b@example.com"},
+		[]string{"b@example.com", "c@example.com"},
+	)
+	want := Copies{CC: []string{"b@example.com"}, BCC: []string{"c@example.com"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("letterCopies = %+v, want %+v", got, want)
+	}
+}
+
+func TestDescribeRecipients(t *testing.T) {
+	copies := Copies{CC: []string{"b@example.com"}, BCC: []string{"c@example.com"}}
+	result := SendEmailResponse{
+		{Index: 0, Email: "a@example.com", ID: "1"},
+		{Index: 1, Email: "b@example.com", ID: "2"},
+		{Index: 2, Email: "c@example.com", Errors: []mailer.RecipientError{{Code: "invalid", Message: "rejected"}}},
+	}
+	want := "Адреса:\n" +
+		"• a@example.com — принято\n" +
+		"• b@example.com (копия) — принято\n" +
+		"• c@example.com (скрытая копия) — не принято"
+	if got := describeRecipients(result, copies); got != want {
+		t.Errorf("describeRecipients =\n%s\nwant\n%s", got, want)
+	}
+	if got := describeRecipients(result[:1], Copies{}); got != "" {
+		t.Errorf("described a letter to one address: %q", got)
+	}
+}
+
+func TestWizardSendsCopies(t *testing.T) {
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		textAction("b@example.com, a@example.com"), textAction("c@example.com"),
+		textAction("Отчёт"), textAction("Отчёт за месяц."), textAction("Иван"),
+		tapAction("confirm:send"),
+	} {
+		steps = append(steps, action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+
+	// The recipient typed again as a copy gets the letter once
+	want := []Copies{{CC: []string{"b@example.com"}, BCC: []string{"c@example.com"}}}
+	if !reflect.DeepEqual(sender.copies, want) {
+		t.Errorf("sent copies %+v, want %+v", sender.copies, want)
+	}
+	for _, text := range []string{"Копия: b@example.com", "• c@example.com (скрытая копия) — принято"} {
+		if !strings.Contains(bot.texts(), text) {
+			t.Errorf("bot did not say %q:\n%s", text, bot.texts())
+		}
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || !reflect.DeepEqual(sent[0].BCC, []string{"c@example.com"}) {
+		t.Errorf("history = %+v, want the blind copy recorded", sent)
+	}
+}
+
+func TestCopyPromptFollowsProvider(t *testing.T) {
+	for _, tc := range []struct {
+		provider, want string
+	}{
+		{mailer.EMAIL_PROVIDER_SMTP, copyPrompts["await_cc"]},
+		{mailer.EMAIL_PROVIDER_UNISENDER, UNLISTED_CC_PROMPT},
+	} {
+		t.Run(tc.provider, func(t *testing.T) {
+			var steps []string
+			secrets := wizardSecrets()
+			secrets.EmailProvider = tc.provider
+			handler, bot, _ := newWizardHandler(t, secrets, &steps)
+			for _, action := range []wizardAction{textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com")} {
+				handler.HandleUpdate(context.Background(), action.update())
+			}
+			if !strings.Contains(bot.texts(), tc.want) {
+				t.Errorf("bot did not ask %q:\n%s", tc.want, bot.texts())
+			}
+		})
+	}
+}
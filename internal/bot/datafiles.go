@@ -0,0 +1,464 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/state"
+)
+
+const (
+	// DATA_FILE_SUFFIX ends the names of /exportdata archives; an administrator's
+	// document named so is imported instead of being offered for sending.
+	DATA_FILE_SUFFIX = ".botmail-backup"
+	// DATA_FILE_MAGIC starts every archive, ahead of the salt and the nonce.
+	DATA_FILE_MAGIC = "BOTMAILDATA"
+	// DATA_FILE_FORMAT marks the decrypted JSON as a bot archive.
+	DATA_FILE_FORMAT = "botmail-data"
+	// DATA_FILE_VERSION is the newest archive layout this build reads and the one it writes.
+	DATA_FILE_VERSION = 1
+	// DATA_KEY_ITERATIONS is the PBKDF2-SHA256 work turning backup_key into the AES key.
+	DATA_KEY_ITERATIONS = 600_000
+	// DATA_SALT_SIZE is the length of the random salt stored in each archive.
+	DATA_SALT_SIZE = 16
+	// MAX_DATA_FILE_SIZE is the largest archive the bot downloads, the cloud Bot API limit.
+	MAX_DATA_FILE_SIZE = 20 * 1024 * 1024
+	// DATA_IMPORT_TTL is how long an uploaded archive waits for its confirmation.
+	DATA_IMPORT_TTL = 10 * time.Minute
+)
+
+// dataArchive is everything /exportdata moves to another server: the settings,
+// the templates, address books and access decisions of every user, and the
+// history without letter bodies and files.
+type dataArchive struct {
+	Format    string               `json:"format"`
+	Version   int                  `json:"version"`
+	CreatedAt time.Time            `json:"created_at"`
+	Config    *Secrets             `json:"config"`
+	Templates map[int64][]Template `json:"templates,omitempty"`
+	Contacts  map[int64][]Contact  `json:"contacts,omitempty"`
+	Access    map[int64]bool       `json:"access,omitempty"`
+	History   []SentEmail          `json:"history,omitempty"` // Oldest first
+}
+
+// collectArchive gathers the settings and the stored data into an archive.
+func collectArchive(secrets *Secrets, stores *Stores) dataArchive {
+	archive := dataArchive{
+		Format:    DATA_FILE_FORMAT,
+		Version:   DATA_FILE_VERSION,
+		CreatedAt: time.Now(),
+		Config:    secrets,
+		Templates: make(map[int64][]Template),
+		Contacts:  make(map[int64][]Contact),
+		Access:    make(map[int64]bool),
+	}
+	stores.Templates.Range(func(userID int64, templates []Template) { archive.Templates[userID] = templates })
+	stores.Contacts.Range(func(userID int64, contacts []Contact) { archive.Contacts[userID] = contacts })
+	stores.Access.Range(func(userID int64, allowed bool) { archive.Access[userID] = allowed })
+	for _, entry := range slices.Backward(stores.History.Since(time.Time{})) {
+		archive.History = append(archive.History, historyMetadata(entry))
+	}
+	return archive
+}
+
+// historyMetadata returns the entry without the body and the files of the letter,
+// which the archive does not carry. Such entries cannot be resent.
+func historyMetadata(e SentEmail) SentEmail {
+	e.Body = ""
+	e.Attachments = nil
+	e.AttachmentText = ""
+	return e
+}
+
+// dataKey derives the AES-256 key of an archive from the passphrase and its salt.
+func dataKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, DATA_KEY_ITERATIONS, 32)
+}
+
+// sealArchive encodes the archive and encrypts it with AES-256-GCM under a key
+// derived from the passphrase.
+func sealArchive(archive dataArchive, passphrase string) ([]byte, error) {
+	plain, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, DATA_SALT_SIZE)
+	rand.Read(salt)
+	key, err := dataKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+
+	// The header is authenticated with the contents, so it cannot be swapped
+	header := slices.Concat([]byte(DATA_FILE_MAGIC), salt, nonce)
+	return gcm.Seal(header, nonce, plain, header), nil
+}
+
+// openArchive decrypts and parses an archive. The message of a returned error is
+// shown to the administrator as is.
+func openArchive(data []byte, passphrase string) (dataArchive, error) {
+	var archive dataArchive
+	rest, ok := bytes.CutPrefix(data, []byte(DATA_FILE_MAGIC))
+	if !ok || len(rest) < DATA_SALT_SIZE {
+		return archive, errors.New("Это не архив бота: выгрузите данные командой /exportdata.")
+	}
+	salt := rest[:DATA_SALT_SIZE]
+	key, err := dataKey(passphrase, salt)
+	if err != nil {
+		return archive, fmt.Errorf("Не удалось получить ключ архива: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return archive, fmt.Errorf("Не удалось получить ключ архива: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return archive, fmt.Errorf("Не удалось получить ключ архива: %v", err)
+	}
+	headerSize := len(DATA_FILE_MAGIC) + DATA_SALT_SIZE + gcm.NonceSize()
+	if len(data) < headerSize {
+		return archive, errors.New("Архив повреждён: файл обрезан.")
+	}
+	header := data[:headerSize]
+	plain, err := gcm.Open(nil, header[headerSize-gcm.NonceSize():], data[headerSize:], header)
+	if err != nil {
+		return archive, errors.New("Не удалось расшифровать архив: backup_key не совпадает с ключом сервера, где он выгружен, или файл повреждён.")
+	}
+
+	if err := json.Unmarshal(plain, &archive); err != nil || archive.Format != DATA_FILE_FORMAT || archive.Version < 1 {
+		return dataArchive{}, errors.New("Архив повреждён: содержимое не читается.")
+	}
+	if archive.Version > DATA_FILE_VERSION {
+		return dataArchive{}, fmt.Errorf("Архив выгружен более новой версией бота (формат %d), обновите бота.", archive.Version)
+	}
+	if archive.Config == nil {
+		archive.Config = &Secrets{}
+	}
+	return archive, nil
+}
+
+// describe counts what the archive holds, for the confirmation and the audit.
+func (a dataArchive) describe() string {
+	templates, contacts := 0, 0
+	for _, list := range a.Templates {
+		templates += len(list)
+	}
+	for _, list := range a.Contacts {
+		contacts += len(list)
+	}
+	return fmt.Sprintf("шаблонов: %d, контактов: %d, решений о доступе: %d, записей истории: %d", templates, contacts, len(a.Access), len(a.History))
+}
+
+// importArchive adds the data of the archive to the stores. Templates and contacts
+// replace those with the same names, and access decisions are overwritten. History
+// is only imported into an empty one: entry IDs follow the send time, which
+// entries appended after newer ones would break. It reports whether the history
+// was imported.
+func importArchive(archive dataArchive, stores *Stores) (historyImported bool) {
+	for userID, templates := range archive.Templates {
+		for _, template := range templates {
+			stores.Templates.Save(userID, template)
+		}
+	}
+	for userID, contacts := range archive.Contacts {
+		for _, contact := range contacts {
+			stores.Contacts.Add(userID, contact)
+		}
+	}
+	for userID, allowed := range archive.Access {
+		stores.Access.Set(userID, allowed)
+	}
+	if len(stores.History.Since(time.Time{})) > 0 {
+		return false
+	}
+	for _, entry := range archive.History {
+		stores.History.Record(&entry)
+	}
+	return true
+}
+
+// dataFileName names an archive after the day it was made; the suffix marks it for import.
+func dataFileName(now time.Time) string {
+	return "botmail-" + now.Format("2006-01-02") + DATA_FILE_SUFFIX
+}
+
+// isDataFile reports whether the document looks like an /exportdata archive.
+func isDataFile(doc *tgbotapi.Document) bool {
+	return strings.HasSuffix(strings.ToLower(doc.FileName), DATA_FILE_SUFFIX)
+}
+
+// handleExportDataCommand replies to /exportdata (admin only) with an encrypted
+// archive of the settings and the data, for moving the bot to another server.
+func (h *Handler) handleExportDataCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	if secrets.BackupKey == "" {
+		bot.Send(newReply(message, "Выгрузка данных выключена: задайте пароль архива backup_key в secrets.json. Тот же пароль нужен на сервере, куда переносятся данные."))
+		return
+	}
+	archive := collectArchive(secrets, h.Stores)
+	data, err := sealArchive(archive, secrets.BackupKey)
+	if err != nil {
+		slog.Error("Ошибка выгрузки данных бота", "user_id", message.From.ID, "error", err)
+		bot.Send(newReply(message, "Не удалось выгрузить данные."))
+		return
+	}
+	audit(message.From, "выгрузил данные бота (%s)", archive.describe())
+	doc := tgbotapi.NewDocument(message.Chat.ID, tgbotapi.FileBytes{Name: dataFileName(archive.CreatedAt), Bytes: data})
+	doc.Caption = fmt.Sprintf("Данные бота (%s), зашифрованы паролем backup_key. Тексты и файлы писем в архив не входят. "+
+		"Чтобы перенести данные, отправьте файл администратором бота на новом сервере или выполните там botmailtest import-data.", archive.describe())
+	if _, err := bot.Send(doc); err != nil {
+		slog.Error("Ошибка отправки архива данных", "user_id", message.From.ID, "error", err)
+	}
+}
+
+// pendingDataImport is an uploaded archive waiting for the administrator to confirm it.
+type pendingDataImport struct {
+	AdminID int64
+	Archive dataArchive
+	Expires time.Time
+}
+
+// importDataFile downloads an uploaded archive, decrypts it with backup_key and
+// asks the administrator to confirm the import. Settings are not applied: the
+// reply names those that differ, to be copied to secrets.json by hand.
+func (h *Handler) importDataFile(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !secrets.IsAdmin(message.From.ID) {
+		audit(message.From, "отказано в загрузке архива данных")
+		bot.Send(newReply(message, "Загружать архивы данных могут только администраторы."))
+		return
+	}
+	if secrets.BackupKey == "" {
+		bot.Send(newReply(message, "Загрузка данных выключена: задайте в secrets.json тот же backup_key, что на сервере, где архив выгружен."))
+		return
+	}
+	doc := message.Document
+	if doc.FileSize > MAX_DATA_FILE_SIZE {
+		bot.Send(newReply(message, fmt.Sprintf("Архив слишком большой: не больше %d МБ. Загрузите его командой botmailtest import-data.", MAX_DATA_FILE_SIZE/1024/1024)))
+		return
+	}
+	attachment, err := downloadTelegramFile(ctx, bot, secrets, doc.FileID, doc.FileName, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки архива данных", "error", err)
+		bot.Send(newReply(message, "Не удалось загрузить архив, попробуйте ещё раз."))
+		return
+	}
+	data, err := attachment.ReadAll()
+	releaseAttachments([]Attachment{attachment})
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка чтения архива данных", "error", err)
+		bot.Send(newReply(message, "Не удалось прочитать архив."))
+		return
+	}
+	archive, err := openArchive(data, secrets.BackupKey)
+	if err != nil {
+		audit(message.From, "загрузка архива данных: %v", err)
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+
+	h.dataImportMu.Lock()
+	h.dataImportSeq++
+	id := h.dataImportSeq
+	h.dataImports[id] = &pendingDataImport{AdminID: message.From.ID, Archive: archive, Expires: time.Now().Add(DATA_IMPORT_TTL)}
+	h.dataImportMu.Unlock()
+	audit(message.From, "загрузил архив данных от %s (%s)", archive.CreatedAt.In(secrets.Location()).Format("2006-01-02 15:04"), archive.describe())
+
+	text := fmt.Sprintf("Архив от %s: %s. Шаблоны и контакты с теми же названиями будут заменены, решения о доступе перезаписаны. "+
+		"История загружается, только если здесь она пуста. Подтвердите в течение %d минут.",
+		archive.CreatedAt.In(secrets.Location()).Format("02.01.2006 15:04"), archive.describe(), int(DATA_IMPORT_TTL.Minutes()))
+	if live, restart := diffSettings(secrets, archive.Config); len(live)+len(restart) > 0 {
+		text += "\n\nНастройки не переносятся. В архиве отличаются: " + strings.Join(slices.Concat(live, restart), ", ") + " — перенесите их в secrets.json вручную."
+	}
+	msg := newReply(message, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Загрузить", fmt.Sprintf("dataimport:confirm:%d", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("dataimport:cancel:%d", id)),
+	))
+	bot.Send(msg)
+}
+
+// handleDataImportCallback confirms or cancels an archive import; only the
+// administrator who uploaded it may do it.
+func (h *Handler) handleDataImportCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	action, arg, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	h.dataImportMu.Lock()
+	pending, ok := h.dataImports[id]
+	if ok && pending.AdminID == query.From.ID {
+		delete(h.dataImports, id)
+	} else {
+		ok = false
+	}
+	h.dataImportMu.Unlock()
+	if !ok || !secrets.IsAdmin(query.From.ID) {
+		return "Кнопка устарела."
+	}
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+
+	switch {
+	case action == "cancel":
+		audit(query.From, "отменил загрузку архива данных")
+		bot.Send(newReply(query.Message, "Загрузка данных отменена."))
+		return "Отменено"
+	case action != "confirm":
+		return "Кнопка устарела."
+	case time.Now().After(pending.Expires):
+		bot.Send(newReply(query.Message, "Подтверждение истекло. Отправьте архив заново."))
+		return "Подтверждение истекло"
+	}
+
+	text := "Данные загружены: " + pending.Archive.describe() + "."
+	if !importArchive(pending.Archive, h.Stores) {
+		text += " История не загружена: здесь она уже не пуста."
+	}
+	audit(query.From, "загрузил данные из архива (%s)", pending.Archive.describe())
+	bot.Send(newReply(query.Message, text))
+	return ""
+}
+
+// RunImportData implements the import-data subcommand: it loads an archive into
+// the database of a stopped bot, writing the settings from it to secrets.json
+// when there is none yet. It returns the process exit code.
+func RunImportData(args []string) int {
+	fs := flag.NewFlagSet("import-data", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "Не спрашивать подтверждения")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Использование: import-data [--yes] файл"+DATA_FILE_SUFFIX)
+		return 2
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка чтения архива: %v\n", err)
+		return 1
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	_, statErr := os.Stat(config.SECRETS_FILE)
+	fresh := errors.Is(statErr, os.ErrNotExist)
+	secrets := &Secrets{}
+	if !fresh {
+		if secrets, err = config.Load(config.SECRETS_FILE); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	key := secrets.BackupKey
+	if key == "" {
+		fmt.Print("Пароль архива (backup_key сервера, где он выгружен): ")
+		line, _ := input.ReadString('\n')
+		key = strings.TrimSpace(line)
+	}
+	archive, err := openArchive(data, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if fresh {
+		copied := *archive.Config
+		secrets = &copied
+	} else if live, restart := diffSettings(secrets, archive.Config); len(live)+len(restart) > 0 {
+		fmt.Printf("%s уже есть и не меняется. В архиве отличаются: %s.\n", config.SECRETS_FILE, strings.Join(slices.Concat(live, restart), ", "))
+	}
+	secrets.LogFile = choose(secrets.LogFile, config.DEFAULT_LOG_FILE)
+	secrets.LogLevel = choose(secrets.LogLevel, config.DEFAULT_LOG_LEVEL)
+	if choose(secrets.StorageBackend, STORAGE_BOLT) != STORAGE_BOLT {
+		fmt.Fprintln(os.Stderr, "Данные хранятся в памяти бота, загружать их на диск некуда.")
+		return 1
+	}
+	// Audit entries go to the bot log, like those of history purge
+	redactor := NewRedactor(slices.Concat(secretValues(secrets), []string{key}), !secrets.LogEmails)
+	level, err := config.ParseLogLevel(secrets.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	telegramLevel, err := secrets.TelegramLevel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*yes {
+		fmt.Printf("Архив от %s: %s. Загрузить? [y/N] ", archive.CreatedAt.Format("2006-01-02 15:04"), archive.describe())
+		answer, _ := input.ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" && answer != "д" && answer != "да" {
+			fmt.Println("Отменено.")
+			return 1
+		}
+	}
+	logFile := setupLogging(secrets.LogFile, secrets.LogRotation, redactor, level, telegramLevel)
+	defer logFile.Close()
+
+	if fresh {
+		// The settings hold the bot token and the provider keys, so the file is private
+		settings, err := json.MarshalIndent(archive.Config, "", "  ")
+		if err == nil {
+			err = os.WriteFile(config.SECRETS_FILE, settings, 0600)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка записи %s: %v\n", config.SECRETS_FILE, err)
+			return 1
+		}
+		fmt.Printf("Настройки из архива записаны в %s.\n", config.SECRETS_FILE)
+	}
+	// The running bot holds the database lock, so this waits for lock_timeout and fails
+	db, err := state.Open(choose(secrets.StorageFile, DEFAULT_STORAGE_FILE), secrets.StorageOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\nОстановите бота или отправьте архив ему в чате.\n", err)
+		return 1
+	}
+	defer db.Close()
+	stores, err := openBoltStores(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	historyImported := importArchive(archive, stores)
+	auditCLI("загрузил данные из архива %s (%s)", fs.Arg(0), archive.describe())
+	fmt.Printf("Готово: %s.\n", archive.describe())
+	if !historyImported {
+		fmt.Println("История не загружена: в базе она уже не пуста.")
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataArchiveRoundTrip(t *testing.T) {
+	source := MemoryStores()
+	source.Templates.Save(1, Template{Name: "Отчёт", Subject: "Отчёт за май", Body: "Во вложении."})
+	source.Contacts.Add(2, Contact{Name: "Иван", Email: "ivan@example.com"})
+	source.Access.Set(3, false)
+	sentAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	source.History.Record(&SentEmail{UserID: 1, Recipient: "a@example.com", Subject: "Первое", SentAt: sentAt, Body: "Текст",
+		Attachments: []DraftAttachment{{FileID: "file", FileName: "отчёт.pdf"}}})
+	source.History.Record(&SentEmail{UserID: 1, Recipient: "b@example.com", Subject: "Второе", SentAt: sentAt.Add(time.Hour)})
+
+	secrets := &Secrets{BotToken: "token", TargetEmail: "target@example.com"}
+	data, err := sealArchive(collectArchive(secrets, source), "пароль")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "token") || strings.Contains(string(data), "Отчёт") {
+		t.Fatal("archive is not encrypted")
+	}
+	archive, err := openArchive(data, "пароль")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Config.BotToken != "token" {
+		t.Errorf("config = %+v, want the settings", archive.Config)
+	}
+
+	target := MemoryStores()
+	if !importArchive(archive, target) {
+		t.Error("history was not imported into an empty store")
+	}
+	if list := target.Templates.List(1); len(list) != 1 || list[0].Subject != "Отчёт за май" {
+		t.Errorf("templates = %+v", list)
+	}
+	if list := target.Contacts.List(2); len(list) != 1 || list[0].Email != "ivan@example.com" {
+		t.Errorf("contacts = %+v", list)
+	}
+	if allowed, decided := target.Access.Get(3); allowed || !decided {
+		t.Errorf("access = %v, %v, want denied", allowed, decided)
+	}
+	history := target.History.Recent(1, 10)
+	if len(history) != 2 || history[0].Subject != "Второе" || history[1].Subject != "Первое" {
+		t.Fatalf("history = %+v, want both letters newest first", history)
+	}
+	if history[1].Body != "" || len(history[1].Attachments) != 0 || !history[1].SentAt.Equal(sentAt) {
+		t.Errorf("history entry = %+v, want metadata only", history[1])
+	}
+}
+
+func TestDataArchiveKeepsExistingHistory(t *testing.T) {
+	source := MemoryStores()
+	source.History.Record(&SentEmail{UserID: 1, Subject: "Старое", SentAt: time.Now().Add(-time.Hour)})
+	target := MemoryStores()
+	target.History.Record(&SentEmail{UserID: 1, Subject: "Новое", SentAt: time.Now()})
+
+	if importArchive(collectArchive(&Secrets{}, source), target) {
+		t.Error("history was imported into a store with entries")
+	}
+	if history := target.History.Recent(1, 10); len(history) != 1 || history[0].Subject != "Новое" {
+		t.Errorf("history = %+v, want it unchanged", history)
+	}
+}
+
+func TestOpenArchiveRejects(t *testing.T) {
+	data, err := sealArchive(collectArchive(&Secrets{}, MemoryStores()), "пароль")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := slices.Clone(data)
+	tampered[len(tampered)-1] ^= 1
+	for _, tc := range []struct {
+		name, key, want string
+		data            []byte
+	}{
+		{"not an archive", "пароль", "не архив бота", []byte(`{"format": "botmail-data"}`)},
+		{"wrong key", "другой", "Не удалось расшифровать", data},
+		{"tampered", "пароль", "Не удалось расшифровать", tampered},
+		{"truncated", "пароль", "обрезан", data[:len(DATA_FILE_MAGIC)+DATA_SALT_SIZE]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := openArchive(tc.data, tc.key)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestExportDataCommand(t *testing.T) {
+	telegram, handler := adminBot(t)
+	handler.HandleUpdate(context.Background(), userMessage(9, "/exportdata"))
+	if _, ok := telegram.find(9, "Команда доступна только администраторам."); !ok {
+		t.Errorf("no denial:\n%s", telegram.transcript(9))
+	}
+	handler.HandleUpdate(context.Background(), textAction("/exportdata").update())
+	if _, ok := telegram.find(wizardUser, "Выгрузка данных выключена"); !ok {
+		t.Errorf("no note about backup_key:\n%s", telegram.transcript(wizardUser))
+	}
+}
+
+func TestDataImportConfirmation(t *testing.T) {
+	telegram, handler := adminBot(t)
+	archive := dataArchive{Templates: map[int64][]Template{9: {{Name: "Отчёт", Subject: "Отчёт"}}}}
+	handler.dataImports[1] = &pendingDataImport{AdminID: wizardUser, Archive: archive, Expires: time.Now().Add(DATA_IMPORT_TTL)}
+	handler.dataImports[2] = &pendingDataImport{AdminID: wizardUser, Archive: archive, Expires: time.Now().Add(-time.Second)}
+
+	handler.HandleUpdate(context.Background(), tapAction("dataimport:confirm:2").update())
+	if _, ok := telegram.find(wizardUser, "Подтверждение истекло"); !ok {
+		t.Errorf("expired import was not refused:\n%s", telegram.transcript(wizardUser))
+	}
+	handler.HandleUpdate(context.Background(), tapAction("dataimport:confirm:1").update())
+	if _, ok := telegram.find(wizardUser, "Данные загружены: шаблонов: 1"); !ok {
+		t.Errorf("no import report:\n%s", telegram.transcript(wizardUser))
+	}
+	if list := handler.Templates.List(9); len(list) != 1 {
+		t.Errorf("templates = %+v, want the imported one", list)
+	}
+}
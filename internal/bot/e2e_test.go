@@ -0,0 +1,74 @@
+package bot
+
+import "testing"
+
+func TestComposeAndSendWithOneRetry(t *testing.T) {
+	h := newHarness(t)
+	const user = 42
+
+	h.provider.respond("sendEmail", `{"result":[
+		{"index":0,"email":"a@example.com","id":"101"},
+		{"index":1,"email":"b@example.com","errors":[{"code":"invalid","message":"Адрес временно недоступен"}]}
+	]}`)
+	h.provider.respond("sendEmail", `{"result":[{"index":0,"email":"b@example.com","id":"102"}]}`)
+
+	h.send(user, "/start")
+	h.waitForMessage(user, "Привет")
+	h.send(user, NEW_LETTER_BUTTON_TEXT)
+	h.waitForMessage(user, "адрес получателя")
+	h.send(user, "a@example.com, b@example.com")
+	h.tap(user, h.waitForMessage(user, "Кому отправить копию"), "Пропустить")
+	h.tap(user, h.waitForMessage(user, "Кому отправить скрытую копию"), "Пропустить")
+	h.waitForMessage(user, "Введите тему")
+	h.send(user, "Отчёт")
+	h.waitForMessage(user, "Введите текст")
+	h.send(user, "Отчёт во вложении.")
+	h.waitForMessage(user, "имя отправителя")
+	h.send(user, "Иван")
+
+	preview := h.waitForMessage(user, "Проверьте письмо")
+	h.tap(user, preview, "Отправить")
+	h.waitForMessage(user, "Не приняты")
+
+	retry := h.waitForMessage(user, "Не принятые адреса: b@example.com")
+	h.tap(user, retry, "Повторить")
+	h.waitForMessage(user, "b@example.com: ")
+
+	calls := h.provider.requests()
+	if len(calls) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(calls))
+	}
+	if got := calls[0].Get("email"); got != "a@example.com,b@example.com" {
+		t.Errorf("first send went to %q", got)
+	}
+	if got := calls[1].Get("email"); got != "b@example.com" {
+		t.Errorf("retry went to %q, want only the rejected address", got)
+	}
+	if got := calls[1].Get("subject"); got != "Отчёт" {
+		t.Errorf("retry subject = %q", got)
+	}
+}
+
+func TestCancelDiscardsDraft(t *testing.T) {
+	h := newHarness(t)
+	const user = 7
+
+	h.send(user, "/start")
+	h.waitForMessage(user, "Привет")
+	h.send(user, NEW_LETTER_BUTTON_TEXT)
+	h.waitForMessage(user, "адрес получателя")
+	h.send(user, DEFAULT_RECIPIENT_BUTTON_TEXT)
+	h.waitForMessage(user, "Кому отправить копию")
+	h.send(user, "-")
+	h.tap(user, h.waitForMessage(user, "Кому отправить скрытую копию"), "Пропустить")
+	h.waitForMessage(user, "Введите тему")
+	h.send(user, "/cancel")
+	h.waitForMessage(user, "Письмо отменено")
+
+	if state, _ := h.handler.States.Get(user); state.State != "initial" || state.Subject != "" {
+		t.Errorf("state after /cancel = %+v", state)
+	}
+	if calls := h.provider.requests(); len(calls) != 0 {
+		t.Errorf("provider called %d times for a cancelled draft", len(calls))
+	}
+}
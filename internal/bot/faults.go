@@ -0,0 +1,183 @@
+package bot
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/state"
+)
+
+// Failure modes that /fail can force on a staging deployment.
+const (
+	FAULT_PROVIDER_500    = "provider_500"    // The email provider API answers with HTTP 500
+	FAULT_STORAGE_TIMEOUT = "storage_timeout" // The state database times out
+	FAULT_TELEGRAM_429    = "telegram_429"    // The Bot API rejects requests as too many
+	FAULT_UPDATE_CHAOS    = "update_chaos"    // Incoming updates are dropped, duplicated and delayed
+)
+
+// faultModes lists the supported failure modes in the order they are shown.
+var faultModes = []string{FAULT_PROVIDER_500, FAULT_STORAGE_TIMEOUT, FAULT_TELEGRAM_429, FAULT_UPDATE_CHAOS}
+
+// STORAGE_FAULT_DELAY is how long a storage operation hangs before the injected timeout.
+const STORAGE_FAULT_DELAY = time.Second
+
+// faultInjector tracks the forced failure modes and when each of them expires.
+// Every mode expires on its own, so a forced Telegram failure cannot lock admins out.
+type faultInjector struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var faults = &faultInjector{until: make(map[string]time.Time)}
+
+// Set forces the failure mode for the given duration.
+func (f *faultInjector) Set(mode string, duration time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.until[mode] = time.Now().Add(duration)
+}
+
+// Clear stops all forced failures.
+func (f *faultInjector) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.until)
+}
+
+// Active reports whether the failure mode is currently forced.
+func (f *faultInjector) Active(mode string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.until[mode])
+}
+
+// Remaining returns how long each active failure mode stays forced.
+func (f *faultInjector) Remaining() map[string]time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	remaining := make(map[string]time.Duration)
+	for mode, until := range f.until {
+		if left := time.Until(until); left > 0 {
+			remaining[mode] = left.Round(time.Second)
+		}
+	}
+	return remaining
+}
+
+// storageFault hangs and returns a timeout while FAULT_STORAGE_TIMEOUT is forced.
+func storageFault() error {
+	if !faults.Active(FAULT_STORAGE_TIMEOUT) {
+		return nil
+	}
+	time.Sleep(STORAGE_FAULT_DELAY)
+	return bolt.ErrTimeout
+}
+
+// faultTransport answers HTTP requests to the email provider and the Bot API with errors
+// while the matching failure mode is forced, so the real error handling runs.
+type faultTransport struct {
+	next           http.RoundTripper
+	telegramPrefix string // Bot API URL up to the token
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	link := req.URL.String()
+	switch {
+	case faults.Active(FAULT_PROVIDER_500) && isProviderAPI(link):
+		return faultResponse(req, http.StatusInternalServerError, "Internal Server Error"), nil
+	case faults.Active(FAULT_TELEGRAM_429) && strings.HasPrefix(link, t.telegramPrefix):
+		return faultResponse(req, http.StatusTooManyRequests,
+			`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`), nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// faultResponse builds a synthetic HTTP response for an injected failure.
+func faultResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// enableFailureInjection routes outgoing HTTP requests through faultTransport.
+// It is only called when failure_injection is set, which is meant for staging.
+func enableFailureInjection(secrets *Secrets) {
+	endpoint := choose(secrets.BotAPIEndpoint, tgbotapi.APIEndpoint)
+	prefix, _, _ := strings.Cut(endpoint, "%s")
+	// The Bot API client and the email providers use the default transport
+	http.DefaultTransport = &faultTransport{next: http.DefaultTransport, telegramPrefix: prefix}
+	state.Fault = storageFault
+	slog.Warn("Включено внедрение сбоев (failure_injection), только для тестовых стендов")
+}
+
+// handleFailCommand forces a failure mode for rehearsing incidents (admin only):
+// /fail <mode> <duration>, /fail off to stop all and /fail alone to list active ones.
+func handleFailCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !secrets.FailureInjection {
+		bot.Send(newReply(message, "Внедрение сбоев выключено. Включите failure_injection в secrets.json на тестовом стенде."))
+		return
+	}
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	switch {
+	case len(args) == 0:
+		remaining := faults.Remaining()
+		if len(remaining) == 0 {
+			bot.Send(newReply(message, "Сбоев нет. Использование: /fail <"+strings.Join(faultModes, "|")+"> <длительность, например 5m>, /fail off"))
+			return
+		}
+		var lines []string
+		for _, mode := range faultModes {
+			if left, ok := remaining[mode]; ok {
+				lines = append(lines, fmt.Sprintf("%s: ещё %s", mode, left))
+			}
+		}
+		bot.Send(newReply(message, "Активные сбои:\n"+strings.Join(lines, "\n")))
+	case len(args) == 1 && args[0] == "off":
+		faults.Clear()
+		audit(message.From, "/fail off")
+		bot.Send(newReply(message, "Все сбои отключены."))
+	case len(args) == 2 && slices.Contains(faultModes, args[0]):
+		duration, err := time.ParseDuration(args[1])
+		if err != nil || duration <= 0 {
+			bot.Send(newReply(message, "Некорректная длительность: "+args[1]))
+			return
+		}
+		faults.Set(args[0], duration)
+		audit(message.From, "/fail %s %s", args[0], duration)
+		bot.Send(newReply(message, fmt.Sprintf("Сбой %s включён на %s.", args[0], duration)))
+	default:
+		bot.Send(newReply(message, "Использование: /fail <"+strings.Join(faultModes, "|")+"> <длительность>, /fail off"))
+	}
+}
+
+// isProviderAPI reports whether link points to the API of an HTTP email provider.
+func isProviderAPI(link string) bool {
+	for _, prefix := range []string{mailer.UNISENDER_API_URL, mailer.MAILGUN_API_URL, mailer.MAILGUN_EU_API_URL} {
+		if strings.HasPrefix(link, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package bot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Zero-width characters the fingerprint of a letter is written in: the ID bits
+// between two word joiners. None of them shows in the letter, and they survive
+// copying its text.
+const (
+	FINGERPRINT_MARK = '\u2060' // Word joiner, starts and ends the fingerprint
+	FINGERPRINT_ZERO = '\u200b' // Zero-width space, a 0 bit
+	FINGERPRINT_ONE  = '\u200c' // Zero-width non-joiner, a 1 bit
+	// FINGERPRINT_BYTES is the length of the ID, shown as hex in the history
+	FINGERPRINT_BYTES = 4
+)
+
+// MAX_TRACE_RESULTS is how many letters /trace lists.
+const MAX_TRACE_RESULTS = 5
+
+// newFingerprint returns a random ID for one send.
+func newFingerprint() string {
+	id := make([]byte, FINGERPRINT_BYTES)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// fingerprintPattern writes the ID in zero-width characters.
+func fingerprintPattern(id string) string {
+	data, _ := hex.DecodeString(id)
+	var b strings.Builder
+	b.WriteRune(FINGERPRINT_MARK)
+	for _, octet := range data {
+		for bit := 7; bit >= 0; bit-- {
+			if octet>>bit&1 == 1 {
+				b.WriteRune(FINGERPRINT_ONE)
+			} else {
+				b.WriteRune(FINGERPRINT_ZERO)
+			}
+		}
+	}
+	b.WriteRune(FINGERPRINT_MARK)
+	return b.String()
+}
+
+// findFingerprints returns the IDs of the fingerprints in the text, in order.
+func findFingerprints(text string) []string {
+	var ids []string
+	runes := []rune(text)
+	size := 8*FINGERPRINT_BYTES + 2
+	for i := 0; i+size <= len(runes); i++ {
+		if runes[i] != FINGERPRINT_MARK || runes[i+size-1] != FINGERPRINT_MARK {
+			continue
+		}
+		data := make([]byte, FINGERPRINT_BYTES)
+		valid := true
+		for bit, r := range runes[i+1 : i+size-1] {
+			switch r {
+			case FINGERPRINT_ONE:
+				data[bit/8] |= 1 << (7 - bit%8)
+			case FINGERPRINT_ZERO:
+			default:
+				valid = false
+			}
+		}
+		if valid {
+			ids = append(ids, hex.EncodeToString(data))
+			i += size - 1
+		}
+	}
+	return ids
+}
+
+// stripFingerprints removes the zero-width characters of fingerprints from the text.
+func stripFingerprints(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == FINGERPRINT_MARK || r == FINGERPRINT_ZERO || r == FINGERPRINT_ONE {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// markBody writes the fingerprint after the first letter of the visible text:
+// past the preheader, tags, entities and the contents of style, script, head
+// and title elements. A body with no letters gets it at the end.
+func markBody(body, id string) string {
+	preheader, rest := splitPreheader(body)
+	at := len(rest)
+	for i := 0; i < len(rest); {
+		switch rest[i] {
+		case '<':
+			i = skipTag(rest, i)
+			continue
+		case '&':
+			if end := strings.IndexByte(rest[i:], ';'); end > 0 {
+				i += end + 1
+				continue
+			}
+		}
+		r, width := utf8.DecodeRuneInString(rest[i:])
+		if unicode.IsLetter(r) {
+			at = i + width
+			break
+		}
+		i += width
+	}
+	return preheader + rest[:at] + fingerprintPattern(id) + rest[at:]
+}
+
+// skipTag returns the position after the tag starting at i, or after the closing
+// tag of an element whose contents are not shown.
+func skipTag(body string, i int) int {
+	end := strings.IndexByte(body[i:], '>')
+	if end < 0 {
+		return len(body)
+	}
+	name, _, _ := strings.Cut(body[i+1:i+end], " ")
+	name = strings.ToLower(strings.TrimRight(name, "/\t\n"))
+	i += end + 1
+	// A closing tag, the name starting with a slash, matches none of these
+	switch name {
+	case "style", "script", "head", "title":
+		closing := strings.Index(strings.ToLower(body[i:]), "</"+name)
+		if closing < 0 {
+			return len(body)
+		}
+		return skipTag(body, i+closing)
+	}
+	return i
+}
+
+// fingerprinted marks the body with a new fingerprint when fingerprint is set in
+// secrets.json, replacing the one of an earlier send, and returns the body with
+// the ID; without the setting the body is returned as is.
+func (h *Handler) fingerprinted(body string) (string, string) {
+	if !h.secrets.Fingerprint {
+		return body, ""
+	}
+	id := newFingerprint()
+	return markBody(stripFingerprints(body), id), id
+}
+
+// handleTraceCommand (admin only) finds the letters a leaked text or header came
+// from: /trace followed by the text with its fingerprint, the fingerprint itself
+// or a Message-Id.
+func (h *Handler) handleTraceCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	text := message.CommandArguments()
+	query := strings.Trim(strings.TrimSpace(stripFingerprints(text)), "<>")
+	ids := findFingerprints(text)
+	if len(ids) == 0 && query == "" {
+		bot.Send(newReply(message, "Использование: /trace <текст из утёкшего письма, ID отпечатка или Message-Id> — находит отправку, из которой письмо."))
+		return
+	}
+	audit(message.From, "/trace %q", query)
+
+	var lines []string
+	for _, entry := range h.History.Since(time.Time{}) {
+		matched := entry.Fingerprint != "" && (slices.Contains(ids, entry.Fingerprint) || strings.EqualFold(query, entry.Fingerprint))
+		if !matched && len(query) > FINGERPRINT_BYTES*2 && entry.MessageID != "" {
+			matched = strings.Contains(entry.MessageID, query)
+		}
+		if !matched {
+			continue
+		}
+		line := historyLine(entry, secrets.Location())
+		line += fmt.Sprintf("\n    Пользователь %d", entry.UserID)
+		if entry.Username != "" {
+			line += " (@" + entry.Username + ")"
+		}
+		if entry.Fingerprint != "" {
+			line += ", отпечаток " + entry.Fingerprint
+		}
+		lines = append(lines, line)
+		if len(lines) == MAX_TRACE_RESULTS {
+			break
+		}
+	}
+	if len(lines) == 0 {
+		reply := "Отправка не найдена."
+		if len(ids) == 0 {
+			reply += " В тексте нет отпечатка: возможно, его удалили при копировании или письмо ушло без fingerprint."
+		}
+		bot.Send(newReply(message, reply))
+		return
+	}
+	bot.Send(newReply(message, "Найденные отправки:\n"+strings.Join(lines, "\n")))
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprintPattern(t *testing.T) {
+	id := newFingerprint()
+	text := "Добрый день," + fingerprintPattern(id) + " отчёт" + fingerprintPattern("00ff00ff")
+	if got := findFingerprints(text); !slices.Equal(got, []string{id, "00ff00ff"}) {
+		t.Errorf("findFingerprints = %v, want %v", got, []string{id, "00ff00ff"})
+	}
+	if got := stripFingerprints(text); got != "Добрый день, отчёт" {
+		t.Errorf("stripFingerprints = %q", got)
+	}
+	if got := findFingerprints("Добрый день\u2060\u200b\u2060"); got != nil {
+		t.Errorf("findFingerprints found %v in a broken pattern", got)
+	}
+}
+
+func TestMarkBody(t *testing.T) {
+	mark := fingerprintPattern("0a0b0c0d")
+	for _, tt := range []struct{ body, want string }{
+		{"Привет", "П" + mark + "ривет"},
+		{"  42 — итог", "  42 — и" + mark + "тог"},
+		{"<html><head><style>p{color:red}</style></head><p>&nbsp;Текст</p>", "<html><head><style>p{color:red}</style></head><p>&nbsp;Т" + mark + "екст</p>"},
+		{withPreheader("Текст", "Кратко"), withPreheader("Т"+mark+"екст", "Кратко")},
+		{"123", "123" + mark},
+	} {
+		if got := markBody(tt.body, "0a0b0c0d"); got != tt.want {
+			t.Errorf("markBody(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintedSend(t *testing.T) {
+	var steps []string
+	secrets := wizardSecrets()
+	secrets.Fingerprint = true
+	handler, _, _ := newWizardHandler(t, secrets, &steps)
+	for _, action := range decodeActions(happyPath) {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	sent := handler.History.Recent(wizardUser, 1)
+	if len(sent) != 1 || sent[0].Fingerprint == "" {
+		t.Fatalf("history = %+v, want a fingerprinted letter", sent)
+	}
+	if ids := findFingerprints(sent[0].Body); !slices.Equal(ids, []string{sent[0].Fingerprint}) {
+		t.Errorf("body carries %v, want the fingerprint %s", ids, sent[0].Fingerprint)
+	}
+}
+
+func TestTraceCommand(t *testing.T) {
+	var steps []string
+	secrets := wizardSecrets()
+	secrets.AdminUserIDs = []int64{wizardUser}
+	handler, bot, _ := newWizardHandler(t, secrets, &steps)
+	handler.History.Record(&SentEmail{UserID: 9, Username: "ivan", Recipient: "a@example.com", Subject: "Отчёт",
+		Body: "О" + fingerprintPattern("0a0b0c0d") + "тчёт", SentAt: time.Now(), Fingerprint: "0a0b0c0d"})
+	handler.History.Record(&SentEmail{UserID: 10, Recipient: "b@example.com", Subject: "Счёт",
+		SentAt: time.Now(), MessageID: "<20261016.abc@mail.example.com>"})
+
+	handler.HandleUpdate(context.Background(), userMessage(9, "/trace 0a0b0c0d"))
+	if !strings.Contains(bot.texts(), "Команда доступна только администраторам.") {
+		t.Errorf("/trace was not refused to a user:\n%s", bot.texts())
+	}
+	for _, tt := range []struct{ query, want string }{
+		{"Пересланный текст: О" + fingerprintPattern("0a0b0c0d") + "тчёт", "Пользователь 9 (@ivan), отпечаток 0a0b0c0d"},
+		{"0A0B0C0D", "Пользователь 9 (@ivan)"},
+		{"<20261016.abc@mail.example.com>", "Пользователь 10"},
+		{"Текст без отметки", "В тексте нет отпечатка"},
+	} {
+		handler.HandleUpdate(context.Background(), textAction("/trace "+tt.query).update())
+		if !strings.Contains(bot.texts(), tt.want) {
+			t.Errorf("/trace %q: bot did not say %q:\n%s", tt.query, tt.want, bot.texts())
+		}
+	}
+}
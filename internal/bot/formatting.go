@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"cmp"
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/state"
+)
+
+// Body formats chosen with the buttons under the body prompt.
+const (
+	BODY_FORMAT_TEXT = state.BODY_FORMAT_TEXT
+	BODY_FORMAT_HTML = state.BODY_FORMAT_HTML
+)
+
+// bodyFormatKeyboard builds the inline buttons that choose how the body is sent.
+func bodyFormatKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Текст", "format:"+BODY_FORMAT_TEXT),
+		tgbotapi.NewInlineKeyboardButtonData("HTML", "format:"+BODY_FORMAT_HTML),
+	))
+}
+
+// handleFormatCallback switches the format the body about to be entered is sent in.
+func (h *Handler) handleFormatCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	if payload != BODY_FORMAT_TEXT && payload != BODY_FORMAT_HTML {
+		return "Кнопка устарела."
+	}
+	var current bool
+	h.States.Update(query.From.ID, func(s *UserState) {
+		if current = s.State == "await_body"; current {
+			s.BodyFormat = payload
+		}
+	})
+	if !current {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Текст письма уже введён."
+	}
+	if payload == BODY_FORMAT_HTML {
+		return "Текст письма будет отправлен как HTML, без изменений."
+	}
+	return "Текст письма будет отправлен как обычный текст."
+}
+
+// entityTags maps Telegram formatting entities to the HTML tags that open and close them.
+var entityTags = map[string][2]string{
+	"bold":          {"<b>", "</b>"},
+	"italic":        {"<i>", "</i>"},
+	"underline":     {"<u>", "</u>"},
+	"strikethrough": {"<s>", "</s>"},
+	"code":          {"<code>", "</code>"},
+	"pre":           {"<pre>", "</pre>"},
+	"blockquote":    {"<blockquote>", "</blockquote>"},
+}
+
+// entitiesToHTML converts a Telegram message text with its formatting entities to
+// an HTML body: the text is escaped, line breaks kept and bold, italic, links and
+// the like turned into tags. Surrounding whitespace is dropped like in the other
+// wizard fields. Entity offsets count UTF-16 code units, as the Bot API does.
+func entitiesToHTML(text string, entities []tgbotapi.MessageEntity) string {
+	runes := []rune(text)
+	start, end := 0, len(runes)
+	for start < end && unicode.IsSpace(runes[start]) {
+		start++
+	}
+	for end > start && unicode.IsSpace(runes[end-1]) {
+		end--
+	}
+
+	// Outer entities must open first, so of those starting together the longer goes first
+	entities = slices.Clone(entities)
+	slices.SortStableFunc(entities, func(a, b tgbotapi.MessageEntity) int {
+		return cmp.Or(cmp.Compare(a.Offset, b.Offset), cmp.Compare(b.Length, a.Length))
+	})
+
+	var b strings.Builder
+	var open []tgbotapi.MessageEntity // Entities whose tags are open, innermost last
+	closeUntil := func(pos int) {
+		for len(open) > 0 && open[len(open)-1].Offset+open[len(open)-1].Length <= pos {
+			b.WriteString(closingTag(open[len(open)-1]))
+			open = open[:len(open)-1]
+		}
+	}
+
+	pos := 0 // UTF-16 offset of the current rune
+	for i, r := range runes {
+		closeUntil(pos)
+		if i >= start && i < end {
+			for _, e := range entities {
+				if e.Offset == pos && e.Length > 0 {
+					if tag := openingTag(e, text); tag != "" {
+						b.WriteString(tag)
+						open = append(open, e)
+					}
+				}
+			}
+			switch r {
+			case '\n':
+				b.WriteString("<br>\n")
+			case '\r':
+			default:
+				b.WriteString(html.EscapeString(string(r)))
+			}
+		}
+		pos += utf16.RuneLen(r)
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString(closingTag(open[i]))
+	}
+	return b.String()
+}
+
+// openingTag returns the tag that starts the entity, or "" for entities with no
+// HTML counterpart such as mentions and hashtags.
+func openingTag(e tgbotapi.MessageEntity, text string) string {
+	switch e.Type {
+	case "text_link":
+		return `<a href="` + html.EscapeString(e.URL) + `">`
+	case "url":
+		link := entityText(text, e)
+		if !strings.Contains(link, "://") {
+			// Telegram links bare domains such as example.com too
+			link = "http://" + link
+		}
+		return `<a href="` + html.EscapeString(link) + `">`
+	case "email":
+		return `<a href="mailto:` + html.EscapeString(entityText(text, e)) + `">`
+	case "phone_number":
+		// tel: links take the digits only, keeping the leading + of international numbers
+		number := strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) || r == '+' {
+				return r
+			}
+			return -1
+		}, entityText(text, e))
+		return `<a href="tel:` + html.EscapeString(number) + `">`
+	}
+	return entityTags[e.Type][0]
+}
+
+// closingTag returns the tag that ends the entity opened by openingTag.
+func closingTag(e tgbotapi.MessageEntity) string {
+	switch e.Type {
+	case "text_link", "url", "email", "phone_number":
+		return "</a>"
+	}
+	return entityTags[e.Type][1]
+}
+
+// entityText returns the part of text the entity covers.
+func entityText(text string, e tgbotapi.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	from, to := min(e.Offset, len(units)), min(e.Offset+e.Length, len(units))
+	return string(utf16.Decode(units[from:to]))
+}
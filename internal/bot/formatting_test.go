@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestEntitiesToHTML(t *testing.T) {
+	entity := func(kind string, offset, length int) tgbotapi.MessageEntity {
+		return tgbotapi.MessageEntity{Type: kind, Offset: offset, Length: length}
+	}
+	tests := []struct {
+		name     string
+		text     string
+		entities []tgbotapi.MessageEntity
+		want     string
+	}{
+		{"plain text is escaped", "  a < b & c\nновая строка\n", nil, "a &lt; b &amp; c<br>\nновая строка"},
+		{"bold and italic", "жирный и курсив", []tgbotapi.MessageEntity{entity("bold", 0, 6), entity("italic", 9, 6)},
+			"<b>жирный</b> и <i>курсив</i>"},
+		{"nested, outer listed second", "всё важно", []tgbotapi.MessageEntity{entity("italic", 4, 5), entity("bold", 0, 9)},
+			"<b>всё <i>важно</i></b>"},
+		{"offsets count UTF-16 units", "👍 ок", []tgbotapi.MessageEntity{entity("bold", 3, 2)}, "👍 <b>ок</b>"},
+		{"text link", "сайт", []tgbotapi.MessageEntity{{Type: "text_link", Offset: 0, Length: 4, URL: "https://example.com/?a=1&b=2"}},
+			`<a href="https://example.com/?a=1&amp;b=2">сайт</a>`},
+		{"bare url and email", "example.com a@example.com", []tgbotapi.MessageEntity{entity("url", 0, 11), entity("email", 12, 13)},
+			`<a href="http://example.com">example.com</a> <a href="mailto:a@example.com">a@example.com</a>`},
+		{"phone number", "звоните +7 (495) 123-45-67", []tgbotapi.MessageEntity{entity("phone_number", 8, 18)},
+			`звоните <a href="tel:+74951234567">+7 (495) 123-45-67</a>`},
+		{"mentions are left as text", "@ivan", []tgbotapi.MessageEntity{entity("mention", 0, 5)}, "@ivan"},
+		{"entity over trailing space", "код ", []tgbotapi.MessageEntity{entity("code", 0, 4)}, "<code>код</code>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entitiesToHTML(tt.text, tt.entities); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailBodyByFormat(t *testing.T) {
+	text := UserState{Body: "**", BodyHTML: "<b>*</b>"}
+	if got := text.EmailBody(); got != "<b>*</b>" {
+		t.Errorf("text mode sends %q, want the converted HTML", got)
+	}
+	custom := UserState{Body: "<table></table>", BodyFormat: BODY_FORMAT_HTML}
+	if got := custom.EmailBody(); got != "<table></table>" {
+		t.Errorf("HTML mode sends %q, want the body as typed", got)
+	}
+}
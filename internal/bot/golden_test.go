@@ -0,0 +1,125 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/testutil"
+)
+
+// The golden files in testdata/golden hold the letters the wizard composes, as
+// handed to the mailer, for fixed drafts; the mailer's own golden files show what
+// it makes of them. After an intended change, rewrite them with
+// UPDATE_GOLDEN=1 go test ./... and check the diff.
+
+// goldenSender writes out every letter it is given and accepts all addresses.
+type goldenSender struct {
+	letters strings.Builder
+}
+
+func (s *goldenSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	fmt.Fprintf(&s.letters, "From: %s <%s>\nTo: %s\n", senderName, senderEmail, targetEmail)
+	if len(copies.CC) > 0 {
+		fmt.Fprintf(&s.letters, "Cc: %s\n", strings.Join(copies.CC, ", "))
+	}
+	if len(copies.BCC) > 0 {
+		fmt.Fprintf(&s.letters, "Bcc: %s\n", strings.Join(copies.BCC, ", "))
+	}
+	fmt.Fprintf(&s.letters, "Subject: %s\n", subject)
+	for _, a := range attachments {
+		fmt.Fprintf(&s.letters, "Attachment: %s\n", a.Name)
+	}
+	fmt.Fprintf(&s.letters, "\n%s\n", body)
+
+	var result SendEmailResponse
+	for i, address := range append(strings.Split(targetEmail, ","), copies.Addresses()...) {
+		result = append(result, SendEmailResult{Index: i, Email: address, ID: "1"})
+	}
+	return result, nil
+}
+
+// formattedAction is a text message with Telegram formatting.
+func formattedAction(text string, entities ...tgbotapi.MessageEntity) wizardAction {
+	action := textAction(text)
+	update := action.update
+	action.update = func() tgbotapi.Update {
+		u := update()
+		u.Message.Entities = entities
+		return u
+	}
+	return action
+}
+
+func TestComposedLetterGolden(t *testing.T) {
+	saved := normalization
+	t.Cleanup(func() { normalization = saved })
+
+	for _, tt := range []struct {
+		name      string
+		configure func(*Secrets)
+		normalize NormalizeRules
+		actions   []wizardAction
+	}{
+		{
+			name: "language",
+			configure: func(s *Secrets) {
+				s.LanguageRules = map[string]LanguageRule{"ru": {SubjectTag: "[RU]", TargetEmail: "ru@example.com"}}
+			},
+			actions: []wizardAction{
+				textAction(DEFAULT_RECIPIENT_BUTTON_TEXT), tapAction("copies:cc"), tapAction("copies:bcc"),
+				textAction("Отчёт за май"), textAction("Добрый день!\n\nОтчёт за май во вложении."), textAction("Иван"),
+			},
+		},
+		{
+			name: "formatted",
+			actions: []wizardAction{
+				textAction("a@example.com, b@example.com"), textAction("boss@example.com"), textAction("archive@example.com"),
+				textAction("Встреча"),
+				formattedAction("Встреча переносится на 15:00. Подробности & <повестка>",
+					tgbotapi.MessageEntity{Type: "bold", Offset: 0, Length: 7},
+					tgbotapi.MessageEntity{Type: "text_link", Offset: 30, Length: 11, URL: "https://example.com/agenda?a=1&b=2"},
+				),
+				textAction("Отдел продаж"),
+				tapAction("confirm:edit_preheader"), textAction("Коротко о встрече"),
+			},
+		},
+		{
+			name: "tags_normalized",
+			configure: func(s *Secrets) {
+				s.TagRules = map[string]TagRule{"срочно": {CC: []string{"boss@example.com"}, SubjectPrefix: "[Срочно]"}}
+			},
+			normalize: NormalizeRules{CollapseWhitespace: true, StripTrackingParams: true, FixPunctuationSpaces: true},
+			actions: []wizardAction{
+				textAction("a@example.com"), tapAction("copies:cc"), textAction("archive@example.com"),
+				textAction("Счёт   к оплате"), textAction("Привет ,  счёт по ссылке:   https://example.com/pay?utm_source=tg&id=7  \n\n\n\nСпасибо!"),
+				textAction("Бухгалтерия"), tapAction("tags:toggle:0"), tapAction("tags:done"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			secrets := wizardSecrets()
+			if tt.configure != nil {
+				tt.configure(secrets)
+			}
+			normalization = tt.normalize
+			var steps []string
+			handler, bot, _ := newWizardHandler(t, secrets, &steps)
+			sender := &goldenSender{}
+			handler = NewHandler(bot, sender, secrets, handler.Stores)
+
+			actions := append([]wizardAction{textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT)}, tt.actions...)
+			for _, action := range append(actions, tapAction("confirm:send")) {
+				steps = append(steps, action.name)
+				handler.HandleUpdate(context.Background(), action.update())
+			}
+			if sender.letters.Len() == 0 {
+				t.Fatalf("no letter sent after:\n%s\nbot said:\n%s", strings.Join(steps, "\n"), bot.texts())
+			}
+			testutil.CheckGolden(t, tt.name+".txt", sender.letters.String())
+		})
+	}
+}
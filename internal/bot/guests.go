@@ -0,0 +1,222 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// GUEST_HISTORY_WINDOW is how many of the guest's latest letters are looked at
+	// to count the approved ones.
+	GUEST_HISTORY_WINDOW = 100
+	// GUEST_NOTE explains guest mode to a user without access.
+	GUEST_NOTE = "Вы в гостевом режиме: каждое письмо уходит только после одобрения администратора."
+)
+
+// guestCommands are the commands a guest may use: those of the letter wizard.
+var guestCommands = []string{"start", "cancel", "invite"}
+
+// guestCallbacks are the prefixes of the buttons a guest may tap, those of the
+// letter wizard; guestRefusedCallbacks are the ones among them that would send
+// the letter without approval.
+var (
+	guestCallbacks        = []string{"confirm", "contact", "alias", "copies", "subject", "format", "tags"}
+	guestRefusedCallbacks = []string{"confirm:later", "confirm:spamcheck"}
+)
+
+// GuestRequest is a guest's letter waiting for an administrator's approval. Every
+// administrator gets a card; the first decision removes the buttons from all of them.
+// Requests live in memory only, so pending ones are lost on restart.
+type GuestRequest struct {
+	Guest     tgbotapi.User
+	ChatID    int64 // Guest's chat, which gets the send result
+	MessageID int   // Preview the request was made from
+	Draft     UserState
+	Requested time.Time
+	Cards     map[int64]int // Message ID of the approval card by administrator chat
+}
+
+// isGuest reports whether the user may only compose letters an administrator
+// approves: guest_mode is on and the user has no access, but was not denied it.
+func (h *Handler) isGuest(userID int64) bool {
+	s := h.secrets
+	if !s.GuestMode.Enabled || h.isAllowed(userID) {
+		return false
+	}
+	_, decided := h.Access.Get(userID)
+	return !decided
+}
+
+// guestMessageAllowed reports whether a guest's message belongs to the letter
+// wizard. Files are only taken as attachments at the body step.
+func (h *Handler) guestMessageAllowed(message *tgbotapi.Message) bool {
+	if command := message.Command(); command != "" {
+		return slices.Contains(guestCommands, command)
+	}
+	if message.Document != nil {
+		state, _ := h.States.Get(message.From.ID)
+		return state.State == "await_body"
+	}
+	return true
+}
+
+// guestCallbackAllowed reports whether a guest may tap the button with the data.
+func guestCallbackAllowed(data string) bool {
+	prefix, _, _ := strings.Cut(data, ":")
+	return slices.Contains(guestCallbacks, prefix) && !slices.Contains(guestRefusedCallbacks, data)
+}
+
+// approvedGuestLetters counts the guest's letters an administrator approved and
+// the provider accepted.
+func (h *Handler) approvedGuestLetters(guestID int64) int {
+	n := 0
+	for _, entry := range h.History.Recent(guestID, GUEST_HISTORY_WINDOW) {
+		if entry.ApprovedBy != 0 && entry.Status != HISTORY_FAILED {
+			n++
+		}
+	}
+	return n
+}
+
+// requestGuestApproval sends the guest's draft, already taken off the preview, to
+// the administrators for approval. The card offers to open access to the guest once
+// enough of their letters were approved.
+func (h *Handler) requestGuestApproval(message *tgbotapi.Message, from *tgbotapi.User, draft UserState) {
+	bot, secrets := h.bot, h.secrets
+	h.guestMu.Lock()
+	h.guestSeq++
+	id := h.guestSeq
+	request := &GuestRequest{
+		Guest:     *from,
+		ChatID:    message.Chat.ID,
+		MessageID: message.MessageID,
+		Draft:     draft,
+		Requested: time.Now(),
+		Cards:     make(map[int64]int),
+	}
+	h.guestRequests[id] = request
+	h.guestMu.Unlock()
+
+	guest := strings.TrimSpace(from.FirstName + " " + from.LastName)
+	if from.UserName != "" {
+		guest += " (@" + from.UserName + ")"
+	}
+	approved := h.approvedGuestLetters(from.ID)
+	buttons := [][]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Одобрить", fmt.Sprintf("guest:approve:%d", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Отклонить", fmt.Sprintf("guest:reject:%d", id)),
+	)}
+	if approved >= secrets.GuestMode.PromotionThreshold() {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Одобрить и открыть доступ", fmt.Sprintf("guest:promote:%d", id)),
+		))
+	}
+	preview := previewText(&draft)
+	if isInviteDraft(&draft) {
+		preview = invitePreview(&draft)
+	}
+	text := fmt.Sprintf("Гость %s (ID %d) просит отправить письмо. Одобрено его писем: %d.\n\n%s", guest, from.ID, approved, preview)
+
+	for _, adminID := range secrets.AdminUserIDs {
+		card := tgbotapi.NewMessage(adminID, text)
+		card.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+		sent, err := bot.Send(card)
+		if err != nil {
+			// The administrator has to start the bot before it can write to them
+			slog.Warn("Ошибка отправки запроса на одобрение письма гостя", "admin_id", adminID, "error", err)
+			continue
+		}
+		h.guestMu.Lock()
+		request.Cards[adminID] = sent.MessageID
+		h.guestMu.Unlock()
+	}
+	h.guestMu.Lock()
+	reached := len(request.Cards) > 0
+	h.guestMu.Unlock()
+	if !reached {
+		h.takeGuestRequest(id)
+		bot.Send(newReply(message, "Не удалось отправить письмо на одобрение: администраторы недоступны. Попробуйте позже."))
+		h.restoreDraft(message, from.ID, draft)
+		return
+	}
+	audit(from, "запросил как гость отправку письма «%s»", draft.Subject)
+
+	msg := newReply(message, fmt.Sprintf("Письмо «%s» отправлено на одобрение администратору. Оно уйдёт, когда администратор его одобрит.", draft.Subject))
+	msg.ReplyMarkup = newInitialKeyboard()
+	bot.Send(msg)
+}
+
+// takeGuestRequest removes a pending request and returns it.
+func (h *Handler) takeGuestRequest(id int64) (*GuestRequest, bool) {
+	h.guestMu.Lock()
+	defer h.guestMu.Unlock()
+	request, ok := h.guestRequests[id]
+	delete(h.guestRequests, id)
+	return request, ok
+}
+
+// handleGuestCallback handles an administrator's decision on a guest's letter.
+// Only the first decision counts: the request is taken at once.
+func (h *Handler) handleGuestCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	action, arg, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || query.Message == nil || action != "approve" && action != "reject" && action != "promote" {
+		return "Кнопка устарела."
+	}
+	if !secrets.IsAdmin(query.From.ID) {
+		audit(query.From, "попытка решить судьбу письма гостя без прав администратора")
+		return "Нет доступа."
+	}
+
+	request, ok := h.takeGuestRequest(id)
+	if !ok {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Запрос уже обработан."
+	}
+	for chatID, messageID := range request.Cards {
+		removeInlineKeyboard(bot, chatID, messageID)
+	}
+
+	message := &tgbotapi.Message{MessageID: request.MessageID, Chat: &tgbotapi.Chat{ID: request.ChatID}}
+	guestID := request.Guest.ID
+	draft := request.Draft
+	if action == "reject" {
+		audit(query.From, "отклонил письмо «%s» гостя %d", draft.Subject, guestID)
+		bot.Send(newReply(message, fmt.Sprintf("Администратор отклонил письмо «%s».", draft.Subject)))
+		h.restoreDraft(message, guestID, draft)
+		return "Отклонено"
+	}
+
+	reply := "Одобрено"
+	if action == "promote" {
+		if _, decided := h.Access.Get(guestID); decided {
+			// Another administrator has opened or closed access since the card was sent
+			audit(query.From, "одобрил письмо «%s» гостя %d, доступ уже решён", draft.Subject, guestID)
+		} else {
+			h.Access.Set(guestID, true)
+			audit(query.From, "одобрил письмо «%s» гостя %d и открыл ему доступ", draft.Subject, guestID)
+			bot.Send(tgbotapi.NewMessage(request.ChatID, "Администратор открыл вам доступ к боту: следующие письма уйдут без одобрения."))
+			reply = "Одобрено, доступ открыт"
+		}
+	} else {
+		audit(query.From, "одобрил письмо «%s» гостя %d", draft.Subject, guestID)
+	}
+	bot.Send(newReply(query.Message, fmt.Sprintf("Письмо «%s» гостя %d отправляется, результат получит гость.", draft.Subject, guestID)))
+	draft.ApprovedBy = query.From.ID
+	inFlightSends.Add(1)
+	defer inFlightSends.Done()
+	if isInviteDraft(&draft) {
+		h.sendInvite(ctx, &request.Guest, message, &draft, newInitialKeyboard())
+		return reply
+	}
+	h.sendDraft(ctx, &request.Guest, message, &draft)
+	return reply
+}
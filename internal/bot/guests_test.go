@@ -0,0 +1,166 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const guestAdmin = 9
+
+// adminTap is a tap on a button by the administrator in their own chat.
+func adminTap(data string) wizardAction {
+	return wizardAction{name: "admin tap " + data, update: func() tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "1",
+			From:    &tgbotapi.User{ID: guestAdmin, FirstName: "Админ"},
+			Message: &tgbotapi.Message{MessageID: 2, Chat: &tgbotapi.Chat{ID: guestAdmin, Type: "private"}},
+			Data:    data,
+		}}
+	}}
+}
+
+// guestCompose is the guest composing a letter and tapping send under the preview.
+var guestCompose = []wizardAction{
+	textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction(DEFAULT_RECIPIENT_BUTTON_TEXT),
+	tapAction("copies:cc"), tapAction("copies:bcc"),
+	textAction("Отчёт"), textAction("Отчёт за месяц."), textAction("Гость"),
+	tapAction("confirm:send"),
+}
+
+// runGuest runs the actions on fresh stores with guest mode on, wizardUser
+// being a guest and guestAdmin the administrator.
+func runGuest(t *testing.T, actions ...wizardAction) (*Handler, *fakeBot, *recordingSender) {
+	secrets := wizardSecrets()
+	secrets.AdminUserIDs = []int64{guestAdmin}
+	secrets.AllowedUserIDs = []int64{}
+	secrets.GuestMode = GuestMode{Enabled: true, PromoteAfter: 1}
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, secrets, &steps)
+	for _, action := range actions {
+		steps = append(steps, action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	return handler, bot, sender
+}
+
+// lastCard returns the buttons of the latest approval card sent to the administrator.
+func lastCard(bot *fakeBot) []string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	var data []string
+	for _, c := range bot.sent {
+		if m, ok := c.(tgbotapi.MessageConfig); ok && m.ChatID == guestAdmin && strings.HasPrefix(m.Text, "Гость") {
+			data = nil
+			for _, row := range m.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup).InlineKeyboard {
+				for _, button := range row {
+					data = append(data, *button.CallbackData)
+				}
+			}
+		}
+	}
+	return data
+}
+
+func TestGuestLetterWaitsForApproval(t *testing.T) {
+	handler, bot, sender := runGuest(t, append(guestCompose, tapAction("guest:approve:1"), adminTap("guest:approve:1"), adminTap("guest:reject:1"))...)
+
+	// The guest's own tap is refused and the second decision finds the request gone
+	if want := []string{"Отчёт"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Fatalf("sent %q, want %q", sender.subjects, want)
+	}
+	if want := []string{"guest:approve:1", "guest:reject:1"}; !reflect.DeepEqual(lastCard(bot), want) {
+		t.Errorf("card buttons = %q, want %q before any letter was approved", lastCard(bot), want)
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].ApprovedBy != guestAdmin {
+		t.Errorf("history = %+v, want the letter approved by %d", sent, guestAdmin)
+	}
+	for _, want := range []string{GUEST_NOTE, "отправлено на одобрение", "Нет доступа.", "Запрос уже обработан."} {
+		if !strings.Contains(bot.texts(), want) {
+			t.Errorf("no %q in:\n%s", want, bot.texts())
+		}
+	}
+}
+
+func TestGuestRejectedRestoresDraft(t *testing.T) {
+	handler, _, sender := runGuest(t, append(guestCompose, adminTap("guest:reject:1"))...)
+
+	if sender.sent != 0 {
+		t.Fatalf("rejected letter was sent")
+	}
+	if state, _ := handler.States.Get(wizardUser); state.State != "await_confirm" || state.Subject != "Отчёт" {
+		t.Errorf("state after rejection = %+v, want the draft on preview", state)
+	}
+}
+
+// guestInvite is the guest composing a meeting invitation with /invite.
+func guestInvite() []wizardAction {
+	return []wizardAction{
+		textAction("/start"), textAction("/invite"), textAction("Планёрка"),
+		textAction(time.Now().Add(48 * time.Hour).Format(INVITE_TIME_LAYOUT)), textAction("30"), textAction("Переговорная"),
+	}
+}
+
+func TestGuestInviteWaitsForApproval(t *testing.T) {
+	handler, _, sender := runGuest(t, guestInvite()...)
+	if sender.sent != 0 || len(handler.guestRequests) != 1 {
+		t.Fatalf("sent %d letters with %d waiting for approval, want the invitation waiting", sender.sent, len(handler.guestRequests))
+	}
+
+	handler, bot, sender := runGuest(t, append(guestInvite(), adminTap("guest:approve:1"))...)
+	if want := []string{"Планёрка"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Fatalf("sent %q, want %q after approval", sender.subjects, want)
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].ApprovedBy != guestAdmin {
+		t.Errorf("history = %+v, want the invitation approved by %d", sent, guestAdmin)
+	}
+	if !strings.Contains(bot.texts(), "Приглашение на встречу «Планёрка»") {
+		t.Errorf("the card does not describe the invitation:\n%s", bot.texts())
+	}
+
+	handler, bot, sender = runGuest(t, append(guestInvite(), adminTap("guest:reject:1"))...)
+	if state, _ := handler.States.Get(wizardUser); sender.sent != 0 || state.State != "await_invite_location" || state.Subject != "Планёрка" {
+		t.Errorf("state after rejection = %+v, want the invitation at its last step:\n%s", state, bot.texts())
+	}
+}
+
+func TestGuestPromotedFromApprovalCard(t *testing.T) {
+	actions := append(append([]wizardAction{}, guestCompose...), adminTap("guest:approve:1"))
+	actions = append(actions, guestCompose...)
+	actions = append(actions, adminTap("guest:promote:2"))
+	// Now an allowed user, the former guest sends without approval
+	handler, bot, sender := runGuest(t, append(actions, guestCompose...)...)
+
+	if want := []string{"guest:approve:2", "guest:reject:2", "guest:promote:2"}; !reflect.DeepEqual(lastCard(bot), want) {
+		t.Errorf("card buttons = %q, want %q after promote_after letters", lastCard(bot), want)
+	}
+	if allowed, _ := handler.Access.Get(wizardUser); !allowed {
+		t.Fatalf("guest was not given access")
+	}
+	if sender.sent != 3 || len(handler.guestRequests) != 0 {
+		t.Errorf("sent %d letters with %d waiting for approval, want all 3 sent", sender.sent, len(handler.guestRequests))
+	}
+}
+
+func TestGuestLimitedToWizard(t *testing.T) {
+	_, bot, _ := runGuest(t, textAction("/history"), fileAction("Отчёт"), tapAction("confirm:later"))
+	if got := strings.Count(bot.texts(), GUEST_NOTE); got != 2 {
+		t.Errorf("guest note shown %d times, want for the command and the file:\n%s", got, bot.texts())
+	}
+	if !strings.Contains(bot.texts(), "Нет доступа.") {
+		t.Errorf("scheduling was not refused:\n%s", bot.texts())
+	}
+
+	deny := textAction("/deny 5")
+	update := deny.update()
+	update.Message.From.ID, update.Message.Chat.ID = guestAdmin, guestAdmin
+	deny.update = func() tgbotapi.Update { return update }
+	_, bot, _ = runGuest(t, deny, textAction("/start"))
+	if !strings.Contains(bot.texts(), "нет доступа") {
+		t.Errorf("denied user was let in as a guest:\n%s", bot.texts())
+	}
+}
@@ -0,0 +1,535 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// BotAPI is the part of the Telegram Bot API the handlers use. *tgbotapi.BotAPI
+// implements it; tests use a fake that keeps what was sent in memory.
+type BotAPI interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error)
+}
+
+// Handler processes updates from Telegram: the commands, the inline buttons and
+// the letter wizard. Replies go through bot, letters through sender and users'
+// data is kept in the stores.
+type Handler struct {
+	bot     BotAPI
+	secrets *Secrets
+	*Stores
+	*shared
+}
+
+// shared is what a Handler and the snapshots taken of it have in common: the
+// provider, which /reload may replace, and what the bot keeps in memory between
+// updates. The latter is lost on restart.
+type shared struct {
+	sender EmailSender // Guarded by configMu
+
+	// Offers to email a received document, by the ID in their buttons
+	pendingFilesMu sync.Mutex
+	pendingFiles   map[int64]*PendingFile
+	pendingFileSeq int64
+	// Letters of assistants waiting for the manager's approval
+	behalfMu       sync.Mutex
+	behalfRequests map[int64]*BehalfRequest
+	behalfSeq      int64
+	// Broadcasts waiting for confirmation, and a count of those being sent, so
+	// shutdown can wait for their reports
+	broadcastMu       sync.Mutex
+	broadcasts        map[int64]*pendingBroadcast
+	broadcastSeq      int64
+	runningBroadcasts sync.WaitGroup
+	// Letters and invitations of guests waiting for an administrator's approval
+	guestMu       sync.Mutex
+	guestRequests map[int64]*GuestRequest
+	guestSeq      int64
+	// History purges waiting for confirmation
+	purgeMu  sync.Mutex
+	purges   map[int64]*pendingPurge
+	purgeSeq int64
+	// Uploaded data archives waiting for confirmation
+	dataImportMu  sync.Mutex
+	dataImports   map[int64]*pendingDataImport
+	dataImportSeq int64
+	// The latest status message of each chat, by chat ID
+	statusMu   sync.Mutex
+	lastStatus map[int64]statusMessage
+	// Follow-up reminder offers, by the ID in their buttons
+	followUpsMu sync.Mutex
+	followUps   map[int64]*FollowUp
+	followUpSeq int64
+	// One-tap retry offers for rejected recipients, by the ID in their buttons
+	failedSendsMu  sync.Mutex
+	failedSends    map[int64]*FailedSend
+	failedSendsSeq int64
+	// Imported templates whose name is taken, until the user chooses to replace
+	// the old one or keep both
+	pendingImportsMu sync.Mutex
+	pendingImports   map[int64]Template
+	// The last letter each user sent, for /savetemplate after sending
+	lastComposedMu sync.Mutex
+	lastComposed   map[int64]Template
+}
+
+// NewHandler creates a Handler replying through bot, sending letters through
+// sender and keeping users' data in stores.
+func NewHandler(bot BotAPI, sender EmailSender, secrets *Secrets, stores *Stores) *Handler {
+	return &Handler{bot: bot, secrets: secrets, Stores: stores, shared: &shared{
+		sender:         sender,
+		pendingFiles:   make(map[int64]*PendingFile),
+		behalfRequests: make(map[int64]*BehalfRequest),
+		broadcasts:     make(map[int64]*pendingBroadcast),
+		guestRequests:  make(map[int64]*GuestRequest),
+		purges:         make(map[int64]*pendingPurge),
+		dataImports:    make(map[int64]*pendingDataImport),
+		lastStatus:     make(map[int64]statusMessage),
+		followUps:      make(map[int64]*FollowUp),
+		failedSends:    make(map[int64]*FailedSend),
+		pendingImports: make(map[int64]Template),
+		lastComposed:   make(map[int64]Template),
+	}}
+}
+
+// snapshot returns a copy of the handler with the settings as they are now, for
+// one update to work with. The snapshot shares the stores and the provider.
+func (h *Handler) snapshot() *Handler {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	secrets := *h.secrets
+	snapshot := *h
+	snapshot.secrets = &secrets
+	return &snapshot
+}
+
+// HandleUpdate processes a single update. Updates of one user are handled in order
+// by that user's worker, different users are handled concurrently.
+func (h *Handler) HandleUpdate(ctx context.Context, update tgbotapi.Update) {
+	// /reload changes the settings themselves, not the snapshot of this update
+	if update.Message != nil && update.Message.Command() == "reload" {
+		h.handleReloadCommand(update.Message)
+		return
+	}
+	// A reload applied meanwhile takes effect from the next update
+	h = h.snapshot()
+
+	bot := h.bot
+	if update.CallbackQuery != nil {
+		// Guests may only tap the buttons of the letter wizard
+		query := update.CallbackQuery
+		if !h.isAllowed(query.From.ID) && !(h.isGuest(query.From.ID) && guestCallbackAllowed(query.Data)) {
+			slog.Warn("Отклонено нажатие кнопки пользователем без доступа", "user_id", query.From.ID, "username", query.From.UserName)
+			// A guest tapping a button closed to guests is not an intruder
+			var chatID int64 // Buttons of inline mode messages have no chat
+			if query.Message != nil {
+				chatID = query.Message.Chat.ID
+			}
+			if h.isGuest(query.From.ID) || !h.noteTelegramProbe(query.From, chatID) {
+				bot.Request(tgbotapi.NewCallback(query.ID, "Нет доступа."))
+			}
+			return
+		}
+		h.handleCallback(ctx, update.CallbackQuery)
+		h.touchDraft(query.From.ID)
+		return
+	}
+	if update.Message == nil { // Ignore other non-message updates
+		return
+	}
+
+	userID := update.Message.From.ID
+	text := strings.TrimSpace(update.Message.Text)
+
+	ctx = h.updateLogAttrs(ctx, userID, update.Message.Chat.ID)
+	slog.InfoContext(ctx, "Получено сообщение", "text", text, "username", update.Message.From.UserName)
+	// Only allowed users get any further, the whitelist is kept by /allow and /deny.
+	// Guests only get to compose letters
+	if !h.isAllowed(userID) {
+		if !h.isGuest(userID) {
+			h.rejectUnauthorized(update.Message.From, update.Message.Chat.ID)
+			return
+		}
+		if !h.guestMessageAllowed(update.Message) {
+			bot.Send(newReply(update.Message, GUEST_NOTE+" Доступны только составление письма и приглашения: /start."))
+			return
+		}
+	}
+	h.announceUpdate(update.Message)
+
+	// A document with a caption outside of the wizard offers a one-tap send, an
+	// exported template or data archive is imported instead
+	if update.Message.Document != nil {
+		if state, exists := h.States.Get(userID); !exists || state.State == "initial" {
+			if isDataFile(update.Message.Document) {
+				h.importDataFile(ctx, update.Message)
+				return
+			}
+			if isTemplateFile(update.Message.Document) {
+				h.importTemplateFile(ctx, update.Message)
+				return
+			}
+			h.offerFileEmail(update.Message)
+			return
+		}
+	}
+
+	if h.handleCommand(ctx, update.Message) {
+		h.touchDraft(userID)
+		return
+	}
+	h.step(ctx, update.Message)
+}
+
+// handleCommand runs the command or the keyboard button in the message and reports
+// whether it was one; the draft in progress is left to step otherwise.
+func (h *Handler) handleCommand(ctx context.Context, message *tgbotapi.Message) bool {
+	bot, secrets := h.bot, h.secrets
+	userID := message.From.ID
+	text := strings.TrimSpace(message.Text)
+
+	// Handle the /start command to show the initial keyboard
+	if text == "/start" {
+		// Reset state for the user and show the initial keyboard
+		h.States.Update(userID, func(s *UserState) { *s = UserState{State: "initial"} }) // Set state to initial
+		msg := newReply(message, "Привет! Нажмите кнопку 'Новое Письмо', чтобы начать отправку.")
+		if h.isGuest(userID) {
+			msg.Text += "\n\n" + GUEST_NOTE
+		}
+		msg.ReplyMarkup = newInitialKeyboard() // Show the initial keyboard
+		bot.Send(msg)
+		return true // Process next update
+	}
+
+	// Handle the /cancel command and button to abort the draft at any step
+	if text == "/cancel" || text == CANCEL_BUTTON_TEXT {
+		h.States.Update(userID, func(s *UserState) { *s = UserState{State: "initial"} })
+		msg := newReply(message, "Письмо отменено. Нажмите 'Новое Письмо', чтобы начать заново.")
+		msg.ReplyMarkup = newInitialKeyboard()
+		bot.Send(msg)
+		return true
+	}
+
+	// Handle the /version command to show build info and the changelog
+	if message.Command() == "version" {
+		handleVersionCommand(bot, message)
+		return true
+	}
+
+	// Handle the address book commands
+	switch message.Command() {
+	case "contacts":
+		h.handleContactsCommand(message)
+		return true
+	case "addcontact":
+		h.handleAddContactCommand(message)
+		return true
+	case "delcontact":
+		h.handleDeleteContactCommand(message)
+		return true
+	}
+
+	// Handle the template commands
+	switch message.Command() {
+	case "templates":
+		h.handleTemplatesCommand(message)
+		return true
+	case "savetemplate":
+		h.handleSaveTemplateCommand(message)
+		return true
+	case "deltemplate":
+		h.handleDeleteTemplateCommand(message)
+		return true
+	case "exporttemplate":
+		h.handleExportTemplateCommand(message)
+		return true
+	}
+
+	// Handle the /scheduled command to list and cancel letters waiting to be sent
+	if message.Command() == "scheduled" {
+		h.handleScheduledCommand(message)
+		return true
+	}
+
+	// Handle the history commands
+	switch message.Command() {
+	case "history":
+		h.handleHistoryCommand(message)
+		return true
+	case "search":
+		h.handleSearchCommand(message)
+		return true
+	case "resend":
+		h.handleResendCommand(ctx, message)
+		return true
+	case "status":
+		h.handleStatusCommand(ctx, message)
+		return true
+	}
+
+	// Handle the /onbehalf command to send the draft on preview for a manager's approval
+	if message.Command() == "onbehalf" {
+		h.handleOnBehalfCommand(message)
+		return true
+	}
+
+	// Handle the /recurring command to manage letters sent on a schedule
+	if message.Command() == "recurring" {
+		h.handleRecurringCommand(message)
+		return true
+	}
+
+	// Handle the /invite command to start composing a meeting invitation
+	if message.Command() == "invite" {
+		var state UserState
+		startInvite(bot, message, &state)
+		h.States.Update(userID, func(s *UserState) { *s = state })
+		return true
+	}
+
+	// Handle the /spamcheck command to test the draft in progress with mail-tester
+	if message.Command() == "spamcheck" {
+		state, _ := h.States.Get(userID)
+		h.startSpamCheck(ctx, message, state)
+		return true
+	}
+
+	// Handle the /notify command to choose how detailed status messages are
+	if message.Command() == "notify" {
+		h.handleNotifyCommand(message)
+		return true
+	}
+
+	// Handle the /probes command (admin only) to list access attempts since the last summary
+	if message.Command() == "probes" {
+		handleProbesCommand(bot, secrets, message)
+		return true
+	}
+
+	// Handle the /allow and /deny commands (admin only) to manage access to the bot
+	if command := message.Command(); command == "allow" || command == "deny" {
+		h.handleAccessCommand(message)
+		return true
+	}
+
+	// Handle the /exportdata command (admin only) to move the bot to another server
+	if message.Command() == "exportdata" {
+		h.handleExportDataCommand(message)
+		return true
+	}
+
+	// Handle the /queue command (admin only) to inspect and change the letters waiting to be sent
+	if message.Command() == "queue" {
+		h.handleQueueCommand(message)
+		return true
+	}
+
+	// Handle the /trace command (admin only) to find the send a leaked letter came from
+	if message.Command() == "trace" {
+		h.handleTraceCommand(message)
+		return true
+	}
+
+	// Handle the /fail command (admin only, staging) to force failure modes
+	if message.Command() == "fail" {
+		handleFailCommand(bot, secrets, message)
+		return true
+	}
+
+	// Handle the /raw command (admin only) to call the provider API directly
+	if message.Command() == "raw" {
+		handleRawCommand(ctx, bot, secrets, message)
+		return true
+	}
+
+	// Handle the /memstats command (admin only) to check memory use and buffer reuse
+	if message.Command() == "memstats" {
+		handleMemStatsCommand(bot, secrets, message)
+		return true
+	}
+
+	// Handle the /netstats command (admin only) to check connection reuse by the email providers
+	if message.Command() == "netstats" {
+		handleNetStatsCommand(bot, secrets, message)
+		return true
+	}
+
+	// Handle the admin commands for running the bot
+	switch message.Command() {
+	case "stats":
+		h.handleStatsCommand(message)
+		return true
+	case "users":
+		h.handleUsersCommand(message)
+		return true
+	case "broadcast":
+		h.handleBroadcastCommand(message)
+		return true
+	case "setlimit":
+		handleSetLimitCommand(bot, secrets, message)
+		return true
+	case "concurrency":
+		handleConcurrencyCommand(bot, secrets, message)
+		return true
+	case "reconcile":
+		h.handleReconcileCommand(ctx, message)
+		return true
+	}
+
+	// Handle the /checkdomain command (admin only) to check the BIMI setup of the sending domain
+	if message.Command() == "checkdomain" {
+		h.handleCheckDomainCommand(ctx, message)
+		return true
+	}
+
+	// Handle the /campaign command to report campaign statistics
+	if message.Command() == "campaign" {
+		handleCampaignCommand(ctx, bot, secrets, message)
+		return true
+	}
+	return false
+}
+
+// step advances the wizard by one message: it checks the text entered at the
+// current step, moves the draft on to the next one and saves it.
+func (h *Handler) step(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	userID := message.From.ID
+	text := strings.TrimSpace(message.Text)
+
+	// Retrieve user state, prompt /start if not found or if state is initial and text is not the button
+	state, exists := h.States.Get(userID)
+	if !exists || (state.State == "initial" && text != NEW_LETTER_BUTTON_TEXT && text != NEW_INVITE_BUTTON_TEXT) {
+		// If state doesn't exist, or if in initial state and received unexpected text
+		if !exists {
+			h.States.Update(userID, func(s *UserState) { *s = UserState{State: "initial"} })
+		}
+		msg := newReply(message, "Пожалуйста, начните с команды /start или нажмите 'Новое Письмо'.")
+		msg.ReplyMarkup = newInitialKeyboard() // Show the initial keyboard
+		bot.Send(msg)
+		return // Process next update
+	}
+
+	// Stickers, files outside the body step and the like carry no text, and an empty
+	// value would leave a required field blank
+	if text == "" && !(state.State == "await_body" && (message.Document != nil || message.Photo != nil)) {
+		bot.Send(newReply(message, "Пожалуйста, ответьте текстом."))
+		return
+	}
+
+	// State machine to guide the user through the email sending process
+	switch state.State {
+	case "initial":
+		// This case is now only reached if text is one of the buttons because of the check above
+		if text == NEW_INVITE_BUTTON_TEXT {
+			startInvite(bot, message, &state)
+			break
+		}
+		state.State = "await_recipient" // Transition to awaiting the recipient
+		msg := newReply(message, "Введите адрес получателя. Несколько адресов укажите через запятую.")
+		msg.ReplyMarkup = newRecipientKeyboard() // Replace the main keyboard with the recipient choice
+		bot.Send(msg)
+		h.offerContacts(message, userID)
+
+	case "await_recipient":
+		var reply string
+		if text == DEFAULT_RECIPIENT_BUTTON_TEXT {
+			state.Recipients = nil
+			reply = "Письмо уйдёт получателю по умолчанию."
+		} else {
+			recipients, err := h.resolveRecipients(userID, text)
+			if err != nil {
+				bot.Send(newReply(message, err.Error()))
+				return
+			}
+			state.Recipients = recipients
+			reply = "Получатели: " + strings.Join(recipients, ", ")
+		}
+		h.acceptRecipients(message, &state, reply)
+
+	case "await_cc", "await_bcc":
+		h.acceptCopies(message, userID, &state, text)
+
+	case "await_subject":
+		if err := validateField(FieldSubject, text); err != nil {
+			bot.Send(newReply(message, err.Error()))
+			return
+		}
+		state.Subject = text
+		acceptSubject(bot, message, &state)
+
+	case "await_body":
+		raw, entities := message.Text, message.Entities
+		if message.Document != nil || message.Photo != nil {
+			// A caption, if any, is taken as the letter text
+			raw, entities = message.Caption, message.CaptionEntities
+			text = strings.TrimSpace(raw)
+			if !addDraftAttachment(bot, secrets, message, &state) || text == "" {
+				break
+			}
+		}
+		if err := validateField(FieldBody, text); err != nil {
+			bot.Send(newReply(message, err.Error()))
+			return
+		}
+		state.Body = text
+		state.BodyHTML = ""
+		if state.BodyFormat != BODY_FORMAT_HTML {
+			state.BodyHTML = entitiesToHTML(raw, entities)
+		}
+		if state.Editing {
+			showPreview(bot, message, &state)
+			break
+		}
+		state.State = "await_sender"
+		bot.Send(newReply(message, "Укажите имя отправителя."))
+
+	case "await_sender":
+		if err := validateField(FieldSenderName, text); err != nil {
+			bot.Send(newReply(message, err.Error()))
+			return
+		}
+		state.SenderName = text
+		if len(secrets.TagRules) > 0 && !state.Editing {
+			promptTags(bot, secrets, message, &state)
+		} else {
+			showPreview(bot, message, &state)
+		}
+
+	case "await_placeholder":
+		h.acceptPlaceholder(message, userID, &state, text)
+
+	case "await_preheader":
+		if text == "-" {
+			text = ""
+		} else if err := validateField(FieldPreheader, text); err != nil {
+			bot.Send(newReply(message, err.Error()))
+			return
+		}
+		state.Preheader = text
+		showPreview(bot, message, &state)
+
+	case "await_schedule":
+		h.acceptSchedule(message, &state, text)
+
+	case "await_tags":
+		acceptTags(bot, secrets, message, &state, text)
+
+	case "await_confirm":
+		bot.Send(newReply(message, "Проверьте письмо и нажмите «Отправить», «Редактировать» или «Отмена» под предпросмотром."))
+
+	case "await_invite_title", "await_invite_time", "await_invite_duration", "await_invite_location":
+		h.handleInviteStep(ctx, message, &state, newInitialKeyboard())
+	}
+
+	// Persist the state changes made by the step above
+	state.Touched = time.Now()
+	h.States.Update(userID, func(s *UserState) { *s = state })
+}
@@ -0,0 +1,430 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeBot is a BotAPI that keeps what the handlers send in memory.
+type fakeBot struct {
+	mu     sync.Mutex
+	nextID int
+	sent   []tgbotapi.Chattable
+}
+
+func (b *fakeBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, c)
+	b.nextID++
+	message := tgbotapi.Message{MessageID: b.nextID, Chat: &tgbotapi.Chat{}}
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		message.Chat.ID, message.Text = m.ChatID, m.Text
+	}
+	return message, nil
+}
+
+func (b *fakeBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, c)
+	return &tgbotapi.APIResponse{Ok: true, Result: json.RawMessage("true")}, nil
+}
+
+func (b *fakeBot) GetFile(tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, errors.New("файлы недоступны")
+}
+
+// texts returns the text of everything sent: messages, edits, captions and button answers.
+func (b *fakeBot) texts() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var texts []string
+	for _, c := range b.sent {
+		switch c := c.(type) {
+		case tgbotapi.MessageConfig:
+			texts = append(texts, c.Text)
+		case tgbotapi.EditMessageTextConfig:
+			texts = append(texts, c.Text)
+		case tgbotapi.DocumentConfig:
+			texts = append(texts, c.Caption)
+		case tgbotapi.CallbackConfig:
+			texts = append(texts, c.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// handlerTransition is one step of the wizard: the update a user sends with their
+// draft at a given step, and what the bot does.
+type handlerTransition struct {
+	name    string
+	secrets *Secrets   // wizardSecrets if nil
+	from    *UserState // The draft before the update; nil when the user has none
+	action  wizardAction
+	want    string // The step after the update
+	reply   string // Part of what the bot answered
+	sent    int
+}
+
+// handlerTransitions lists a case for every way out of every step.
+func handlerTransitions() []handlerTransition {
+	tagged := wizardSecrets()
+	tagged.TagRules = map[string]TagRule{"Срочно": {SubjectPrefix: "[Срочно]"}}
+	draft := func(state string) UserState {
+		return UserState{State: state, Recipients: []string{"a@example.com"}, Subject: "Тема", Body: "Текст", SenderName: "Иван"}
+	}
+	editing := func(state string) UserState {
+		s := draft(state)
+		s.Editing = true
+		return s
+	}
+	meetingAt := time.Now().Add(48 * time.Hour)
+
+	return []handlerTransition{
+		{name: "no draft", action: textAction("Привет"), want: "initial", reply: "начните с команды /start"},
+		{name: "start", from: &UserState{State: "await_body"}, action: textAction("/start"), want: "initial", reply: "Привет!"},
+		{name: "cancel", from: &UserState{State: "await_subject"}, action: textAction(CANCEL_BUTTON_TEXT), want: "initial", reply: "Письмо отменено"},
+		{name: "no text", from: &UserState{State: "await_subject"}, action: textAction(""), want: "await_subject", reply: "ответьте текстом"},
+
+		{name: "initial, other text", from: &UserState{State: "initial"}, action: textAction("Привет"), want: "initial", reply: "начните с команды /start"},
+		{name: "initial, new letter", from: &UserState{State: "initial"}, action: textAction(NEW_LETTER_BUTTON_TEXT), want: "await_recipient", reply: "Введите адрес получателя"},
+		{name: "initial, new invite", from: &UserState{State: "initial"}, action: textAction(NEW_INVITE_BUTTON_TEXT), want: "await_invite_title", reply: "Введите название встречи"},
+
+		{name: "recipient", from: &UserState{State: "await_recipient"}, action: textAction("a@example.com"), want: "await_cc", reply: "Получатели: a@example.com"},
+		{name: "recipient, default", from: &UserState{State: "await_recipient"}, action: textAction(DEFAULT_RECIPIENT_BUTTON_TEXT), want: "await_cc", reply: "получателю по умолчанию"},
+		{name: "recipient, invalid", from: &UserState{State: "await_recipient"}, action: textAction("not an address"), want: "await_recipient", reply: "Некорректный адрес"},
+		{name: "recipient, template", from: &UserState{State: "await_recipient", Template: "Отчёт", Subject: "Тема", Body: "Текст"}, action: textAction("a@example.com"), want: "await_cc", reply: "Кому отправить копию"},
+		{name: "recipient, editing", from: ptr(editing("await_recipient")), action: textAction("b@example.com"), want: "await_cc", reply: "Кому отправить копию"},
+
+		{name: "cc", from: ptr(draft("await_cc")), action: textAction("c@example.com"), want: "await_bcc", reply: "Копия: c@example.com"},
+		{name: "cc, skipped", from: ptr(draft("await_cc")), action: tapAction("copies:cc"), want: "await_bcc", reply: "Кому отправить скрытую копию"},
+		{name: "cc, removed", from: &UserState{State: "await_cc", Recipients: []string{"a@example.com"}, CC: []string{"c@example.com"}}, action: textAction("-"), want: "await_bcc", reply: "Без копии"},
+		{name: "cc, invalid", from: ptr(draft("await_cc")), action: textAction("not an address"), want: "await_cc", reply: "Некорректный адрес"},
+		{name: "cc, too many", from: &UserState{State: "await_cc", Recipients: make([]string, MAX_RECIPIENTS)}, action: textAction("c@example.com"), want: "await_cc", reply: "вместе с копиями"},
+		{name: "cc, other button", from: ptr(draft("await_cc")), action: tapAction("copies:bcc"), want: "await_cc", reply: "Этот шаг уже пройден"},
+
+		{name: "bcc", from: &UserState{State: "await_bcc", Recipients: []string{"a@example.com"}}, action: textAction("d@example.com"), want: "await_subject", reply: "Скрытая копия: d@example.com"},
+		{name: "bcc, skipped", from: &UserState{State: "await_bcc", Recipients: []string{"a@example.com"}}, action: tapAction("copies:bcc"), want: "await_subject", reply: "Введите тему письма"},
+		{name: "bcc, template", from: &UserState{State: "await_bcc", Template: "Отчёт", Subject: "Тема", Body: "Текст"}, action: tapAction("copies:bcc"), want: "await_sender", reply: "Укажите имя отправителя"},
+		{name: "bcc, editing", from: ptr(editing("await_bcc")), action: textAction("d@example.com"), want: "await_confirm", reply: "Скрытая копия: d@example.com"},
+
+		{name: "subject", from: &UserState{State: "await_subject"}, action: textAction("Тема"), want: "await_body", reply: "Введите текст письма"},
+		{name: "subject, editing", from: ptr(editing("await_subject")), action: textAction("Новая тема"), want: "await_confirm", reply: "Тема: Новая тема"},
+
+		{name: "body", from: &UserState{State: "await_body", Subject: "Тема"}, action: textAction("Текст"), want: "await_sender", reply: "Укажите имя отправителя"},
+		{name: "body, file", from: &UserState{State: "await_body", Subject: "Тема"}, action: fileAction(""), want: "await_body", reply: "Файл «report.pdf» приложен"},
+		{name: "body, file with text", from: &UserState{State: "await_body", Subject: "Тема"}, action: fileAction("Текст"), want: "await_sender", reply: "Укажите имя отправителя"},
+		{name: "body, editing", from: ptr(editing("await_body")), action: textAction("Новый текст"), want: "await_confirm", reply: "Новый текст"},
+
+		{name: "sender", from: &UserState{State: "await_sender", Subject: "Тема", Body: "Текст"}, action: textAction("Иван"), want: "await_confirm", reply: "Проверьте письмо перед отправкой"},
+		{name: "sender, tags", secrets: tagged, from: &UserState{State: "await_sender", Subject: "Тема", Body: "Текст"}, action: textAction("Иван"), want: "await_tags", reply: "Отметьте метки"},
+		{name: "sender, tags, editing", secrets: tagged, from: ptr(editing("await_sender")), action: textAction("Пётр"), want: "await_confirm", reply: "Отправитель: Пётр"},
+
+		{name: "tags", secrets: tagged, from: ptr(draft("await_tags")), action: textAction("срочно"), want: "await_confirm", reply: "Метки: Срочно"},
+		{name: "tags, none", secrets: tagged, from: ptr(draft("await_tags")), action: textAction("-"), want: "await_confirm", reply: "Проверьте письмо перед отправкой"},
+		{name: "tags, unknown", secrets: tagged, from: ptr(draft("await_tags")), action: textAction("Важно"), want: "await_tags", reply: "Неизвестная метка «Важно»"},
+		{name: "tags, done", secrets: tagged, from: ptr(draft("await_tags")), action: tapAction("tags:done"), want: "await_confirm", reply: "Проверьте письмо перед отправкой"},
+
+		{name: "placeholder", from: &UserState{State: "await_placeholder", Template: "Отчёт", Subject: "{{месяц}}", Body: "{{имя}}", Placeholders: []string{"месяц", "имя"}}, action: textAction("май"), want: "await_placeholder", reply: "Введите значение поля «имя»"},
+		{name: "placeholder, last", from: &UserState{State: "await_placeholder", Template: "Отчёт", Subject: "Отчёт за {{месяц}}", Body: "Текст", Placeholders: []string{"месяц"}}, action: textAction("май"), want: "await_recipient", reply: "Тема: Отчёт за май"},
+
+		{name: "preheader", from: ptr(editing("await_preheader")), action: textAction("Коротко о главном"), want: "await_confirm", reply: "Коротко о главном"},
+		{name: "preheader, removed", from: ptr(editing("await_preheader")), action: textAction("-"), want: "await_confirm", reply: "Проверьте письмо перед отправкой"},
+
+		{name: "schedule", from: ptr(draft("await_schedule")), action: textAction(time.Now().Add(2 * time.Hour).Format(SCHEDULE_TIME_LAYOUT)), want: "initial", reply: "будет отправлено"},
+		{name: "schedule, invalid", from: ptr(draft("await_schedule")), action: textAction("когда-нибудь"), want: "await_schedule", reply: "Не удалось разобрать время"},
+		{name: "schedule, button", from: ptr(draft("await_schedule")), action: tapAction("schedule:in:60"), want: "initial", reply: "будет отправлено"},
+
+		{name: "confirm, text", from: ptr(draft("await_confirm")), action: textAction("Отправить"), want: "await_confirm", reply: "нажмите «Отправить»"},
+		{name: "confirm, send", from: ptr(draft("await_confirm")), action: tapAction("confirm:send"), want: "initial", sent: 1},
+		{name: "confirm, cancel", from: ptr(draft("await_confirm")), action: tapAction("confirm:cancel"), want: "initial", reply: "Письмо отменено"},
+		{name: "confirm, later", from: ptr(draft("await_confirm")), action: tapAction("confirm:later"), want: "await_schedule"},
+		{name: "confirm, keep as typed", from: ptr(draft("await_confirm")), action: tapAction("confirm:normalize"), want: "await_confirm", reply: "Письмо уйдёт как введено"},
+		{name: "confirm, edit subject", from: ptr(draft("await_confirm")), action: tapAction("confirm:edit_subject"), want: "await_subject", reply: "Введите новую тему письма"},
+		{name: "confirm, edit tags", secrets: tagged, from: ptr(draft("await_confirm")), action: tapAction("confirm:edit_tags"), want: "await_tags", reply: "Отметьте метки"},
+		{name: "confirm, stale button", from: ptr(draft("await_subject")), action: tapAction("confirm:send"), want: "await_subject", reply: "уже отправлено или отменено"},
+
+		{name: "invite title", from: &UserState{State: "await_invite_title"}, action: textAction("Планёрка"), want: "await_invite_time", reply: "Когда начинается встреча"},
+		{name: "invite time", from: &UserState{State: "await_invite_time", Subject: "Планёрка"}, action: textAction(meetingAt.Format(INVITE_TIME_LAYOUT)), want: "await_invite_duration", reply: "Сколько минут"},
+		{name: "invite time, invalid", from: &UserState{State: "await_invite_time", Subject: "Планёрка"}, action: textAction("завтра"), want: "await_invite_time", reply: "Не удалось разобрать дату"},
+		{name: "invite duration", from: &UserState{State: "await_invite_duration", Subject: "Планёрка"}, action: textAction("30"), want: "await_invite_location", reply: "Где пройдёт встреча"},
+		{name: "invite duration, invalid", from: &UserState{State: "await_invite_duration", Subject: "Планёрка"}, action: textAction("полчаса"), want: "await_invite_duration", reply: "целым числом минут"},
+		{name: "invite location", from: &UserState{State: "await_invite_location", Subject: "Планёрка", Invite: Invite{Start: meetingAt, Duration: 30 * time.Minute}}, action: textAction("-"), want: "initial", reply: "Хотите отправить ещё одно письмо?", sent: 1},
+	}
+}
+
+func TestHandlerTransitions(t *testing.T) {
+	for _, tc := range handlerTransitions() {
+		t.Run(tc.name, func(t *testing.T) {
+			secrets := tc.secrets
+			if secrets == nil {
+				secrets = wizardSecrets()
+			}
+			steps := []string{"  " + tc.action.name}
+			handler, bot, sender := newWizardHandler(t, secrets, &steps)
+			if tc.from != nil {
+				handler.States.Update(wizardUser, func(s *UserState) { *s = *tc.from })
+			}
+
+			handler.HandleUpdate(context.Background(), tc.action.update())
+
+			if state, _ := handler.States.Get(wizardUser); state.State != tc.want {
+				t.Errorf("step = %q, want %q; the bot answered:\n%s", state.State, tc.want, bot.texts())
+			}
+			if !strings.Contains(bot.texts(), tc.reply) {
+				t.Errorf("the bot answered:\n%s\nwant it to contain %q", bot.texts(), tc.reply)
+			}
+			if sender.sent != tc.sent {
+				t.Errorf("sent %d letters, want %d", sender.sent, tc.sent)
+			}
+		})
+	}
+}
+
+// TestHandlerTransitionsCoverEveryStep keeps handlerTransitions in step with the
+// wizard: a new step must come with cases for it.
+func TestHandlerTransitionsCoverEveryStep(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, tc := range handlerTransitions() {
+		if tc.from != nil {
+			covered[tc.from.State] = true
+		}
+	}
+	for state := range wizardStates {
+		if state != "" && !covered[state] {
+			t.Errorf("no transition case starts at %q", state)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// sendLetter takes the wizard from /start to a sent letter for the recipients.
+func sendLetter(handler *Handler, recipients, subject string) {
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction(recipients),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction(subject), textAction("Текст"), textAction("Иван"), tapAction("confirm:send"),
+	} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+}
+
+func TestRepliesQuoteTheMessage(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	handler.States.Update(wizardUser, func(s *UserState) { *s = UserState{State: "await_recipient"} })
+	handler.HandleUpdate(context.Background(), textAction("not an address").update())
+	if len(bot.sent) != 1 {
+		t.Fatalf("sent %d messages, want the refusal", len(bot.sent))
+	}
+	if reply := bot.sent[0].(tgbotapi.MessageConfig); reply.ReplyToMessageID != 1 || !reply.AllowSendingWithoutReply {
+		t.Errorf("reply %+v does not quote the message", reply.BaseChat)
+	}
+}
+
+func TestFieldRulesHoldTheStep(t *testing.T) {
+	defer func(saved map[Field][]Validator) { ruleValidators = saved }(ruleValidators)
+	err := registerFieldRules(map[Field][]FieldRule{
+		FieldSubject:    {{Pattern: `^\[ACME\]`, Message: "Тема должна начинаться с [ACME]."}},
+		FieldSenderName: {{Pattern: `^\S+$`, Message: "Имя одним словом."}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	handler.States.Update(wizardUser, func(s *UserState) { *s = UserState{State: "await_recipient"} })
+	for _, tc := range []struct {
+		action wizardAction
+		want   string
+		reply  string
+	}{
+		{textAction("a@example.com"), "await_cc", ""},
+		{tapAction("copies:cc"), "await_bcc", ""},
+		{tapAction("copies:bcc"), "await_subject", ""},
+		{textAction("Отчёт"), "await_subject", "Тема должна начинаться с [ACME]."},
+		{textAction("[ACME] Отчёт"), "await_body", ""},
+		{textAction("Текст"), "await_sender", ""},
+		{textAction("Иван Петров"), "await_sender", "Имя одним словом."},
+		{textAction("Иван"), "await_confirm", ""},
+	} {
+		handler.HandleUpdate(context.Background(), tc.action.update())
+		if state, _ := handler.States.Get(wizardUser); state.State != tc.want {
+			t.Fatalf("after %s: step %q, want %q; the bot answered:\n%s", tc.action.name, state.State, tc.want, bot.texts())
+		}
+		if !strings.HasSuffix(bot.texts(), tc.reply) {
+			t.Errorf("after %s the bot answered:\n%s\nwant %q", tc.action.name, bot.texts(), tc.reply)
+		}
+	}
+	if sender.sent != 0 {
+		t.Errorf("sent %d letters before confirmation", sender.sent)
+	}
+}
+
+func TestContactButtonsAndNames(t *testing.T) {
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	handler.HandleUpdate(context.Background(), textAction("/addcontact Аня Смирнова anya@example.com").update())
+	handler.HandleUpdate(context.Background(), textAction("/addcontact Боря bad-address").update())
+	if got := handler.Contacts.List(wizardUser); len(got) != 1 || got[0] != (Contact{Name: "Аня Смирнова", Email: "anya@example.com"}) {
+		t.Fatalf("contacts = %+v", got)
+	}
+	if !strings.Contains(bot.texts(), "Некорректный адрес: bad-address") {
+		t.Errorf("invalid contact was not refused:\n%s", bot.texts())
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/start").update())
+	handler.HandleUpdate(context.Background(), textAction(NEW_LETTER_BUTTON_TEXT).update())
+	if !strings.Contains(bot.texts(), "Или выберите из контактов") {
+		t.Fatalf("no contact buttons at the recipient step:\n%s", bot.texts())
+	}
+	handler.HandleUpdate(context.Background(), tapAction("contact:0").update())
+	if state, _ := handler.States.Get(wizardUser); state.State != "await_cc" || !slices.Equal(state.Recipients, []string{"anya@example.com"}) {
+		t.Errorf("after the contact button: %+v", state)
+	}
+	// A second tap comes after the step and changes nothing
+	handler.HandleUpdate(context.Background(), tapAction("contact:0").update())
+	if !strings.Contains(bot.texts(), "Получатель уже выбран") {
+		t.Errorf("stale contact button was not refused:\n%s", bot.texts())
+	}
+
+	// Names typed instead of addresses are expanded, case aside
+	sendLetter(handler, "аня смирнова, b@example.com", "Отчёт")
+	if sender.sent != 1 {
+		t.Fatalf("sent %d letters, want 1:\n%s", sender.sent, bot.texts())
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].Recipient != "anya@example.com,b@example.com" {
+		t.Errorf("history = %+v, want the contact's address", sent)
+	}
+}
+
+func TestFrequentSubjectsAreSuggested(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	for _, subject := range []string{"Отчёт", "Счёт", "Отчёт"} {
+		sendLetter(handler, "a@example.com", subject)
+	}
+	if got := handler.frequentSubjects(wizardUser); !slices.Equal(got, []string{"Отчёт", "Счёт"}) {
+		t.Fatalf("frequentSubjects = %q, want the most used first", got)
+	}
+
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"), tapAction("subject:1"),
+	} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	if state, _ := handler.States.Get(wizardUser); state.State != "await_body" || state.Subject != "Счёт" {
+		t.Errorf("after the subject button: %+v\nthe bot answered:\n%s", state, bot.texts())
+	}
+}
+
+func TestRetryRejectedRecipients(t *testing.T) {
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	sendLetter(handler, "a@example.com, reject@example.com", "Отчёт")
+	if !strings.Contains(bot.texts(), "Не принятые адреса: reject@example.com") {
+		t.Fatalf("rejected address was not reported:\n%s", bot.texts())
+	}
+
+	retry := tapAction(fmt.Sprintf("retry:%d", handler.failedSendsSeq))
+	handler.HandleUpdate(context.Background(), retry.update())
+	if sender.sent != 2 || sender.subjects[1] != "Отчёт" {
+		t.Fatalf("sent %q, want the retry", sender.subjects)
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].Recipient != "reject@example.com" {
+		t.Errorf("history = %+v, want the retry to the rejected address only", sent)
+	}
+	// The address is rejected again: the old button is spent, a new one is offered
+	handler.HandleUpdate(context.Background(), retry.update())
+	if sender.sent != 2 || !strings.Contains(bot.texts(), "Повтор уже выполнен или устарел") {
+		t.Errorf("spent retry button sent again: %d letters", sender.sent)
+	}
+	if strings.Count(bot.texts(), "Не принятые адреса") != 2 {
+		t.Errorf("no new offer after the second rejection:\n%s", bot.texts())
+	}
+}
+
+func TestRetryOfferExpires(t *testing.T) {
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	sendLetter(handler, "a@example.com, reject@example.com", "Отчёт")
+	stale := handler.failedSendsSeq
+	handler.failedSendsMu.Lock()
+	handler.failedSends[stale].Expires = time.Now().Add(-time.Second)
+	handler.failedSendsMu.Unlock()
+
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("retry:%d", stale)).update())
+	if sender.sent != 1 || !strings.Contains(bot.texts(), "Кнопка повтора устарела") {
+		t.Errorf("expired retry button: %d letters sent\n%s", sender.sent, bot.texts())
+	}
+
+	// An offer nobody tapped is dropped when the next one is made
+	sendLetter(handler, "reject@example.com", "Отчёт")
+	handler.failedSendsMu.Lock()
+	handler.failedSends[handler.failedSendsSeq].Expires = time.Now().Add(-time.Second)
+	handler.failedSendsMu.Unlock()
+	sendLetter(handler, "reject@example.com", "Отчёт")
+	handler.failedSendsMu.Lock()
+	defer handler.failedSendsMu.Unlock()
+	if _, kept := handler.failedSends[handler.failedSendsSeq-1]; kept || handler.failedSends[handler.failedSendsSeq] == nil {
+		t.Errorf("offers %v, want the expired one swept", handler.failedSends)
+	}
+}
+
+func TestAllowAndDeny(t *testing.T) {
+	resetProbes(t, 10)
+	secrets := wizardSecrets()
+	secrets.AllowedUserIDs = []int64{wizardUser}
+	secrets.AdminUserIDs = []int64{reloadAdmin}
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, secrets, &steps)
+	asAdmin := func(text string) {
+		update := textAction(text).update()
+		update.Message.From.ID, update.Message.Chat.ID = reloadAdmin, reloadAdmin
+		handler.HandleUpdate(context.Background(), update)
+	}
+
+	asAdmin("/deny 5")
+	handler.HandleUpdate(context.Background(), textAction("/start").update())
+	if !strings.Contains(bot.texts(), "нет доступа") || strings.Contains(bot.texts(), "Привет!") {
+		t.Errorf("denied user was let in:\n%s", bot.texts())
+	}
+	asAdmin("/deny 9")
+	if !strings.Contains(bot.texts(), "Администраторам нельзя закрыть доступ") || !handler.isAllowed(reloadAdmin) {
+		t.Errorf("an admin was denied access")
+	}
+	asAdmin("/allow 5")
+	handler.HandleUpdate(context.Background(), textAction("/start").update())
+	if !strings.Contains(bot.texts(), "Привет!") {
+		t.Errorf("allowed user was refused:\n%s", bot.texts())
+	}
+
+	// Only admins decide
+	handler.HandleUpdate(context.Background(), textAction("/deny 5").update())
+	if !handler.isAllowed(wizardUser) {
+		t.Errorf("a user without admin rights changed access")
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	handler.HandleUpdate(context.Background(), textAction("/version").update())
+	if !strings.Contains(bot.texts(), buildInfo()) {
+		t.Errorf("/version answered:\n%s\nwant the build info", bot.texts())
+	}
+}
@@ -0,0 +1,329 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/testutil"
+)
+
+// harnessWait bounds how long a scenario step waits for the bot to react.
+const harnessWait = 5 * time.Second
+
+// harness runs the whole bot, from polling to provider calls, against an in-process
+// fake Bot API and a fake Unisender. Scenarios talk to it as a Telegram user would:
+//
+//	h := newHarness(t)
+//	h.send(user, "/start")
+//	h.waitForMessage(user, "Привет")
+type harness struct {
+	t        *testing.T
+	telegram *fakeTelegram
+	provider *fakeUnisender
+	secrets  *Secrets
+	handler  *Handler // For the stores behind the scenario
+}
+
+// newHarness starts the fakes and the bot with fresh in-memory stores. Everything
+// is stopped when the test ends.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	return newHarnessWith(t, func(source UpdateSource) UpdateSource { return source })
+}
+
+// newHarnessWith is newHarness with the update source wrapped, e.g. in a chaosSource.
+func newHarnessWith(t *testing.T, wrap func(UpdateSource) UpdateSource) *harness {
+	t.Helper()
+	telegram, bot := newTestBot(t)
+	provider := &fakeUnisender{responses: make(map[string][]string)}
+	providerServer := httptest.NewServer(provider)
+
+	// mailer.CallUnisender uses the default transport, so point it at the fake provider
+	testutil.Reroute(t, mailer.UNISENDER_API_URL, providerServer.URL+"/")
+
+	secrets := &Secrets{
+		BotToken:        "123:TEST",
+		UnisenderAPIKey: "test-key",
+		TargetEmail:     "target@example.com",
+		SenderEmail:     "sender@example.com",
+	}
+	sender, err := mailer.New(secrets.EmailProvider, secrets.UnisenderAPIKey, secrets.SMTP, secrets.Mailgun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(bot, sender, secrets, MemoryStores())
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := handler.serveUpdates(ctx, bot, wrap(&pollingSource{bot: bot})); err != nil {
+			t.Errorf("serveUpdates: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-done
+		providerServer.Close()
+	})
+	return &harness{t: t, telegram: telegram, provider: provider, secrets: secrets, handler: handler}
+}
+
+// newTestBot returns a bot on a fresh fake Telegram, for tests that call the
+// handlers directly instead of running the whole bot.
+func newTestBot(t testing.TB) (*fakeTelegram, *tgbotapi.BotAPI) {
+	t.Helper()
+	telegram := newFakeTelegram()
+	bot, _ := newBotOn(t, telegram)
+	return telegram, bot
+}
+
+// newBotOn returns a bot whose Bot API calls go to handler and the URL of the
+// server it runs. The server is stopped when the test ends.
+func newBotOn(t testing.TB, handler http.Handler) (*tgbotapi.BotAPI, string) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("123:TEST", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatalf("creating bot: %v", err)
+	}
+	return bot, server.URL
+}
+
+// send delivers a text message from the user to the bot.
+func (h *harness) send(userID int64, text string) {
+	message := &tgbotapi.Message{
+		From: &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat: &tgbotapi.Chat{ID: userID, Type: "private"},
+		Date: int(time.Now().Unix()),
+		Text: text,
+	}
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	}
+	h.telegram.push(tgbotapi.Update{Message: message})
+}
+
+// tap presses the inline button with the given text under a message the bot sent.
+func (h *harness) tap(userID int64, message sentMessage, buttonText string) {
+	h.t.Helper()
+	data, ok := message.button(buttonText)
+	if !ok {
+		h.t.Fatalf("no button %q under %q", buttonText, message.Text)
+	}
+	h.telegram.push(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		From: &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Message: &tgbotapi.Message{
+			MessageID: message.ID,
+			Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+			Text:      message.Text,
+		},
+		Data: data,
+	}})
+}
+
+// waitForMessage waits until the bot sends the chat a message containing text.
+func (h *harness) waitForMessage(chatID int64, text string) sentMessage {
+	h.t.Helper()
+	deadline := time.Now().Add(harnessWait)
+	for time.Now().Before(deadline) {
+		if message, ok := h.telegram.find(chatID, text); ok {
+			return message
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.t.Fatalf("bot did not send %q to chat %d; sent:\n%s", text, chatID, h.telegram.transcript(chatID))
+	return sentMessage{}
+}
+
+// sentMessage is a message the bot sent through the fake Bot API.
+type sentMessage struct {
+	ID     int
+	ChatID int64
+	Text   string
+	Markup string // Raw reply_markup JSON
+	seen   bool   // Already returned by find, so steps match new messages only
+}
+
+// button returns the callback data of the inline button with the given text.
+func (m sentMessage) button(text string) (string, bool) {
+	var markup tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(m.Markup), &markup); err != nil {
+		return "", false
+	}
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if strings.Contains(button.Text, text) && button.CallbackData != nil {
+				return *button.CallbackData, true
+			}
+		}
+	}
+	return "", false
+}
+
+// fakeTelegram is a minimal Bot API server: it serves queued updates to getUpdates
+// and records the messages the bot sends.
+type fakeTelegram struct {
+	mu       sync.Mutex
+	updates  []tgbotapi.Update
+	nextID   int
+	messages []sentMessage
+	arrived  chan struct{} // Signalled when an update is queued
+}
+
+func newFakeTelegram() *fakeTelegram {
+	return &fakeTelegram{arrived: make(chan struct{}, 1)}
+}
+
+// push queues an update for the bot.
+func (f *fakeTelegram) push(update tgbotapi.Update) {
+	f.mu.Lock()
+	f.nextID++
+	update.UpdateID = f.nextID
+	if update.Message != nil {
+		update.Message.MessageID = f.nextID
+	}
+	f.updates = append(f.updates, update)
+	f.mu.Unlock()
+	select {
+	case f.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// find returns the first message not returned before that was sent to the chat and contains text.
+func (f *fakeTelegram) find(chatID int64, text string) (sentMessage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.messages {
+		if m := &f.messages[i]; !m.seen && m.ChatID == chatID && strings.Contains(m.Text, text) {
+			m.seen = true
+			return *m, true
+		}
+	}
+	return sentMessage{}, false
+}
+
+// transcript lists everything sent to the chat, for failure messages.
+func (f *fakeTelegram) transcript(chatID int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for _, m := range f.messages {
+		if m.ChatID == chatID {
+			lines = append(lines, fmt.Sprintf("  #%d %q", m.ID, m.Text))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(1 << 20)
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch method {
+	case "getMe":
+		reply(w, tgbotapi.User{ID: 1, IsBot: true, UserName: "test_bot"})
+	case "getUpdates":
+		reply(w, f.waitForUpdates(r))
+	case "sendMessage", "editMessageText", "editMessageReplyMarkup":
+		reply(w, f.record(r))
+	default:
+		// answerCallbackQuery, deleteWebhook, pinChatMessage and the like
+		reply(w, true)
+	}
+}
+
+// waitForUpdates returns the updates after the requested offset, waiting briefly
+// for new ones like a long poll would.
+func (f *fakeTelegram) waitForUpdates(r *http.Request) []tgbotapi.Update {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	for attempt := 0; attempt < 2; attempt++ {
+		f.mu.Lock()
+		var pending []tgbotapi.Update
+		for _, update := range f.updates {
+			if update.UpdateID >= offset {
+				pending = append(pending, update)
+			}
+		}
+		f.mu.Unlock()
+		if len(pending) > 0 {
+			return pending
+		}
+		select {
+		case <-f.arrived:
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}
+	return []tgbotapi.Update{}
+}
+
+// record stores a sent or edited message and returns it as the Bot API would.
+func (f *fakeTelegram) record(r *http.Request) tgbotapi.Message {
+	chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := f.nextID
+	if edited, err := strconv.Atoi(r.FormValue("message_id")); err == nil {
+		id = edited
+	}
+	f.messages = append(f.messages, sentMessage{ID: id, ChatID: chatID, Text: r.FormValue("text"), Markup: r.FormValue("reply_markup")})
+	return tgbotapi.Message{MessageID: id, Chat: &tgbotapi.Chat{ID: chatID}, Text: r.FormValue("text")}
+}
+
+// reply writes a successful Bot API response.
+func reply(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+// fakeUnisender answers API methods with scripted responses, in order.
+type fakeUnisender struct {
+	mu        sync.Mutex
+	responses map[string][]string
+	calls     []url.Values
+}
+
+// respond queues the raw JSON response for the next call of the method.
+func (f *fakeUnisender) respond(method, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[method] = append(f.responses[method], body)
+}
+
+// requests returns the parameters of every call made so far.
+func (f *fakeUnisender) requests() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.calls...)
+}
+
+func (f *fakeUnisender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	method := strings.Trim(r.URL.Path, "/")
+	f.mu.Lock()
+	f.calls = append(f.calls, r.PostForm)
+	queue := f.responses[method]
+	body := `{"error":"unexpected call","code":"unexpected"}`
+	if len(queue) > 0 {
+		body, f.responses[method] = queue[0], queue[1:]
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, body)
+}
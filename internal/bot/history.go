@@ -0,0 +1,593 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/mailer"
+)
+
+const (
+	// SUBJECT_SUGGESTIONS is how many frequent subjects are offered at the subject step.
+	SUBJECT_SUGGESTIONS = 5
+	// SUBJECT_HISTORY_WINDOW is how many recent emails the suggestions are computed from.
+	SUBJECT_HISTORY_WINDOW = 50
+	// HISTORY_PAGE_SIZE is how many emails one page of /history shows.
+	HISTORY_PAGE_SIZE = 10
+)
+
+// Outcomes of a send attempt recorded in the history.
+const (
+	HISTORY_SENT    = "sent"    // Accepted for every recipient
+	HISTORY_PARTIAL = "partial" // Some recipients were rejected
+	HISTORY_FAILED  = "failed"  // Nothing was accepted
+)
+
+// SentEmail is an entry of the sent-mail history: one send attempt with what is
+// needed to send the letter again. Entries written before attempts were recorded
+// have only the first five fields and were all sent.
+type SentEmail struct {
+	ID        uint64    `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	SentAt    time.Time `json:"sent_at"`
+
+	CC  []string `json:"cc,omitempty"`  // Copies listed in the letter
+	BCC []string `json:"bcc,omitempty"` // Blind copies
+
+	Status     string `json:"status,omitempty"`     // HISTORY_SENT, HISTORY_PARTIAL or HISTORY_FAILED
+	MessageID  string `json:"message_id,omitempty"` // Provider IDs of the accepted copies
+	Error      string `json:"error,omitempty"`      // Why the attempt failed or which recipients were rejected
+	Body       string `json:"body,omitempty"`       // Body as sent, with the preheader
+	SenderName string `json:"sender_name,omitempty"`
+	// Attachments are the Telegram files of the letter, downloaded again by /resend.
+	// Incomplete marks letters with files the bot generated, which cannot be resent.
+	Attachments []DraftAttachment `json:"attachments,omitempty"`
+	Incomplete  bool              `json:"incomplete,omitempty"`
+	// AttachmentText is the text of the plain-text attachments, for /search
+	AttachmentText string `json:"attachment_text,omitempty"`
+	// OnBehalfOf is the manager who approved the letter their assistant sent as UserID
+	OnBehalfOf int64  `json:"on_behalf_of,omitempty"`
+	ApprovedBy int64  `json:"approved_by,omitempty"` // Administrator who approved the letter of a guest
+	Username   string `json:"username,omitempty"`    // Telegram username of UserID when known
+	// Anonymized marks entries whose contents and senders were erased by /history purge
+	Anonymized bool `json:"anonymized,omitempty"`
+	// Important is set when the send confirmation is pinned, for /history important
+	Important bool `json:"important,omitempty"`
+	// Fingerprint is the ID hidden in the body when fingerprint is set, for /trace
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// involves reports whether the letter is in the user's history, as its sender or
+// as the manager it was sent on behalf of.
+func (e SentEmail) involves(userID int64) bool {
+	return e.UserID == userID || e.OnBehalfOf != 0 && e.OnBehalfOf == userID
+}
+
+// HistoryStore keeps the emails sent through the bot.
+type HistoryStore interface {
+	// Record stores the entry and assigns its ID.
+	Record(entry *SentEmail)
+	// Recent returns up to limit of the user's emails, newest first.
+	Recent(userID int64, limit int) []SentEmail
+	// RecentImportant returns up to limit of the user's emails marked important, newest first.
+	RecentImportant(userID int64, limit int) []SentEmail
+	// MarkImportant marks the entry as important and reports whether it exists.
+	MarkImportant(id uint64) bool
+	// Get returns the entry with the given ID.
+	Get(id uint64) (SentEmail, bool)
+	// Since returns the emails of all users sent at or after the given time, newest first.
+	Since(from time.Time) []SentEmail
+	// Purge deletes or anonymizes the entries the purge selects and returns their
+	// number; with dryRun it only counts them.
+	Purge(purge HistoryPurge, dryRun bool) (int, error)
+	// FindUser returns the ID of the user with the given Telegram username, as last
+	// recorded in the history.
+	FindUser(username string) (int64, bool)
+	// Search returns up to limit of the user's emails that mention the query, newest first.
+	Search(userID int64, query string, limit int) []SentEmail
+}
+
+// memoryHistoryStore is a HistoryStore kept in process memory.
+type memoryHistoryStore struct {
+	mu      sync.Mutex
+	entries []SentEmail // In ID order, with gaps left by purges
+	lastID  uint64
+}
+
+func (m *memoryHistoryStore) Record(entry *SentEmail) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	entry.ID = m.lastID
+	m.entries = append(m.entries, *entry)
+}
+
+func (m *memoryHistoryStore) Recent(userID int64, limit int) []SentEmail {
+	return m.recent(limit, func(e SentEmail) bool { return e.involves(userID) })
+}
+
+func (m *memoryHistoryStore) RecentImportant(userID int64, limit int) []SentEmail {
+	return m.recent(limit, func(e SentEmail) bool { return e.Important && e.involves(userID) })
+}
+
+func (m *memoryHistoryStore) Search(userID int64, query string, limit int) []SentEmail {
+	return m.recent(limit, func(e SentEmail) bool { return e.involves(userID) && e.mentions(query) })
+}
+
+// recent returns up to limit of the entries match selects, newest first.
+func (m *memoryHistoryStore) recent(limit int, match func(SentEmail) bool) []SentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var recent []SentEmail
+	for i := len(m.entries) - 1; i >= 0 && len(recent) < limit; i-- {
+		if match(m.entries[i]) {
+			recent = append(recent, m.entries[i])
+		}
+	}
+	return recent
+}
+
+func (m *memoryHistoryStore) MarkImportant(id uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, found := slices.BinarySearchFunc(m.entries, id, func(e SentEmail, id uint64) int { return cmp.Compare(e.ID, id) })
+	if found {
+		m.entries[i].Important = true
+	}
+	return found
+}
+
+func (m *memoryHistoryStore) Get(id uint64) (SentEmail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, found := slices.BinarySearchFunc(m.entries, id, func(e SentEmail, id uint64) int { return cmp.Compare(e.ID, id) })
+	if !found {
+		return SentEmail{}, false
+	}
+	return m.entries[i], true
+}
+
+func (m *memoryHistoryStore) Since(from time.Time) []SentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var since []SentEmail
+	for i := len(m.entries) - 1; i >= 0 && !m.entries[i].SentAt.Before(from); i-- {
+		since = append(since, m.entries[i])
+	}
+	return since
+}
+
+// historyBucket holds JSON-encoded SentEmail entries keyed by their sequential ID.
+var historyBucket = []byte("history")
+
+// boltHistoryStore is a HistoryStore persisted in the bbolt database.
+type boltHistoryStore struct {
+	db *bolt.DB
+}
+
+// newBoltHistoryStore creates the history bucket in the given database.
+func newBoltHistoryStore(db *bolt.DB) (*boltHistoryStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы истории: %w", err)
+	}
+	return &boltHistoryStore{db: db}, nil
+}
+
+func (b *boltHistoryStore) Record(entry *SentEmail) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(binary.BigEndian.AppendUint64(nil, id), data)
+	})
+	if err != nil {
+		slog.Error("Ошибка записи истории отправки", "user_id", entry.UserID, "error", err)
+	}
+}
+
+func (b *boltHistoryStore) Recent(userID int64, limit int) []SentEmail {
+	return b.recent(userID, limit, func(e SentEmail) bool { return e.involves(userID) })
+}
+
+func (b *boltHistoryStore) RecentImportant(userID int64, limit int) []SentEmail {
+	return b.recent(userID, limit, func(e SentEmail) bool { return e.Important && e.involves(userID) })
+}
+
+func (b *boltHistoryStore) Search(userID int64, query string, limit int) []SentEmail {
+	return b.recent(userID, limit, func(e SentEmail) bool { return e.involves(userID) && e.mentions(query) })
+}
+
+// recent returns up to limit of the entries match selects, newest first; userID
+// only labels errors.
+func (b *boltHistoryStore) recent(userID int64, limit int, match func(SentEmail) bool) []SentEmail {
+	var recent []SentEmail
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// Keys are sequential IDs, so walking backwards yields the newest entries first
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(recent) < limit; k, v = c.Prev() {
+			var entry SentEmail
+			if err := json.Unmarshal(v, &entry); err != nil {
+				slog.Error("Ошибка чтения записи истории", "key", fmt.Sprintf("%x", k), "error", err)
+				continue
+			}
+			if match(entry) {
+				recent = append(recent, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения истории пользователя", "user_id", userID, "error", err)
+	}
+	return recent
+}
+
+func (b *boltHistoryStore) Get(id uint64) (SentEmail, bool) {
+	var entry SentEmail
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(historyBucket).Get(binary.BigEndian.AppendUint64(nil, id))
+		if found = data != nil; !found {
+			return nil
+		}
+		return json.Unmarshal(data, &entry)
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения записи истории", "history_id", id, "error", err)
+		return SentEmail{}, false
+	}
+	return entry, found
+}
+
+func (b *boltHistoryStore) MarkImportant(id uint64) bool {
+	var found bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		key := binary.BigEndian.AppendUint64(nil, id)
+		data := bucket.Get(key)
+		if found = data != nil; !found {
+			return nil
+		}
+		var entry SentEmail
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entry.Important = true
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("Ошибка отметки записи истории", "history_id", id, "error", err)
+		return false
+	}
+	return found
+}
+
+func (b *boltHistoryStore) Since(from time.Time) []SentEmail {
+	var since []SentEmail
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// IDs grow with the send time, so the walk stops at the first older entry
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var entry SentEmail
+			if err := json.Unmarshal(v, &entry); err != nil {
+				slog.Error("Ошибка чтения записи истории", "key", fmt.Sprintf("%x", k), "error", err)
+				continue
+			}
+			if entry.SentAt.Before(from) {
+				break
+			}
+			since = append(since, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения истории", "error", err)
+	}
+	return since
+}
+
+// recordSend stores a send attempt with its outcome in history and returns the entry.
+func recordSend(history HistoryStore, entry SentEmail, attachments []Attachment, result SendEmailResponse, err error) SentEmail {
+	entry.SentAt = time.Now()
+	for _, a := range attachments {
+		if a.FileID == "" {
+			entry.Incomplete = true
+			continue
+		}
+		entry.Attachments = append(entry.Attachments, DraftAttachment{FileID: a.FileID, FileName: a.Name})
+	}
+	entry.AttachmentText = attachmentText(attachments)
+
+	accepted, rejected := result.Split()
+	var ids []string
+	for _, r := range accepted {
+		if r.ID != "" {
+			ids = append(ids, string(r.ID))
+		}
+	}
+	entry.MessageID = strings.Join(ids, ", ")
+	switch {
+	case err != nil:
+		entry.Status, entry.Error = HISTORY_FAILED, err.Error()
+	case len(accepted) == 0 && len(rejected) > 0:
+		entry.Status, entry.Error = HISTORY_FAILED, mailer.DescribeRejected(rejected)
+	case len(rejected) > 0:
+		entry.Status, entry.Error = HISTORY_PARTIAL, mailer.DescribeRejected(rejected)
+	default:
+		entry.Status = HISTORY_SENT
+	}
+	history.Record(&entry)
+	return entry
+}
+
+// frequentSubjects returns the user's most frequent recent subjects, ties broken by recency.
+func (h *Handler) frequentSubjects(userID int64) []string {
+	counts := make(map[string]int)
+	var subjects []string // In order of last use, newest first
+	for _, entry := range h.History.Recent(userID, SUBJECT_HISTORY_WINDOW) {
+		if entry.Status == HISTORY_FAILED {
+			continue
+		}
+		if counts[entry.Subject] == 0 {
+			subjects = append(subjects, entry.Subject)
+		}
+		counts[entry.Subject]++
+	}
+	slices.SortStableFunc(subjects, func(a, b string) int { return counts[b] - counts[a] })
+	return subjects[:min(len(subjects), SUBJECT_SUGGESTIONS)]
+}
+
+// offerSubjects shows the user's frequent subjects as buttons at the subject step.
+func (h *Handler) offerSubjects(chatID, userID int64) {
+	bot := h.bot
+	subjects := h.frequentSubjects(userID)
+	if len(subjects) == 0 {
+		return
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, subject := range subjects {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(subject, fmt.Sprintf("subject:%d", i)),
+		))
+	}
+	msg := tgbotapi.NewMessage(chatID, "Или выберите одну из частых тем:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	bot.Send(msg)
+}
+
+// handleSubjectCallback uses the tapped suggestion as the subject of the draft.
+func (h *Handler) handleSubjectCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	state, exists := h.States.Get(userID)
+	if !exists || state.State != "await_subject" {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Тема уже выбрана."
+	}
+	subjects := h.frequentSubjects(userID)
+	i, err := strconv.Atoi(payload)
+	if err != nil || i < 0 || i >= len(subjects) {
+		return "Тема не найдена, введите её вручную."
+	}
+	if err := validateField(FieldSubject, subjects[i]); err != nil {
+		return err.Error()
+	}
+
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	state.Subject = subjects[i]
+	acceptSubject(bot, query.Message, &state)
+	h.States.Update(userID, func(s *UserState) { *s = state })
+	return ""
+}
+
+// historyStatus describes the outcome of an attempt for the /history list.
+func historyStatus(entry SentEmail) string {
+	switch entry.Status {
+	case HISTORY_FAILED:
+		return "ошибка"
+	case HISTORY_PARTIAL:
+		return "частично"
+	}
+	return "отправлено"
+}
+
+// historyLine describes an entry in the /history and /search lists.
+func historyLine(entry SentEmail, loc *time.Location) string {
+	line := fmt.Sprintf("#%d %s, %s: «%s» → %s", entry.ID, entry.SentAt.In(loc).Format(SCHEDULE_TIME_LAYOUT),
+		historyStatus(entry), entry.Subject, entry.Recipient)
+	if entry.MessageID != "" {
+		line += " (ID: " + entry.MessageID + ")"
+	}
+	if entry.Error != "" {
+		line += "\n    " + strings.ReplaceAll(entry.Error, "\n", "; ")
+	}
+	return line
+}
+
+// historyPage renders a page of the user's history with the paging buttons; with
+// important set, only the letters whose confirmation was pinned.
+func (h *Handler) historyPage(userID int64, page int, important bool) (string, *tgbotapi.InlineKeyboardMarkup) {
+	secrets := h.secrets
+	// One entry past the page tells whether there is an older page
+	recent, title, callback := h.History.Recent, "Отправленные письма", "history:%d"
+	if important {
+		recent, title, callback = h.History.RecentImportant, "Важные письма", "history:important:%d"
+	}
+	entries := recent(userID, (page+1)*HISTORY_PAGE_SIZE+1)
+	if page*HISTORY_PAGE_SIZE >= len(entries) {
+		switch {
+		case page > 0:
+			return "На этой странице писем нет.", nil
+		case important:
+			return "Важных писем нет. Чтобы отметить письмо, закрепите сообщение об его отправке кнопкой «Закрепить».", nil
+		default:
+			return "История пуста: писем ещё не было.", nil
+		}
+	}
+	older := len(entries) > (page+1)*HISTORY_PAGE_SIZE
+	entries = entries[page*HISTORY_PAGE_SIZE : min(len(entries), (page+1)*HISTORY_PAGE_SIZE)]
+
+	lines := []string{fmt.Sprintf("%s, страница %d:", title, page+1)}
+	for _, entry := range entries {
+		marker := ""
+		if entry.Important && !important {
+			marker = "📌 "
+		}
+		lines = append(lines, marker+historyLine(entry, secrets.Location()))
+	}
+	lines = append(lines, "", "Отправить письмо снова: /resend <номер>")
+	if !important {
+		lines = append(lines, "Только важные: /history important")
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("← Новее", fmt.Sprintf(callback, page-1)))
+	}
+	if older {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("Старее →", fmt.Sprintf(callback, page+1)))
+	}
+	if len(row) == 0 {
+		return strings.Join(lines, "\n"), nil
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(row)
+	return strings.Join(lines, "\n"), &markup
+}
+
+// handleHistoryCommand replies to /history with the first page of the user's history
+// and to /history important with the letters marked important; /history purge is
+// the cleanup for administrators.
+func (h *Handler) handleHistoryCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	args := strings.Fields(message.CommandArguments())
+	if len(args) > 0 && args[0] == "purge" {
+		h.handleHistoryPurge(message, args[1:])
+		return
+	}
+	important := len(args) > 0 && args[0] == "important"
+	text, markup := h.historyPage(message.From.ID, 0, important)
+	msg := newReply(message, text)
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	bot.Send(msg)
+}
+
+// handleHistoryCallback turns the /history message to another page, or confirms
+// or cancels a purge.
+func (h *Handler) handleHistoryCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	important := false
+	if action, arg, found := strings.Cut(payload, ":"); found {
+		switch action {
+		case "purge", "purge_cancel":
+			return h.handlePurgeCallback(query, action, arg)
+		case "important":
+			important, payload = true, arg
+		default:
+			return "Кнопка устарела."
+		}
+	}
+	page, err := strconv.Atoi(payload)
+	if err != nil || page < 0 || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	text, markup := h.historyPage(query.From.ID, page, important)
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ReplyMarkup = markup
+	bot.Send(edit)
+	return ""
+}
+
+// handleResendCommand sends a letter from the user's history again, to the same
+// recipients, and records the new attempt.
+func (h *Handler) handleResendCommand(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(message.CommandArguments()), "#"), 10, 64)
+	if err != nil {
+		bot.Send(newReply(message, "Укажите номер письма из /history: /resend <номер>"))
+		return
+	}
+	entry, found := h.History.Get(id)
+	if !found || !entry.involves(message.From.ID) {
+		bot.Send(newReply(message, fmt.Sprintf("Письма #%d нет в вашей истории.", id)))
+		return
+	}
+	if entry.Body == "" && len(entry.Attachments) == 0 || entry.Incomplete {
+		bot.Send(newReply(message, fmt.Sprintf("Письмо #%d нельзя отправить снова: его содержимое не сохранилось. Составьте его заново.", id)))
+		return
+	}
+	if !allowSend(bot, secrets, message, message.From) {
+		return
+	}
+
+	attachments, err := h.downloadDraftAttachments(ctx, message, entry.Attachments)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки вложений для повторной отправки", "history_id", id, "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось загрузить вложение: %v", err)))
+		return
+	}
+	h.sendComplianceProgress(newReply(message, fmt.Sprintf("Отправляю письмо #%d снова...", id)))
+	slog.InfoContext(ctx, "Повторная отправка письма", "history_id", id)
+	copies := Copies{CC: entry.CC, BCC: entry.BCC}
+	// The letter sent again is a send of its own, so it gets a fingerprint of its own
+	body, fingerprint := h.fingerprinted(entry.Body)
+	result, _, err := h.sendEmailCountingAttempts(ctx, entry.Recipient, copies, secrets.SenderEmail, entry.Subject, body, entry.SenderName, attachments...)
+	recordSend(h.History, SentEmail{
+		UserID:      entry.UserID,
+		Recipient:   entry.Recipient,
+		CC:          entry.CC,
+		BCC:         entry.BCC,
+		Subject:     entry.Subject,
+		Body:        body,
+		SenderName:  entry.SenderName,
+		OnBehalfOf:  entry.OnBehalfOf,
+		Username:    entry.Username,
+		Fingerprint: fingerprint,
+	}, attachments, result, err)
+	text, _ := describeSendResult(ctx, message.From.LanguageCode, result, err)
+	if addresses := describeRecipients(result, copies); addresses != "" {
+		text += "\n" + addresses
+	}
+	bot.Send(newReply(message, text))
+	if !h.offerRetryRejected(entry.UserID, message.Chat.ID, Email{
+		Subject:     entry.Subject,
+		Body:        body,
+		SenderName:  entry.SenderName,
+		Attachments: attachments,
+	}, result) {
+		releaseAttachments(attachments)
+	}
+}
@@ -0,0 +1,135 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/state"
+)
+
+func TestRecordSendStatus(t *testing.T) {
+	handler := NewHandler(&fakeBot{}, nil, &Secrets{}, MemoryStores())
+	accepted := SendEmailResponse{{Email: "a@example.com", ID: "m1"}}
+	mixed := SendEmailResponse{{Email: "a@example.com", ID: "m1"}, {Index: 1, Email: "b@example.com", Errors: []mailer.RecipientError{{Code: "invalid", Message: "rejected"}}}}
+	recordSend(handler.History, SentEmail{UserID: 1, Subject: "Сдано"}, []Attachment{{Name: "a.pdf", FileID: "f1"}}, accepted, nil)
+	recordSend(handler.History, SentEmail{UserID: 1, Subject: "Частично"}, nil, mixed, nil)
+	recordSend(handler.History, SentEmail{UserID: 1, Subject: "Ошибка"}, []Attachment{{Name: "invite.ics", Data: []byte("x")}}, nil, errors.New("timeout"))
+
+	var statuses []string
+	for _, entry := range handler.History.Recent(1, 10) {
+		statuses = append(statuses, entry.Status)
+	}
+	if want := []string{HISTORY_FAILED, HISTORY_PARTIAL, HISTORY_SENT}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %q, want %q", statuses, want)
+	}
+	sent, _ := handler.History.Get(1)
+	if sent.MessageID != "m1" || len(sent.Attachments) != 1 || sent.Attachments[0].FileID != "f1" || sent.Incomplete {
+		t.Errorf("sent entry = %+v", sent)
+	}
+	if failed, _ := handler.History.Get(3); failed.Error != "timeout" || !failed.Incomplete {
+		t.Errorf("failed entry = %+v", failed)
+	}
+	if subjects := handler.frequentSubjects(1); slices.Contains(subjects, "Ошибка") {
+		t.Errorf("failed letter suggested as a subject: %q", subjects)
+	}
+}
+
+func TestBoltHistoryGet(t *testing.T) {
+	db, err := state.Open(filepath.Join(t.TempDir(), "bot.db"), state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := newBoltHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &SentEmail{UserID: 1, Subject: "Отчёт", Body: "Текст", Status: HISTORY_SENT}
+	store.Record(entry)
+	if got, ok := store.Get(entry.ID); !ok || got.Body != "Текст" {
+		t.Errorf("Get(%d) = %+v, %v", entry.ID, got, ok)
+	}
+	if _, ok := store.Get(entry.ID + 1); ok {
+		t.Error("Get found a missing entry")
+	}
+	if !store.MarkImportant(entry.ID) || store.MarkImportant(entry.ID+1) {
+		t.Error("MarkImportant did not report which entries exist")
+	}
+	if got := store.RecentImportant(1, 10); len(got) != 1 || got[0].Body != "Текст" {
+		t.Errorf("RecentImportant = %+v", got)
+	}
+}
+
+func TestPinMarksLetterImportant(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт за неделю."), textAction("Иван"), tapAction("confirm:send"),
+	} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	handler.History.Record(&SentEmail{UserID: wizardUser, Recipient: "b@example.com", Subject: "Обычное"})
+	id := handler.History.Recent(wizardUser, 2)[1].ID
+
+	// Someone else's tap pins the message in a shared chat but does not mark the letter
+	other := tapAction(fmt.Sprintf("pin:%d", id)).update()
+	other.CallbackQuery.From.ID = wizardUser + 1
+	handler.HandleUpdate(context.Background(), other)
+	if got := handler.History.RecentImportant(wizardUser, 10); len(got) != 0 {
+		t.Fatalf("another user marked %+v", got)
+	}
+
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("pin:%d", id)).update())
+	handler.HandleUpdate(context.Background(), textAction("/history important").update())
+	texts := bot.texts()
+	if !strings.Contains(texts, "Важные письма, страница 1:") || !strings.Contains(texts, "«Отчёт»") || strings.Contains(texts, "«Обычное»") {
+		t.Errorf("/history important:\n%s", texts)
+	}
+	if text, _ := handler.historyPage(wizardUser, 0, false); !strings.Contains(text, fmt.Sprintf("📌 #%d ", id)) {
+		t.Errorf("/history does not mark the important letter:\n%s", text)
+	}
+}
+
+func TestHistoryPagingAndResend(t *testing.T) {
+	wizard, sender := runWizard(t, []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт за неделю."), textAction("Иван"), tapAction("confirm:send"),
+	})
+	for range HISTORY_PAGE_SIZE {
+		wizard.History.Record(&SentEmail{UserID: wizardUser, Recipient: "b@example.com", Subject: "Старое"})
+	}
+
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com"}
+	handler := NewHandler(bot, sender, secrets, wizard.Stores)
+
+	if text, markup := handler.historyPage(wizardUser, 0, false); markup == nil || len(markup.InlineKeyboard[0]) != 1 || strings.Contains(text, "«Отчёт»") {
+		t.Errorf("first page = %q, %+v; want only newer letters and a button to older ones", text, markup)
+	}
+	if text, _ := handler.historyPage(wizardUser, 1, false); !strings.Contains(text, "#1 ") || !strings.Contains(text, "«Отчёт» → a@example.com (ID: 1)") {
+		t.Errorf("second page = %q, want the sent letter with its ID", text)
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/resend 1").update())
+	if want := []string{"Отчёт", "Отчёт"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Errorf("sent %q, want %q", sender.subjects, want)
+	}
+	if latest := handler.History.Recent(wizardUser, 1); len(latest) != 1 || latest[0].Subject != "Отчёт" || latest[0].Status != HISTORY_SENT {
+		t.Errorf("resend not recorded: %+v", latest)
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/resend 2").update())
+	if _, ok := telegram.find(wizardUser, "содержимое не сохранилось"); !ok {
+		t.Errorf("letter without a body was resent:\n%s", telegram.transcript(wizardUser))
+	}
+}
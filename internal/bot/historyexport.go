@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/state"
+)
+
+// Formats of the export-history subcommand.
+const (
+	EXPORT_FORMAT_CSV   = "csv"   // One row per letter, for spreadsheets
+	EXPORT_FORMAT_JSONL = "jsonl" // One JSON object per line with every recorded field
+)
+
+// historyCSVHeader names the columns written by writeHistoryCSV.
+var historyCSVHeader = []string{
+	"id", "sent_at", "user_id", "username", "on_behalf_of", "recipient", "cc", "bcc",
+	"subject", "sender_name", "attachments", "status", "message_id", "error",
+}
+
+// writeHistoryCSV writes the entries as CSV with times in the bot's time zone.
+func writeHistoryCSV(w io.Writer, entries []SentEmail, loc *time.Location) error {
+	out := csv.NewWriter(w)
+	out.Write(historyCSVHeader)
+	for _, e := range entries {
+		names := make([]string, len(e.Attachments))
+		for i, a := range e.Attachments {
+			names[i] = a.FileName
+		}
+		var onBehalfOf string
+		if e.OnBehalfOf != 0 {
+			onBehalfOf = strconv.FormatInt(e.OnBehalfOf, 10)
+		}
+		out.Write([]string{
+			strconv.FormatUint(e.ID, 10), e.SentAt.In(loc).Format(time.RFC3339),
+			strconv.FormatInt(e.UserID, 10), e.Username, onBehalfOf,
+			e.Recipient, strings.Join(e.CC, ", "), strings.Join(e.BCC, ", "),
+			e.Subject, e.SenderName, strings.Join(names, ", "),
+			choose(e.Status, HISTORY_SENT), e.MessageID, e.Error,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeHistoryJSONL writes each entry as a JSON object on its own line.
+func writeHistoryJSONL(w io.Writer, entries []SentEmail) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	for _, e := range entries {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunExportHistory implements the export-history subcommand: it writes the send
+// history from the database of a stopped bot, oldest letter first. It returns the
+// process exit code.
+func RunExportHistory(args []string) int {
+	fs := flag.NewFlagSet("export-history", flag.ContinueOnError)
+	since := fs.String("since", "", "Письма, отправленные начиная с даты ГГГГ-ММ-ДД")
+	user := fs.String("user", "", "Письма пользователя: Telegram ID или @имя")
+	format := fs.String("format", EXPORT_FORMAT_CSV, "Формат: csv или jsonl")
+	output := fs.String("output", "", "Файл для выгрузки (по умолчанию стандартный вывод)")
+	overrides := config.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != EXPORT_FORMAT_CSV && *format != EXPORT_FORMAT_JSONL {
+		fmt.Fprintf(os.Stderr, "Неизвестный формат %q, допустимы %s и %s.\n", *format, EXPORT_FORMAT_CSV, EXPORT_FORMAT_JSONL)
+		return 2
+	}
+
+	secrets, err := overrides.Resolve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if choose(secrets.StorageBackend, STORAGE_BOLT) != STORAGE_BOLT {
+		fmt.Fprintln(os.Stderr, "История хранится в памяти бота, выгружать с диска нечего.")
+		return 1
+	}
+	// Audit entries go to the bot log, like those of history purge
+	redactor := NewRedactor(secretValues(secrets), !secrets.LogEmails)
+	level, err := config.ParseLogLevel(secrets.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	telegramLevel, err := secrets.TelegramLevel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logFile := setupLogging(secrets.LogFile, secrets.LogRotation, redactor, level, telegramLevel)
+	defer logFile.Close()
+
+	// The running bot holds the database lock, so this waits for lock_timeout and fails
+	db, err := state.Open(choose(secrets.StorageFile, DEFAULT_STORAGE_FILE), secrets.StorageOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\nОстановите бота перед выгрузкой истории.\n", err)
+		return 1
+	}
+	defer db.Close()
+	history, err := newBoltHistoryStore(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	loc := secrets.Location()
+	var from time.Time
+	if *since != "" {
+		if from, err = time.ParseInLocation(PURGE_DATE_LAYOUT, *since, loc); err != nil {
+			fmt.Fprintf(os.Stderr, "Не удалось разобрать дату %q. Формат: ГГГГ-ММ-ДД\n", *since)
+			return 2
+		}
+	}
+	userID, err := resolveHistoryUser(history, *user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	entries := slices.DeleteFunc(history.Since(from), func(e SentEmail) bool {
+		return userID != 0 && !e.involves(userID)
+	})
+	slices.Reverse(entries)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		// The history holds addresses and letters, so the file is private like the database
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ошибка создания файла выгрузки: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == EXPORT_FORMAT_JSONL {
+		err = writeHistoryJSONL(w, entries)
+	} else {
+		err = writeHistoryCSV(w, entries, loc)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка выгрузки истории: %v\n", err)
+		return 1
+	}
+	auditCLI("выгрузил историю (%s, с %s, пользователь %s): %d записей",
+		*format, choose(*since, "начала"), choose(*user, "все"), len(entries))
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Выгружено записей: %d.\n", len(entries))
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package bot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var exportEntries = []SentEmail{
+	{
+		ID: 1, UserID: 7, Username: "ivan", Recipient: "a@example.com,b@example.com", CC: []string{"boss@example.com"},
+		Subject: "Отчёт, май", SenderName: "Иван", SentAt: time.Date(2024, 5, 31, 21, 30, 0, 0, time.UTC),
+		Attachments: []DraftAttachment{{FileID: "f1", FileName: "отчёт.pdf"}}, MessageID: "m1",
+	},
+	{ID: 2, UserID: 8, OnBehalfOf: 7, Recipient: "c@example.com", Subject: "Счёт",
+		SentAt: time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC), Status: HISTORY_FAILED, Error: "timeout"},
+}
+
+func TestWriteHistoryCSV(t *testing.T) {
+	var out strings.Builder
+	moscow := time.FixedZone("MSK", 3*60*60)
+	if err := writeHistoryCSV(&out, exportEntries, moscow); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		"id,sent_at,user_id,username,on_behalf_of,recipient,cc,bcc,subject,sender_name,attachments,status,message_id,error",
+		`1,2024-06-01T00:30:00+03:00,7,ivan,,"a@example.com,b@example.com",boss@example.com,,"Отчёт, май",Иван,отчёт.pdf,sent,m1,`,
+		"2,2024-06-03T12:00:00+03:00,8,,7,c@example.com,,,Счёт,,,failed,,timeout",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("csv:\n%s", out.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d:\n%s\nwant\n%s", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestWriteHistoryJSONL(t *testing.T) {
+	var out strings.Builder
+	if err := writeHistoryJSONL(&out, exportEntries); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("jsonl:\n%s", out.String())
+	}
+	var first SentEmail
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Subject != "Отчёт, май" || first.Attachments[0].FileName != "отчёт.pdf" || !first.SentAt.Equal(exportEntries[0].SentAt) {
+		t.Errorf("first entry read back as %+v", first)
+	}
+}
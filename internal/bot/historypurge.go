@@ -0,0 +1,448 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/state"
+)
+
+const (
+	// PURGE_DATE_LAYOUT is the format of --before, a date in the bot's time zone.
+	PURGE_DATE_LAYOUT = "2006-01-02"
+	// PURGE_CONFIRM_TTL is how long a purge waits for its confirmation, after which
+	// its count may be out of date.
+	PURGE_CONFIRM_TTL = 10 * time.Minute
+)
+
+// PURGE_USAGE explains the options of /history purge and the history purge subcommand.
+const PURGE_USAGE = "Очистка истории (только администраторы):\n" +
+	"/history purge --before 2024-01-01 — удалить письма, отправленные до даты\n" +
+	"/history purge --user @имя или --user 123 — удалить письма пользователя\n" +
+	"--anonymize — не удалять записи, а стереть из них содержимое и отправителя\n" +
+	"--dry-run — только посчитать записи, ничего не меняя\n\n" +
+	"Условия можно сочетать, нужно хотя бы одно из --before и --user."
+
+// HistoryPurge selects history entries to delete or anonymize for a compliance cleanup.
+type HistoryPurge struct {
+	Before    time.Time // Entries sent before this moment; zero for any time
+	UserID    int64     // Entries the user sent or that were sent on their behalf; 0 for everyone
+	Anonymize bool      // Erase contents and senders but keep the entries for statistics
+}
+
+// matches reports whether the purge changes the entry. Anonymized entries are
+// not anonymized again, but are deleted by a purge that deletes.
+func (p HistoryPurge) matches(e SentEmail) bool {
+	if p.Anonymize && e.Anonymized {
+		return false
+	}
+	return (p.Before.IsZero() || e.SentAt.Before(p.Before)) && (p.UserID == 0 || e.involves(p.UserID))
+}
+
+// anonymized returns the entry with everything identifying the people and the letter
+// erased, keeping the time and outcome of the attempt.
+func anonymized(e SentEmail) SentEmail {
+	return SentEmail{ID: e.ID, SentAt: e.SentAt, Status: e.Status, Anonymized: true}
+}
+
+// describe lists the conditions of the purge for the confirmation and the audit.
+func (p HistoryPurge) describe(loc *time.Location) string {
+	var conditions []string
+	if !p.Before.IsZero() {
+		conditions = append(conditions, "отправленные до "+p.Before.In(loc).Format(PURGE_DATE_LAYOUT))
+	}
+	if p.UserID != 0 {
+		conditions = append(conditions, "пользователя "+strconv.FormatInt(p.UserID, 10))
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// action names what the purge does to the entries.
+func (p HistoryPurge) action() string {
+	if p.Anonymize {
+		return "обезличить"
+	}
+	return "удалить"
+}
+
+// done names what the purge has done or will do to the entries.
+func (p HistoryPurge) done() string {
+	if p.Anonymize {
+		return "обезличено"
+	}
+	return "удалено"
+}
+
+func (m *memoryHistoryStore) Purge(purge HistoryPurge, dryRun bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	kept := m.entries[:0:0]
+	for _, entry := range m.entries {
+		if !purge.matches(entry) {
+			kept = append(kept, entry)
+			continue
+		}
+		count++
+		if purge.Anonymize {
+			kept = append(kept, anonymized(entry))
+		}
+	}
+	if !dryRun {
+		m.entries = kept
+	}
+	return count, nil
+}
+
+func (m *memoryHistoryStore) FindUser(username string) (int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].Username != "" && strings.EqualFold(m.entries[i].Username, username) {
+			return m.entries[i].UserID, true
+		}
+	}
+	return 0, false
+}
+
+func (b *boltHistoryStore) Purge(purge HistoryPurge, dryRun bool) (int, error) {
+	count := 0
+	update := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		// Collected first: changing a bucket while its cursor walks it skips keys
+		changed := make(map[uint64]SentEmail)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var entry SentEmail
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("запись истории %x: %w", k, err)
+			}
+			if purge.matches(entry) {
+				changed[binary.BigEndian.Uint64(k)] = entry
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count = len(changed)
+		if dryRun {
+			return nil
+		}
+		for id, entry := range changed {
+			key := binary.BigEndian.AppendUint64(nil, id)
+			if !purge.Anonymize {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := json.Marshal(anonymized(entry))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = b.db.View(update)
+	} else {
+		err = b.db.Update(update)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ошибка очистки истории: %w", err)
+	}
+	return count, nil
+}
+
+func (b *boltHistoryStore) FindUser(username string) (int64, bool) {
+	var userID int64
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil && !found; k, v = c.Prev() {
+			var entry SentEmail
+			if json.Unmarshal(v, &entry) == nil && entry.Username != "" && strings.EqualFold(entry.Username, username) {
+				userID, found = entry.UserID, true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false
+	}
+	return userID, found
+}
+
+// purgeFlags are the options shared by /history purge and the history purge subcommand.
+type purgeFlags struct {
+	before    *string
+	user      *string
+	anonymize *bool
+	dryRun    *bool
+}
+
+// addPurgeFlags registers the purge options on the flag set.
+func addPurgeFlags(fs *flag.FlagSet) *purgeFlags {
+	return &purgeFlags{
+		before:    fs.String("before", "", "Письма, отправленные до даты ГГГГ-ММ-ДД"),
+		user:      fs.String("user", "", "Письма пользователя: Telegram ID или @имя"),
+		anonymize: fs.Bool("anonymize", false, "Стереть содержимое и отправителя вместо удаления записей"),
+		dryRun:    fs.Bool("dry-run", false, "Только посчитать записи"),
+	}
+}
+
+// resolve turns the options into a purge, looking a @username up in history.
+func (f *purgeFlags) resolve(history HistoryStore, loc *time.Location) (HistoryPurge, error) {
+	purge := HistoryPurge{Anonymize: *f.anonymize}
+	if *f.before == "" && *f.user == "" {
+		return purge, errors.New("Укажите --before, --user или оба условия.")
+	}
+	if *f.before != "" {
+		before, err := time.ParseInLocation(PURGE_DATE_LAYOUT, *f.before, loc)
+		if err != nil {
+			return purge, fmt.Errorf("Не удалось разобрать дату %q. Формат: ГГГГ-ММ-ДД", *f.before)
+		}
+		purge.Before = before
+	}
+	userID, err := resolveHistoryUser(history, *f.user)
+	purge.UserID = userID
+	return purge, err
+}
+
+// resolveHistoryUser turns a Telegram ID or @username into a user ID, 0 for an
+// empty option. A username is looked up in history, since Telegram does not
+// resolve the usernames of users.
+func resolveHistoryUser(history HistoryStore, user string) (int64, error) {
+	if username, ok := strings.CutPrefix(user, "@"); ok {
+		userID, found := history.FindUser(username)
+		if !found {
+			return 0, fmt.Errorf("Пользователь @%s не найден в истории. Укажите его Telegram ID.", username)
+		}
+		return userID, nil
+	}
+	if user == "" {
+		return 0, nil
+	}
+	userID, err := strconv.ParseInt(user, 10, 64)
+	if err != nil || userID == 0 {
+		return 0, fmt.Errorf("Некорректный пользователь %q: укажите Telegram ID или @имя.", user)
+	}
+	return userID, nil
+}
+
+// parsePurgeArgs reads the options of /history purge.
+func parsePurgeArgs(history HistoryStore, args []string, loc *time.Location) (HistoryPurge, bool, error) {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flags := addPurgeFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return HistoryPurge{}, false, fmt.Errorf("Некорректные параметры: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return HistoryPurge{}, false, fmt.Errorf("Лишние параметры: %s", strings.Join(fs.Args(), " "))
+	}
+	purge, err := flags.resolve(history, loc)
+	return purge, *flags.dryRun, err
+}
+
+// pendingPurge is a purge waiting for the administrator to confirm it.
+type pendingPurge struct {
+	AdminID int64
+	Purge   HistoryPurge
+	Count   int
+	Expires time.Time
+}
+
+// handleHistoryPurge replies to /history purge: it counts the entries and asks the
+// administrator to confirm, or only reports the count with --dry-run.
+func (h *Handler) handleHistoryPurge(message *tgbotapi.Message, args []string) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	loc := secrets.Location()
+	purge, dryRun, err := parsePurgeArgs(h.History, args, loc)
+	if err != nil {
+		bot.Send(newReply(message, err.Error()+"\n\n"+PURGE_USAGE))
+		return
+	}
+	count, err := h.History.Purge(purge, true)
+	if err != nil {
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось прочитать историю: %v", err)))
+		return
+	}
+	if dryRun {
+		audit(message.From, "проверил очистку истории (%s, %s): %d записей", purge.action(), purge.describe(loc), count)
+		bot.Send(newReply(message, fmt.Sprintf("Проверка: %s можно %d записей (%s). Ничего не изменено.", purge.action(), count, purge.describe(loc))))
+		return
+	}
+	if count == 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Под условия (%s) не подходит ни одна запись.", purge.describe(loc))))
+		return
+	}
+
+	h.purgeMu.Lock()
+	h.purgeSeq++
+	id := h.purgeSeq
+	h.purges[id] = &pendingPurge{AdminID: message.From.ID, Purge: purge, Count: count, Expires: time.Now().Add(PURGE_CONFIRM_TTL)}
+	h.purgeMu.Unlock()
+	audit(message.From, "запросил очистку истории (%s, %s): %d записей", purge.action(), purge.describe(loc), count)
+
+	msg := newReply(message, fmt.Sprintf("Будет %s %d записей истории (%s). Это нельзя отменить. Подтвердите в течение %d минут.",
+		purge.done(), count, purge.describe(loc), int(PURGE_CONFIRM_TTL.Minutes())))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Да, %s %d", purge.action(), count), fmt.Sprintf("history:purge:%d", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("history:purge_cancel:%d", id)),
+	))
+	bot.Send(msg)
+}
+
+// handlePurgeCallback confirms or cancels a purge; only its administrator may do it.
+func (h *Handler) handlePurgeCallback(query *tgbotapi.CallbackQuery, action, arg string) string {
+	bot, secrets := h.bot, h.secrets
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	h.purgeMu.Lock()
+	pending, ok := h.purges[id]
+	if ok && pending.AdminID == query.From.ID {
+		delete(h.purges, id)
+	} else {
+		ok = false
+	}
+	h.purgeMu.Unlock()
+	if !ok || !secrets.IsAdmin(query.From.ID) {
+		return "Кнопка устарела."
+	}
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+
+	loc := secrets.Location()
+	if action == "purge_cancel" {
+		audit(query.From, "отменил очистку истории (%s)", pending.Purge.describe(loc))
+		bot.Send(newReply(query.Message, "Очистка истории отменена."))
+		return "Отменено"
+	}
+	if time.Now().After(pending.Expires) {
+		bot.Send(newReply(query.Message, "Подтверждение истекло. Повторите команду, чтобы пересчитать записи."))
+		return "Подтверждение истекло"
+	}
+
+	count, err := h.History.Purge(pending.Purge, false)
+	if err != nil {
+		audit(query.From, "очистка истории (%s, %s): ошибка: %v", pending.Purge.action(), pending.Purge.describe(loc), err)
+		bot.Send(newReply(query.Message, fmt.Sprintf("Не удалось очистить историю: %v", err)))
+		return ""
+	}
+	audit(query.From, "очистил историю (%s, %s): %d записей", pending.Purge.action(), pending.Purge.describe(loc), count)
+	bot.Send(newReply(query.Message, fmt.Sprintf("Готово: %s записей истории: %d.", pending.Purge.done(), count)))
+	return ""
+}
+
+// RunHistory implements the history subcommand: history purge cleans up the
+// history in the database of a stopped bot. It returns the process exit code.
+func RunHistory(args []string) int {
+	if len(args) == 0 || args[0] != "purge" {
+		fmt.Fprintln(os.Stderr, "Использование: history purge [--before ГГГГ-ММ-ДД] [--user ID|@имя] [--anonymize] [--dry-run] [--yes]")
+		return 2
+	}
+	fs := flag.NewFlagSet("history purge", flag.ContinueOnError)
+	flags := addPurgeFlags(fs)
+	yes := fs.Bool("yes", false, "Не спрашивать подтверждения")
+	overrides := config.AddFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	secrets, err := overrides.Resolve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if choose(secrets.StorageBackend, STORAGE_BOLT) != STORAGE_BOLT {
+		fmt.Fprintln(os.Stderr, "История хранится в памяти бота, очищать на диске нечего.")
+		return 1
+	}
+	// Audit entries go to the bot log, like those of the chat command
+	redactor := NewRedactor(secretValues(secrets), !secrets.LogEmails)
+	level, err := config.ParseLogLevel(secrets.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	telegramLevel, err := secrets.TelegramLevel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logFile := setupLogging(secrets.LogFile, secrets.LogRotation, redactor, level, telegramLevel)
+	defer logFile.Close()
+
+	// The running bot holds the database lock, so this waits for lock_timeout and fails
+	db, err := state.Open(choose(secrets.StorageFile, DEFAULT_STORAGE_FILE), secrets.StorageOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\nОстановите бота или воспользуйтесь командой /history purge в чате.\n", err)
+		return 1
+	}
+	defer db.Close()
+	history, err := newBoltHistoryStore(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	loc := secrets.Location()
+	purge, err := flags.resolve(history, loc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	count, err := history.Purge(purge, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *flags.dryRun {
+		auditCLI("проверил очистку истории (%s, %s): %d записей", purge.action(), purge.describe(loc), count)
+		fmt.Printf("Проверка: %s можно %d записей (%s). Ничего не изменено.\n", purge.action(), count, purge.describe(loc))
+		return 0
+	}
+	if count == 0 {
+		fmt.Printf("Под условия (%s) не подходит ни одна запись.\n", purge.describe(loc))
+		return 0
+	}
+	if !*yes {
+		fmt.Printf("Будет %s %d записей истории (%s). Это нельзя отменить. Продолжить? [y/N] ", purge.done(), count, purge.describe(loc))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" && answer != "д" && answer != "да" {
+			fmt.Println("Отменено.")
+			return 1
+		}
+	}
+
+	if count, err = history.Purge(purge, false); err != nil {
+		auditCLI("очистка истории (%s, %s): ошибка: %v", purge.action(), purge.describe(loc), err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	auditCLI("очистил историю (%s, %s): %d записей", purge.action(), purge.describe(loc), count)
+	fmt.Printf("Готово: %s записей истории: %d.\n", purge.done(), count)
+	return 0
+}
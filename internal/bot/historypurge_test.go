@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"botmailtest/internal/state"
+)
+
+func TestHistoryPurge(t *testing.T) {
+	db, err := state.Open(filepath.Join(t.TempDir(), "bot.db"), state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	boltStore, err := newBoltHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, store := range map[string]HistoryStore{"memory": &memoryHistoryStore{}, "bolt": boltStore} {
+		t.Run(name, func(t *testing.T) {
+			for _, entry := range []SentEmail{
+				{UserID: 1, Username: "ivan", Subject: "Старое", SentAt: cutoff.Add(-time.Hour)},
+				{UserID: 2, OnBehalfOf: 1, Subject: "От имени", SentAt: cutoff.Add(time.Hour)},
+				{UserID: 2, Subject: "Старое чужое", SentAt: cutoff.Add(-time.Hour)},
+				{UserID: 1, Subject: "Новое", SentAt: cutoff.Add(time.Hour)},
+			} {
+				store.Record(&entry)
+			}
+			if userID, ok := store.FindUser("IVAN"); !ok || userID != 1 {
+				t.Errorf("FindUser = %d, %v; want 1", userID, ok)
+			}
+
+			user := HistoryPurge{UserID: 1, Anonymize: true}
+			if n, err := store.Purge(user, true); err != nil || n != 3 {
+				t.Fatalf("dry run counted %d, %v; want 3", n, err)
+			}
+			if recent := store.Recent(1, 10); len(recent) != 3 {
+				t.Fatalf("dry run changed the history: %+v", recent)
+			}
+			if n, err := store.Purge(user, false); err != nil || n != 3 {
+				t.Fatalf("anonymized %d, %v; want 3", n, err)
+			}
+			if recent := store.Recent(1, 10); len(recent) != 0 {
+				t.Errorf("user still has %+v", recent)
+			}
+			if entry, ok := store.Get(1); !ok || !entry.Anonymized || entry.Subject != "" || entry.SentAt.IsZero() {
+				t.Errorf("anonymized entry = %+v, %v", entry, ok)
+			}
+			if _, ok := store.FindUser("ivan"); ok {
+				t.Error("username survived anonymization")
+			}
+			if n, _ := store.Purge(user, false); n != 0 {
+				t.Errorf("anonymized %d entries again", n)
+			}
+
+			if n, err := store.Purge(HistoryPurge{Before: cutoff}, false); err != nil || n != 2 {
+				t.Fatalf("deleted %d, %v; want 2", n, err)
+			}
+			if _, ok := store.Get(3); ok {
+				t.Error("deleted entry is still there")
+			}
+			if entry, ok := store.Get(4); !ok || !entry.Anonymized {
+				t.Errorf("entry after the cutoff = %+v, %v", entry, ok)
+			}
+		})
+	}
+}
+
+func TestHistoryPurgeCommand(t *testing.T) {
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", AdminUserIDs: []int64{wizardUser}, Timezone: "UTC"}
+	handler := NewHandler(bot, nil, secrets, MemoryStores())
+	handler.History.Record(&SentEmail{UserID: 9, Username: "petr", Subject: "Отчёт", SentAt: time.Now()})
+	handler.History.Record(&SentEmail{UserID: 8, Subject: "Другое", SentAt: time.Now()})
+
+	for _, action := range []wizardAction{
+		textAction("/history purge --user @petr --dry-run"),
+		textAction("/history purge --user @petr"),
+		tapAction("history:purge:1"),
+	} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+
+	if _, ok := telegram.find(wizardUser, "Проверка: удалить можно 1 записей"); !ok {
+		t.Errorf("no dry run report:\n%s", telegram.transcript(wizardUser))
+	}
+	if _, ok := telegram.find(wizardUser, "Готово: удалено записей истории: 1"); !ok {
+		t.Errorf("no purge report:\n%s", telegram.transcript(wizardUser))
+	}
+	if _, ok := handler.History.Get(1); ok {
+		t.Error("entry of @petr was not deleted")
+	}
+	if _, ok := handler.History.Get(2); !ok {
+		t.Error("entry of another user was deleted")
+	}
+}
@@ -0,0 +1,221 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Define the text for the meeting invitation button
+	NEW_INVITE_BUTTON_TEXT = "Приглашение на встречу"
+	// INVITE_TIME_LAYOUT is the format users enter the meeting start in
+	INVITE_TIME_LAYOUT = "02.01.2006 15:04"
+	// ICS_TIME_LAYOUT is the UTC date-time format of iCalendar
+	ICS_TIME_LAYOUT = "20060102T150405Z"
+)
+
+// startInvite begins composing a meeting invitation.
+func startInvite(bot BotAPI, message *tgbotapi.Message, state *UserState) {
+	*state = UserState{State: "await_invite_title"}
+	msg := newReply(message, "Введите название встречи.")
+	msg.ReplyMarkup = newCancelKeyboard()
+	bot.Send(msg)
+}
+
+// handleInviteStep processes user input for the current step of the invitation wizard.
+func (h *Handler) handleInviteStep(ctx context.Context, message *tgbotapi.Message, state *UserState, initialKeyboard tgbotapi.ReplyKeyboardMarkup) {
+	bot, secrets := h.bot, h.secrets
+	text := strings.TrimSpace(message.Text)
+
+	switch state.State {
+	case "await_invite_title":
+		if err := validateField(FieldSubject, text); err != nil {
+			bot.Send(newReply(message, err.Error()))
+			return
+		}
+		state.Subject = text
+		state.State = "await_invite_time"
+		bot.Send(newReply(message, "Когда начинается встреча? Формат: ДД.ММ.ГГГГ ЧЧ:ММ, например "+time.Now().Add(24*time.Hour).Format(INVITE_TIME_LAYOUT)))
+
+	case "await_invite_time":
+		start, err := time.ParseInLocation(INVITE_TIME_LAYOUT, text, secrets.Location())
+		if err != nil {
+			bot.Send(newReply(message, "Не удалось разобрать дату. Формат: ДД.ММ.ГГГГ ЧЧ:ММ"))
+			return
+		}
+		if start.Before(time.Now()) {
+			bot.Send(newReply(message, "Эта дата уже прошла. Укажите время в будущем."))
+			return
+		}
+		state.Invite.Start = start
+		state.State = "await_invite_duration"
+		bot.Send(newReply(message, "Сколько минут длится встреча?"))
+
+	case "await_invite_duration":
+		minutes, err := strconv.Atoi(text)
+		if err != nil || minutes <= 0 {
+			bot.Send(newReply(message, "Укажите длительность целым числом минут, например 30."))
+			return
+		}
+		state.Invite.Duration = time.Duration(minutes) * time.Minute
+		state.State = "await_invite_location"
+		bot.Send(newReply(message, "Где пройдёт встреча? Отправьте «-», если место не нужно."))
+
+	case "await_invite_location":
+		if text != "-" {
+			state.Invite.Location = text
+		}
+		if h.isGuest(message.From.ID) {
+			// Like a letter, a guest's invitation waits for an administrator
+			draft := *state
+			*state = UserState{State: "initial"}
+			h.requestGuestApproval(message, message.From, draft)
+			return
+		}
+		h.sendInvite(ctx, message.From, message, state, initialKeyboard)
+	}
+}
+
+// isInviteDraft reports whether the draft is a meeting invitation rather than a letter.
+func isInviteDraft(state *UserState) bool {
+	return !state.Invite.Start.IsZero()
+}
+
+// invitePreview describes the composed invitation.
+func invitePreview(state *UserState) string {
+	text := fmt.Sprintf("Приглашение на встречу «%s»\nКогда: %s (%d мин.)", state.Subject,
+		state.Invite.Start.Format(INVITE_TIME_LAYOUT), int(state.Invite.Duration.Minutes()))
+	if state.Invite.Location != "" {
+		text += "\nГде: " + state.Invite.Location
+	}
+	return text
+}
+
+// sendInvite emails the composed invitation with an ICS attachment and resets the
+// wizard. from is the organizer, who may not be the one who sent the message, as
+// with an invitation of a guest approved by an administrator.
+func (h *Handler) sendInvite(ctx context.Context, from *tgbotapi.User, message *tgbotapi.Message, state *UserState, initialKeyboard tgbotapi.ReplyKeyboardMarkup) {
+	bot, secrets := h.bot, h.secrets
+	// The wizard stays at the last step, so the location can be sent again later
+	if !allowSend(bot, secrets, message, from) {
+		return
+	}
+	h.sendComplianceProgress(newReply(message, "Отправляю приглашение..."))
+
+	organizer := strings.TrimSpace(from.FirstName + " " + from.LastName)
+	subject, recipient := routeByLanguage(secrets, state.Subject, "")
+	start := state.Invite.Start
+	body := fmt.Sprintf("Приглашаю на встречу «%s».\n\nКогда: %s (%d мин.)", state.Subject,
+		start.Format(INVITE_TIME_LAYOUT+" MST"), int(state.Invite.Duration.Minutes()))
+	if state.Invite.Location != "" {
+		body += "\nГде: " + state.Invite.Location
+	}
+
+	ics := Attachment{Name: "invite.ics", Data: buildICS(state.Subject, state.Invite, organizer, secrets.SenderEmail, recipient, time.Now())}
+	result, err := h.sendEmail(ctx, recipient, secrets.SenderEmail, subject, body, organizer, ics)
+	recordSend(h.History, SentEmail{
+		UserID:     from.ID,
+		Recipient:  recipient,
+		Subject:    subject,
+		Body:       body,
+		SenderName: organizer,
+		Username:   from.UserName,
+		ApprovedBy: state.ApprovedBy,
+	}, []Attachment{ics}, result, err)
+	text, _ := describeSendResult(ctx, from.LanguageCode, result, err)
+	h.offerRetryRejected(from.ID, message.Chat.ID, Email{
+		Subject:     subject,
+		Body:        body,
+		SenderName:  organizer,
+		Attachments: []Attachment{ics},
+	}, result)
+
+	*state = UserState{State: "initial"}
+	msg := newReply(message, text+"\nХотите отправить ещё одно письмо? Нажмите 'Новое Письмо'.")
+	msg.ReplyMarkup = initialKeyboard
+	bot.Send(msg)
+}
+
+// buildICS renders a single-event iCalendar invitation (RFC 5545, METHOD:REQUEST).
+func buildICS(title string, invite Invite, organizerName, organizerEmail, attendeeEmail string, now time.Time) []byte {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"PRODID:-//AVIAIT//Email Telegram Bot//RU",
+		"VERSION:2.0",
+		"CALSCALE:GREGORIAN",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:" + newEventUID(organizerEmail),
+		"DTSTAMP:" + now.UTC().Format(ICS_TIME_LAYOUT),
+		"DTSTART:" + invite.Start.UTC().Format(ICS_TIME_LAYOUT),
+		"DTEND:" + invite.Start.Add(invite.Duration).UTC().Format(ICS_TIME_LAYOUT),
+		"SUMMARY:" + escapeICSText(title),
+	}
+	if invite.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICSText(invite.Location))
+	}
+	lines = append(lines,
+		fmt.Sprintf("ORGANIZER;CN=%s:mailto:%s", quoteICSParam(organizerName), organizerEmail),
+		"ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:"+attendeeEmail,
+		"SEQUENCE:0",
+		"STATUS:CONFIRMED",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(foldICSLine(line))
+		sb.WriteString("\r\n")
+	}
+	return []byte(sb.String())
+}
+
+// newEventUID generates a globally unique event identifier in the sender's domain.
+func newEventUID(senderEmail string) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		slog.Error("Ошибка генерации UID события", "error", err)
+	}
+	domain := "localhost"
+	if _, d, found := strings.Cut(senderEmail, "@"); found {
+		domain = d
+	}
+	return hex.EncodeToString(buf) + "@" + domain
+}
+
+// escapeICSText escapes a TEXT property value.
+func escapeICSText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// quoteICSParam quotes a parameter value, which may not contain double quotes.
+func quoteICSParam(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
+
+// foldICSLine splits lines longer than 75 octets, continuing them with a leading space,
+// without breaking multi-byte characters.
+func foldICSLine(line string) string {
+	const limit = 75
+	var sb strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			sb.WriteString("\r\n ")
+			width = 1
+		}
+		sb.WriteRune(r)
+		width += size
+	}
+	return sb.String()
+}
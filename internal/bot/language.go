@@ -0,0 +1,51 @@
+package bot
+
+import (
+	"strings"
+	"unicode"
+)
+
+// detectLanguage makes a rough guess of the text language by its alphabet:
+// "ru" for mostly Cyrillic text, "en" for mostly Latin, "" when there are no letters.
+func detectLanguage(text string) string {
+	var cyrillic, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	switch {
+	case cyrillic == 0 && latin == 0:
+		return ""
+	case cyrillic >= latin:
+		return "ru"
+	default:
+		return "en"
+	}
+}
+
+// routeByLanguage applies the language rule matching the body (or the subject, when the
+// body has no letters) and returns the tagged subject and the recipient to use.
+func routeByLanguage(secrets *Secrets, subject, body string) (string, string) {
+	recipient := secrets.TargetEmail
+
+	lang := detectLanguage(body)
+	if lang == "" {
+		lang = detectLanguage(subject)
+	}
+	rule, exists := secrets.LanguageRules[lang]
+	if !exists {
+		return subject, recipient
+	}
+
+	if rule.SubjectTag != "" && !strings.HasPrefix(subject, rule.SubjectTag) {
+		subject = rule.SubjectTag + " " + subject
+	}
+	if rule.TargetEmail != "" {
+		recipient = rule.TargetEmail
+	}
+	return subject, recipient
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// notifyAdminChat sends a service message to the admin chat, if one is configured.
+func notifyAdminChat(bot BotAPI, secrets *Secrets, text string) {
+	if secrets.AdminChatID == 0 {
+		return
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(secrets.AdminChatID, text)); err != nil {
+		slog.Error("Ошибка отправки сообщения в чат администраторов", "chat_id", secrets.AdminChatID, "error", err)
+	}
+}
+
+// startupBanner describes the running instance for the admin chat, with addresses masked.
+func startupBanner(bot *tgbotapi.BotAPI, secrets *Secrets) string {
+	mask := NewRedactor(nil, true)
+	lines := []string{
+		fmt.Sprintf("Бот @%s запущен, версия %s", bot.Self.UserName, version),
+		fmt.Sprintf("Почтовый сервис: %s", choose(secrets.EmailProvider, mailer.EMAIL_PROVIDER_UNISENDER)),
+		fmt.Sprintf("Хранилище: %s", describeStorage(secrets)),
+		fmt.Sprintf("Отправитель: %s", mask.Redact(secrets.SenderEmail)),
+		fmt.Sprintf("Получатель по умолчанию: %s", mask.Redact(secrets.TargetEmail)),
+		fmt.Sprintf("Администраторов: %d", len(secrets.AdminUserIDs)),
+	}
+	if host, err := os.Hostname(); err == nil {
+		lines = append(lines, "Сервер: "+host)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describeStorage names the storage backend in use.
+func describeStorage(secrets *Secrets) string {
+	if choose(secrets.StorageBackend, STORAGE_BOLT) == STORAGE_MEMORY {
+		return "память процесса"
+	}
+	return "bbolt, " + choose(secrets.StorageFile, DEFAULT_STORAGE_FILE)
+}
+
+// notifyPendingDrafts warns users with an unfinished draft that the bot is stopping.
+// Conversations are private chats, so the user ID is also the chat ID.
+func (h *Handler) notifyPendingDrafts() {
+	bot, secrets := h.bot, h.secrets
+	text := "Бот перезапускается. Ваш черновик сохранён, продолжите заполнять его через пару минут."
+	if choose(secrets.StorageBackend, STORAGE_BOLT) == STORAGE_MEMORY {
+		text = "Бот перезапускается, незавершённый черновик письма будет потерян. Начните заново через пару минут командой /start."
+	}
+	h.States.Range(func(userID int64, state UserState) {
+		if state.State == "" || state.State == "initial" {
+			return
+		}
+		if _, err := bot.Send(tgbotapi.NewMessage(userID, text)); err != nil {
+			slog.Warn("Ошибка уведомления пользователя об остановке", "user_id", userID, "error", err)
+		}
+	})
+}
+
+// waitGroupTimeout waits up to timeout for the wait group and reports whether it finished.
+func waitGroupTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
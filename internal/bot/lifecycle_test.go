@@ -0,0 +1,22 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+func TestStartupBannerNamesProvider(t *testing.T) {
+	bot := &tgbotapi.BotAPI{Self: tgbotapi.User{UserName: "mail_bot"}}
+	for provider, want := range map[string]string{
+		"":                         "Почтовый сервис: " + mailer.EMAIL_PROVIDER_UNISENDER,
+		mailer.EMAIL_PROVIDER_SMTP: "Почтовый сервис: " + mailer.EMAIL_PROVIDER_SMTP,
+	} {
+		if banner := startupBanner(bot, &Secrets{EmailProvider: provider}); !strings.Contains(banner, want) {
+			t.Errorf("email_provider %q: banner lacks %q:\n%s", provider, want, banner)
+		}
+	}
+}
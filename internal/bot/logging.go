@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logAttrsKey is the context key of the attributes added to every entry logged with the context.
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log entries carry the given key-value pairs,
+// in addition to those of the parent.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]any)
+	return context.WithValue(ctx, logAttrsKey{}, append(attrs[:len(attrs):len(attrs)], args...))
+}
+
+// updateLogAttrs are the attributes of the conversation an update belongs to, so
+// that every entry logged while handling it can be found by user.
+func (h *Handler) updateLogAttrs(ctx context.Context, userID, chatID int64) context.Context {
+	state, _ := h.States.Get(userID)
+	return withLogAttrs(ctx, "user_id", userID, "chat_id", chatID, "state", choose(state.State, "initial"))
+}
+
+// contextHandler adds the attributes stored by withLogAttrs to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]any); ok {
+		r.Add(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newLogger creates a logger writing JSON entries at or above level to w.
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, AddSource: true})})
+}
+
+// fatal logs an error that prevents the bot from running and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// telegramLogger receives the output of the Telegram library. The library logs
+// requests and responses in debug mode with Printf and failures to get updates
+// with Println, so those are the debug and warn levels.
+type telegramLogger struct {
+	logger *slog.Logger
+}
+
+// newTelegramLogger writes the library entries to w with component=telegram,
+// dropping those below level.
+func newTelegramLogger(w io.Writer, level slog.Level) *telegramLogger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	return &telegramLogger{logger: slog.New(handler).With("component", "telegram")}
+}
+
+func (l *telegramLogger) Printf(format string, v ...interface{}) {
+	l.logger.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l *telegramLogger) Println(v ...interface{}) {
+	l.logger.Warn(strings.TrimSpace(fmt.Sprintln(v...)))
+}
@@ -0,0 +1,50 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoggerAddsContextAttrs(t *testing.T) {
+	var out bytes.Buffer
+	logger := newLogger(&out, slog.LevelInfo)
+	handler := NewHandler(&fakeBot{}, nil, &Secrets{}, MemoryStores())
+	handler.States.Update(42, func(s *UserState) { s.State = "await_subject" })
+
+	ctx := withLogAttrs(handler.updateLogAttrs(context.Background(), 42, 7), "schedule_id", 3)
+	logger.DebugContext(ctx, "Скрыто")
+	logger.InfoContext(ctx, "Получено сообщение", "text", "Привет")
+
+	var entry map[string]any
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("not a single JSON entry: %q: %v", out.String(), err)
+	}
+	want := map[string]any{"level": "INFO", "msg": "Получено сообщение", "text": "Привет",
+		"user_id": 42.0, "chat_id": 7.0, "state": "await_subject", "schedule_id": 3.0}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v in %s", key, entry[key], value, out.String())
+		}
+	}
+}
+
+func TestTelegramLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := newTelegramLogger(&out, slog.LevelWarn)
+	logger.Printf("Endpoint: %s, params: %v\n", "getMe", "{}")
+	logger.Println("Failed to get updates, retrying in 3 seconds...")
+
+	got := out.String()
+	if strings.Contains(got, "getMe") {
+		t.Errorf("debug entry logged at warn level:\n%s", got)
+	}
+	for _, want := range []string{`"level":"WARN"`, `"component":"telegram"`, `"msg":"Failed to get updates`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log %q does not contain %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package bot
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_LOG_MAX_SIZE_MB is the size the log file is rotated at when
+	// log_rotation.max_size_mb is not set.
+	DEFAULT_LOG_MAX_SIZE_MB = 100
+	// LOG_BACKUP_TIME_LAYOUT stamps rotated files, e.g. bot_errors-2026-05-10T12-30-00.000.log.
+	// It has no colons, which Windows does not allow in file names.
+	LOG_BACKUP_TIME_LAYOUT = "2006-01-02T15-04-05.000"
+)
+
+// rotatingFile is the log file: entries are appended to it, and once it grows past
+// the size limit it is renamed with a timestamp and a new one is started. Rotated
+// files are compressed and pruned in the background.
+type rotatingFile struct {
+	path     string
+	settings LogRotation
+	now      func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	cleanupMu sync.Mutex     // Cleanups of consecutive rotations do not overlap
+	cleanups  sync.WaitGroup // Waited for by Close
+}
+
+// openRotatingFile opens the log file for appending, creating it if needed.
+func openRotatingFile(path string, settings LogRotation) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, settings: settings, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current file and takes its size.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия файла логов %s: %w", r.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка открытия файла логов %s: %w", r.path, err)
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// maxSize returns the size limit in bytes.
+func (r *rotatingFile) maxSize() int64 {
+	return int64(cmp.Or(r.settings.MaxSizeMB, DEFAULT_LOG_MAX_SIZE_MB)) << 20
+}
+
+// Write appends an entry, rotating the file first if the entry would not fit. The
+// log package and slog write one entry per call, so entries are never split.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize() {
+		if err := r.rotate(); err != nil {
+			// Keep logging into the oversized file rather than losing entries
+			fmt.Fprintf(os.Stderr, "Ошибка ротации файла логов: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to a backup and starts a new one.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(r.path)
+	backup := strings.TrimSuffix(r.path, ext) + "-" + r.now().Format(LOG_BACKUP_TIME_LAYOUT) + ext
+	renameErr := os.Rename(r.path, backup)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	r.cleanups.Add(1)
+	go func() {
+		defer r.cleanups.Done()
+		r.cleanupMu.Lock()
+		defer r.cleanupMu.Unlock()
+		r.cleanup()
+	}()
+	return nil
+}
+
+// cleanup compresses the backups and removes those over the limits. Errors go to
+// stderr, since the log itself may be what failed.
+func (r *rotatingFile) cleanup() {
+	backups, err := r.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ошибка чтения каталога логов: %v\n", err)
+		return
+	}
+	var cutoff time.Time
+	if r.settings.MaxAgeDays > 0 {
+		cutoff = r.now().AddDate(0, 0, -r.settings.MaxAgeDays)
+	}
+	for i, b := range backups {
+		tooMany := r.settings.MaxBackups > 0 && i >= r.settings.MaxBackups
+		if tooMany || b.rotated.Before(cutoff) {
+			if err := os.Remove(b.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Ошибка удаления старого файла логов %s: %v\n", b.path, err)
+			}
+			continue
+		}
+		if r.settings.Compress && !strings.HasSuffix(b.path, ".gz") {
+			if err := compressFile(b.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Ошибка сжатия файла логов %s: %v\n", b.path, err)
+			}
+		}
+	}
+}
+
+// logBackup is a rotated log file.
+type logBackup struct {
+	path    string
+	rotated time.Time
+}
+
+// backups lists the rotated files of the log, newest first.
+func (r *rotatingFile) backups() ([]logBackup, error) {
+	ext := filepath.Ext(r.path)
+	prefix := filepath.Base(strings.TrimSuffix(r.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return nil, err
+	}
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		rotated, err := time.ParseInLocation(LOG_BACKUP_TIME_LAYOUT, stamp, time.Local)
+		if err != nil {
+			continue // Another file sharing the prefix
+		}
+		backups = append(backups, logBackup{path: filepath.Join(filepath.Dir(r.path), name), rotated: rotated})
+	}
+	slices.SortFunc(backups, func(a, b logBackup) int { return b.rotated.Compare(a.rotated) })
+	return backups, nil
+}
+
+// compressFile replaces the file with its gzipped copy.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// Close closes the file and waits for the background cleanup.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.mu.Unlock()
+	r.cleanups.Wait()
+	return err
+}
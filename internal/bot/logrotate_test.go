@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bot.log")
+	if err := os.WriteFile(path, []byte("до запуска\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openRotatingFile(path, LogRotation{MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Date(2026, 5, 10, 12, 0, 0, 0, time.Local)
+	file.now = func() time.Time { clock = clock.Add(time.Minute); return clock }
+
+	entry := strings.Repeat("x", 400<<10) + "\n"
+	for range 8 { // Two entries fit in a file, so every other write rotates
+		if _, err := file.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	want := []string{"bot-2026-05-10T12-02-00.000.log.gz", "bot-2026-05-10T12-03-00.000.log.gz", "bot.log"}
+	if !slices.Equal(names, want) {
+		t.Errorf("files = %q, want %q", names, want)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 2*len(entry) {
+		t.Errorf("current file has %d bytes, want %d", len(data), 2*len(entry))
+	}
+}
+
+func TestRotatingFileRemovesOldBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bot.log")
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.Local)
+	old := filepath.Join(dir, "bot-"+now.AddDate(0, 0, -10).Format(LOG_BACKUP_TIME_LAYOUT)+".log")
+	recent := filepath.Join(dir, "bot-"+now.AddDate(0, 0, -1).Format(LOG_BACKUP_TIME_LAYOUT)+".log")
+	unrelated := filepath.Join(dir, "bot-notes.log")
+	for _, name := range []string{old, recent, unrelated} {
+		if err := os.WriteFile(name, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := openRotatingFile(path, LogRotation{MaxSizeMB: 1, MaxAgeDays: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.now = func() time.Time { return now }
+	file.Write([]byte(strings.Repeat("x", 1<<20)))
+	file.Write([]byte("y"))
+	file.Close()
+
+	for name, exists := range map[string]bool{old: false, recent: true, unrelated: true} {
+		if _, err := os.Stat(name); (err == nil) != exists {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(name), err == nil, exists)
+		}
+	}
+}
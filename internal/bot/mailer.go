@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"botmailtest/internal/mailer"
+)
+
+// The providers live in the mailer package; the handlers use its types under
+// their own names.
+type (
+	EmailSender       = mailer.EmailSender
+	Attachment        = mailer.Attachment
+	Copies            = mailer.Copies
+	SendEmailResponse = mailer.SendEmailResponse
+	SendEmailResult   = mailer.SendEmailResult
+)
+
+// sendEmail sends a letter through the provider in use, retrying transient
+// failures according to send_retry.
+func (h *Handler) sendEmail(ctx context.Context, targetEmail, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	result, _, err := h.sendEmailCountingAttempts(ctx, targetEmail, Copies{}, senderEmail, subject, body, senderName, attachments...)
+	return result, err
+}
+
+// sendEmailCountingAttempts is sendEmail with copies that also returns how many
+// attempts the send took, for replies that report it. The provider is looked up
+// when the send runs, not when the update arrived, so work finishing after a
+// /reload uses the provider the reload put in place.
+func (h *Handler) sendEmailCountingAttempts(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, int, error) {
+	configMu.RLock()
+	sender := h.sender
+	configMu.RUnlock()
+	return sendThrough(ctx, sender, targetEmail, copies, senderEmail, subject, body, senderName, attachments...)
+}
+
+// sendThrough sends a letter through sender, retrying transient failures
+// according to send_retry. Shutdown waits for the send and the status board
+// counts it.
+func sendThrough(ctx context.Context, sender EmailSender, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, int, error) {
+	inFlightSends.Add(1)
+	defer inFlightSends.Done()
+	if err := providerSlots.acquire(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer providerSlots.release()
+	sendingNow.Add(1)
+	defer sendingNow.Add(-1)
+
+	slog.InfoContext(ctx, "Подготовка отправки письма", "subject", subject, "sender_name", senderName, "recipient", targetEmail, "copies", len(copies.Addresses()), "attachments", len(attachments))
+
+	var result SendEmailResponse
+	attempts, err := mailer.WithRetries(ctx, "sendEmail", func() error {
+		var err error
+		result, err = sender.SendEmail(ctx, targetEmail, copies, senderEmail, subject, body, senderName, attachments...)
+		return err
+	})
+	providerStatus.record(err, time.Now())
+	if err != nil {
+		return nil, attempts, err
+	}
+	return result, attempts, nil
+}
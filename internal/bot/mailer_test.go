@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/testutil"
+)
+
+// serveUnisender routes Unisender calls to a server answering each call with the
+// next of the given status codes and bodies, repeating the last one, and returns
+// a Unisender sender that does not wait between retries.
+func serveUnisender(t *testing.T, statuses []int, bodies []string) (*atomic.Int32, EmailSender) {
+	t.Helper()
+	calls := testutil.ServeUnisender(t, mailer.UNISENDER_API_URL, statuses, bodies)
+	if err := mailer.ConfigureRetry(mailer.RetryPolicy{Backoff: "1ms", MaxBackoff: "1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mailer.ConfigureRetry(mailer.RetryPolicy{}) })
+	return calls, &mailer.UnisenderSender{APIKey: "key"}
+}
+
+func TestSendEmailCountsAttempts(t *testing.T) {
+	const success = `{"result":[{"index":0,"email":"office@example.com","id":"1"}]}`
+	calls, sender := serveUnisender(t, []int{http.StatusInternalServerError, http.StatusOK}, []string{"Internal Server Error", success})
+	handler := NewHandler(&fakeBot{}, sender, &Secrets{}, MemoryStores())
+	result, attempts, err := handler.sendEmailCountingAttempts(context.Background(), "office@example.com", Copies{}, "me@example.com", "s", "b", "n")
+	if err != nil || len(result) != 1 {
+		t.Fatalf("send = %v, %v", result, err)
+	}
+	if attempts != 2 || calls.Load() != 2 {
+		t.Errorf("attempts = %d, calls = %d, want 2", attempts, calls.Load())
+	}
+}
+
+func TestDescribeSendResultPartialFailure(t *testing.T) {
+	if err := loadReplyTemplates(nil); err != nil {
+		t.Fatal(err)
+	}
+	result := SendEmailResponse{
+		{Index: 0, Email: "office@example.com", ID: "36422782"},
+		{Index: 1, Email: "broken@example", Errors: []mailer.RecipientError{{Code: "invalid_arg", Message: "Email address is invalid: broken@example"}}},
+	}
+
+	text, sent := describeSendResult(context.Background(), "ru", result, nil)
+	want := "Письмо успешно отправлено, ID: 36422782\nНе приняты:\nbroken@example: Email address is invalid: broken@example"
+	if !sent || text != want {
+		t.Errorf("got %q, %v; want %q, true", text, sent, want)
+	}
+}
+
+func TestSendUsesSenderInPlaceWhenItRuns(t *testing.T) {
+	var steps []string
+	handler, _, old := newWizardHandler(t, wizardSecrets(), &steps)
+	// A reminder or other deferred send keeps the handler of the update that set it up
+	deferred := handler.snapshot()
+	fresh := &recordingSender{t: t, steps: &steps}
+	handler.sender = fresh // As /reload does
+
+	if _, err := deferred.sendEmail(context.Background(), "office@example.com", "me@example.com", "Тема", "Текст", "Иван"); err != nil {
+		t.Fatal(err)
+	}
+	if old.sent != 0 || fresh.sent != 1 {
+		t.Errorf("sent %d through the replaced sender and %d through the new one", old.sent, fresh.sent)
+	}
+}
@@ -0,0 +1,280 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// NORMALIZE_DIFF_MAX_LINES caps the changed body lines listed in the preview.
+	NORMALIZE_DIFF_MAX_LINES = 8
+	// NORMALIZE_DIFF_LINE_LIMIT is how much of a long changed line the preview shows.
+	NORMALIZE_DIFF_LINE_LIMIT = 80
+)
+
+// normalization holds the clean-up rules of this deployment, set from secrets.Normalize
+// at start. Without any rule turned on letters are sent as typed.
+var normalization NormalizeRules
+
+// normalizeRules returns the clean-up rules in force; /reload may replace them.
+func normalizeRules() NormalizeRules {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return normalization
+}
+
+// defaultTrackingParams are removed from links when normalize.tracking_params is empty.
+var defaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "yclid", "ysclid", "_openstat", "mc_cid", "mc_eid", "igshid"}
+
+var (
+	// trackedLinkPattern matches a link in text or in an href attribute, which ends at the quote.
+	trackedLinkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+	// innerSpacesPattern matches runs of spaces after the first word of a line, so
+	// indentation at the start of lines is kept.
+	innerSpacesPattern    = regexp.MustCompile(`(\S)[ \t]{2,}`)
+	trailingSpacesPattern = regexp.MustCompile(`(?m)[ \t]+$`)
+	blankLinesPattern     = regexp.MustCompile(`\n{3,}`)
+	blankBreaksPattern    = regexp.MustCompile(`(<br>\n){3,}`)
+	// spaceBeforePunctPattern matches spaces before punctuation that ends a word, as in
+	// "слово ,"; a smiley like " :)" is left alone.
+	spaceBeforePunctPattern = regexp.MustCompile(`[ \t]+([,.;:!?]+)([\s<]|$)`)
+	spacesAfterPunctPattern = regexp.MustCompile(`([,.;:!?])[ \t]{2,}`)
+	// hiddenSpacesPattern matches the spaces visibleSpaces marks.
+	hiddenSpacesPattern = regexp.MustCompile(`  +| +$`)
+)
+
+// normalizeDraft returns the draft as it will be sent: with the rules applied to its
+// subject, preheader and body, unless the user chose to send it as typed. The body
+// of an HTML letter is the user's own markup, so only its links are cleaned.
+func normalizeDraft(rules NormalizeRules, state UserState) UserState {
+	if state.KeepAsTyped || !rules.Enabled() {
+		return state
+	}
+	params := rules.TrackingParams
+	if len(params) == 0 {
+		params = defaultTrackingParams
+	}
+	state.Subject = normalizeLine(rules, params, state.Subject)
+	state.Preheader = normalizeLine(rules, params, state.Preheader)
+	if state.BodyFormat == BODY_FORMAT_HTML {
+		if rules.StripTrackingParams {
+			state.Body = stripTrackingParams(state.Body, params)
+		}
+		return state
+	}
+	state.Body = normalizeText(rules, params, state.Body)
+	state.BodyHTML = normalizeHTML(rules, params, state.BodyHTML)
+	return state
+}
+
+// normalizeLine applies the rules to a single line such as the subject.
+func normalizeLine(rules NormalizeRules, params []string, s string) string {
+	s = normalizeText(rules, params, s)
+	if rules.CollapseWhitespace {
+		s = strings.Join(strings.Fields(s), " ")
+	}
+	return s
+}
+
+// normalizeText applies the rules to plain text.
+func normalizeText(rules NormalizeRules, params []string, s string) string {
+	if rules.StripTrackingParams {
+		s = stripTrackingParams(s, params)
+	}
+	if rules.FixPunctuationSpaces {
+		s = fixPunctuationSpaces(s)
+	}
+	if rules.CollapseWhitespace {
+		s = trailingSpacesPattern.ReplaceAllString(s, "")
+		s = innerSpacesPattern.ReplaceAllString(s, "$1 ")
+		s = blankLinesPattern.ReplaceAllString(s, "\n\n")
+		s = strings.TrimSpace(s)
+	}
+	return s
+}
+
+// normalizeHTML applies the rules to the body converted from Telegram formatting,
+// where lines end with <br>. Spaces inside a line are collapsed by mail clients
+// anyway, so only runs of empty lines are left to collapse.
+func normalizeHTML(rules NormalizeRules, params []string, s string) string {
+	if rules.StripTrackingParams {
+		s = stripTrackingParams(s, params)
+	}
+	if rules.FixPunctuationSpaces {
+		s = fixPunctuationSpaces(s)
+	}
+	if rules.CollapseWhitespace {
+		s = blankBreaksPattern.ReplaceAllString(s, "<br>\n<br>\n")
+	}
+	return s
+}
+
+// fixPunctuationSpaces removes spaces before punctuation and collapses those after it.
+func fixPunctuationSpaces(s string) string {
+	s = spaceBeforePunctPattern.ReplaceAllString(s, "$1$2")
+	return spacesAfterPunctPattern.ReplaceAllString(s, "$1 ")
+}
+
+// stripTrackingParams removes the tracking parameters from the query of every link,
+// keeping the order of the others. Links in HTML separate parameters with &amp;.
+func stripTrackingParams(s string, params []string) string {
+	return trackedLinkPattern.ReplaceAllStringFunc(s, func(link string) string {
+		// Punctuation closing the sentence is not part of the link
+		trimmed := strings.TrimRight(link, ".,;:!?)")
+		tail := link[len(trimmed):]
+		base, query, ok := strings.Cut(trimmed, "?")
+		if !ok {
+			return link
+		}
+		query, fragment, hasFragment := strings.Cut(query, "#")
+		separator := "&"
+		if strings.Contains(query, "&amp;") {
+			separator = "&amp;"
+		}
+		var kept []string
+		for _, pair := range strings.Split(query, separator) {
+			name, _, _ := strings.Cut(pair, "=")
+			if !isTrackingParam(name, params) {
+				kept = append(kept, pair)
+			}
+		}
+		link = base
+		if len(kept) > 0 {
+			link += "?" + strings.Join(kept, separator)
+		}
+		if hasFragment {
+			link += "#" + fragment
+		}
+		return link + tail
+	})
+}
+
+// isTrackingParam reports whether the query parameter is one of params, where a
+// trailing * matches any name with that prefix.
+func isTrackingParam(name string, params []string) bool {
+	name = strings.ToLower(name)
+	for _, param := range params {
+		param = strings.ToLower(param)
+		if prefix, ok := strings.CutSuffix(param, "*"); ok && strings.HasPrefix(name, prefix) || name == param {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingNormalization describes what the rules change in the draft, even when
+// the user turned them off for it. It returns "" when they change nothing.
+func pendingNormalization(state *UserState) string {
+	draft := *state
+	draft.KeepAsTyped = false
+	sent := normalizeDraft(normalizeRules(), draft)
+	return describeNormalization(state, &sent)
+}
+
+// describeNormalization lists what the rules change in the draft, for the preview:
+// the subject and preheader before and after, and the changed lines of the body.
+func describeNormalization(typed, sent *UserState) string {
+	var lines []string
+	if typed.Subject != sent.Subject {
+		lines = append(lines, fmt.Sprintf("Тема: «%s» → «%s»", visibleSpaces(typed.Subject), sent.Subject))
+	}
+	if typed.Preheader != sent.Preheader {
+		lines = append(lines, fmt.Sprintf("Прехедер: «%s» → «%s»", visibleSpaces(typed.Preheader), sent.Preheader))
+	}
+	if typed.Body != sent.Body {
+		lines = append(lines, "Текст:")
+		diff := diffLines(strings.Split(typed.Body, "\n"), strings.Split(sent.Body, "\n"))
+		for i, line := range diff {
+			if i == NORMALIZE_DIFF_MAX_LINES {
+				lines = append(lines, fmt.Sprintf("…и ещё строк: %d", len(diff)-i))
+				break
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// diffLines returns the lines removed from a, marked "−", and added in b, marked "+",
+// in order. Lines kept in both are left out. A long line changed in place is cut
+// down to the part around the first change.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case i < len(a) && j < len(b) && lcs[i][j] == lcs[i+1][j+1]:
+			// The line was changed rather than added or removed
+			at := commonPrefixLength([]rune(a[i]), []rune(b[j]))
+			diff = append(diff, "− "+visibleSpaces(clipAround(a[i], at)), "+ "+visibleSpaces(clipAround(b[j], at)))
+			i, j = i+1, j+1
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			diff = append(diff, "+ "+visibleSpaces(clipAround(b[j], 0)))
+			j++
+		default:
+			diff = append(diff, "− "+visibleSpaces(clipAround(a[i], 0)))
+			i++
+		}
+	}
+	return diff
+}
+
+// commonPrefixLength returns how many runes a and b share at the start.
+func commonPrefixLength(a, b []rune) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// clipAround shortens a line to NORMALIZE_DIFF_LINE_LIMIT runes, keeping the rune at
+// the given position in view with some context before it.
+func clipAround(line string, at int) string {
+	runes := []rune(line)
+	if len(runes) <= NORMALIZE_DIFF_LINE_LIMIT {
+		return line
+	}
+	start := min(max(at-NORMALIZE_DIFF_LINE_LIMIT/4, 0), len(runes)-NORMALIZE_DIFF_LINE_LIMIT)
+	clipped := string(runes[start : start+NORMALIZE_DIFF_LINE_LIMIT])
+	if start > 0 {
+		clipped = "…" + clipped
+	}
+	if start+NORMALIZE_DIFF_LINE_LIMIT < len(runes) {
+		clipped += "…"
+	}
+	return clipped
+}
+
+// visibleSpaces marks the whitespace the rules remove, which Telegram would not
+// show: runs of spaces as dots, tabs as arrows and empty lines in words.
+func visibleSpaces(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "(пустая строка)"
+	}
+	s = strings.ReplaceAll(s, "\t", "→")
+	s = hiddenSpacesPattern.ReplaceAllStringFunc(s, func(run string) string {
+		return strings.Repeat("·", len(run))
+	})
+	return s
+}
@@ -0,0 +1,81 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	all := NormalizeRules{CollapseWhitespace: true, StripTrackingParams: true, FixPunctuationSpaces: true}
+	for _, tc := range []struct {
+		name, text, want string
+	}{
+		{"spaces", "  Привет,   мир  \n\n\n\nПока\t\t!", "Привет, мир\n\nПока!"},
+		{"indentation", "Список:\n    пункт  один", "Список:\n    пункт один"},
+		{"punctuation", "Здравствуйте , коллеги .  Встреча в 10:00 ; приходите !", "Здравствуйте, коллеги. Встреча в 10:00; приходите!"},
+		{"smiley", "Спасибо :) и до встречи ...", "Спасибо :) и до встречи..."},
+		{"tracking", "См. https://example.com/a?id=7&utm_source=tg&UTM_Medium=x&fbclid=1#top.", "См. https://example.com/a?id=7#top."},
+		{"only tracking", "(https://example.com/?utm_campaign=may)", "(https://example.com/)"},
+		{"no query", "https://example.com/utm_source", "https://example.com/utm_source"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeText(all, defaultTrackingParams, tc.text); got != tc.want {
+				t.Errorf("normalizeText(%q) = %q, want %q", tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDraft(t *testing.T) {
+	rules := NormalizeRules{CollapseWhitespace: true, StripTrackingParams: true, TrackingParams: []string{"ref"}}
+	typed := UserState{
+		Subject:  " Отчёт  за май ",
+		Body:     "Ссылка:  https://example.com/?ref=tg&utm_source=tg\n\n\n\nКонец",
+		BodyHTML: `Ссылка:  <a href="https://example.com/?ref=tg&amp;utm_source=tg">ссылка</a><br>` + "\n<br>\n<br>\n<br>\nКонец",
+	}
+	sent := normalizeDraft(rules, typed)
+	if sent.Subject != "Отчёт за май" {
+		t.Errorf("subject = %q", sent.Subject)
+	}
+	if want := "Ссылка: https://example.com/?utm_source=tg\n\nКонец"; sent.Body != want {
+		t.Errorf("body = %q, want %q", sent.Body, want)
+	}
+	if want := `Ссылка:  <a href="https://example.com/?utm_source=tg">ссылка</a><br>` + "\n<br>\nКонец"; sent.BodyHTML != want {
+		t.Errorf("HTML body = %q, want %q", sent.BodyHTML, want)
+	}
+
+	custom := UserState{Subject: "Тема", Body: "<p>Текст  <a href=\"https://example.com/?ref=1\">тут</a></p>", BodyFormat: BODY_FORMAT_HTML}
+	if got := normalizeDraft(rules, custom).Body; got != "<p>Текст  <a href=\"https://example.com/\">тут</a></p>" {
+		t.Errorf("HTML letter body = %q, want only the link cleaned", got)
+	}
+
+	typed.KeepAsTyped = true
+	if got := normalizeDraft(rules, typed); got.Subject != typed.Subject || got.Body != typed.Body || got.BodyHTML != typed.BodyHTML {
+		t.Errorf("a draft kept as typed was changed: %+v", got)
+	}
+}
+
+func TestDescribeNormalization(t *testing.T) {
+	typed := &UserState{Subject: "Отчёт  за май", Body: "Добрый день ,\n\n\n\nотчёт во вложении.\nСпасибо!"}
+	sent := normalizeDraft(NormalizeRules{CollapseWhitespace: true, FixPunctuationSpaces: true}, *typed)
+	want := "Тема: «Отчёт··за май» → «Отчёт за май»\n" +
+		"Текст:\n" +
+		"− Добрый день ,\n" +
+		"+ Добрый день,\n" +
+		"− (пустая строка)\n" +
+		"− (пустая строка)\n"
+	if got := describeNormalization(typed, &sent); got != want {
+		t.Errorf("describeNormalization =\n%s\nwant\n%s", got, want)
+	}
+	if got := describeNormalization(&sent, &sent); got != "" {
+		t.Errorf("describeNormalization of an unchanged draft = %q", got)
+	}
+}
+
+func TestDiffLinesClipsLongLines(t *testing.T) {
+	long := strings.Repeat("слово ", 40)
+	diff := diffLines([]string{long + " ,конец"}, []string{long + ",конец"})
+	if len(diff) != 2 || !strings.HasPrefix(diff[0], "− …") || !strings.HasSuffix(diff[1], ",конец") {
+		t.Errorf("diff = %q, want both lines cut to the change at the end", diff)
+	}
+}
@@ -0,0 +1,300 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+// Notification verbosity levels a chat can choose with /notify.
+const (
+	VERBOSITY_VERBOSE = "verbose" // Progress messages and the final result (default)
+	VERBOSITY_QUIET   = "quiet"   // Only the final result
+)
+
+// STATUS_COALESCE_WINDOW is how soon after the last status update of a chat a new one
+// replaces its text instead of arriving as another message.
+const STATUS_COALESCE_WINDOW = 3 * time.Second
+
+// ALL_CHATS is the key of the floor an administrator set for every chat; a floor
+// set for a single chat takes precedence over it. Telegram never uses chat ID 0.
+const ALL_CHATS = 0
+
+// statusMessage is the status message of a chat that later updates may edit.
+type statusMessage struct {
+	messageID int
+	updated   time.Time
+}
+
+// ChatNotifications are the notification settings of a chat.
+type ChatNotifications struct {
+	Verbosity string `json:"verbosity,omitempty"` // Chosen in the chat with /notify, VERBOSITY_VERBOSE when empty
+	// Floor is the least detail an administrator requires for compliance events,
+	// such as a letter leaving the bot; VERBOSITY_VERBOSE keeps them in quiet chats
+	Floor string `json:"floor,omitempty"`
+}
+
+// NotifyStore keeps the notification settings of each chat.
+type NotifyStore interface {
+	// Get returns the chat's settings, empty if it has none.
+	Get(chatID int64) ChatNotifications
+	// Update calls fn with the chat's settings and stores the result.
+	Update(chatID int64, fn func(settings *ChatNotifications))
+}
+
+// memoryNotifyStore is a NotifyStore kept in process memory.
+type memoryNotifyStore struct {
+	mu    sync.Mutex
+	chats map[int64]ChatNotifications
+}
+
+func (m *memoryNotifyStore) Get(chatID int64) ChatNotifications {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chats[chatID]
+}
+
+func (m *memoryNotifyStore) Update(chatID int64, fn func(settings *ChatNotifications)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings := m.chats[chatID]
+	fn(&settings)
+	m.chats[chatID] = settings
+}
+
+// notifyBucket holds JSON-encoded ChatNotifications keyed by chat ID.
+var notifyBucket = []byte("notify")
+
+// boltNotifyStore is a NotifyStore persisted in the bbolt database.
+type boltNotifyStore struct {
+	db *bolt.DB
+}
+
+// newBoltNotifyStore creates the notification settings bucket in the given database.
+func newBoltNotifyStore(db *bolt.DB) (*boltNotifyStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(notifyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы уведомлений: %w", err)
+	}
+	return &boltNotifyStore{db: db}, nil
+}
+
+func (b *boltNotifyStore) Get(chatID int64) ChatNotifications {
+	var settings ChatNotifications
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(notifyBucket).Get(state.Int64Key(chatID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &settings)
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения настроек уведомлений", "chat_id", chatID, "error", err)
+	}
+	return settings
+}
+
+func (b *boltNotifyStore) Update(chatID int64, fn func(settings *ChatNotifications)) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(notifyBucket)
+		key := state.Int64Key(chatID)
+		var settings ChatNotifications
+		if data := bucket.Get(key); data != nil {
+			if err := json.Unmarshal(data, &settings); err != nil {
+				slog.Error("Ошибка чтения настроек уведомлений, настройки сброшены", "chat_id", chatID, "error", err)
+				settings = ChatNotifications{}
+			}
+		}
+		fn(&settings)
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения настроек уведомлений", "chat_id", chatID, "error", err)
+	}
+}
+
+// isQuiet reports whether the chat asked for final results only.
+func (h *Handler) isQuiet(chatID int64) bool {
+	return h.NotifySettings.Get(chatID).Verbosity == VERBOSITY_QUIET
+}
+
+// verbosityFloor returns the floor an administrator set for the chat, or for all chats.
+func (h *Handler) verbosityFloor(chatID int64) string {
+	if floor := h.NotifySettings.Get(chatID).Floor; floor != "" {
+		return floor
+	}
+	return h.NotifySettings.Get(ALL_CHATS).Floor
+}
+
+// sendProgress sends an intermediate status message unless the chat chose quiet notifications.
+func (h *Handler) sendProgress(msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
+	if h.isQuiet(msg.ChatID) {
+		return tgbotapi.Message{}, errQuiet
+	}
+	return h.sendStatus(msg)
+}
+
+// sendComplianceProgress sends the status message of a compliance event, such as a
+// letter leaving the bot. A quiet chat skips it unless an administrator set a
+// verbose floor for it.
+func (h *Handler) sendComplianceProgress(msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
+	if h.isQuiet(msg.ChatID) && h.verbosityFloor(msg.ChatID) != VERBOSITY_VERBOSE {
+		return tgbotapi.Message{}, errQuiet
+	}
+	return h.sendStatus(msg)
+}
+
+// sendStatus sends a status message, merging it into the latest one when it can.
+func (h *Handler) sendStatus(msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
+	bot := h.bot
+	if sent, ok := h.coalesceStatus(msg); ok {
+		return sent, nil
+	}
+	sent, err := bot.Send(msg)
+	if err == nil {
+		h.touchStatus(msg.ChatID, sent.MessageID)
+	}
+	return sent, err
+}
+
+// coalesceStatus edits the latest status message of the chat to the text of msg when
+// it was updated within STATUS_COALESCE_WINDOW, saving an API call and a chat line.
+// Messages with buttons are never merged, and neither are replies to messages that
+// arrived after the status, as the edit would then land above them.
+func (h *Handler) coalesceStatus(msg tgbotapi.MessageConfig) (tgbotapi.Message, bool) {
+	bot := h.bot
+	h.statusMu.Lock()
+	last, ok := h.lastStatus[msg.ChatID]
+	h.statusMu.Unlock()
+	if !ok || time.Since(last.updated) >= STATUS_COALESCE_WINDOW || msg.ReplyMarkup != nil || msg.ReplyToMessageID > last.messageID {
+		return tgbotapi.Message{}, false
+	}
+	edit := tgbotapi.NewEditMessageText(msg.ChatID, last.messageID, msg.Text)
+	edit.ParseMode = msg.ParseMode
+	sent, err := bot.Send(edit)
+	if err != nil && !isNotModified(err) {
+		// The status was deleted or is too old to edit, so a new one is sent instead
+		return tgbotapi.Message{}, false
+	}
+	if err != nil {
+		sent = tgbotapi.Message{MessageID: last.messageID, Chat: &tgbotapi.Chat{ID: msg.ChatID}, Text: msg.Text}
+	}
+	h.touchStatus(msg.ChatID, last.messageID)
+	return sent, true
+}
+
+// editStatus replaces the text of a status message, keeping it open for coalescing.
+func (h *Handler) editStatus(chatID int64, messageID int, text string) {
+	bot := h.bot
+	if _, err := bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, text)); err == nil || isNotModified(err) {
+		h.touchStatus(chatID, messageID)
+	}
+}
+
+// touchStatus records an update of the status message of a chat.
+func (h *Handler) touchStatus(chatID int64, messageID int) {
+	h.statusMu.Lock()
+	defer h.statusMu.Unlock()
+	h.lastStatus[chatID] = statusMessage{messageID: messageID, updated: time.Now()}
+}
+
+// isNotModified reports whether an edit failed only because the text was the same.
+func isNotModified(err error) bool {
+	return strings.Contains(err.Error(), "message is not modified")
+}
+
+// errQuiet is returned by sendProgress when a message was suppressed.
+var errQuiet = errors.New("уведомление отключено настройками чата")
+
+// NOTIFY_USAGE explains /notify; the floor options are only shown to administrators.
+const (
+	NOTIFY_USAGE       = "Использование: /notify verbose — сообщать о каждом шаге, /notify quiet — только итог."
+	NOTIFY_FLOOR_USAGE = "\n\nАдминистраторы: /notify floor verbose [ID чата] — всегда сообщать об отправке писем, " +
+		"/notify floor quiet [ID чата] — снять требование. Без ID чата — для всех чатов."
+)
+
+// handleNotifyCommand switches the chat between verbose and quiet notifications,
+// or lets an administrator set the floor for compliance events.
+func (h *Handler) handleNotifyCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	args := strings.Fields(strings.ToLower(message.CommandArguments()))
+	if len(args) > 0 && args[0] == "floor" {
+		h.handleNotifyFloor(message, args[1:])
+		return
+	}
+	usage := NOTIFY_USAGE
+	if secrets.IsAdmin(message.From.ID) {
+		usage += NOTIFY_FLOOR_USAGE
+	}
+	if len(args) != 1 {
+		bot.Send(newReply(message, usage))
+		return
+	}
+	level := args[0]
+	switch level {
+	case VERBOSITY_VERBOSE, VERBOSITY_QUIET:
+		h.NotifySettings.Update(message.Chat.ID, func(s *ChatNotifications) { s.Verbosity = level })
+		switch {
+		case level == VERBOSITY_VERBOSE:
+			bot.Send(newReply(message, "Теперь бот будет сообщать о каждом шаге отправки."))
+		case h.verbosityFloor(message.Chat.ID) == VERBOSITY_VERBOSE:
+			bot.Send(newReply(message, "Теперь бот будет сообщать только итог отправки. "+
+				"По требованию администратора сообщения об отправке писем останутся."))
+		default:
+			bot.Send(newReply(message, "Теперь бот будет сообщать только итог отправки."))
+		}
+	default:
+		bot.Send(newReply(message, usage))
+	}
+}
+
+// handleNotifyFloor replies to /notify floor <level> [chat ID] (admin only).
+func (h *Handler) handleNotifyFloor(message *tgbotapi.Message, args []string) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	if len(args) == 0 || len(args) > 2 || args[0] != VERBOSITY_VERBOSE && args[0] != VERBOSITY_QUIET {
+		bot.Send(newReply(message, NOTIFY_USAGE+NOTIFY_FLOOR_USAGE))
+		return
+	}
+	level, chatID, target := args[0], int64(ALL_CHATS), "всех чатов"
+	if len(args) == 2 {
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || id == ALL_CHATS {
+			bot.Send(newReply(message, fmt.Sprintf("Некорректный ID чата %q.", args[1])))
+			return
+		}
+		chatID, target = id, fmt.Sprintf("чата %d", id)
+	}
+	// A chat set to quiet is exempt from the floor of all chats; clearing that one
+	// leaves nothing to keep
+	floor := level
+	if level == VERBOSITY_QUIET && chatID == ALL_CHATS {
+		floor = ""
+	}
+	h.NotifySettings.Update(chatID, func(s *ChatNotifications) { s.Floor = floor })
+	audit(message.From, "установил минимум уведомлений %s для %s", level, target)
+	if level == VERBOSITY_VERBOSE {
+		bot.Send(newReply(message, fmt.Sprintf("Для %s сообщения об отправке писем будут приходить и в тихом режиме.", target)))
+	} else {
+		bot.Send(newReply(message, fmt.Sprintf("Для %s требование снято: тихий режим скрывает и сообщения об отправке писем.", target)))
+	}
+}
@@ -0,0 +1,118 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/state"
+)
+
+func TestSendProgressCoalescesStatuses(t *testing.T) {
+	telegram, bot := newTestBot(t)
+	handler := NewHandler(bot, nil, &Secrets{}, MemoryStores())
+	const chatID = 7001
+
+	first, err := handler.sendProgress(tgbotapi.NewMessage(chatID, "Загрузка файла «a.pdf»..."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := handler.sendProgress(tgbotapi.NewMessage(chatID, "Отправляю письмо..."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.MessageID != first.MessageID {
+		t.Errorf("second status is message #%d, want an edit of #%d", second.MessageID, first.MessageID)
+	}
+
+	// A reply to a message newer than the status must not be moved above it
+	reply := tgbotapi.NewMessage(chatID, "Отправляю письмо...")
+	reply.ReplyToMessageID = first.MessageID + 1
+	third, _ := handler.sendProgress(reply)
+	if third.MessageID == first.MessageID {
+		t.Error("status replying to a newer message was merged into the old one")
+	}
+
+	// After the window a status arrives as a new message again
+	handler.statusMu.Lock()
+	handler.lastStatus[chatID] = statusMessage{messageID: third.MessageID, updated: time.Now().Add(-STATUS_COALESCE_WINDOW)}
+	handler.statusMu.Unlock()
+	fourth, _ := handler.sendProgress(tgbotapi.NewMessage(chatID, "Отправляю приглашение..."))
+	if fourth.MessageID == third.MessageID {
+		t.Error("status after the window was merged")
+	}
+	if _, ok := telegram.find(chatID, "Отправляю письмо..."); !ok {
+		t.Errorf("edited status not found:\n%s", telegram.transcript(chatID))
+	}
+}
+
+func TestNotifyFloorKeepsComplianceEvents(t *testing.T) {
+	const admin = 9
+	secrets := wizardSecrets()
+	secrets.AdminUserIDs = []int64{admin}
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, secrets, &steps)
+	send := func(from int64, actions ...wizardAction) {
+		for _, action := range actions {
+			update := action.update()
+			if update.Message != nil {
+				update.Message.From.ID, update.Message.Chat.ID = from, from
+			}
+			handler.HandleUpdate(context.Background(), update)
+		}
+	}
+	letter := []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт за месяц."), textAction("Иван"), tapAction("confirm:send"),
+	}
+
+	send(wizardUser, textAction("/notify quiet"))
+	send(wizardUser, letter...)
+	if sender.sent != 1 || strings.Contains(bot.texts(), "Отправляю письмо...") {
+		t.Fatalf("quiet chat got the progress message:\n%s", bot.texts())
+	}
+
+	send(wizardUser, textAction("/notify floor verbose"))
+	if !strings.Contains(bot.texts(), "Команда доступна только администраторам.") {
+		t.Errorf("a user set the floor:\n%s", bot.texts())
+	}
+	send(admin, textAction("/notify floor verbose"))
+	send(wizardUser, letter...)
+	if sender.sent != 2 || !strings.Contains(bot.texts(), "Отправляю письмо...") {
+		t.Errorf("the floor did not keep the progress message:\n%s", bot.texts())
+	}
+
+	// A chat exempted by the administrator is quiet again
+	bot.sent = nil
+	send(admin, textAction(fmt.Sprintf("/notify floor quiet %d", wizardUser)))
+	send(wizardUser, letter...)
+	if sender.sent != 3 || strings.Contains(bot.texts(), "Отправляю письмо...") {
+		t.Errorf("exempted chat got the progress message:\n%s", bot.texts())
+	}
+}
+
+func TestBoltNotifyStore(t *testing.T) {
+	db, err := state.Open(filepath.Join(t.TempDir(), "bot.db"), state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := newBoltNotifyStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Update(7, func(s *ChatNotifications) { s.Verbosity = VERBOSITY_QUIET })
+	store.Update(7, func(s *ChatNotifications) { s.Floor = VERBOSITY_VERBOSE })
+	if got := store.Get(7); got != (ChatNotifications{Verbosity: VERBOSITY_QUIET, Floor: VERBOSITY_VERBOSE}) {
+		t.Errorf("stored %+v", got)
+	}
+	if got := store.Get(8); got != (ChatNotifications{}) {
+		t.Errorf("unknown chat has %+v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// PREHEADER_SNIPPET_LENGTH is roughly how much of the preheader inbox lists show after the subject.
+const PREHEADER_SNIPPET_LENGTH = 90
+
+// PREHEADER_OPEN starts the hidden element withPreheader puts before the body.
+const PREHEADER_OPEN = `<div style="display:none;max-height:0;overflow:hidden;mso-hide:all">`
+
+// preheaderSnippet returns the text an inbox row shows after the subject: the explicit
+// preheader or, as mail clients do without one, the start of the body.
+func preheaderSnippet(state *UserState) string {
+	text := strings.Join(strings.Fields(choose(state.Preheader, state.Body)), " ")
+	if runes := []rune(text); len(runes) > PREHEADER_SNIPPET_LENGTH {
+		text = strings.TrimSpace(string(runes[:PREHEADER_SNIPPET_LENGTH])) + "…"
+	}
+	return text
+}
+
+// inboxPreview shows how the letter is likely to look in the Gmail and Outlook message lists.
+func inboxPreview(state *UserState) string {
+	snippet := preheaderSnippet(state)
+	return fmt.Sprintf("Gmail: %s | %s — %s\nOutlook:\n  %s\n  %s\n  %s",
+		state.SenderName, state.Subject, snippet, state.SenderName, state.Subject, snippet)
+}
+
+// withPreheader prepends the preheader to the body as hidden text, which mail
+// clients pick up for the inbox row but do not display in the letter itself.
+func withPreheader(body, preheader string) string {
+	if preheader == "" {
+		return body
+	}
+	hidden := PREHEADER_OPEN + html.EscapeString(preheader) + "</div>"
+	return hidden + body
+}
+
+// splitPreheader separates the hidden preheader withPreheader added from the body.
+func splitPreheader(body string) (preheader, rest string) {
+	if !strings.HasPrefix(body, PREHEADER_OPEN) {
+		return "", body
+	}
+	end := strings.Index(body, "</div>")
+	if end < 0 {
+		return "", body
+	}
+	end += len("</div>")
+	return body[:end], body[end:]
+}
@@ -0,0 +1,233 @@
+package bot
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Kinds of access attempts. Webhook requests are only counted: behind a proxy they
+// all come from its address, and Telegram's own could be refused.
+const (
+	PROBE_TELEGRAM = "telegram" // Message or button tap from a user without access
+	PROBE_DEBUG    = "debug"    // Debug server request without the right debug_token
+	PROBE_WEBHOOK  = "webhook"  // Request to the webhook server at a path other than the webhook's
+)
+
+// PROBE_SUMMARY_TOP caps the sources listed in a summary.
+const PROBE_SUMMARY_TOP = 10
+
+// probeKinds names the kinds of attempts in summaries.
+var probeKinds = map[string]string{
+	PROBE_TELEGRAM: "Telegram",
+	PROBE_DEBUG:    "профилирование",
+	PROBE_WEBHOOK:  "вебхук",
+}
+
+// probeSource counts the attempts from one user or address since the last summary.
+type probeSource struct {
+	Kind   string
+	Key    string // Telegram user ID or IP address
+	Detail string // Username or the path requested, as of the last attempt
+	Count  int
+	Last   time.Time
+}
+
+// probeTracker collects access attempts for the daily summary and bans the sources
+// making ban_after of them in a day. Bans of Telegram users are also saved
+// as a /deny, other bans and the counts live in memory until restart.
+type probeTracker struct {
+	mu       sync.Mutex
+	banAfter int
+	since    time.Time
+	sources  map[string]*probeSource
+	banned   map[string]bool
+	now      func() time.Time
+}
+
+// probes holds the attempts since the last summary; serve sets its ban threshold.
+var probes = newProbeTracker()
+
+func newProbeTracker() *probeTracker {
+	return &probeTracker{since: time.Now(), sources: make(map[string]*probeSource), banned: make(map[string]bool), now: time.Now}
+}
+
+// configure sets the ban threshold from the settings, at start and on /reload.
+func (p *probeTracker) configure(settings ProbeSettings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.banAfter = settings.BanAfter
+}
+
+// record counts an attempt and reports whether the source is banned, and whether
+// this attempt is the one that got it banned.
+func (p *probeTracker) record(kind, key, detail string) (banned, now bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := kind + ":" + key
+	source := p.sources[id]
+	if source == nil {
+		source = &probeSource{Kind: kind, Key: key}
+		p.sources[id] = source
+	}
+	source.Count++
+	source.Last = p.now()
+	source.Detail = cmp.Or(detail, source.Detail)
+	if p.banned[id] {
+		return true, false
+	}
+	if kind != PROBE_WEBHOOK && p.banAfter > 0 && source.Count >= p.banAfter {
+		p.banned[id] = true
+		return true, true
+	}
+	return false, false
+}
+
+// isBanned reports whether the source is ignored.
+func (p *probeTracker) isBanned(kind, key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.banned[kind+":"+key]
+}
+
+// unban lifts the ban of the source, as /allow does for a user.
+func (p *probeTracker) unban(kind, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.banned, kind+":"+key)
+}
+
+// summary describes the attempts since the last summary, the most persistent
+// sources first, and starts counting anew when reset is set. It returns "" when
+// there were none.
+func (p *probeTracker) summary(loc *time.Location, reset bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	since := p.since
+	sources := make([]*probeSource, 0, len(p.sources))
+	total := 0
+	for _, source := range p.sources {
+		sources = append(sources, source)
+		total += source.Count
+	}
+	if reset {
+		p.since, p.sources = p.now(), make(map[string]*probeSource)
+	}
+	if total == 0 {
+		return ""
+	}
+	slices.SortFunc(sources, func(a, b *probeSource) int {
+		return cmp.Or(b.Count-a.Count, strings.Compare(a.Kind+a.Key, b.Kind+b.Key))
+	})
+
+	lines := []string{fmt.Sprintf("Попытки доступа с %s: %d, источников: %d.", since.In(loc).Format(SCHEDULE_TIME_LAYOUT), total, len(sources))}
+	for i, source := range sources {
+		if i == PROBE_SUMMARY_TOP {
+			lines = append(lines, fmt.Sprintf("…и ещё источников: %d", len(sources)-i))
+			break
+		}
+		line := fmt.Sprintf("• %s %s", probeKinds[source.Kind], source.Key)
+		if source.Detail != "" {
+			line += " (" + source.Detail + ")"
+		}
+		line += fmt.Sprintf(": %d, последняя в %s", source.Count, source.Last.In(loc).Format(SCHEDULE_CLOCK_LAYOUT))
+		if p.banned[source.Kind+":"+source.Key] {
+			line += ", заблокирован"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// noteTelegramProbe records an update from a user without access and reports
+// whether to ignore it. A user banned for persistence is also denied access, so
+// the ban outlives a restart and is lifted with /allow; they are told so once, in
+// the chat of the update when it has one.
+func (h *Handler) noteTelegramProbe(user *tgbotapi.User, chatID int64) bool {
+	bot := h.bot
+	username := ""
+	if user.UserName != "" {
+		username = "@" + user.UserName
+	}
+	banned, now := probes.record(PROBE_TELEGRAM, strconv.FormatInt(user.ID, 10), username)
+	if now {
+		h.Access.Set(user.ID, false)
+		slog.Warn("Пользователь заблокирован за повторные попытки доступа", "audit", true, "user_id", user.ID, "username", user.UserName)
+		if chatID != 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, renderReply(user.LanguageCode, REPLY_BANNED, ReplyData{UserID: user.ID})))
+		}
+	}
+	return banned
+}
+
+// noteHTTPProbe records a refused request to one of the bot's HTTP servers and
+// reports whether the address is banned.
+func noteHTTPProbe(kind string, r *http.Request) bool {
+	banned, now := probes.record(kind, remoteIP(r), r.URL.Path)
+	if now {
+		slog.Warn("Адрес заблокирован за повторные попытки доступа", "audit", true, "kind", kind, "remote_addr", r.RemoteAddr)
+	}
+	return banned
+}
+
+// remoteIP returns the address of the client without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// nextProbeSummary returns the first summary time after now.
+func nextProbeSummary(now time.Time, settings ProbeSettings, loc *time.Location) time.Time {
+	hour, minute, _ := settings.SummaryClock() // Checked by validate
+	now = now.In(loc)
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, loc)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runProbeSummaries sends the summary of access attempts to the admin chat every
+// day at probes.summary_at until stop is closed, and starts the counts that bans
+// go by anew. Days without attempts are skipped.
+func runProbeSummaries(stop <-chan struct{}, bot BotAPI, secrets *Secrets) {
+	for {
+		settings := snapshotSettings(secrets)
+		next := nextProbeSummary(time.Now(), settings.Probes, settings.Location())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		settings = snapshotSettings(secrets)
+		if text := probes.summary(settings.Location(), true); text != "" {
+			notifyAdminChat(bot, settings, text)
+		}
+	}
+}
+
+// handleProbesCommand shows the attempts since the last summary (admin only).
+func handleProbesCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	text := probes.summary(secrets.Location(), false)
+	if text == "" {
+		text = "Попыток доступа с последней сводки не было."
+	}
+	bot.Send(newReply(message, text))
+}
@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetProbes starts counting anew with the given threshold for the test.
+func resetProbes(t *testing.T, banAfter int) {
+	saved := probes
+	t.Cleanup(func() { probes = saved })
+	probes = newProbeTracker()
+	probes.configure(ProbeSettings{BanAfter: banAfter})
+}
+
+func TestProbeSummary(t *testing.T) {
+	resetProbes(t, 3)
+	clock := time.Date(2026, 5, 4, 9, 0, 0, 0, time.UTC)
+	probes.since, probes.now = clock, func() time.Time { return clock }
+	for range 3 {
+		probes.record(PROBE_TELEGRAM, "42", "@probe")
+	}
+	clock = clock.Add(time.Hour)
+	probes.record(PROBE_WEBHOOK, "10.0.0.1", "/.env")
+	probes.record(PROBE_WEBHOOK, "10.0.0.1", "/wp-login.php")
+	probes.record(PROBE_WEBHOOK, "10.0.0.1", "/admin")
+
+	want := "Попытки доступа с 04.05.2026 09:00: 6, источников: 2.\n" +
+		"• Telegram 42 (@probe): 3, последняя в 09:00, заблокирован\n" +
+		"• вебхук 10.0.0.1 (/admin): 3, последняя в 10:00"
+	if got := probes.summary(time.UTC, true); got != want {
+		t.Errorf("summary =\n%s\nwant\n%s", got, want)
+	}
+	if got := probes.summary(time.UTC, false); got != "" {
+		t.Errorf("summary after reset = %q", got)
+	}
+	// Bans outlast the summary, counts do not
+	if banned, now := probes.record(PROBE_TELEGRAM, "42", ""); !banned || now {
+		t.Errorf("record after the summary = %v, %v, want still banned", banned, now)
+	}
+}
+
+func TestBannedUserIsIgnored(t *testing.T) {
+	resetProbes(t, 2)
+	secrets := wizardSecrets()
+	secrets.AllowedUserIDs = []int64{}
+	secrets.AdminUserIDs = []int64{reloadAdmin}
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, secrets, &steps)
+	for _, action := range []wizardAction{textAction("/start"), textAction("/start"), textAction("/start"), tapAction("confirm:send")} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	if got := strings.Count(bot.texts(), "нет доступа"); got != 1 {
+		t.Errorf("refusals = %d, want only the one before the ban:\n%s", got, bot.texts())
+	}
+	if got := strings.Count(bot.texts(), "Доступ к боту заблокирован"); got != 1 || !strings.Contains(bot.texts(), "ваш ID: 5") {
+		t.Errorf("ban notices = %d, want one with the user's ID:\n%s", got, bot.texts())
+	}
+	if allowed, decided := handler.Access.Get(wizardUser); allowed || !decided {
+		t.Errorf("banned user was not denied access")
+	}
+
+	allow := textAction("/allow 5")
+	update := allow.update()
+	update.Message.From.ID, update.Message.Chat.ID = reloadAdmin, reloadAdmin
+	handler.HandleUpdate(context.Background(), update)
+	if probes.isBanned(PROBE_TELEGRAM, "5") || !handler.isAllowed(wizardUser) {
+		t.Errorf("/allow did not lift the ban")
+	}
+}
+
+func TestDebugServerBansProbers(t *testing.T) {
+	resetProbes(t, 2)
+	server := httptest.NewServer(debugHandler("s3cret"))
+	defer server.Close()
+
+	var codes []int
+	for _, token := range []string{"guess", "guess2", "s3cret"} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/debug/pprof/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+	}
+	if codes[0] != http.StatusUnauthorized || codes[2] != http.StatusForbidden {
+		t.Errorf("statuses %v, want the address banned after two wrong tokens", codes)
+	}
+}
+
+func TestNextProbeSummary(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*3600)
+	settings := ProbeSettings{SummaryAt: "09:30"}
+	for _, tt := range []struct {
+		now, want time.Time
+	}{
+		{time.Date(2026, 5, 4, 8, 0, 0, 0, loc), time.Date(2026, 5, 4, 9, 30, 0, 0, loc)},
+		{time.Date(2026, 5, 4, 9, 30, 0, 0, loc), time.Date(2026, 5, 5, 9, 30, 0, 0, loc)},
+		{time.Date(2026, 5, 4, 23, 0, 0, 0, time.UTC), time.Date(2026, 5, 5, 9, 30, 0, 0, loc)},
+	} {
+		if got := nextProbeSummary(tt.now, settings, loc); !got.Equal(tt.want) {
+			t.Errorf("nextProbeSummary(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MAX_QUEUE_ITEMS is how many waiting letters /queue lists, the soonest first.
+const MAX_QUEUE_ITEMS = 20
+
+// queuedLetters returns the scheduled letters of every user and the reminder
+// letters to recipients, without the reminders sent in Telegram.
+func (h *Handler) queuedLetters() []ScheduledEmail {
+	return slices.DeleteFunc(h.Scheduled.All(), func(job ScheduledEmail) bool { return !job.sendsLetter() })
+}
+
+// queuedRetries returns the retry offers for rejected recipients that still work,
+// oldest first, with their IDs.
+func (h *Handler) queuedRetries() ([]int64, map[int64]FailedSend) {
+	now := time.Now()
+	h.failedSendsMu.Lock()
+	defer h.failedSendsMu.Unlock()
+	retries := make(map[int64]FailedSend)
+	for id, failed := range h.failedSends {
+		if now.Before(failed.Expires) {
+			retries[id] = *failed
+		}
+	}
+	return slices.Sorted(maps.Keys(retries)), retries
+}
+
+// queueList renders the letters waiting to be sent or retried with buttons acting
+// on each: send a one-off letter now, change the recipients of a letter and
+// cancel any of them.
+func (h *Handler) queueList() (string, *tgbotapi.InlineKeyboardMarkup) {
+	secrets := h.secrets
+	loc := secrets.Location()
+	jobs := h.queuedLetters()
+	ids, retries := h.queuedRetries()
+	if len(jobs) == 0 && len(ids) == 0 {
+		return "Очередь пуста: запланированных писем и предложений повтора нет.", nil
+	}
+
+	var lines []string
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if len(jobs) > 0 {
+		lines = append(lines, "Запланированные письма:")
+	}
+	for _, job := range jobs[:min(len(jobs), MAX_QUEUE_ITEMS)] {
+		at := job.SendAt.In(loc).Format(SCHEDULE_TIME_LAYOUT)
+		label := fmt.Sprintf("№%d", job.ID)
+		var buttons []tgbotapi.InlineKeyboardButton
+		switch {
+		case job.FollowUp != nil:
+			lines = append(lines, fmt.Sprintf("%s %s — напоминание получателю о «%s» → %s (пользователь %d)",
+				label, at, job.FollowUp.Subject, job.FollowUp.Recipient, job.UserID))
+		case job.Repeat != "":
+			lines = append(lines, fmt.Sprintf("%s %s — «%s» → %s, повторяется %s (пользователь %d)",
+				label, at, job.Draft.Subject, queueRecipients(job), job.RepeatLabel, job.UserID))
+			buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(label+": получатели", fmt.Sprintf("queue:to:%d", job.ID)))
+		default:
+			lines = append(lines, fmt.Sprintf("%s %s — «%s» → %s (пользователь %d)",
+				label, at, job.Draft.Subject, queueRecipients(job), job.UserID))
+			buttons = append(buttons,
+				tgbotapi.NewInlineKeyboardButtonData(label+": сейчас", fmt.Sprintf("queue:send:%d", job.ID)),
+				tgbotapi.NewInlineKeyboardButtonData(label+": получатели", fmt.Sprintf("queue:to:%d", job.ID)))
+		}
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(label+": отменить", fmt.Sprintf("queue:cancel:%d", job.ID)))
+		rows = append(rows, buttons)
+	}
+	if len(jobs) > MAX_QUEUE_ITEMS {
+		lines = append(lines, fmt.Sprintf("…и ещё %d, они появятся здесь, когда подойдёт их очередь.", len(jobs)-MAX_QUEUE_ITEMS))
+	}
+
+	if len(ids) > 0 {
+		lines = append(lines, "Ждут повтора для непринятых адресов:")
+	}
+	for _, id := range ids[:min(len(ids), MAX_QUEUE_ITEMS)] {
+		failed := retries[id]
+		label := fmt.Sprintf("П%d", id)
+		lines = append(lines, fmt.Sprintf("%s «%s» → %s (пользователь %d), кнопка работает до %s",
+			label, failed.Email.Subject, strings.Join(failed.Email.Recipients, ", "), failed.UserID,
+			failed.Expires.In(loc).Format(SCHEDULE_TIME_LAYOUT)))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label+": отменить", fmt.Sprintf("queue:drop:%d", id)),
+		))
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return strings.Join(lines, "\n"), &markup
+}
+
+// queueRecipients names the recipients of a scheduled letter.
+func queueRecipients(job ScheduledEmail) string {
+	return cmp.Or(strings.Join(job.Draft.Recipients, ", "), "получатель по умолчанию")
+}
+
+// queuedLetter returns the waiting letter with the given ID.
+func (h *Handler) queuedLetter(id int64) (ScheduledEmail, bool) {
+	jobs := h.queuedLetters()
+	i := slices.IndexFunc(jobs, func(job ScheduledEmail) bool { return job.ID == id })
+	if i < 0 {
+		return ScheduledEmail{}, false
+	}
+	return jobs[i], true
+}
+
+// handleQueueCommand (admin only) replies to /queue with the letters waiting to be
+// sent or retried, and to /queue to <№> <адреса> by changing the recipients of a
+// scheduled letter.
+func (h *Handler) handleQueueCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 {
+		text, markup := h.queueList()
+		msg := newReply(message, text)
+		if markup != nil {
+			msg.ReplyMarkup = *markup
+		}
+		bot.Send(msg)
+		return
+	}
+
+	usage := "Использование: /queue — очередь писем, /queue to <№> адрес@example.com, ... — сменить получателей запланированного письма."
+	if len(args) < 3 || args[0] != "to" {
+		bot.Send(newReply(message, usage))
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "№"), 10, 64)
+	if err != nil {
+		bot.Send(newReply(message, usage))
+		return
+	}
+	recipients, err := parseRecipients(strings.Join(args[2:], " "))
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	job, ok := h.queuedLetter(id)
+	if !ok || job.FollowUp != nil {
+		bot.Send(newReply(message, fmt.Sprintf("Письма №%d нет в очереди.", id)))
+		return
+	}
+	if !h.Scheduled.Retarget(id, recipients) {
+		bot.Send(newReply(message, "Письмо уже отправлено или отменено."))
+		return
+	}
+	audit(message.From, "сменил получателей письма №%d пользователя %d: %s", id, job.UserID, strings.Join(recipients, ", "))
+	bot.Send(tgbotapi.NewMessage(job.ChatID, fmt.Sprintf("Администратор изменил получателей запланированного письма «%s»: %s",
+		job.Draft.Subject, strings.Join(recipients, ", "))))
+	bot.Send(newReply(message, fmt.Sprintf("Получатели письма №%d: %s", id, strings.Join(recipients, ", "))))
+}
+
+// handleQueueCallback handles the buttons under /queue and updates the list in place.
+func (h *Handler) handleQueueCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil || !secrets.IsAdmin(query.From.ID) {
+		return "Кнопка устарела."
+	}
+	action, arg, _ := strings.Cut(payload, ":")
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return "Кнопка устарела."
+	}
+
+	var reply string
+	switch action {
+	case "drop":
+		h.failedSendsMu.Lock()
+		failed, ok := h.failedSends[id]
+		delete(h.failedSends, id)
+		h.failedSendsMu.Unlock()
+		if !ok {
+			return "Повтор уже выполнен или устарел."
+		}
+		releaseAttachments(failed.Email.Attachments)
+		audit(query.From, "отменил повтор письма «%s» пользователя %d", failed.Email.Subject, failed.UserID)
+		bot.Send(tgbotapi.NewMessage(failed.ChatID, fmt.Sprintf("Администратор отменил повтор письма «%s», кнопка повтора больше не работает.", failed.Email.Subject)))
+		reply = "Повтор отменён"
+	case "send", "cancel", "to":
+		job, ok := h.queuedLetter(id)
+		if !ok {
+			return "Письмо уже отправлено или отменено."
+		}
+		// Only a one-off letter is sent early, and a reminder keeps its recipient
+		if action == "send" && job.Repeat != "" || action != "cancel" && job.FollowUp != nil {
+			return "Кнопка устарела."
+		}
+		if action == "to" {
+			bot.Send(newReply(query.Message, fmt.Sprintf("Чтобы сменить получателей письма №%d «%s», отправьте:\n/queue to %d адрес@example.com, ...", id, job.Draft.Subject, id)))
+			return ""
+		}
+		if !h.Scheduled.Remove(id) {
+			return "Письмо уже отправлено или отменено."
+		}
+		if action == "cancel" {
+			notice := fmt.Sprintf("Администратор отменил запланированное письмо «%s».", job.Draft.Subject)
+			if job.FollowUp != nil {
+				notice = fmt.Sprintf("Администратор отменил письмо-напоминание получателю о «%s».", job.FollowUp.Subject)
+			}
+			audit(query.From, "отменил письмо №%d пользователя %d", id, job.UserID)
+			slog.InfoContext(ctx, "Запланированное письмо отменено администратором", "schedule_id", id, "owner_id", job.UserID)
+			bot.Send(tgbotapi.NewMessage(job.ChatID, notice))
+			reply = "Отправка отменена"
+		} else {
+			audit(query.From, "отправил письмо №%d пользователя %d раньше срока", id, job.UserID)
+			h.sendScheduled(ctx, job, time.Time{})
+			reply = "Письмо отправлено"
+		}
+	default:
+		return "Кнопка устарела."
+	}
+
+	text, markup := h.queueList()
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ReplyMarkup = markup
+	bot.Send(edit)
+	return reply
+}
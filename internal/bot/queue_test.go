@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueCommand(t *testing.T) {
+	var steps []string
+	secrets := wizardSecrets()
+	secrets.AdminUserIDs = []int64{wizardUser}
+	handler, bot, sender := newWizardHandler(t, secrets, &steps)
+	draft := UserState{Recipients: []string{"a@example.com"}, Subject: "Отчёт", Body: "Текст", SenderName: "Иван"}
+	oneOff := &ScheduledEmail{UserID: 9, ChatID: 9, SendAt: time.Now().Add(time.Hour), Draft: draft}
+	recurring := &ScheduledEmail{UserID: 9, ChatID: 9, SendAt: time.Now().Add(2 * time.Hour), Draft: draft, Repeat: "0 9 * * 1", RepeatLabel: "по понедельникам в 09:00"}
+	handler.Scheduled.Add(oneOff)
+	handler.Scheduled.Add(recurring)
+	handler.failedSends[1] = &FailedSend{UserID: 9, ChatID: 9, Email: Email{Recipients: []string{"b@example.com"}, Subject: "Счёт"}, Expires: time.Now().Add(time.Hour)}
+
+	handler.HandleUpdate(context.Background(), userMessage(9, "/queue"))
+	if !strings.Contains(bot.texts(), "Команда доступна только администраторам.") {
+		t.Errorf("/queue was not refused to a user:\n%s", bot.texts())
+	}
+	handler.HandleUpdate(context.Background(), textAction("/queue").update())
+	for _, want := range []string{
+		"№1 ", "— «Отчёт» → a@example.com (пользователь 9)",
+		"повторяется по понедельникам в 09:00",
+		"П1 «Счёт» → b@example.com (пользователь 9)",
+	} {
+		if !strings.Contains(bot.texts(), want) {
+			t.Errorf("queue does not list %q:\n%s", want, bot.texts())
+		}
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/queue to 1 c@example.com, d@example.com").update())
+	if list := handler.Scheduled.List(9); len(list) != 2 || strings.Join(list[0].Draft.Recipients, ",") != "c@example.com,d@example.com" {
+		t.Errorf("scheduled = %+v, want the new recipients", list)
+	}
+	for _, action := range []wizardAction{tapAction("queue:send:2"), tapAction("queue:send:1"), tapAction("queue:cancel:2"), tapAction("queue:drop:1")} {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	if sender.sent != 1 {
+		t.Errorf("sent %d letters, want only the one-off one", sender.sent)
+	}
+	if sent := handler.History.Recent(9, 1); len(sent) != 1 || sent[0].Recipient != "c@example.com,d@example.com" {
+		t.Errorf("history = %+v, want the letter to the new recipients", sent)
+	}
+	if list := handler.Scheduled.All(); len(list) != 0 {
+		t.Errorf("scheduled = %+v, want none left", list)
+	}
+	if len(handler.failedSends) != 0 {
+		t.Error("the retry offer was not dropped")
+	}
+	for _, want := range []string{"Администратор изменил получателей", "Администратор отменил запланированное письмо «Отчёт»", "Администратор отменил повтор письма «Счёт»"} {
+		if !strings.Contains(bot.texts(), want) {
+			t.Errorf("the user was not told %q:\n%s", want, bot.texts())
+		}
+	}
+}
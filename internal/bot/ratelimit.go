@@ -0,0 +1,329 @@
+package bot
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// RATE_LIMIT_DAY is the period of rate_limit.daily_cap, counted from the sends
+// rather than from midnight.
+const RATE_LIMIT_DAY = 24 * time.Hour
+
+// SETLIMIT_USAGE explains the arguments of /setlimit.
+const SETLIMIT_USAGE = "Лимиты отправки (только администраторы):\n" +
+	"/setlimit — показать текущие\n" +
+	"/setlimit per_hour 10 — писем в час на пользователя\n" +
+	"/setlimit burst 3 — писем подряд на пользователя\n" +
+	"/setlimit daily_cap 200 — писем в сутки на всех\n\n" +
+	"Значение 0 снимает ограничение. Изменения действуют до перезапуска бота, постоянные лимиты задаются в rate_limit в secrets.json."
+
+// sendLimits limits the sends of all users; it has no limits until configureRateLimits.
+var sendLimits = newRateLimiter(RateLimit{})
+
+// configureRateLimits applies rate_limit from secrets.json.
+func configureRateLimits(secrets *Secrets) {
+	sendLimits = newRateLimiter(secrets.RateLimit)
+	if secrets.RateLimit.PerHour > 0 || secrets.RateLimit.DailyCap > 0 {
+		slog.Info("Включено ограничение отправки", "per_hour", secrets.RateLimit.PerHour,
+			"burst", sendLimits.user.capacity, "daily_cap", secrets.RateLimit.DailyCap)
+	}
+}
+
+// rateLimitError reports a send refused by the limiter and how long until the
+// next one is allowed.
+type rateLimitError struct {
+	Wait   time.Duration
+	Global bool // The daily cap of the bot is used up rather than the user's allowance
+	Limit  int  // Letters per hour, or per day for the daily cap
+}
+
+func (e *rateLimitError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("исчерпан общий лимит бота (%d в сутки)", e.Limit)
+	}
+	return fmt.Sprintf("исчерпан ваш лимит отправки (%d в час)", e.Limit)
+}
+
+// describeLimits lists the limits for /setlimit.
+func describeLimits(r RateLimit) string {
+	perUser, total := "нет", "нет"
+	if r.PerHour > 0 {
+		perUser = fmt.Sprintf("%d в час", r.PerHour)
+		if r.Burst > 0 && r.Burst != r.PerHour {
+			perUser += fmt.Sprintf(", подряд до %d", r.Burst)
+		}
+	}
+	if r.DailyCap > 0 {
+		total = fmt.Sprintf("%d в сутки", r.DailyCap)
+	}
+	return fmt.Sprintf("Лимит на пользователя: %s.\nОбщий лимит бота: %s.", perUser, total)
+}
+
+// bucketSpec is the size of a token bucket and how often it regains a token.
+// A zero capacity means no limit.
+type bucketSpec struct {
+	capacity float64
+	every    time.Duration
+}
+
+// tokenBucket is the allowance left at the time of the last update. Sends that
+// are charged rather than taken may leave it below zero.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens regained since the last update, up to the capacity.
+func (s bucketSpec) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = min(s.capacity, b.tokens+float64(elapsed)/float64(s.every))
+	}
+	b.updated = now
+}
+
+// wait returns how long until the refilled bucket has a whole token.
+func (s bucketSpec) wait(b *tokenBucket) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(s.every))
+}
+
+// rateLimiter keeps a token bucket per user and one for the whole bot.
+type rateLimiter struct {
+	user   bucketSpec
+	global bucketSpec
+	limit  RateLimit
+	now    func() time.Time
+
+	mu    sync.Mutex
+	users map[int64]*tokenBucket
+	all   tokenBucket
+}
+
+// newRateLimiter creates a limiter whose buckets start full.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	l := &rateLimiter{limit: limit, now: time.Now, users: make(map[int64]*tokenBucket)}
+	if limit.PerHour > 0 {
+		l.user = bucketSpec{capacity: float64(cmp.Or(limit.Burst, limit.PerHour)), every: time.Hour / time.Duration(limit.PerHour)}
+	}
+	if limit.DailyCap > 0 {
+		l.global = bucketSpec{capacity: float64(limit.DailyCap), every: RATE_LIMIT_DAY / time.Duration(limit.DailyCap)}
+		l.all = tokenBucket{tokens: l.global.capacity, updated: l.now()}
+	}
+	return l
+}
+
+// current returns the limits in effect.
+func (l *rateLimiter) current() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// set changes the limits at run time, keeping what was spent: buckets shrink to
+// the new size, and those that had no limit start full.
+func (l *rateLimiter) set(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	fresh := newRateLimiter(limit)
+	fresh.all.updated = now
+	if l.global.capacity > 0 && fresh.global.capacity > 0 {
+		l.global.refill(&l.all, now)
+		fresh.all.tokens = min(l.all.tokens, fresh.global.capacity)
+	}
+	if l.user.capacity > 0 && fresh.user.capacity > 0 {
+		for id, b := range l.users {
+			l.user.refill(b, now)
+			b.tokens = min(b.tokens, fresh.user.capacity)
+			fresh.users[id] = b
+		}
+	}
+	l.user, l.global, l.limit, l.users, l.all = fresh.user, fresh.global, fresh.limit, fresh.users, fresh.all
+}
+
+// bucket returns the refilled bucket of the user, creating a full one for a new user.
+// The caller holds mu.
+func (l *rateLimiter) bucket(userID int64, now time.Time) *tokenBucket {
+	b, ok := l.users[userID]
+	if !ok {
+		b = &tokenBucket{tokens: l.user.capacity, updated: now}
+		l.users[userID] = b
+	}
+	l.user.refill(b, now)
+	return b
+}
+
+// take spends a send of the user and of the bot, or returns a *rateLimitError
+// with the wait until both allow one. Nothing is spent when the send is refused.
+func (l *rateLimiter) take(userID int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var refused *rateLimitError
+	if l.user.capacity > 0 {
+		b := l.bucket(userID, now)
+		if wait := l.user.wait(b); wait > 0 {
+			refused = &rateLimitError{Wait: wait, Limit: l.limit.PerHour}
+		}
+	}
+	if l.global.capacity > 0 {
+		l.global.refill(&l.all, now)
+		// The longer wait is the one that matters
+		if wait := l.global.wait(&l.all); wait > 0 && (refused == nil || wait > refused.Wait) {
+			refused = &rateLimitError{Wait: wait, Global: true, Limit: l.limit.DailyCap}
+		}
+	}
+	if refused != nil {
+		return refused
+	}
+	l.spend(userID, now)
+	return nil
+}
+
+// charge spends a send even when the allowance is used up, for letters the user
+// does not send right now, such as scheduled ones. It delays the user's next sends.
+func (l *rateLimiter) charge(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.user.capacity > 0 {
+		l.bucket(userID, now)
+	}
+	if l.global.capacity > 0 {
+		l.global.refill(&l.all, now)
+	}
+	l.spend(userID, now)
+}
+
+// spend takes a token from the refilled buckets. The caller holds mu.
+func (l *rateLimiter) spend(userID int64, now time.Time) {
+	if l.user.capacity > 0 {
+		l.users[userID].tokens--
+	}
+	if l.global.capacity > 0 {
+		l.all.tokens--
+	}
+	// Full buckets are the same as missing ones, so they are dropped to keep the map small
+	for id, b := range l.users {
+		if l.user.refill(b, now); b.tokens >= l.user.capacity {
+			delete(l.users, id)
+		}
+	}
+}
+
+// allowSend takes a send from the user's allowance, replying to the message with
+// the time of the next allowed send when it is used up. It reports whether the
+// letter may be sent.
+func allowSend(bot BotAPI, secrets *Secrets, message *tgbotapi.Message, user *tgbotapi.User) bool {
+	var limited *rateLimitError
+	if err := sendLimits.take(user.ID); !errors.As(err, &limited) {
+		return true
+	}
+	slog.Info("Отправка отклонена ограничением", "user_id", user.ID, "global", limited.Global, "wait", limited.Wait.Round(time.Second))
+	now := time.Now().In(secrets.Location())
+	next := now.Add(limited.Wait)
+	layout := SCHEDULE_CLOCK_LAYOUT
+	if !sameDay(next, now) {
+		layout = SCHEDULE_TIME_LAYOUT
+	}
+	bot.Send(newReply(message, renderReply(user.LanguageCode, REPLY_QUOTA_EXCEEDED, ReplyData{
+		Error:   limited.Error(),
+		Wait:    formatWait(limited.Wait),
+		RetryAt: next.Format(layout),
+		When:    formatRetry(next, now),
+		UserID:  user.ID,
+	})))
+	return false
+}
+
+// sameDay reports whether both times fall on the same calendar day.
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// formatWait renders a wait rounded up to a minute: "40 мин", "2 ч 5 мин". Waits
+// of a day or more drop the minutes: "2 дн 3 ч".
+func formatWait(wait time.Duration) string {
+	minutes := int((wait + time.Minute - 1) / time.Minute)
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%d мин", minutes)
+	case minutes >= 24*60 && minutes/60%24 == 0:
+		return fmt.Sprintf("%d дн", minutes/60/24)
+	case minutes >= 24*60:
+		return fmt.Sprintf("%d дн %d ч", minutes/60/24, minutes/60%24)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d ч", minutes/60)
+	}
+	return fmt.Sprintf("%d ч %d мин", minutes/60, minutes%60)
+}
+
+// formatMoment names a time relative to now, both in the bot's time zone: "в 14:32"
+// today, "завтра в 09:00", or the date for later days, "20.05 в 09:00".
+func formatMoment(at, now time.Time) string {
+	clock := "в " + at.Format(SCHEDULE_CLOCK_LAYOUT)
+	switch {
+	case sameDay(at, now):
+		return clock
+	case sameDay(at, now.AddDate(0, 0, 1)):
+		return "завтра " + clock
+	case at.Year() == now.Year():
+		return at.Format("02.01") + " " + clock
+	}
+	return at.Format("02.01.2006") + " " + clock
+}
+
+// formatRetry tells when something may be tried again, both as a wait and as a
+// time: "через 5 мин, в 14:32".
+func formatRetry(at, now time.Time) string {
+	return "через " + formatWait(at.Sub(now)) + ", " + formatMoment(at, now)
+}
+
+// handleSetLimitCommand shows or changes a send limit until the bot restarts:
+// /setlimit per_hour|burst|daily_cap <число> (admin only).
+func handleSetLimitCommand(bot BotAPI, secrets *Secrets, message *tgbotapi.Message) {
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	limit := sendLimits.current()
+	fields := strings.Fields(message.CommandArguments())
+	if len(fields) == 0 {
+		bot.Send(newReply(message, describeLimits(limit)+"\n\n"+SETLIMIT_USAGE))
+		return
+	}
+	value, err := strconv.Atoi(fields[len(fields)-1])
+	if len(fields) != 2 || err != nil {
+		bot.Send(newReply(message, SETLIMIT_USAGE))
+		return
+	}
+	switch fields[0] {
+	case "per_hour":
+		limit.PerHour = value
+	case "burst":
+		limit.Burst = value
+	case "daily_cap":
+		limit.DailyCap = value
+	default:
+		bot.Send(newReply(message, fmt.Sprintf("Неизвестный лимит %q.\n\n%s", fields[0], SETLIMIT_USAGE)))
+		return
+	}
+	if err := limit.Validate(); err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	sendLimits.set(limit)
+	audit(message.From, "изменил лимит отправки %s на %d", fields[0], value)
+	bot.Send(newReply(message, "Лимиты изменены до перезапуска бота.\n"+describeLimits(limit)))
+}
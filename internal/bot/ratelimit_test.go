@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLimiter returns a limiter on a clock the test moves with advance.
+func testLimiter(limit RateLimit) (*rateLimiter, func(time.Duration)) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(limit)
+	l.now = func() time.Time { return now }
+	l.all.updated = now
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+// refusal returns the error of take as a *rateLimitError, failing when it is not one.
+func refusal(t *testing.T, err error) *rateLimitError {
+	t.Helper()
+	var limited *rateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("take = %v, want a refusal", err)
+	}
+	return limited
+}
+
+func TestRateLimiterPerUser(t *testing.T) {
+	l, advance := testLimiter(RateLimit{PerHour: 2})
+	for range 2 {
+		if err := l.take(1); err != nil {
+			t.Fatalf("take within the limit: %v", err)
+		}
+	}
+	if limited := refusal(t, l.take(1)); limited.Global || limited.Wait != 30*time.Minute || limited.Limit != 2 {
+		t.Errorf("refusal = %+v, want the user's limit with 30m to wait", limited)
+	}
+	if err := l.take(2); err != nil {
+		t.Errorf("another user was limited: %v", err)
+	}
+
+	advance(20 * time.Minute)
+	if limited := refusal(t, l.take(1)); limited.Wait != 10*time.Minute {
+		t.Errorf("wait = %v, want 10m", limited.Wait)
+	}
+	advance(10 * time.Minute)
+	if err := l.take(1); err != nil {
+		t.Errorf("take after the wait: %v", err)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l, _ := testLimiter(RateLimit{PerHour: 60, Burst: 3})
+	for range 3 {
+		if err := l.take(1); err != nil {
+			t.Fatalf("take within the burst: %v", err)
+		}
+	}
+	if limited := refusal(t, l.take(1)); limited.Wait != time.Minute || limited.Limit != 60 {
+		t.Errorf("refusal = %+v, want 1m to wait at 60 an hour", limited)
+	}
+}
+
+func TestRateLimiterDailyCap(t *testing.T) {
+	l, advance := testLimiter(RateLimit{PerHour: 10, DailyCap: 2})
+	for _, userID := range []int64{1, 2} {
+		if err := l.take(userID); err != nil {
+			t.Fatalf("take within the cap: %v", err)
+		}
+	}
+	if limited := refusal(t, l.take(3)); !limited.Global || limited.Wait != 12*time.Hour || limited.Limit != 2 {
+		t.Errorf("refusal = %+v, want the daily cap with 12h to wait", limited)
+	}
+	advance(12 * time.Hour)
+	if err := l.take(3); err != nil {
+		t.Errorf("take after the wait: %v", err)
+	}
+}
+
+func TestRateLimiterChargeOverLimit(t *testing.T) {
+	l, _ := testLimiter(RateLimit{PerHour: 1})
+	if err := l.take(1); err != nil {
+		t.Fatal(err)
+	}
+	// A scheduled letter goes out anyway and pushes the next send back
+	l.charge(1)
+	if limited := refusal(t, l.take(1)); limited.Wait != 2*time.Hour {
+		t.Errorf("wait = %v, want 2h", limited.Wait)
+	}
+}
+
+func TestRateLimiterDropsFullBuckets(t *testing.T) {
+	l, advance := testLimiter(RateLimit{PerHour: 4})
+	l.take(1)
+	advance(15 * time.Minute)
+	l.take(2)
+	if _, ok := l.users[1]; ok {
+		t.Error("refilled bucket of user 1 is kept")
+	}
+	if _, ok := l.users[2]; !ok {
+		t.Error("bucket of user 2 is dropped")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l, _ := testLimiter(RateLimit{})
+	for range 100 {
+		if err := l.take(1); err != nil {
+			t.Fatalf("take without limits: %v", err)
+		}
+		l.charge(1)
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		time.Second:                   "1 мин",
+		30 * time.Minute:              "30 мин",
+		59*time.Minute + time.Second:  "1 ч",
+		2 * time.Hour:                 "2 ч",
+		2*time.Hour + 5*time.Minute:   "2 ч 5 мин",
+		23*time.Hour + 59*time.Minute: "23 ч 59 мин",
+		24 * time.Hour:                "1 дн",
+		50*time.Hour + 30*time.Minute: "2 дн 2 ч",
+	} {
+		if got := formatWait(wait); got != want {
+			t.Errorf("formatWait(%v) = %q, want %q", wait, got, want)
+		}
+	}
+}
+
+func TestFormatRetry(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	now := time.Date(2026, 5, 18, 14, 27, 0, 0, loc)
+	for at, want := range map[time.Time]string{
+		now.Add(5 * time.Minute):               "через 5 мин, в 14:32",
+		now.Add(18*time.Hour + 33*time.Minute): "через 18 ч 33 мин, завтра в 09:00",
+		now.Add(48 * time.Hour):                "через 2 дн, 20.05 в 14:27",
+		now.AddDate(1, 0, 0):                   "через 365 дн, 18.05.2027 в 14:27",
+	} {
+		if got := formatRetry(at, now); got != want {
+			t.Errorf("formatRetry(%v) = %q, want %q", at, got, want)
+		}
+	}
+}
+
+func TestWizardSendOverLimitReturnsToPreview(t *testing.T) {
+	defaultLimits := sendLimits
+	t.Cleanup(func() { sendLimits = defaultLimits })
+	sendLimits = newRateLimiter(RateLimit{PerHour: 1})
+
+	handler, sender := runWizard(t, decodeActions(slices.Concat(happyPath, happyPath)))
+	if sender.sent != 1 {
+		t.Errorf("sent %d letters, want 1", sender.sent)
+	}
+	if state, _ := handler.States.Get(wizardUser); state.State != "await_confirm" {
+		t.Errorf("state after a refused send = %q, want the draft on preview", state.State)
+	}
+}
+
+func TestSpamCheckCountsAgainstLimit(t *testing.T) {
+	defaultLimits := sendLimits
+	t.Cleanup(func() { sendLimits = defaultLimits })
+	sendLimits = newRateLimiter(RateLimit{PerHour: 1})
+
+	secrets := wizardSecrets()
+	secrets.MailTesterUsername = "tester"
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, secrets, &steps)
+	// The report poller stops with the context instead of waiting for mail-tester
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	draft := happyPath[:len(happyPath)-1]
+	for _, action := range decodeActions(slices.Concat(happyPath, draft)) {
+		handler.HandleUpdate(ctx, action.update())
+	}
+	handler.HandleUpdate(ctx, tapAction("confirm:spamcheck").update())
+	if sender.sent != 1 || strings.Contains(bot.texts(), "Тестовое письмо отправлено") {
+		t.Errorf("sent %d letters, want the spam check refused:\n%s", sender.sent, bot.texts())
+	}
+}
+
+func TestRateLimiterSetKeepsSpent(t *testing.T) {
+	l, _ := testLimiter(RateLimit{PerHour: 10})
+	for range 8 {
+		l.take(1)
+	}
+	l.set(RateLimit{PerHour: 4, DailyCap: 5})
+	// Two of the four letters an hour are left, as they were
+	for range 2 {
+		if err := l.take(1); err != nil {
+			t.Fatalf("take of what was left: %v", err)
+		}
+	}
+	if limited := refusal(t, l.take(1)); limited.Global || limited.Limit != 4 {
+		t.Errorf("refusal = %+v, want the new per-user limit", limited)
+	}
+	// The daily cap was not set before, so its bucket started full
+	for _, userID := range []int64{2, 3, 4} {
+		if err := l.take(userID); err != nil {
+			t.Fatalf("take within the new cap: %v", err)
+		}
+	}
+	if limited := refusal(t, l.take(5)); !limited.Global {
+		t.Errorf("refusal = %+v, want the daily cap", limited)
+	}
+}
+
+func TestSetLimitCommand(t *testing.T) {
+	telegram, handler := adminBot(t)
+	for _, command := range []string{"/setlimit per_hour 5", "/setlimit burst 2", "/setlimit daily_cap -1", "/setlimit weekly 3"} {
+		handler.HandleUpdate(context.Background(), textAction(command).update())
+	}
+	if limit := sendLimits.current(); limit != (RateLimit{PerHour: 5, Burst: 2}) {
+		t.Errorf("limits = %+v, want 5 an hour, 2 in a row", limit)
+	}
+	for _, want := range []string{"Лимит на пользователя: 5 в час, подряд до 2.", "не могут быть отрицательными", "Неизвестный лимит \"weekly\""} {
+		if _, ok := telegram.find(wizardUser, want); !ok {
+			t.Errorf("no %q in:\n%s", want, telegram.transcript(wizardUser))
+		}
+	}
+}
+
+func TestQuotaReplyTemplate(t *testing.T) {
+	defaultLimits := sendLimits
+	t.Cleanup(func() {
+		sendLimits = defaultLimits
+		loadReplyTemplates(nil)
+	})
+	sendLimits = newRateLimiter(RateLimit{PerHour: 1})
+	err := loadReplyTemplates(map[string]map[string]string{
+		DEFAULT_REPLY_LOCALE: {REPLY_QUOTA_EXCEEDED: "Лимит: {{.Error}}; ждать {{.Wait}}, до {{.RetryAt}}."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	for _, action := range decodeActions(slices.Concat(happyPath, happyPath)) {
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	want := regexp.MustCompile(`Лимит: исчерпан ваш лимит отправки \(1 в час\); ждать 1 ч, до [^.]+\.`)
+	if sender.sent != 1 || !want.MatchString(bot.texts()) {
+		t.Errorf("refusal does not follow the template:\n%s", bot.texts())
+	}
+}
@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+const (
+	// RECONCILE_INTERVAL is how often the history is checked against the provider,
+	// and the period each check covers.
+	RECONCILE_INTERVAL = 24 * time.Hour
+	// RECONCILE_SETTLE is how old a letter must be before the provider is expected
+	// to know it; newer ones are left for the next check.
+	RECONCILE_SETTLE = 15 * time.Minute
+	// RECONCILE_BATCH is how many letter IDs one checkEmail call asks about.
+	RECONCILE_BATCH = 100
+	// MAX_RECONCILE_ITEMS is how many mismatched letters a report lists.
+	MAX_RECONCILE_ITEMS = 20
+)
+
+// reconcileMismatch is a letter of the history the provider does not know.
+type reconcileMismatch struct {
+	Entry   SentEmail
+	Unknown []string // IDs of the letter checkEmail did not return
+}
+
+// reconcileHistory asks the provider about every letter it accepted between from
+// and until according to the history, and returns the letters checked and those
+// with IDs the provider does not know, newest first.
+func (h *Handler) reconcileHistory(ctx context.Context, secrets *Secrets, from, until time.Time) (int, []reconcileMismatch, error) {
+	var entries []SentEmail
+	var ids []string
+	for _, entry := range h.History.Since(from) {
+		if entry.SentAt.After(until) || entry.Status == HISTORY_FAILED || entry.MessageID == "" {
+			continue
+		}
+		entries = append(entries, entry)
+		ids = append(ids, strings.Split(entry.MessageID, ", ")...)
+	}
+
+	known := make(map[string]bool)
+	for start := 0; start < len(ids); start += RECONCILE_BATCH {
+		statuses, err := checkEmailStatus(ctx, secrets.UnisenderAPIKey, ids[start:min(start+RECONCILE_BATCH, len(ids))])
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, status := range statuses {
+			known[string(status.ID)] = true
+		}
+	}
+
+	var mismatches []reconcileMismatch
+	for _, entry := range entries {
+		var unknown []string
+		for _, id := range strings.Split(entry.MessageID, ", ") {
+			if !known[id] {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) > 0 {
+			mismatches = append(mismatches, reconcileMismatch{Entry: entry, Unknown: unknown})
+		}
+	}
+	return len(entries), mismatches, nil
+}
+
+// formatReconcileReport describes the result of a check for the admin chat. Like
+// the status board it leaves addresses out; the history number finds the letter.
+func formatReconcileReport(checked int, mismatches []reconcileMismatch, loc *time.Location) string {
+	if len(mismatches) == 0 {
+		return fmt.Sprintf("Сверка истории с Unisender: проверено писем %d, расхождений нет.", checked)
+	}
+	lines := []string{fmt.Sprintf("Сверка истории с Unisender: проверено писем %d, Unisender не знает %d из них:", checked, len(mismatches))}
+	for _, m := range mismatches[:min(len(mismatches), MAX_RECONCILE_ITEMS)] {
+		lines = append(lines, fmt.Sprintf("№%d %s «%s» (пользователь %d): нет ID %s",
+			m.Entry.ID, m.Entry.SentAt.In(loc).Format(SCHEDULE_TIME_LAYOUT), m.Entry.Subject, m.Entry.UserID, strings.Join(m.Unknown, ", ")))
+	}
+	if len(mismatches) > MAX_RECONCILE_ITEMS {
+		lines = append(lines, fmt.Sprintf("…и ещё %d.", len(mismatches)-MAX_RECONCILE_ITEMS))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runReconciliation checks the history of the last RECONCILE_INTERVAL against
+// Unisender every RECONCILE_INTERVAL until stop is closed, and reports letters
+// the provider does not know to the admin chat. Checks that find nothing stay quiet.
+func (h *Handler) runReconciliation(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(RECONCILE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		secrets := snapshotSettings(h.secrets)
+		if !mailer.CapabilitiesOf(secrets.EmailProvider).DeliveryStatus || secrets.AdminChatID == 0 {
+			continue
+		}
+		until := time.Now().Add(-RECONCILE_SETTLE)
+		checked, mismatches, err := h.reconcileHistory(ctx, secrets, until.Add(-RECONCILE_INTERVAL), until)
+		switch {
+		case err != nil:
+			slog.ErrorContext(ctx, "Ошибка сверки истории с Unisender", "error", err)
+			notifyAdminChat(h.bot, secrets, fmt.Sprintf("Не удалось сверить историю с Unisender: %v", err))
+		case len(mismatches) > 0:
+			slog.WarnContext(ctx, "История расходится с Unisender", "checked", checked, "mismatches", len(mismatches))
+			notifyAdminChat(h.bot, secrets, formatReconcileReport(checked, mismatches, secrets.Location()))
+		}
+	}
+}
+
+// handleReconcileCommand checks the history of the last RECONCILE_INTERVAL against
+// Unisender at once (admin only).
+func (h *Handler) handleReconcileCommand(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !requireAdmin(bot, secrets, message) {
+		return
+	}
+	if !mailer.CapabilitiesOf(secrets.EmailProvider).DeliveryStatus {
+		bot.Send(newReply(message, "Сверка истории доступна только при отправке через Unisender."))
+		return
+	}
+	until := time.Now().Add(-RECONCILE_SETTLE)
+	checked, mismatches, err := h.reconcileHistory(ctx, secrets, until.Add(-RECONCILE_INTERVAL), until)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка сверки истории с Unisender", "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Не удалось сверить историю с Unisender: %v", err)))
+		return
+	}
+	bot.Send(newReply(message, formatReconcileReport(checked, mismatches, secrets.Location())))
+}
@@ -0,0 +1,45 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileHistory(t *testing.T) {
+	const statuses = `{"result":{"statuses":[{"id":"1","status":"ok_delivered"},{"id":"3","status":"ok_sent"}]}}`
+	calls, sender := serveUnisender(t, []int{http.StatusOK, http.StatusOK}, []string{statuses, statuses})
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", UnisenderAPIKey: "key", AdminUserIDs: []int64{wizardUser}}
+	handler := NewHandler(bot, sender, secrets, MemoryStores())
+	now := time.Now()
+	for _, entry := range []SentEmail{
+		{UserID: 9, Subject: "Вчерашнее", MessageID: "7", Status: HISTORY_SENT, SentAt: now.Add(-2 * RECONCILE_INTERVAL)},
+		{UserID: 9, Subject: "Отчёт", MessageID: "1, 2", Status: HISTORY_PARTIAL, SentAt: now.Add(-time.Hour)},
+		{UserID: 9, Subject: "Счёт", MessageID: "3", Status: HISTORY_SENT, SentAt: now.Add(-time.Hour)},
+		{UserID: 9, Subject: "Ошибка", Status: HISTORY_FAILED, SentAt: now.Add(-time.Hour)},
+		{UserID: 9, Subject: "Только что", MessageID: "8", Status: HISTORY_SENT, SentAt: now},
+	} {
+		handler.History.Record(&entry)
+	}
+
+	until := now.Add(-RECONCILE_SETTLE)
+	checked, mismatches, err := handler.reconcileHistory(context.Background(), secrets, until.Add(-RECONCILE_INTERVAL), until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || len(mismatches) != 1 || mismatches[0].Entry.Subject != "Отчёт" || strings.Join(mismatches[0].Unknown, ",") != "2" {
+		t.Errorf("checked %d, mismatches %+v, want the second copy of «Отчёт» unknown", checked, mismatches)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("checkEmail called %d times, want one batch", calls.Load())
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/reconcile").update())
+	report, ok := telegram.find(wizardUser, "Сверка истории с Unisender: проверено писем 2, Unisender не знает 1 из них:")
+	if !ok || !strings.Contains(report.Text, "«Отчёт» (пользователь 9): нет ID 2") {
+		t.Errorf("no report listing the letter in:\n%s", telegram.transcript(wizardUser))
+	}
+}
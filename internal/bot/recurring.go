@@ -0,0 +1,292 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CRON_SEARCH_YEARS bounds the search for the next run, so an expression that never
+// matches, such as February 30th, is reported instead of looping forever.
+const CRON_SEARCH_YEARS = 5
+
+// RECURRING_USAGE explains the /recurring subcommands.
+const RECURRING_USAGE = "Повторяющиеся письма:\n" +
+	"/recurring list — список\n" +
+	"/recurring add daily 09:00 — каждый день\n" +
+	"/recurring add weekly пн 09:00 — каждую неделю\n" +
+	"/recurring add cron 0 9 * * 1-5 — по выражению cron (минута, час, день, месяц, день недели)\n" +
+	"/recurring delete ID — удалить\n\n" +
+	"Добавляется письмо, которое сейчас на предпросмотре."
+
+// weekdayNames maps the day names accepted by "weekly" to cron day numbers.
+var weekdayNames = map[string]int{
+	"вс": 0, "пн": 1, "вт": 2, "ср": 3, "чт": 4, "пт": 5, "сб": 6,
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// cronSchedule is a parsed five-field cron expression, each field a bit set of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	// Standard cron matches either day field when both are restricted
+	anyDay, anyWeekday bool
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week", each field a *, a
+// number, a range a-b or a list of them, optionally with a /step.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("в выражении cron должно быть 5 полей, а не %d", len(fields))
+	}
+	var c cronSchedule
+	limits := []struct {
+		set      *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.day, 1, 31}, {&c.month, 1, 12}, {&c.weekday, 0, 7}}
+	for i, limit := range limits {
+		set, err := parseCronField(fields[i], limit.min, limit.max)
+		if err != nil {
+			return nil, fmt.Errorf("поле %d выражения cron: %w", i+1, err)
+		}
+		*limit.set = set
+	}
+	// Both 0 and 7 mean Sunday
+	if c.weekday&(1<<7) != 0 {
+		c.weekday = c.weekday&^(1<<7) | 1
+	}
+	c.anyDay = fields[2] == "*"
+	c.anyWeekday = fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the bit set of the values a cron field matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("некорректный шаг %q", stepPart)
+			}
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("некорректное значение %q", rangePart)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("некорректное значение %q", rangePart)
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("значение %q вне диапазона %d-%d", rangePart, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after the given one the schedule matches, in its location.
+func (c *cronSchedule) next(after time.Time) (time.Time, error) {
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute()+1, 0, 0, loc)
+	limit := after.AddDate(CRON_SEARCH_YEARS, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("расписание не срабатывает ближайшие %d лет", CRON_SEARCH_YEARS)
+}
+
+// matchesDay checks the day of month and day of week fields.
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day := c.day&(1<<t.Day()) != 0
+	weekday := c.weekday&(1<<int(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// parseRecurrence turns the schedule of /recurring add into a cron expression and
+// its description for the user.
+func parseRecurrence(spec string) (string, string, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return "", "", errors.New("Не указано расписание.\n\n" + RECURRING_USAGE)
+	}
+	clock := func(text string) (time.Time, error) {
+		at, err := time.Parse(SCHEDULE_CLOCK_LAYOUT, text)
+		if err != nil {
+			return at, fmt.Errorf("Не удалось разобрать время %q. Формат: ЧЧ:ММ", text)
+		}
+		return at, nil
+	}
+	switch strings.ToLower(fields[0]) {
+	case "daily", "ежедневно":
+		if len(fields) != 2 {
+			return "", "", errors.New("Укажите время: /recurring add daily 09:00")
+		}
+		at, err := clock(fields[1])
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("%d %d * * *", at.Minute(), at.Hour()), "ежедневно в " + at.Format(SCHEDULE_CLOCK_LAYOUT), nil
+	case "weekly", "еженедельно":
+		if len(fields) != 3 {
+			return "", "", errors.New("Укажите день и время: /recurring add weekly пн 09:00")
+		}
+		day, ok := weekdayNames[strings.ToLower(fields[1])]
+		if !ok {
+			return "", "", fmt.Errorf("Неизвестный день недели %q, используйте пн, вт, ср, чт, пт, сб или вс", fields[1])
+		}
+		at, err := clock(fields[2])
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("%d %d * * %d", at.Minute(), at.Hour(), day),
+			fmt.Sprintf("еженедельно, %s в %s", strings.ToLower(fields[1]), at.Format(SCHEDULE_CLOCK_LAYOUT)), nil
+	case "cron":
+		expr := strings.Join(fields[1:], " ")
+		if _, err := parseCron(expr); err != nil {
+			return "", "", fmt.Errorf("Некорректное выражение cron: %v", err)
+		}
+		return expr, "cron «" + expr + "»", nil
+	}
+	return "", "", fmt.Errorf("Неизвестное расписание %q.\n\n%s", fields[0], RECURRING_USAGE)
+}
+
+// handleRecurringCommand handles /recurring list, add and delete.
+func (h *Handler) handleRecurringCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	action, args, _ := strings.Cut(strings.TrimSpace(message.CommandArguments()), " ")
+	switch action {
+	case "list":
+		bot.Send(newReply(message, h.recurringList(message.From.ID)))
+	case "add":
+		h.addRecurring(message, args)
+	case "delete":
+		h.deleteRecurring(message, args)
+	default:
+		bot.Send(newReply(message, RECURRING_USAGE))
+	}
+}
+
+// recurringList describes the user's recurring letters with their IDs.
+func (h *Handler) recurringList(userID int64) string {
+	secrets := h.secrets
+	list := slices.DeleteFunc(h.Scheduled.List(userID), func(job ScheduledEmail) bool { return job.Repeat == "" })
+	if len(list) == 0 {
+		return "Повторяющихся писем нет.\n\n" + RECURRING_USAGE
+	}
+	lines := []string{"Повторяющиеся письма:"}
+	for _, job := range list {
+		lines = append(lines, fmt.Sprintf("%d. «%s» — %s, следующая отправка %s",
+			job.ID, job.Draft.Subject, job.RepeatLabel, job.SendAt.In(secrets.Location()).Format(SCHEDULE_TIME_LAYOUT)))
+	}
+	lines = append(lines, "", "Удалить: /recurring delete ID")
+	return strings.Join(lines, "\n")
+}
+
+// addRecurring turns the draft on preview into a recurring letter.
+func (h *Handler) addRecurring(message *tgbotapi.Message, spec string) {
+	bot, secrets := h.bot, h.secrets
+	userID := message.From.ID
+	repeat, label, err := parseRecurrence(spec)
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	schedule, err := parseCron(repeat)
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+	first, err := schedule.next(time.Now().In(secrets.Location()))
+	if err != nil {
+		bot.Send(newReply(message, fmt.Sprintf("Расписание не подходит: %v", err)))
+		return
+	}
+	if len(h.scheduledLetters(userID)) >= MAX_SCHEDULED {
+		bot.Send(newReply(message, fmt.Sprintf("Запланировано уже %d писем, это максимум. Удалите лишние: /recurring list, /scheduled", MAX_SCHEDULED)))
+		return
+	}
+
+	// Taking the draft off the preview in one update keeps a repeated command from adding it twice
+	var draft UserState
+	var current bool
+	h.States.Update(userID, func(s *UserState) {
+		if current = s.State == "await_confirm"; current {
+			draft = *s
+			*s = UserState{State: "initial"}
+		}
+	})
+	if !current {
+		bot.Send(newReply(message, "Сначала составьте письмо и дойдите до предпросмотра, затем повторите команду."))
+		return
+	}
+
+	job := &ScheduledEmail{
+		UserID:      userID,
+		ChatID:      message.Chat.ID,
+		MessageID:   message.MessageID,
+		Language:    message.From.LanguageCode,
+		SendAt:      first,
+		Draft:       draft,
+		Repeat:      repeat,
+		RepeatLabel: label,
+	}
+	h.Scheduled.Add(job)
+	slog.Info("Повторяющееся письмо добавлено", "schedule_id", job.ID, "subject", draft.Subject, "repeat", repeat, "user_id", userID)
+
+	msg := newReply(message, fmt.Sprintf("Повторяющееся письмо «%s» добавлено (%s), ID %d. Первая отправка — %s. Список: /recurring list",
+		draft.Subject, label, job.ID, first.Format(SCHEDULE_TIME_LAYOUT)))
+	msg.ReplyMarkup = newInitialKeyboard()
+	bot.Send(msg)
+}
+
+// deleteRecurring removes a recurring letter of the user by its ID.
+func (h *Handler) deleteRecurring(message *tgbotapi.Message, arg string) {
+	bot := h.bot
+	id, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+	if err != nil {
+		bot.Send(newReply(message, "Укажите ID письма из /recurring list: /recurring delete ID"))
+		return
+	}
+	owned := slices.ContainsFunc(h.Scheduled.List(message.From.ID), func(job ScheduledEmail) bool { return job.ID == id && job.Repeat != "" })
+	if !owned || !h.Scheduled.Remove(id) {
+		bot.Send(newReply(message, fmt.Sprintf("Повторяющегося письма с ID %d нет.", id)))
+		return
+	}
+	slog.Info("Повторяющееся письмо удалено", "schedule_id", id, "user_id", message.From.ID)
+	bot.Send(newReply(message, fmt.Sprintf("Повторяющееся письмо %d удалено.", id)))
+}
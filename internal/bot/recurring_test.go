@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	// A Friday
+	now := time.Date(2026, 5, 15, 12, 30, 0, 0, loc)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 9 * * *", time.Date(2026, 5, 16, 9, 0, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2026, 5, 15, 12, 45, 0, 0, loc)},
+		{"0 9 * * 1-5", time.Date(2026, 5, 18, 9, 0, 0, 0, loc)},
+		{"30 8 1 * *", time.Date(2026, 6, 1, 8, 30, 0, 0, loc)},
+		{"0 0 * * 7", time.Date(2026, 5, 17, 0, 0, 0, 0, loc)},
+		// Both day fields restricted: the 20th or any Monday, whichever comes first
+		{"0 10 20 * 1", time.Date(2026, 5, 18, 10, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got, err := schedule.next(now); err != nil || !got.Equal(tt.want) {
+			t.Errorf("next(%q) = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"0 9 * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted an invalid expression", expr)
+		}
+	}
+	never, _ := parseCron("0 0 30 2 *")
+	if _, err := never.next(now); err == nil {
+		t.Error("February 30th was found")
+	}
+}
+
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct{ spec, cron, label string }{
+		{"daily 09:00", "0 9 * * *", "ежедневно в 09:00"},
+		{"weekly пн 18:30", "30 18 * * 1", "еженедельно, пн в 18:30"},
+		{"cron 0 9 * * 1-5", "0 9 * * 1-5", "cron «0 9 * * 1-5»"},
+	}
+	for _, tt := range tests {
+		cron, label, err := parseRecurrence(tt.spec)
+		if err != nil || cron != tt.cron || label != tt.label {
+			t.Errorf("parseRecurrence(%q) = %q, %q, %v; want %q, %q", tt.spec, cron, label, err, tt.cron, tt.label)
+		}
+	}
+	for _, spec := range []string{"", "hourly", "daily", "weekly xx 09:00", "cron * *"} {
+		if _, _, err := parseRecurrence(spec); err == nil {
+			t.Errorf("parseRecurrence(%q) accepted an invalid schedule", spec)
+		}
+	}
+}
+
+func TestRecurringLetterIsSentAndRescheduled(t *testing.T) {
+	wizard, sender := runWizard(t, []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Сводка"), textAction("Сводка за день."), textAction("Иван"),
+		textAction("/recurring add daily 09:00"),
+	})
+	list := wizard.Scheduled.List(wizardUser)
+	if len(list) != 1 || list[0].Repeat != "0 9 * * *" {
+		t.Fatalf("scheduled = %+v", list)
+	}
+	first := list[0].SendAt
+
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com"}
+	handler := NewHandler(bot, sender, secrets, wizard.Stores)
+
+	if sent := handler.dispatchDue(context.Background(), first); sent != 1 {
+		t.Fatalf("dispatched %d letters, want 1", sent)
+	}
+	if want := []string{"Сводка"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Errorf("sent %q, want %q", sender.subjects, want)
+	}
+	list = handler.Scheduled.List(wizardUser)
+	if len(list) != 1 || !list[0].SendAt.Equal(first.AddDate(0, 0, 1)) {
+		t.Errorf("after sending, scheduled = %+v; want the next day", list)
+	}
+	if _, ok := telegram.find(wizardUser, "Следующая отправка"); !ok {
+		t.Errorf("no report of the run:\n%s", telegram.transcript(wizardUser))
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/recurring delete 1").update())
+	if list := handler.Scheduled.List(wizardUser); len(list) != 0 {
+		t.Errorf("deleted letter is still scheduled: %+v", list)
+	}
+}
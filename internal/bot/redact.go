@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// REDACTED replaces secret values in log output.
+const REDACTED = "[REDACTED]"
+
+var (
+	// botTokenPattern matches Telegram bot tokens even when they are not configured ones.
+	botTokenPattern = regexp.MustCompile(`\d{5,}:[A-Za-z0-9_-]{30,}`)
+	// emailPattern matches email addresses, capturing the first character and the domain.
+	emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+)
+
+// Redactor masks secrets and, optionally, email addresses in log output.
+type Redactor struct {
+	secrets    atomic.Pointer[[]string] // Literal values to mask, such as API keys
+	maskEmails bool
+}
+
+// logRedactor masks the bot log; serve sets it, and /reload adds the secrets it changes.
+var logRedactor *Redactor
+
+// secretValues lists the settings the logs must never show.
+func secretValues(secrets *Secrets) []string {
+	return []string{secrets.BotToken, secrets.UnisenderAPIKey, secrets.SMTP.Password, secrets.Mailgun.APIKey, secrets.DebugToken, secrets.BackupKey}
+}
+
+// NewRedactor creates a redactor for the given secret values. Empty values are ignored.
+func NewRedactor(secrets []string, maskEmails bool) *Redactor {
+	r := &Redactor{maskEmails: maskEmails}
+	r.secrets.Store(new([]string))
+	r.AddSecrets(secrets)
+	return r
+}
+
+// AddSecrets masks the values from now on too. Values masked before stay masked,
+// since entries about sends started with a replaced key may still be written.
+func (r *Redactor) AddSecrets(secrets []string) {
+	for {
+		current := r.secrets.Load()
+		next := slices.Clone(*current)
+		for _, s := range secrets {
+			if s == "" {
+				continue
+			}
+			// The log handlers escape quotes and backslashes before the text gets here
+			for _, form := range []string{s, jsonEscaped(s), quoteEscaped(s)} {
+				if !slices.Contains(next, form) {
+					next = append(next, form)
+				}
+			}
+		}
+		if r.secrets.CompareAndSwap(current, &next) {
+			return
+		}
+	}
+}
+
+// jsonEscaped returns s as the JSON log handler writes it inside a string.
+func jsonEscaped(s string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false) // slog does not escape HTML characters either
+	encoder.Encode(s)
+	quoted := strings.TrimSuffix(buf.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
+
+// quoteEscaped returns s as the text log handler writes a quoted value.
+func quoteEscaped(s string) string {
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// Redact returns text with all secrets masked.
+func (r *Redactor) Redact(text string) string {
+	for _, s := range *r.secrets.Load() {
+		text = strings.ReplaceAll(text, s, REDACTED)
+	}
+	// Every log entry passes through here, so the patterns only run when the text
+	// may contain a match; most entries have neither a token nor an address
+	if mayContainBotToken(text) {
+		text = botTokenPattern.ReplaceAllString(text, REDACTED)
+	}
+	if r.maskEmails && strings.IndexByte(text, '@') >= 0 {
+		// Keep the first character and the domain so entries remain useful for debugging
+		text = emailPattern.ReplaceAllString(text, "$1***@$2")
+	}
+	return text
+}
+
+// mayContainBotToken reports whether text has a colon preceded by at least five
+// digits, the start of every bot token. Timestamps like 12:00:00 do not qualify.
+func mayContainBotToken(text string) bool {
+	digits := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == ':' && digits >= 5:
+			return true
+		default:
+			digits = 0
+		}
+	}
+	return false
+}
+
+// redactingWriter masks secrets in everything written through it. The log package
+// issues one Write per entry, so secrets are never split between calls.
+type redactingWriter struct {
+	w io.Writer
+	r *Redactor
+}
+
+// Write redacts p and writes it to the underlying writer.
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, rw.r.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
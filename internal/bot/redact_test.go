@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	const token = "123456789:AAHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw"
+	for _, tt := range []struct {
+		name       string
+		maskEmails bool
+		text       string
+		want       string
+	}{
+		{"bot token", false, "GET /bot" + token + "/getUpdates", "GET /bot" + REDACTED + "/getUpdates"},
+		{"unconfigured bot token", false, "token 987654321:ZZHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw", "token " + REDACTED},
+		{"api key", false, "api_key=6b7f3c1e9a&format=json", "api_key=" + REDACTED + "&format=json"},
+		{"json-escaped password", false, `{"msg":"SMTP auth","password":"pa\\ss\"<w>"}`, `{"msg":"SMTP auth","password":"` + REDACTED + `"}`},
+		{"quoted password", false, `msg="SMTP auth" password="pa\\ss\"<w>"`, `msg="SMTP auth" password="` + REDACTED + `"`},
+		{"email masked", true, "Письмо для ivan.petrov@example.com отправлено", "Письмо для i***@example.com отправлено"},
+		{"email kept", false, "Письмо для ivan.petrov@example.com отправлено", "Письмо для ivan.petrov@example.com отправлено"},
+		{"time is not a token", true, "Отправлено в 12:00:00", "Отправлено в 12:00:00"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRedactor([]string{token, "6b7f3c1e9a", `pa\ss"<w>`, ""}, tt.maskEmails)
+			if got := r.Redact(tt.text); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorAddSecrets(t *testing.T) {
+	r := NewRedactor([]string{"old-key"}, false)
+	r.AddSecrets([]string{"new-key"})
+	if got := r.Redact("old-key new-key"); got != REDACTED+" "+REDACTED {
+		t.Errorf("Redact = %q, want both keys masked", got)
+	}
+}
+
+func TestMayContainBotToken(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want bool
+	}{
+		{"123456789:AAHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw", true},
+		{"bot12345:x", true},
+		{"1234:abc", false},
+		{"12:00:00", false},
+		{"ivan@example.com", false},
+		{"", false},
+	} {
+		if got := mayContainBotToken(tt.text); got != tt.want {
+			t.Errorf("mayContainBotToken(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingWriterMasksEscapedSecrets(t *testing.T) {
+	const password = `pa\ss"<w>`
+	var out strings.Builder
+	logger := slog.New(slog.NewJSONHandler(redactingWriter{w: &out, r: NewRedactor([]string{password}, false)}, nil))
+	logger.Info("SMTP auth", "password", password)
+	if strings.Contains(out.String(), `pa\\ss`) || !strings.Contains(out.String(), REDACTED) {
+		t.Errorf("log entry %s shows the password", out.String())
+	}
+}
@@ -0,0 +1,171 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/config"
+	"botmailtest/internal/mailer"
+)
+
+// configMu guards the settings /reload changes: the live fields of the secrets,
+// the provider and the validation, normalize and reply globals. Readers hold it
+// only to copy what they need, so a reload never waits for a send; an update or
+// a scheduler pass works on a snapshot taken when it starts.
+var configMu sync.RWMutex
+
+// snapshotSettings returns a copy of the secrets that a reload will not change
+// underneath. A reload replaces fields rather than modifying their contents, so
+// a shallow copy is enough.
+func snapshotSettings(secrets *Secrets) *Secrets {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	snapshot := *secrets
+	return &snapshot
+}
+
+// configSource rereads the configuration for /reload; serve sets it to read
+// secrets.json with the command-line overrides. Without it /reload is refused.
+var configSource func() (*Secrets, error)
+
+// liveSettings are the secrets.json keys /reload applies at once. The others are
+// read at start, by the log, the storage and the Telegram connection, and only
+// change with a restart.
+var liveSettings = []string{
+	"unisender_api_key", "target_email", "sender_email",
+	"admin_user_ids", "allowed_user_ids",
+	"survey_rate", "timezone", "mail_tester_username",
+	"email_provider", "smtp", "mailgun", "send_retry",
+	"field_rules", "language_rules", "tag_rules", "aliases", "delegations",
+	"rate_limit", "normalize", "guest_mode", "reply_templates", "probes", "session_timeout", "fingerprint", "send_concurrency",
+}
+
+// providerSettings are the live keys a new EmailSender is created for.
+var providerSettings = []string{"unisender_api_key", "email_provider", "smtp", "mailgun"}
+
+// diffSettings lists the keys whose values differ between the two configurations,
+// split into those /reload applies and those that need a restart.
+func diffSettings(current, fresh *Secrets) (live, restart []string) {
+	cur, next := reflect.ValueOf(current).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := range cur.NumField() {
+		if reflect.DeepEqual(cur.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		key, _, _ := strings.Cut(cur.Type().Field(i).Tag.Get("json"), ",")
+		if slices.Contains(liveSettings, key) {
+			live = append(live, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	return live, restart
+}
+
+// applySettings copies the fields with the given keys from fresh. Fields are set
+// one by one, so code reading the others, such as the status board, is not disturbed.
+func applySettings(current, fresh *Secrets, keys []string) {
+	cur, next := reflect.ValueOf(current).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := range cur.NumField() {
+		key, _, _ := strings.Cut(cur.Type().Field(i).Tag.Get("json"), ",")
+		if slices.Contains(keys, key) {
+			cur.Field(i).Set(next.Field(i))
+		}
+	}
+}
+
+// reload rereads the configuration and applies its live settings, leaving every
+// one unchanged when any of them is invalid. It returns the keys applied and the
+// changed keys that wait for a restart.
+func (h *Handler) reload() (live, restart []string, err error) {
+	fresh, err := configSource()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fresh.Validate(); err != nil {
+		return nil, nil, err
+	}
+	// New keys are masked before the provider made with them can log anything;
+	// masking values that end up unused does no harm
+	if logRedactor != nil {
+		logRedactor.AddSecrets(secretValues(fresh))
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	live, restart = diffSettings(h.secrets, fresh)
+	if len(live) == 0 {
+		return nil, restart, nil
+	}
+
+	sender := h.sender
+	if slices.ContainsFunc(live, func(key string) bool { return slices.Contains(providerSettings, key) }) {
+		if sender, err = mailer.New(fresh.EmailProvider, fresh.UnisenderAPIKey, fresh.SMTP, fresh.Mailgun); err != nil {
+			return nil, nil, err
+		}
+	}
+	// The rules are compiled into globals, which are put back if any fails
+	savedRules, savedReplies := ruleValidators, replyTemplates
+	err = registerFieldRules(fresh.FieldRules)
+	if err == nil {
+		err = loadReplyTemplates(fresh.ReplyTemplates)
+	}
+	if err == nil {
+		err = mailer.ConfigureRetry(fresh.SendRetry)
+	}
+	if err != nil {
+		ruleValidators, replyTemplates = savedRules, savedReplies
+		return nil, nil, err
+	}
+
+	if slices.Contains(live, "rate_limit") {
+		// Spent allowances are kept; a limit changed with /setlimit is replaced
+		sendLimits.set(fresh.RateLimit)
+	}
+	if slices.Contains(live, "send_concurrency") {
+		// A limit changed with /concurrency is replaced too
+		providerSlots.set(fresh.SendConcurrency)
+	}
+	normalization = fresh.Normalize
+	probes.configure(fresh.Probes)
+	h.sender = sender
+	applySettings(h.secrets, fresh, live)
+	return live, restart, nil
+}
+
+// handleReloadCommand rereads secrets.json (admin only) and reports what changed.
+// It runs outside of configMu, which the reload takes for itself.
+func (h *Handler) handleReloadCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	configMu.RLock()
+	admin := requireAdmin(bot, h.secrets, message)
+	configMu.RUnlock()
+	if !admin {
+		return
+	}
+	if configSource == nil {
+		bot.Send(newReply(message, "Перезагрузка настроек недоступна в этом режиме запуска."))
+		return
+	}
+
+	live, restart, err := h.reload()
+	if err != nil {
+		slog.Error("Ошибка перезагрузки настроек", "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Настройки не изменены, в %s ошибка:\n%v", config.SECRETS_FILE, err)))
+		return
+	}
+	audit(message.From, "/reload: применено %v, ждёт перезапуска %v", live, restart)
+	text := "Настройки в " + config.SECRETS_FILE + " не изменились."
+	if len(live) > 0 {
+		text = "Настройки перечитаны, изменено: " + strings.Join(live, ", ") + "."
+	}
+	if len(restart) > 0 {
+		text += "\nВступят в силу после перезапуска: " + strings.Join(restart, ", ") + "."
+	}
+	bot.Send(newReply(message, text))
+}
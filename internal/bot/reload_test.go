@@ -0,0 +1,209 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"botmailtest/internal/mailer"
+)
+
+const reloadAdmin = 9
+
+// reloadSecrets is a complete configuration, as serve would have read it.
+func reloadSecrets() *Secrets {
+	secrets := wizardSecrets()
+	secrets.BotToken = "123:TEST"
+	secrets.SMTP = mailer.SMTPSettings{Host: "smtp.example.com"}
+	secrets.AdminUserIDs = []int64{reloadAdmin}
+	secrets.LogFile = "bot.log"
+	return secrets
+}
+
+// runReload sends /reload as the administrator, with secrets.json reading as fresh.
+func runReload(t *testing.T, secrets, fresh *Secrets) (*Handler, string) {
+	t.Cleanup(func(saved map[Field][]Validator) func() {
+		return func() {
+			ruleValidators, configSource, normalization = saved, nil, NormalizeRules{}
+			sendLimits = newRateLimiter(RateLimit{})
+			loadReplyTemplates(nil)
+		}
+	}(ruleValidators))
+	configSource = func() (*Secrets, error) { return fresh, nil }
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, secrets, &steps)
+	reload := textAction("/reload")
+	update := reload.update()
+	update.Message.From.ID, update.Message.Chat.ID = reloadAdmin, reloadAdmin
+	handler.HandleUpdate(context.Background(), update)
+	return handler, bot.texts()
+}
+
+func TestDiffSettings(t *testing.T) {
+	current, fresh := reloadSecrets(), reloadSecrets()
+	fresh.AllowedUserIDs = []int64{1}
+	fresh.RateLimit.PerHour = 5
+	fresh.LogFile = "other.log"
+	live, restart := diffSettings(current, fresh)
+	if want := []string{"allowed_user_ids", "rate_limit"}; !reflect.DeepEqual(live, want) {
+		t.Errorf("live = %q, want %q", live, want)
+	}
+	if want := []string{"log_file"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("restart = %q, want %q", restart, want)
+	}
+
+	applySettings(current, fresh, live)
+	if current.RateLimit.PerHour != 5 || len(current.AllowedUserIDs) != 1 || current.LogFile != "bot.log" {
+		t.Errorf("after apply %+v", current)
+	}
+}
+
+func TestReloadAppliesLiveSettings(t *testing.T) {
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	fresh.AllowedUserIDs = []int64{wizardUser}
+	fresh.RateLimit = RateLimit{PerHour: 2}
+	fresh.Normalize = NormalizeRules{CollapseWhitespace: true}
+	fresh.FieldRules = map[Field][]FieldRule{FieldSubject: {{Pattern: `^\[ACME\]`}}}
+	fresh.LogFile = "other.log"
+	handler, reply := runReload(t, secrets, fresh)
+
+	if !strings.Contains(reply, "изменено: allowed_user_ids, field_rules, rate_limit, normalize") || !strings.Contains(reply, "после перезапуска: log_file") {
+		t.Errorf("reply = %q", reply)
+	}
+	if !handler.isAllowed(wizardUser) || secrets.LogFile != "bot.log" {
+		t.Errorf("secrets after reload %+v", secrets)
+	}
+	if sendLimits.current().PerHour != 2 || !normalization.CollapseWhitespace || validateField(FieldSubject, "Отчёт") == nil {
+		t.Errorf("limits, normalize or field rules were not applied")
+	}
+	if _, ok := handler.sender.(*recordingSender); !ok {
+		t.Errorf("sender replaced without a provider change: %T", handler.sender)
+	}
+}
+
+func TestReloadKeepsSettingsOnError(t *testing.T) {
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	fresh.AllowedUserIDs = []int64{wizardUser}
+	fresh.FieldRules = map[Field][]FieldRule{FieldSubject: {{Pattern: `(`}}}
+	_, reply := runReload(t, secrets, fresh)
+	if !strings.Contains(reply, "Настройки не изменены") || secrets.AllowedUserIDs != nil || len(ruleValidators) != 0 {
+		t.Errorf("a broken configuration was applied: %q", reply)
+	}
+
+	fresh = reloadSecrets()
+	fresh.TargetEmail = ""
+	if _, reply = runReload(t, secrets, fresh); !strings.Contains(reply, "email получателя") {
+		t.Errorf("an invalid configuration was not reported: %q", reply)
+	}
+}
+
+func TestReloadChangesProvider(t *testing.T) {
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	fresh.SMTP.Host = "mail.example.com"
+	handler, _ := runReload(t, secrets, fresh)
+	if _, ok := handler.sender.(*mailer.SMTPSender); !ok {
+		t.Errorf("sender after reload = %T, want a new SMTP sender", handler.sender)
+	}
+}
+
+func TestReloadAdminOnly(t *testing.T) {
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	secrets.AdminUserIDs = nil
+	fresh.AllowedUserIDs = []int64{1}
+	if _, reply := runReload(t, secrets, fresh); !strings.Contains(reply, "только администраторам") || secrets.AllowedUserIDs != nil {
+		t.Errorf("reload by a non-admin: %q", reply)
+	}
+}
+
+func TestReloadKeepsRegisteredValidators(t *testing.T) {
+	defer func(saved map[Field][]Validator) { validators = saved }(validators)
+	validators = make(map[Field][]Validator)
+	RegisterValidator(FieldSubject, func(value string) error {
+		if strings.Contains(value, "секрет") {
+			return errors.New("Тема не должна раскрывать секреты.")
+		}
+		return nil
+	})
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	secrets.FieldRules = map[Field][]FieldRule{FieldBody: {{Pattern: `.{5}`}}}
+	fresh.FieldRules = map[Field][]FieldRule{FieldSubject: {{Pattern: `^\[ACME\]`}}}
+	runReload(t, secrets, fresh)
+
+	if validateField(FieldSubject, "[ACME] секрет") == nil {
+		t.Errorf("a validator registered in code was dropped by /reload")
+	}
+	if validateField(FieldSubject, "Отчёт") == nil || validateField(FieldBody, "ок") != nil {
+		t.Errorf("field_rules were not replaced by the reloaded ones")
+	}
+}
+
+func TestReloadMasksRotatedKeys(t *testing.T) {
+	defer func(saved *Redactor) { logRedactor = saved }(logRedactor)
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	secrets.SMTP.Password = "old-password"
+	fresh.SMTP.Password = "new-password"
+	logRedactor = NewRedactor(secretValues(secrets), false)
+	runReload(t, secrets, fresh)
+
+	if got := logRedactor.Redact("auth old-password new-password"); got != "auth [REDACTED] [REDACTED]" {
+		t.Errorf("log after the key was rotated: %q", got)
+	}
+}
+
+// blockingSender holds every send until release is closed.
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return SendEmailResponse{{Email: targetEmail, ID: "1"}}, nil
+}
+
+func TestReloadDoesNotWaitForSends(t *testing.T) {
+	t.Cleanup(func() {
+		configSource = nil
+		sendLimits = newRateLimiter(RateLimit{})
+	})
+	secrets, fresh := reloadSecrets(), reloadSecrets()
+	fresh.RateLimit = RateLimit{PerHour: 5}
+	configSource = func() (*Secrets, error) { return fresh, nil }
+	var steps []string
+	wizard, bot, _ := newWizardHandler(t, secrets, &steps)
+	sender := &blockingSender{started: make(chan struct{}), release: make(chan struct{})}
+	handler := NewHandler(bot, sender, secrets, wizard.Stores)
+
+	handler.States.Update(wizardUser, func(s *UserState) {
+		*s = UserState{State: "await_confirm", Recipients: []string{"a@example.com"}, Subject: "Тема", Body: "Текст", SenderName: "Иван"}
+	})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		handler.HandleUpdate(context.Background(), tapAction("confirm:send").update())
+	}()
+	<-sender.started
+
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		update := textAction("/reload").update()
+		update.Message.From.ID, update.Message.Chat.ID = reloadAdmin, reloadAdmin
+		handler.HandleUpdate(context.Background(), update)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Error("/reload waited for a send in progress")
+	}
+	close(sender.release)
+	<-sent
+	<-reloaded
+	if secrets.RateLimit.PerHour != 5 {
+		t.Errorf("rate_limit = %+v after reload", secrets.RateLimit)
+	}
+}
@@ -0,0 +1,255 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// reminderDays lists the follow-up delays offered after a successful send.
+var reminderDays = []int{1, 3, 7}
+
+// Channels a scheduled follow-up is delivered through.
+const (
+	REMINDER_TELEGRAM = "tg"    // Remind the user in Telegram, the follow-up email is sent on tap
+	REMINDER_EMAIL    = "email" // Send the follow-up email to the recipient automatically
+)
+
+const (
+	// FOLLOW_UP_BUTTON_TTL is how long the button under a Telegram reminder sends the
+	// follow-up email.
+	FOLLOW_UP_BUTTON_TTL = 7 * 24 * time.Hour
+	// FOLLOW_UP_OFFER_TTL is how long the buttons offering a reminder after a send work.
+	FOLLOW_UP_OFFER_TTL = 24 * time.Hour
+)
+
+// FollowUp is a sent email the user may ask to be reminded about. Offers not taken
+// up live in memory for FOLLOW_UP_OFFER_TTL; a chosen reminder is a job of the scheduler, stored with the
+// scheduled letters, so it survives a restart.
+type FollowUp struct {
+	UserID     int64     `json:"user_id"`
+	ChatID     int64     `json:"chat_id"`
+	Recipient  string    `json:"recipient"`
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	SenderName string    `json:"sender_name"`
+	SentAt     time.Time `json:"sent_at"`
+	Channel    string    `json:"channel,omitempty"` // REMINDER_TELEGRAM or REMINDER_EMAIL, set when scheduled
+	// Reminded is set once the user got the Telegram reminder; the job then waits for
+	// a tap on its button until FOLLOW_UP_BUTTON_TTL runs out
+	Reminded bool `json:"reminded,omitempty"`
+}
+
+// offerFollowUpReminder remembers the sent email and asks whether to remind about it later.
+func (h *Handler) offerFollowUpReminder(followUp *FollowUp) {
+	bot := h.bot
+	followUp.SentAt = time.Now()
+
+	h.followUpsMu.Lock()
+	// Offers nobody tapped are dropped here, as there is no other moment to notice them
+	for id, offered := range h.followUps {
+		if followUp.SentAt.Sub(offered.SentAt) > FOLLOW_UP_OFFER_TTL {
+			delete(h.followUps, id)
+		}
+	}
+	h.followUpSeq++
+	id := h.followUpSeq
+	h.followUps[id] = followUp
+	h.followUpsMu.Unlock()
+
+	var remindRow, emailRow []tgbotapi.InlineKeyboardButton
+	for _, days := range reminderDays {
+		remindRow = append(remindRow, tgbotapi.NewInlineKeyboardButtonData(
+			"Мне: "+formatDays(days), fmt.Sprintf("remind:%d:%d:%s", id, days, REMINDER_TELEGRAM)))
+		emailRow = append(emailRow, tgbotapi.NewInlineKeyboardButtonData(
+			"Получателю: "+formatDays(days), fmt.Sprintf("remind:%d:%d:%s", id, days, REMINDER_EMAIL)))
+	}
+	msg := tgbotapi.NewMessage(followUp.ChatID, "Напомнить об этом письме, если не ответят? Можно напомнить вам в Telegram или сразу отправить получателю письмо-напоминание.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(remindRow, emailRow)
+	bot.Send(msg)
+}
+
+// handleRemindCallback schedules a reminder for the follow-up chosen with an inline button.
+// The payload is "<id>:<days>[:<channel>]"; buttons from older versions have no channel.
+func (h *Handler) handleRemindCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	parts := strings.Split(payload, ":")
+	id, _ := strconv.ParseInt(parts[0], 10, 64)
+	days := 0
+	if len(parts) > 1 {
+		days, _ = strconv.Atoi(parts[1])
+	}
+	if days <= 0 {
+		return "Некорректный срок напоминания."
+	}
+	channel := REMINDER_TELEGRAM
+	if len(parts) > 2 {
+		channel = parts[2]
+	}
+	if channel != REMINDER_TELEGRAM && channel != REMINDER_EMAIL {
+		return "Некорректный способ напоминания."
+	}
+
+	// Taking the offer out keeps a double tap from scheduling it twice
+	h.followUpsMu.Lock()
+	followUp, exists := h.followUps[id]
+	if exists && followUp.UserID == query.From.ID {
+		delete(h.followUps, id)
+	} else {
+		exists = false
+	}
+	h.followUpsMu.Unlock()
+	if !exists || time.Since(followUp.SentAt) > FOLLOW_UP_OFFER_TTL {
+		return "Напоминание уже установлено или устарело."
+	}
+
+	followUp.Channel = channel
+	job := &ScheduledEmail{
+		UserID:   followUp.UserID,
+		ChatID:   followUp.ChatID,
+		Language: query.From.LanguageCode,
+		SendAt:   time.Now().Add(time.Duration(days) * 24 * time.Hour),
+		FollowUp: followUp,
+	}
+	h.Scheduled.Add(job)
+	slog.Info("Напоминание о письме", "channel", channel, "subject", followUp.Subject, "days", days, "user_id", followUp.UserID, "schedule_id", job.ID)
+
+	if query.Message != nil {
+		text := fmt.Sprintf("Напомню через %s, если не ответят.", formatDays(days))
+		if channel == REMINDER_EMAIL {
+			text = fmt.Sprintf("Через %s получателю уйдёт письмо-напоминание.", formatDays(days))
+		}
+		bot.Send(tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text+" Отменить: /scheduled"))
+	}
+	return "Напоминание установлено"
+}
+
+// dispatchFollowUp runs a follow-up job that is due and reports whether a letter
+// was sent. secrets is a snapshot, like for the scheduled letters.
+func (h *Handler) dispatchFollowUp(ctx context.Context, job ScheduledEmail, now time.Time) bool {
+	if !h.Scheduled.Remove(job.ID) {
+		// Cancelled or tapped meanwhile
+		return false
+	}
+	ctx = withLogAttrs(ctx, "user_id", job.UserID, "chat_id", job.ChatID, "schedule_id", job.ID)
+	switch {
+	case job.FollowUp.Reminded:
+		slog.InfoContext(ctx, "Кнопка напоминания устарела", "subject", job.FollowUp.Subject)
+		return false
+	case job.FollowUp.Channel == REMINDER_EMAIL:
+		h.sendFollowUpEmail(ctx, job)
+		return true
+	default:
+		h.sendFollowUpReminder(ctx, job, now)
+		return false
+	}
+}
+
+// sendFollowUpEmail sends the follow-up email to the recipient when its time comes
+// and tells the user how it went.
+func (h *Handler) sendFollowUpEmail(ctx context.Context, job ScheduledEmail) {
+	bot, secrets := h.bot, h.secrets
+	followUp := job.FollowUp
+	subject, body := followUpDraft(followUp)
+	// The reminder was ordered in advance, so it is sent over the limit
+	sendLimits.charge(followUp.UserID)
+	result, err := h.sendEmail(ctx, followUp.Recipient, secrets.SenderEmail, subject, body, followUp.SenderName)
+	h.recordFollowUp(followUp, subject, body, result, err)
+	text, _ := describeSendResult(ctx, job.Language, result, err)
+	msg := tgbotapi.NewMessage(followUp.ChatID, fmt.Sprintf("Письмо-напоминание «%s»:\n%s", subject, text))
+	if _, err := bot.Send(msg); err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки результата напоминания", "error", err)
+	}
+}
+
+// sendFollowUpReminder reminds the user about an email and offers a prefilled
+// follow-up. The job goes back to the scheduler to wait for the tap on the button,
+// which works until FOLLOW_UP_BUTTON_TTL runs out.
+func (h *Handler) sendFollowUpReminder(ctx context.Context, job ScheduledEmail, now time.Time) {
+	bot := h.bot
+	followUp := *job.FollowUp
+	followUp.Reminded = true
+	waiting := &ScheduledEmail{UserID: job.UserID, ChatID: job.ChatID, Language: job.Language, SendAt: now.Add(FOLLOW_UP_BUTTON_TTL), FollowUp: &followUp}
+	h.Scheduled.Add(waiting)
+
+	subject, body := followUpDraft(&followUp)
+	text := fmt.Sprintf("Напоминание: письмо «%s» отправлено %s. Если ответа нет, можно отправить напоминание:\n\nТема: %s\n\n%s",
+		followUp.Subject, followUp.SentAt.Format("02.01.2006 15:04"), subject, body)
+	msg := tgbotapi.NewMessage(followUp.ChatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Отправить напоминание", fmt.Sprintf("followup:%d", waiting.ID)),
+	))
+	if _, err := bot.Send(msg); err != nil {
+		slog.ErrorContext(ctx, "Ошибка отправки напоминания", "error", err)
+	}
+}
+
+// handleFollowUpCallback sends the prefilled follow-up email with one tap on the
+// button of a Telegram reminder.
+func (h *Handler) handleFollowUpCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	id, _ := strconv.ParseInt(payload, 10, 64)
+	jobs := h.Scheduled.List(query.From.ID)
+	i := slices.IndexFunc(jobs, func(job ScheduledEmail) bool {
+		return job.ID == id && job.FollowUp != nil && job.FollowUp.Reminded
+	})
+	if i < 0 {
+		return "Напоминание уже отправлено или устарело."
+	}
+	// Over the limit the button keeps working for when the limit allows
+	if !allowSend(bot, secrets, query.Message, query.From) {
+		return ""
+	}
+	job := jobs[i]
+	// Removing the job first keeps a double tap from sending it twice
+	if !h.Scheduled.Remove(id) {
+		return "Напоминание уже отправлено или устарело."
+	}
+
+	subject, body := followUpDraft(job.FollowUp)
+	result, err := h.sendEmail(ctx, job.FollowUp.Recipient, secrets.SenderEmail, subject, body, job.FollowUp.SenderName)
+	h.recordFollowUp(job.FollowUp, subject, body, result, err)
+	text, _ := describeSendResult(ctx, query.From.LanguageCode, result, err)
+	bot.Send(newReply(query.Message, text))
+	return ""
+}
+
+// recordFollowUp stores a follow-up send attempt in the history.
+func (h *Handler) recordFollowUp(followUp *FollowUp, subject, body string, result SendEmailResponse, err error) {
+	recordSend(h.History, SentEmail{
+		UserID:     followUp.UserID,
+		Recipient:  followUp.Recipient,
+		Subject:    subject,
+		Body:       body,
+		SenderName: followUp.SenderName,
+	}, nil, result, err)
+}
+
+// followUpDraft builds the subject and body of a follow-up to the original email.
+func followUpDraft(followUp *FollowUp) (string, string) {
+	subject := "Re: " + followUp.Subject
+	body := fmt.Sprintf("Добрый день!\n\nНапоминаю о письме от %s. Прошу ответить, когда будет возможность.\n\n> %s",
+		followUp.SentAt.Format("02.01.2006"), strings.ReplaceAll(followUp.Body, "\n", "\n> "))
+	return subject, body
+}
+
+// formatDays renders a number of days with the matching Russian plural form.
+func formatDays(days int) string {
+	switch {
+	case days%10 == 1 && days%100 != 11:
+		return fmt.Sprintf("%d день", days)
+	case days%10 >= 2 && days%10 <= 4 && (days%100 < 10 || days%100 >= 20):
+		return fmt.Sprintf("%d дня", days)
+	default:
+		return fmt.Sprintf("%d дней", days)
+	}
+}
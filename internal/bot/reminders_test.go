@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendAndRemind sends a letter through the wizard and taps the reminder offered
+// after it. It returns the handler, the fake bot and the sender.
+func sendAndRemind(t *testing.T, days int, channel string) (*Handler, *fakeBot, *recordingSender) {
+	t.Helper()
+	var steps []string
+	handler, bot, sender := newWizardHandler(t, wizardSecrets(), &steps)
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт во вложении."), textAction("Иван"),
+		tapAction("confirm:send"),
+	} {
+		steps = append(steps, action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("remind:%d:%d:%s", handler.followUpSeq, days, channel)).update())
+	return handler, bot, sender
+}
+
+func TestEmailReminderIsAScheduledJob(t *testing.T) {
+	handler, bot, sender := sendAndRemind(t, 3, REMINDER_EMAIL)
+	jobs := handler.Scheduled.List(wizardUser)
+	if len(jobs) != 1 || jobs[0].FollowUp == nil || jobs[0].FollowUp.Channel != REMINDER_EMAIL {
+		t.Fatalf("scheduled %+v, want the follow-up job", jobs)
+	}
+	if due := jobs[0].SendAt; due.Before(time.Now().Add(71*time.Hour)) || due.After(time.Now().Add(73*time.Hour)) {
+		t.Errorf("follow-up due at %v, want in 3 days", due)
+	}
+	if text, _ := handler.scheduledList(wizardUser); !strings.Contains(text, "письмо-напоминание получателю о «Отчёт»") {
+		t.Errorf("/scheduled does not list the reminder:\n%s", text)
+	}
+	// A second tap on the same offer does nothing
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("remind:%d:1:%s", handler.followUpSeq, REMINDER_EMAIL)).update())
+	if len(handler.Scheduled.List(wizardUser)) != 1 {
+		t.Errorf("the offer was scheduled twice")
+	}
+
+	ctx := context.Background()
+	if n := handler.dispatchDue(ctx, time.Now().Add(2*24*time.Hour)); n != 0 || sender.sent != 1 {
+		t.Fatalf("follow-up sent early: %d, %d letters", n, sender.sent)
+	}
+	if n := handler.dispatchDue(ctx, time.Now().Add(4*24*time.Hour)); n != 1 || sender.sent != 2 {
+		t.Fatalf("follow-up not sent when due: %d, %d letters", n, sender.sent)
+	}
+	if got := sender.subjects[1]; got != "Re: Отчёт" {
+		t.Errorf("follow-up subject %q", got)
+	}
+	if len(handler.Scheduled.List(wizardUser)) != 0 || !strings.Contains(bot.texts(), "Письмо-напоминание «Re: Отчёт»") {
+		t.Errorf("the job was not finished:\n%s", bot.texts())
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].Subject != "Re: Отчёт" {
+		t.Errorf("history = %+v, want the follow-up", sent)
+	}
+}
+
+func TestTelegramReminderWaitsForTap(t *testing.T) {
+	handler, bot, sender := sendAndRemind(t, 1, REMINDER_TELEGRAM)
+	ctx := context.Background()
+	now := time.Now().Add(25 * time.Hour)
+	if n := handler.dispatchDue(ctx, now); n != 0 || !strings.Contains(bot.texts(), "Напоминание: письмо «Отчёт»") {
+		t.Fatalf("no reminder in Telegram:\n%s", bot.texts())
+	}
+	jobs := handler.Scheduled.List(wizardUser)
+	if len(jobs) != 1 || !jobs[0].FollowUp.Reminded || !jobs[0].SendAt.Equal(now.Add(FOLLOW_UP_BUTTON_TTL)) {
+		t.Fatalf("scheduled %+v, want the reminder waiting for the tap", jobs)
+	}
+	if text, _ := handler.scheduledList(wizardUser); strings.Contains(text, "напоминание") {
+		t.Errorf("/scheduled lists a reminder already sent:\n%s", text)
+	}
+
+	tap := tapAction(fmt.Sprintf("followup:%d", jobs[0].ID))
+	handler.HandleUpdate(context.Background(), tap.update())
+	handler.HandleUpdate(context.Background(), tap.update())
+	if sender.sent != 2 || sender.subjects[1] != "Re: Отчёт" {
+		t.Errorf("sent %q, want the follow-up once", sender.subjects)
+	}
+	if !strings.Contains(bot.texts(), "Напоминание уже отправлено или устарело") {
+		t.Errorf("second tap was not refused:\n%s", bot.texts())
+	}
+}
+
+func TestTelegramReminderButtonExpires(t *testing.T) {
+	handler, _, sender := sendAndRemind(t, 1, REMINDER_TELEGRAM)
+	ctx := context.Background()
+	now := time.Now().Add(25 * time.Hour)
+	handler.dispatchDue(ctx, now)
+	id := handler.Scheduled.List(wizardUser)[0].ID
+	handler.dispatchDue(ctx, now.Add(FOLLOW_UP_BUTTON_TTL))
+
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("followup:%d", id)).update())
+	if sender.sent != 1 || len(handler.Scheduled.List(wizardUser)) != 0 {
+		t.Errorf("an expired reminder button sent the follow-up")
+	}
+}
+
+func TestFollowUpOfferExpires(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	sendLetter(handler, "a@example.com", "Отчёт")
+	stale := handler.followUpSeq
+	handler.followUpsMu.Lock()
+	handler.followUps[stale].SentAt = time.Now().Add(-FOLLOW_UP_OFFER_TTL - time.Minute)
+	handler.followUpsMu.Unlock()
+
+	handler.HandleUpdate(context.Background(), tapAction(fmt.Sprintf("remind:%d:3:%s", stale, REMINDER_TELEGRAM)).update())
+	if len(handler.Scheduled.List(wizardUser)) != 0 || !strings.Contains(bot.texts(), "Напоминание уже установлено или устарело") {
+		t.Errorf("an expired offer scheduled a reminder:\n%s", bot.texts())
+	}
+
+	// An offer nobody tapped is dropped when the next one is made
+	sendLetter(handler, "a@example.com", "Отчёт")
+	handler.followUpsMu.Lock()
+	handler.followUps[handler.followUpSeq].SentAt = time.Now().Add(-FOLLOW_UP_OFFER_TTL - time.Minute)
+	handler.followUpsMu.Unlock()
+	sendLetter(handler, "a@example.com", "Отчёт")
+	handler.followUpsMu.Lock()
+	defer handler.followUpsMu.Unlock()
+	if _, kept := handler.followUps[handler.followUpSeq-1]; kept || handler.followUps[handler.followUpSeq] == nil {
+		t.Errorf("offers %v, want the expired one swept", handler.followUps)
+	}
+}
+
+func TestFollowUpJobSurvivesRestart(t *testing.T) {
+	store := openBoltScheduleStore(t)
+	job := &ScheduledEmail{UserID: 1, ChatID: 1, SendAt: time.Now(), FollowUp: &FollowUp{
+		UserID: 1, Recipient: "a@example.com", Subject: "Отчёт", Channel: REMINDER_TELEGRAM, Reminded: true,
+	}}
+	store.Add(job)
+	if got := store.List(1); len(got) != 1 || got[0].FollowUp == nil || *got[0].FollowUp != *job.FollowUp {
+		t.Errorf("stored %+v, want %+v", got, job.FollowUp)
+	}
+}
@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/template"
+)
+
+// Reply event types whose wording operators can override in secrets.json.
+const (
+	REPLY_SEND_SUCCESS       = "send_success"       // Email accepted, provider returned an ID
+	REPLY_SEND_SUCCESS_NO_ID = "send_success_no_id" // Email accepted, ID missing from the response
+	REPLY_SEND_ERROR         = "send_error"         // Request to the provider failed
+	REPLY_API_ERROR          = "api_error"          // Provider rejected the email
+	REPLY_QUOTA_EXCEEDED     = "quota_exceeded"     // Send refused by the rate limits
+	REPLY_BANNED             = "banned"             // User banned for repeated attempts without access
+	DEFAULT_REPLY_LOCALE     = "default"            // Overrides applied to every locale
+)
+
+// ReplyData holds the variables available to reply templates.
+type ReplyData struct {
+	EmailID  string // Provider message ID, {{.EmailID}}
+	Error    string // Error description, {{.Error}}
+	Provider string // Email provider that refused the letter, {{.Provider}}
+	Wait     string // Time until the next allowed send, such as "2 ч 5 мин", {{.Wait}}
+	// RetryAt is when the user may try again, in the bot's time zone, {{.RetryAt}};
+	// empty for a ban, which lasts until an administrator runs /allow
+	RetryAt string
+	// When is the wait and the time together, such as "через 5 мин, в 14:32" or
+	// "через 20 ч, завтра в 09:00", {{.When}}
+	When   string
+	UserID int64 // Telegram ID of the user, {{.UserID}}
+}
+
+// defaultReplies holds the built-in wording of every reply event.
+var defaultReplies = map[string]string{
+	REPLY_SEND_SUCCESS:       "Письмо успешно отправлено, ID: {{.EmailID}}",
+	REPLY_SEND_SUCCESS_NO_ID: "Письмо успешно отправлено!",
+	REPLY_SEND_ERROR:         "Ошибка при отправке письма: {{.Error}}",
+	REPLY_API_ERROR:          "Ошибка API {{.Provider}}: {{.Error}}",
+	REPLY_QUOTA_EXCEEDED:     "Письмо не отправлено: {{.Error}}. Следующее письмо можно будет отправить {{.When}}.",
+	REPLY_BANNED: "Доступ к боту заблокирован из-за повторных попыток без разрешения." +
+		"{{if .RetryAt}} Попробуйте снова в {{.RetryAt}}.{{else}} Чтобы снять блокировку, передайте администратору ваш ID: {{.UserID}}{{end}}",
+}
+
+// replyTemplates maps a locale (Telegram language code or DEFAULT_REPLY_LOCALE)
+// to the parsed templates of each event.
+var replyTemplates = make(map[string]map[string]*template.Template)
+
+// loadReplyTemplates parses the built-in replies and the per-locale overrides from the configuration.
+func loadReplyTemplates(overrides map[string]map[string]string) error {
+	replyTemplates = make(map[string]map[string]*template.Template)
+	builtIn := make(map[string]*template.Template)
+	for event, text := range defaultReplies {
+		builtIn[event] = template.Must(template.New(event).Parse(text))
+	}
+	replyTemplates[""] = builtIn
+
+	for locale, events := range overrides {
+		parsed := make(map[string]*template.Template)
+		for event, text := range events {
+			if _, known := defaultReplies[event]; !known {
+				return fmt.Errorf("неизвестный тип ответа %q для языка %s", event, locale)
+			}
+			tmpl, err := template.New(event).Parse(text)
+			if err != nil {
+				return fmt.Errorf("ошибка в шаблоне ответа %s для языка %s: %w", event, locale, err)
+			}
+			parsed[event] = tmpl
+		}
+		replyTemplates[strings.ToLower(locale)] = parsed
+	}
+	return nil
+}
+
+// renderReply renders the reply for an event, preferring the user's locale,
+// then the default override, then the built-in wording.
+func renderReply(locale, event string, data ReplyData) string {
+	candidates := []string{DEFAULT_REPLY_LOCALE, ""}
+	if locale != "" {
+		// An empty locale would pick the built-in wording before the default override
+		candidates = append([]string{strings.ToLower(locale)}, candidates...)
+	}
+	configMu.RLock()
+	templates := replyTemplates
+	configMu.RUnlock()
+	for _, candidate := range candidates {
+		tmpl, exists := templates[candidate][event]
+		if !exists {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			slog.Error("Ошибка шаблона ответа", "event", event, "locale", candidate, "error", err)
+			continue
+		}
+		return buf.String()
+	}
+	return defaultReplies[event]
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package bot
+
+import "errors"
+
+// restartProcess cannot replace the process outside Unix; the bot exits with an
+// error instead, for the service manager to start it again.
+func restartProcess() error {
+	return errors.New("перезапуск процесса не поддерживается в этой системе")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package bot
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess replaces the running bot with a fresh copy of the same binary and
+// arguments. The process ID stays the same, so service managers do not notice.
+func restartProcess() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
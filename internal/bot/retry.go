@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Email is a composed message together with everything needed to send it again.
+type Email struct {
+	Recipients  []string
+	Subject     string
+	Body        string
+	SenderName  string
+	Attachments []Attachment
+}
+
+// RETRY_OFFER_TTL is how long the button resending to rejected recipients works.
+const RETRY_OFFER_TTL = 24 * time.Hour
+
+// FailedSend is an email whose recipients were rejected and may be retried with one tap.
+type FailedSend struct {
+	UserID  int64
+	ChatID  int64
+	Email   Email     // Recipients holds only the rejected addresses
+	Expires time.Time // The button stops working after RETRY_OFFER_TTL
+}
+
+// offerRetryRejected offers to resend the email to the recipients Unisender rejected, if any.
+// It reports whether an offer was made, in which case the offer keeps the attachments
+// and the caller must not release them.
+func (h *Handler) offerRetryRejected(userID, chatID int64, email Email, result SendEmailResponse) bool {
+	bot, secrets := h.bot, h.secrets
+	_, rejected := result.Split()
+	var recipients []string
+	for _, r := range rejected {
+		// Results without an address (legacy responses) cannot be matched to a recipient
+		if r.Email != "" {
+			recipients = append(recipients, r.Email)
+		}
+	}
+	if len(recipients) == 0 {
+		return false
+	}
+	email.Recipients = recipients
+
+	now := time.Now()
+	h.failedSendsMu.Lock()
+	// Offers nobody tapped are dropped here, with the attachments they keep
+	for id, failed := range h.failedSends {
+		if now.After(failed.Expires) {
+			delete(h.failedSends, id)
+			releaseAttachments(failed.Email.Attachments)
+		}
+	}
+	h.failedSendsSeq++
+	id := h.failedSendsSeq
+	h.failedSends[id] = &FailedSend{UserID: userID, ChatID: chatID, Email: email, Expires: now.Add(RETRY_OFFER_TTL)}
+	h.failedSendsMu.Unlock()
+
+	loc := secrets.Location()
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не принятые адреса: %s\nКнопка повтора перестанет работать %s.",
+		strings.Join(recipients, ", "), formatRetry(now.Add(RETRY_OFFER_TTL).In(loc), now.In(loc))))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Повторить для %d адр.", len(recipients)), fmt.Sprintf("retry:%d", id)),
+	))
+	bot.Send(msg)
+	return true
+}
+
+// handleRetryCallback resends an email to its previously rejected recipients.
+func (h *Handler) handleRetryCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	id, _ := strconv.ParseInt(payload, 10, 64)
+
+	// Remove the entry right away so a double tap cannot send twice
+	h.failedSendsMu.Lock()
+	failed, exists := h.failedSends[id]
+	if exists && failed.UserID == query.From.ID {
+		delete(h.failedSends, id)
+	} else {
+		exists = false
+	}
+	h.failedSendsMu.Unlock()
+	if !exists {
+		return "Повтор уже выполнен или устарел."
+	}
+	if time.Now().After(failed.Expires) {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		releaseAttachments(failed.Email.Attachments)
+		return "Кнопка повтора устарела, отправьте письмо заново."
+	}
+	if !allowSend(bot, secrets, query.Message, query.From) {
+		// Keep the button working for when the limit allows
+		h.failedSendsMu.Lock()
+		h.failedSends[id] = failed
+		h.failedSendsMu.Unlock()
+		return ""
+	}
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+
+	email := failed.Email
+	for _, a := range email.Attachments {
+		if !a.Available() {
+			bot.Send(newReply(query.Message, "Вложения этого письма уже удалены, отправьте его заново."))
+			releaseAttachments(email.Attachments)
+			return ""
+		}
+	}
+	var combined SendEmailResponse
+	var lines []string
+	for _, recipient := range email.Recipients {
+		result, err := h.sendEmail(ctx, recipient, secrets.SenderEmail, email.Subject, email.Body, email.SenderName, email.Attachments...)
+		recordSend(h.History, SentEmail{
+			UserID:     failed.UserID,
+			Recipient:  recipient,
+			Subject:    email.Subject,
+			Body:       email.Body,
+			SenderName: email.SenderName,
+		}, email.Attachments, result, err)
+		text, _ := describeSendResult(ctx, query.From.LanguageCode, result, err)
+		lines = append(lines, recipient+": "+text)
+		combined = append(combined, result...)
+	}
+	bot.Send(newReply(query.Message, strings.Join(lines, "\n")))
+	if !h.offerRetryRejected(failed.UserID, failed.ChatID, email, combined) {
+		releaseAttachments(email.Attachments)
+	}
+	return ""
+}
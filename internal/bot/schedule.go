@@ -0,0 +1,605 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+const (
+	// SCHEDULE_TIME_LAYOUT is the format users enter the sending time in
+	SCHEDULE_TIME_LAYOUT = "02.01.2006 15:04"
+	// SCHEDULE_CLOCK_LAYOUT is the short form for the nearest occurrence of a time of day
+	SCHEDULE_CLOCK_LAYOUT = "15:04"
+	// SCHEDULE_MAX_AHEAD is how far ahead a letter can be scheduled.
+	SCHEDULE_MAX_AHEAD = 90 * 24 * time.Hour
+	// MAX_SCHEDULED is how many letters a user can have waiting at once.
+	MAX_SCHEDULED = 20
+	// SCHEDULER_INTERVAL is how often the scheduler looks for letters that are due,
+	// so a letter leaves at most this late.
+	SCHEDULER_INTERVAL = 30 * time.Second
+)
+
+// ScheduledEmail is a confirmed draft waiting for its sending time.
+type ScheduledEmail struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	ChatID    int64     `json:"chat_id"`
+	MessageID int       `json:"message_id"` // Message the result replies to
+	Language  string    `json:"language"`   // Locale the result is worded for
+	SendAt    time.Time `json:"send_at"`
+	Draft     UserState `json:"draft"`
+	// Repeat is the cron expression of a recurring letter, empty for a one-off one,
+	// and RepeatLabel describes it for the user
+	Repeat      string `json:"repeat,omitempty"`
+	RepeatLabel string `json:"repeat_label,omitempty"`
+	// FollowUp makes the job a reminder about a sent letter, to the user or to its
+	// recipient, instead of a letter of its own; Draft is then empty
+	FollowUp *FollowUp `json:"follow_up,omitempty"`
+}
+
+// sendsLetter reports whether the job ends in a letter rather than a reminder in Telegram.
+func (job ScheduledEmail) sendsLetter() bool {
+	return job.FollowUp == nil || job.FollowUp.Channel == REMINDER_EMAIL
+}
+
+// scheduledLetters returns the user's letters waiting to be sent, one-off and
+// recurring, without the follow-up reminders; MAX_SCHEDULED caps them.
+func (h *Handler) scheduledLetters(userID int64) []ScheduledEmail {
+	return slices.DeleteFunc(h.Scheduled.List(userID), func(job ScheduledEmail) bool { return job.FollowUp != nil })
+}
+
+// ScheduleStore keeps the letters waiting to be sent.
+type ScheduleStore interface {
+	// Add stores the letter and assigns its ID.
+	Add(job *ScheduledEmail)
+	// List returns the user's letters, soonest first.
+	List(userID int64) []ScheduledEmail
+	// Due returns the letters of every user whose time has come by now.
+	Due(now time.Time) []ScheduledEmail
+	// All returns the letters of every user, soonest first.
+	All() []ScheduledEmail
+	// Remove deletes the letter and reports whether it was still there, so of a
+	// cancel and the scheduler racing for it only one wins.
+	Remove(id int64) bool
+	// Advance moves a recurring letter due at due to its next time and reports
+	// whether it was still there and still due then, like Remove for one-off letters.
+	Advance(id int64, due, next time.Time) bool
+	// Retarget replaces the recipients of a waiting letter and reports whether it
+	// was still there.
+	Retarget(id int64, recipients []string) bool
+}
+
+// sortScheduled orders letters by sending time.
+func sortScheduled(list []ScheduledEmail) []ScheduledEmail {
+	slices.SortFunc(list, func(a, b ScheduledEmail) int { return a.SendAt.Compare(b.SendAt) })
+	return list
+}
+
+// memoryScheduleStore is a ScheduleStore kept in process memory.
+type memoryScheduleStore struct {
+	mu   sync.Mutex
+	seq  int64
+	jobs map[int64]ScheduledEmail
+}
+
+func (m *memoryScheduleStore) Add(job *ScheduledEmail) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	job.ID = m.seq
+	m.jobs[job.ID] = *job
+}
+
+func (m *memoryScheduleStore) List(userID int64) []ScheduledEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []ScheduledEmail
+	for _, job := range m.jobs {
+		if job.UserID == userID {
+			list = append(list, job)
+		}
+	}
+	return sortScheduled(list)
+}
+
+func (m *memoryScheduleStore) Due(now time.Time) []ScheduledEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []ScheduledEmail
+	for _, job := range m.jobs {
+		if !job.SendAt.After(now) {
+			due = append(due, job)
+		}
+	}
+	return sortScheduled(due)
+}
+
+func (m *memoryScheduleStore) All() []ScheduledEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all := make([]ScheduledEmail, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		all = append(all, job)
+	}
+	return sortScheduled(all)
+}
+
+func (m *memoryScheduleStore) Remove(id int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.jobs[id]
+	delete(m.jobs, id)
+	return ok
+}
+
+func (m *memoryScheduleStore) Advance(id int64, due, next time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || !job.SendAt.Equal(due) {
+		return false
+	}
+	job.SendAt = next
+	m.jobs[id] = job
+	return true
+}
+
+func (m *memoryScheduleStore) Retarget(id int64, recipients []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return false
+	}
+	job.Draft.Recipients = slices.Clone(recipients)
+	m.jobs[id] = job
+	return true
+}
+
+// scheduledBucket holds JSON-encoded ScheduledEmail entries keyed by their sequential ID.
+var scheduledBucket = []byte("scheduled")
+
+// boltScheduleStore is a ScheduleStore persisted in the bbolt database, so letters
+// survive a restart and the overdue ones leave right after it.
+type boltScheduleStore struct {
+	db *bolt.DB
+}
+
+// newBoltScheduleStore creates the scheduled letters bucket in the given database.
+func newBoltScheduleStore(db *bolt.DB) (*boltScheduleStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(scheduledBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы запланированных писем: %w", err)
+	}
+	return &boltScheduleStore{db: db}, nil
+}
+
+func (b *boltScheduleStore) Add(job *ScheduledEmail) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = int64(id)
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(state.Int64Key(job.ID), data)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения запланированного письма", "user_id", job.UserID, "error", err)
+	}
+}
+
+// filter returns the stored letters that match.
+func (b *boltScheduleStore) filter(match func(ScheduledEmail) bool) []ScheduledEmail {
+	var list []ScheduledEmail
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).ForEach(func(k, v []byte) error {
+			var job ScheduledEmail
+			if err := json.Unmarshal(v, &job); err != nil {
+				slog.Error("Ошибка чтения запланированного письма", "key", fmt.Sprintf("%x", k), "error", err)
+				return nil
+			}
+			if match(job) {
+				list = append(list, job)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения запланированных писем", "error", err)
+	}
+	return sortScheduled(list)
+}
+
+func (b *boltScheduleStore) List(userID int64) []ScheduledEmail {
+	return b.filter(func(job ScheduledEmail) bool { return job.UserID == userID })
+}
+
+func (b *boltScheduleStore) Due(now time.Time) []ScheduledEmail {
+	return b.filter(func(job ScheduledEmail) bool { return !job.SendAt.After(now) })
+}
+
+func (b *boltScheduleStore) All() []ScheduledEmail {
+	return b.filter(func(ScheduledEmail) bool { return true })
+}
+
+func (b *boltScheduleStore) Remove(id int64) bool {
+	var removed bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket)
+		if removed = bucket.Get(state.Int64Key(id)) != nil; !removed {
+			return nil
+		}
+		return bucket.Delete(state.Int64Key(id))
+	})
+	if err != nil {
+		slog.Error("Ошибка удаления запланированного письма", "schedule_id", id, "error", err)
+		return false
+	}
+	return removed
+}
+
+func (b *boltScheduleStore) Advance(id int64, due, next time.Time) bool {
+	var advanced bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket)
+		data := bucket.Get(state.Int64Key(id))
+		if data == nil {
+			return nil
+		}
+		var job ScheduledEmail
+		if err := json.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		if !job.SendAt.Equal(due) {
+			return nil
+		}
+		job.SendAt = next
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		advanced = true
+		return bucket.Put(state.Int64Key(id), data)
+	})
+	if err != nil {
+		slog.Error("Ошибка переноса повторяющегося письма", "schedule_id", id, "error", err)
+		return false
+	}
+	return advanced
+}
+
+func (b *boltScheduleStore) Retarget(id int64, recipients []string) bool {
+	var retargeted bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledBucket)
+		data := bucket.Get(state.Int64Key(id))
+		if data == nil {
+			return nil
+		}
+		var job ScheduledEmail
+		if err := json.Unmarshal(data, &job); err != nil {
+			return err
+		}
+		job.Draft.Recipients = recipients
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		retargeted = true
+		return bucket.Put(state.Int64Key(id), data)
+	})
+	if err != nil {
+		slog.Error("Ошибка смены получателей запланированного письма", "schedule_id", id, "error", err)
+		return false
+	}
+	return retargeted
+}
+
+// scheduleKeyboard builds the quick choices under the sending time prompt.
+func scheduleKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Через час", "schedule:in:60"),
+			tgbotapi.NewInlineKeyboardButtonData("Через 3 часа", "schedule:in:180"),
+			tgbotapi.NewInlineKeyboardButtonData("Завтра в 9:00", "schedule:tomorrow"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Назад к письму", "schedule:back"),
+		),
+	)
+}
+
+// schedulePrompt asks when to send the draft, with an example in the user's timezone.
+func schedulePrompt(secrets *Secrets) string {
+	example := time.Now().In(secrets.Location()).Add(24 * time.Hour).Format(SCHEDULE_TIME_LAYOUT)
+	return "Когда отправить письмо? Выберите вариант или введите дату и время в формате ДД.ММ.ГГГГ ЧЧ:ММ, например " +
+		example + ". Если указать только время ЧЧ:ММ, письмо уйдёт в ближайшее такое время."
+}
+
+// parseScheduleTime reads a sending time typed by the user: a full date and time,
+// or a time of day meaning its nearest occurrence after now.
+func parseScheduleTime(text string, now time.Time, loc *time.Location) (time.Time, error) {
+	if at, err := time.ParseInLocation(SCHEDULE_TIME_LAYOUT, text, loc); err == nil {
+		return at, nil
+	}
+	clock, err := time.ParseInLocation(SCHEDULE_CLOCK_LAYOUT, text, loc)
+	if err != nil {
+		return time.Time{}, errors.New("Не удалось разобрать время. Формат: ДД.ММ.ГГГГ ЧЧ:ММ или ЧЧ:ММ")
+	}
+	now = now.In(loc)
+	at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+	if !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at, nil
+}
+
+// scheduleDraft stores the draft to be sent at the given time and returns the user
+// to the start. The result of the send will reply to message.
+func (h *Handler) scheduleDraft(message *tgbotapi.Message, from *tgbotapi.User, state *UserState, at time.Time) error {
+	bot, secrets := h.bot, h.secrets
+	now := time.Now()
+	if !at.After(now) {
+		return errors.New("Это время уже прошло. Укажите время в будущем.")
+	}
+	if at.After(now.Add(SCHEDULE_MAX_AHEAD)) {
+		return fmt.Errorf("Письмо можно запланировать не больше чем на %s вперёд.", formatDays(int(SCHEDULE_MAX_AHEAD/(24*time.Hour))))
+	}
+	if len(h.scheduledLetters(from.ID)) >= MAX_SCHEDULED {
+		return fmt.Errorf("Запланировано уже %d писем, это максимум. Отмените лишние: /scheduled", MAX_SCHEDULED)
+	}
+
+	draft := *state
+	draft.State = "await_confirm"
+	draft.Editing = false
+	job := &ScheduledEmail{
+		UserID:    from.ID,
+		ChatID:    message.Chat.ID,
+		MessageID: message.MessageID,
+		Language:  from.LanguageCode,
+		SendAt:    at,
+		Draft:     draft,
+	}
+	h.Scheduled.Add(job)
+	slog.Info("Письмо запланировано", "subject", draft.Subject, "send_at", at.Format(time.RFC3339), "user_id", from.ID)
+
+	*state = UserState{State: "initial"}
+	msg := newReply(message, fmt.Sprintf("Письмо «%s» будет отправлено %s. Посмотреть или отменить запланированные письма: /scheduled",
+		draft.Subject, at.In(secrets.Location()).Format(SCHEDULE_TIME_LAYOUT)))
+	msg.ReplyMarkup = newInitialKeyboard()
+	bot.Send(msg)
+	return nil
+}
+
+// acceptSchedule schedules the draft for the time the user typed.
+func (h *Handler) acceptSchedule(message *tgbotapi.Message, state *UserState, text string) {
+	bot, secrets := h.bot, h.secrets
+	at, err := parseScheduleTime(text, time.Now(), secrets.Location())
+	if err == nil {
+		err = h.scheduleDraft(message, message.From, state, at)
+	}
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+	}
+}
+
+// handleScheduleCallback handles the quick sending times under the prompt and the
+// cancel buttons of /scheduled.
+func (h *Handler) handleScheduleCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	chatID := query.Message.Chat.ID
+	action, arg, _ := strings.Cut(payload, ":")
+	if action == "cancel" {
+		return h.cancelScheduled(query, arg)
+	}
+
+	// Taking the draft out of the step in one update keeps a double tap from scheduling it twice
+	var draft UserState
+	var current bool
+	h.States.Update(userID, func(s *UserState) {
+		if current = s.State == "await_schedule"; current {
+			draft = *s
+			*s = UserState{State: "initial"}
+		}
+	})
+	if !current {
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		return "Это письмо уже отправлено или отменено."
+	}
+
+	now := time.Now()
+	var at time.Time
+	switch action {
+	case "in":
+		minutes, err := strconv.Atoi(arg)
+		if err != nil || minutes <= 0 {
+			h.States.Update(userID, func(s *UserState) { *s = draft })
+			return "Кнопка устарела."
+		}
+		at = now.Add(time.Duration(minutes) * time.Minute)
+	case "tomorrow":
+		local := now.In(secrets.Location())
+		at = time.Date(local.Year(), local.Month(), local.Day()+1, 9, 0, 0, 0, local.Location())
+	case "back":
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		showPreview(bot, query.Message, &draft)
+		h.States.Update(userID, func(s *UserState) { *s = draft })
+		return ""
+	default:
+		h.States.Update(userID, func(s *UserState) { *s = draft })
+		return "Кнопка устарела."
+	}
+
+	if err := h.scheduleDraft(query.Message, query.From, &draft, at); err != nil {
+		h.States.Update(userID, func(s *UserState) { *s = draft })
+		return err.Error()
+	}
+	removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+	return "Письмо запланировано"
+}
+
+// scheduledList renders the user's waiting one-off letters and follow-up reminders
+// with a cancel button for each; recurring ones are listed by /recurring.
+func (h *Handler) scheduledList(userID int64) (string, *tgbotapi.InlineKeyboardMarkup) {
+	secrets := h.secrets
+	list := slices.DeleteFunc(h.Scheduled.List(userID), func(job ScheduledEmail) bool {
+		return job.Repeat != "" || job.FollowUp != nil && job.FollowUp.Reminded
+	})
+	if len(list) == 0 {
+		return "Запланированных писем нет. Чтобы запланировать письмо, нажмите «Отправить позже» под предпросмотром.", nil
+	}
+	lines := []string{"Запланированные письма:"}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, job := range list {
+		at := job.SendAt.In(secrets.Location()).Format(SCHEDULE_TIME_LAYOUT)
+		switch {
+		case job.FollowUp == nil:
+			lines = append(lines, fmt.Sprintf("%s — «%s»", at, job.Draft.Subject))
+		case job.FollowUp.Channel == REMINDER_EMAIL:
+			lines = append(lines, fmt.Sprintf("%s — письмо-напоминание получателю о «%s»", at, job.FollowUp.Subject))
+		default:
+			lines = append(lines, fmt.Sprintf("%s — напоминание вам о «%s»", at, job.FollowUp.Subject))
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Отменить: "+at, fmt.Sprintf("schedule:cancel:%d", job.ID)),
+		))
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return strings.Join(lines, "\n"), &markup
+}
+
+// handleScheduledCommand replies to /scheduled with the user's waiting letters.
+func (h *Handler) handleScheduledCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	text, markup := h.scheduledList(message.From.ID)
+	msg := newReply(message, text)
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	bot.Send(msg)
+}
+
+// cancelScheduled removes a waiting letter of the user and updates the list in place.
+func (h *Handler) cancelScheduled(query *tgbotapi.CallbackQuery, arg string) string {
+	bot := h.bot
+	id, _ := strconv.ParseInt(arg, 10, 64)
+	owned := slices.ContainsFunc(h.Scheduled.List(query.From.ID), func(job ScheduledEmail) bool { return job.ID == id })
+	if !owned || !h.Scheduled.Remove(id) {
+		return "Письмо уже отправлено или отменено."
+	}
+	slog.Info("Запланированное письмо отменено", "schedule_id", id, "user_id", query.From.ID)
+
+	text, markup := h.scheduledList(query.From.ID)
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ReplyMarkup = markup
+	bot.Send(edit)
+	return "Отправка отменена"
+}
+
+// runScheduler sends the letters that are due every SCHEDULER_INTERVAL until stop
+// is closed. Sends run under ctx, like the ones started by users.
+func (h *Handler) runScheduler(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(SCHEDULER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		// The first pass right at startup sends what fell due while the bot was down
+		h.snapshot().dispatchDue(ctx, time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchDue sends every letter and follow-up reminder due by now and returns how
+// many letters were sent. Each
+// one-off letter is removed and each recurring one moved to its next time before
+// sending, so a crash mid-send never sends it twice.
+func (h *Handler) dispatchDue(ctx context.Context, now time.Time) int {
+	secrets := h.secrets
+	sent := 0
+	for _, job := range h.Scheduled.Due(now) {
+		if job.FollowUp != nil {
+			if h.dispatchFollowUp(ctx, job, now) {
+				sent++
+			}
+			continue
+		}
+		var next time.Time
+		if job.Repeat == "" {
+			if !h.Scheduled.Remove(job.ID) {
+				// Cancelled meanwhile
+				continue
+			}
+		} else {
+			// Runs missed while the bot was down collapse into this one
+			schedule, err := parseCron(job.Repeat)
+			if err == nil {
+				next, err = schedule.next(now.In(secrets.Location()))
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "Повторяющееся письмо удалено, расписание не действует", "schedule_id", job.ID, "repeat", job.Repeat, "user_id", job.UserID, "error", err)
+				h.Scheduled.Remove(job.ID)
+				continue
+			}
+			if !h.Scheduled.Advance(job.ID, job.SendAt, next) {
+				continue
+			}
+		}
+		h.sendScheduled(ctx, job, next)
+		sent++
+	}
+	return sent
+}
+
+// sendScheduled sends a letter whose time has come and reports the result to its
+// chat. next is the following run of a recurring letter.
+func (h *Handler) sendScheduled(ctx context.Context, job ScheduledEmail, next time.Time) {
+	bot, secrets := h.bot, h.secrets
+	ctx = withLogAttrs(ctx, "user_id", job.UserID, "chat_id", job.ChatID, "schedule_id", job.ID)
+	slog.InfoContext(ctx, "Отправка запланированного письма", "subject", job.Draft.Subject)
+	message := &tgbotapi.Message{MessageID: job.MessageID, Chat: &tgbotapi.Chat{ID: job.ChatID}}
+	from := &tgbotapi.User{ID: job.UserID, LanguageCode: job.Language}
+	notice := fmt.Sprintf("Отправляю письмо «%s», запланированное на %s.", job.Draft.Subject, job.SendAt.In(secrets.Location()).Format(SCHEDULE_TIME_LAYOUT))
+	if job.Repeat != "" {
+		notice = fmt.Sprintf("Отправляю повторяющееся письмо «%s» (%s). Следующая отправка — %s.",
+			job.Draft.Subject, job.RepeatLabel, next.In(secrets.Location()).Format(SCHEDULE_TIME_LAYOUT))
+	}
+	bot.Send(newReply(message, notice))
+	// The letter was confirmed when it was scheduled, so it is sent over the limit
+	sendLimits.charge(job.UserID)
+
+	attachments, err := h.downloadDraftAttachments(ctx, message, job.Draft.Attachments)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки вложений запланированного письма", "error", err)
+		bot.Send(newReply(message, fmt.Sprintf("Запланированное письмо «%s» не отправлено: не удалось загрузить вложение: %v", job.Draft.Subject, err)))
+		return
+	}
+	h.deliverDraft(ctx, from, message, &job.Draft, attachments)
+}
@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"botmailtest/internal/state"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	now := time.Date(2026, 5, 10, 12, 30, 0, 0, loc)
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"11.05.2026 09:15", time.Date(2026, 5, 11, 9, 15, 0, 0, loc)},
+		{"18:00", time.Date(2026, 5, 10, 18, 0, 0, 0, loc)},
+		{"12:30", time.Date(2026, 5, 11, 12, 30, 0, 0, loc)}, // Not after now, so tomorrow
+	}
+	for _, tt := range tests {
+		if got, err := parseScheduleTime(tt.text, now, loc); err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseScheduleTime(%q) = %v, %v; want %v", tt.text, got, err, tt.want)
+		}
+	}
+	if _, err := parseScheduleTime("завтра", now, loc); err == nil {
+		t.Error("parseScheduleTime accepted text without a time")
+	}
+}
+
+// openBoltScheduleStore opens a schedule store in a fresh database for the test.
+func openBoltScheduleStore(t *testing.T) *boltScheduleStore {
+	t.Helper()
+	db, err := state.Open(filepath.Join(t.TempDir(), "bot.db"), state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := newBoltScheduleStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBoltScheduleStore(t *testing.T) {
+	store := openBoltScheduleStore(t)
+
+	now := time.Now()
+	late := &ScheduledEmail{UserID: 1, SendAt: now.Add(time.Hour), Draft: UserState{Subject: "Позже"}}
+	soon := &ScheduledEmail{UserID: 1, SendAt: now.Add(-time.Minute), Draft: UserState{Subject: "Сейчас"}}
+	other := &ScheduledEmail{UserID: 2, SendAt: now.Add(time.Minute)}
+	for _, job := range []*ScheduledEmail{late, soon, other} {
+		store.Add(job)
+	}
+
+	var subjects []string
+	for _, job := range store.List(1) {
+		subjects = append(subjects, job.Draft.Subject)
+	}
+	if want := []string{"Сейчас", "Позже"}; !reflect.DeepEqual(subjects, want) {
+		t.Errorf("List = %q, want %q", subjects, want)
+	}
+	if due := store.Due(now); len(due) != 1 || due[0].ID != soon.ID {
+		t.Errorf("Due = %+v, want only letter %d", due, soon.ID)
+	}
+	if !store.Remove(soon.ID) || store.Remove(soon.ID) {
+		t.Error("Remove must succeed exactly once")
+	}
+}
+
+func TestScheduledDraftIsSentWhenDue(t *testing.T) {
+	wizard, sender := runWizard(t, []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт во вложении."), textAction("Иван"),
+		tapAction("confirm:later"), tapAction("schedule:in:60"),
+	})
+	if sender.sent != 0 {
+		t.Fatalf("scheduled letter sent right away")
+	}
+	list := wizard.Scheduled.List(wizardUser)
+	if len(list) != 1 || list[0].Draft.Subject != "Отчёт" {
+		t.Fatalf("scheduled = %+v", list)
+	}
+	if state, _ := wizard.States.Get(wizardUser); state.State != "initial" {
+		t.Errorf("state after scheduling = %q, want initial", state.State)
+	}
+
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com"}
+	handler := NewHandler(bot, sender, secrets, wizard.Stores)
+
+	if sent := handler.dispatchDue(context.Background(), time.Now()); sent != 0 {
+		t.Fatalf("dispatched %d letters before their time", sent)
+	}
+	if sent := handler.dispatchDue(context.Background(), time.Now().Add(2*time.Hour)); sent != 1 {
+		t.Fatalf("dispatched %d letters, want 1", sent)
+	}
+	if want := []string{"Отчёт"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Errorf("sent %q, want %q", sender.subjects, want)
+	}
+	if _, ok := telegram.find(wizardUser, "запланированное на"); !ok {
+		t.Errorf("no notice about the scheduled send:\n%s", telegram.transcript(wizardUser))
+	}
+	if len(handler.Scheduled.List(wizardUser)) != 0 {
+		t.Error("sent letter is still scheduled")
+	}
+}
+
+func TestBoltScheduleStoreRetarget(t *testing.T) {
+	store := openBoltScheduleStore(t)
+	job := &ScheduledEmail{UserID: 1, SendAt: time.Now(), Draft: UserState{Recipients: []string{"a@example.com"}, Subject: "Отчёт"}}
+	store.Add(job)
+	if !store.Retarget(job.ID, []string{"b@example.com"}) {
+		t.Fatal("Retarget missed the letter")
+	}
+	if list := store.List(1); len(list) != 1 || !reflect.DeepEqual(list[0].Draft.Recipients, []string{"b@example.com"}) || list[0].Draft.Subject != "Отчёт" {
+		t.Errorf("letters = %+v, want the new recipients only", list)
+	}
+	if store.Retarget(job.ID+1, nil) {
+		t.Error("Retarget found a letter that does not exist")
+	}
+}
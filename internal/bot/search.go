@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// MAX_SEARCH_RESULTS is how many letters /search lists.
+	MAX_SEARCH_RESULTS = 10
+	// MAX_ATTACHMENT_TEXT is how many bytes of attachment text each history entry
+	// keeps for /search.
+	MAX_ATTACHMENT_TEXT = 64 * 1024
+)
+
+// textAttachmentTypes are the file extensions whose contents /search looks into.
+var textAttachmentTypes = []string{".txt", ".csv", ".md"}
+
+// attachmentText returns the text of the plain-text attachments, up to
+// MAX_ATTACHMENT_TEXT in all. Files that are not valid UTF-8 are skipped.
+func attachmentText(attachments []Attachment) string {
+	var texts []string
+	left := MAX_ATTACHMENT_TEXT
+	for _, a := range attachments {
+		if left <= 0 || !slices.Contains(textAttachmentTypes, strings.ToLower(filepath.Ext(a.Name))) {
+			continue
+		}
+		r, err := a.Open()
+		if err != nil {
+			slog.Warn("Ошибка чтения вложения для поиска", "name", a.Name, "error", err)
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(r, int64(left)))
+		r.Close()
+		if err != nil {
+			slog.Warn("Ошибка чтения вложения для поиска", "name", a.Name, "error", err)
+			continue
+		}
+		if !utf8.Valid(data) {
+			if len(data) < left {
+				continue
+			}
+			// The limit may have cut the last character in two
+			data = []byte(strings.ToValidUTF8(string(data), ""))
+		}
+		texts = append(texts, string(data))
+		left -= len(data)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// mentions reports whether the query occurs, ignoring case, in the subject, the
+// addresses, the attachment names or the attachment text of the letter.
+func (e SentEmail) mentions(query string) bool {
+	query = strings.ToLower(query)
+	fields := slices.Concat([]string{e.Subject, e.Recipient, e.AttachmentText}, e.CC, e.BCC)
+	for _, a := range e.Attachments {
+		fields = append(fields, a.FileName)
+	}
+	return slices.ContainsFunc(fields, func(field string) bool { return strings.Contains(strings.ToLower(field), query) })
+}
+
+// handleSearchCommand replies to /search with the user's letters that mention the
+// query, naming the attachments of each.
+func (h *Handler) handleSearchCommand(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	query := strings.TrimSpace(message.CommandArguments())
+	if query == "" {
+		bot.Send(newReply(message, "Использование: /search договор.pdf — ищет в истории ваших писем по теме, адресам, названиям вложений и тексту вложений .txt, .csv и .md."))
+		return
+	}
+	entries := h.History.Search(message.From.ID, query, MAX_SEARCH_RESULTS+1)
+	if len(entries) == 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Писем, где встречается «%s», не найдено.", query)))
+		return
+	}
+
+	lines := []string{fmt.Sprintf("Письма, где встречается «%s»:", query)}
+	for _, entry := range entries[:min(len(entries), MAX_SEARCH_RESULTS)] {
+		line := historyLine(entry, secrets.Location())
+		var names []string
+		for _, a := range entry.Attachments {
+			names = append(names, a.FileName)
+		}
+		if len(names) > 0 {
+			line += "\n    Вложения: " + strings.Join(names, ", ")
+		}
+		lines = append(lines, line)
+	}
+	if len(entries) > MAX_SEARCH_RESULTS {
+		lines = append(lines, fmt.Sprintf("Показаны %d самых новых, уточните запрос, чтобы увидеть остальные.", MAX_SEARCH_RESULTS))
+	}
+	lines = append(lines, "", "Отправить письмо снова: /resend <номер>")
+	bot.Send(newReply(message, strings.Join(lines, "\n")))
+}
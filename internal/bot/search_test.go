@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentText(t *testing.T) {
+	text := attachmentText([]Attachment{
+		{Name: "Заметки.TXT", Data: []byte("Срок оплаты по договору — май")},
+		{Name: "договор.pdf", Data: []byte("%PDF-1.7 договор")},
+		{Name: "binary.txt", Data: []byte{0xff, 0xfe, 0x00}},
+		{Name: "long.csv", Data: []byte(strings.Repeat("я", MAX_ATTACHMENT_TEXT))},
+	})
+	if !strings.HasPrefix(text, "Срок оплаты по договору — май\n") {
+		t.Errorf("text = %.60q, want the text file first", text)
+	}
+	if strings.Contains(text, "PDF") || strings.ContainsRune(text, 0xfffd) {
+		t.Errorf("text has the contents of a PDF or a binary file: %.60q", text)
+	}
+	if len(text) > MAX_ATTACHMENT_TEXT+1 || !strings.HasSuffix(text, "я") {
+		t.Errorf("text is %d bytes ending in %q, want it cut at the limit on a character", len(text), text[len(text)-2:])
+	}
+}
+
+func TestSearchCommand(t *testing.T) {
+	telegram, handler := adminBot(t)
+	recordSend(handler.History, SentEmail{UserID: wizardUser, Recipient: "lawyer@example.com", Subject: "Документы"},
+		[]Attachment{{Name: "Договор.pdf", FileID: "f1"}, {Name: "заметки.txt", FileID: "f2", Data: []byte("Аренда офиса")}}, nil, nil)
+	recordSend(handler.History, SentEmail{UserID: wizardUser, Recipient: "boss@example.com", Subject: "Отчёт"}, nil, nil, nil)
+	recordSend(handler.History, SentEmail{UserID: 9, Recipient: "other@example.com", Subject: "Договор"}, nil, nil, nil)
+
+	for query, want := range map[string]string{
+		"договор.pdf": "«Документы» → lawyer@example.com\n    Вложения: Договор.pdf, заметки.txt",
+		"аренда":      "«Документы»",
+		"BOSS@":       "«Отчёт»",
+	} {
+		handler.HandleUpdate(context.Background(), textAction("/search "+query).update())
+		if _, ok := telegram.find(wizardUser, want); !ok {
+			t.Errorf("/search %s: no %q in:\n%s", query, want, telegram.transcript(wizardUser))
+		}
+	}
+	handler.HandleUpdate(context.Background(), textAction("/search Договор").update())
+	if msg, ok := telegram.find(wizardUser, "Письма, где встречается «Договор»"); !ok || strings.Contains(msg.Text, "other@example.com") {
+		t.Errorf("search shows the letters of another user or none:\n%s", telegram.transcript(wizardUser))
+	}
+}
@@ -0,0 +1,97 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SESSION_SWEEP_INTERVAL is how often the janitor looks for idle drafts, so a
+// draft is discarded at most this long after its session_timeout.
+const SESSION_SWEEP_INTERVAL = time.Minute
+
+// draftInProgress reports whether the user is in the middle of the wizard.
+func draftInProgress(state *UserState) bool {
+	return state.State != "" && state.State != "initial"
+}
+
+// touchDraft marks the user's draft as worked on, after a button or command that
+// changed it outside of the wizard steps. Users without a draft are left alone.
+func (h *Handler) touchDraft(userID int64) {
+	if state, _ := h.States.Get(userID); !draftInProgress(&state) {
+		return
+	}
+	now := time.Now()
+	h.States.Update(userID, func(s *UserState) {
+		if draftInProgress(s) {
+			s.Touched = now
+		}
+	})
+}
+
+// expireIdleDrafts resets the drafts untouched for longer than timeout and tells
+// their authors. Drafts are not counted as idle before since, when the janitor
+// started, so the time the bot was down is not held against them. It returns how
+// many drafts were discarded.
+func (h *Handler) expireIdleDrafts(timeout time.Duration, since, now time.Time) int {
+	bot := h.bot
+	expired := 0
+	h.States.Range(func(userID int64, state UserState) {
+		if !draftInProgress(&state) || now.Sub(later(state.Touched, since)) < timeout {
+			return
+		}
+		// The user may have come back since the copy was taken
+		var reset bool
+		h.States.Update(userID, func(s *UserState) {
+			if reset = draftInProgress(s) && s.Touched.Equal(state.Touched); reset {
+				*s = UserState{State: "initial"}
+			}
+		})
+		if !reset {
+			return
+		}
+		expired++
+		slog.Info("Черновик удалён по неактивности", "user_id", userID, "state", state.State)
+		text := fmt.Sprintf("Черновик письма удалён: его не заполняли дольше %s. Нажмите 'Новое Письмо', чтобы начать заново.", formatWait(timeout))
+		if state.Subject != "" {
+			text = fmt.Sprintf("Черновик письма «%s» удалён: его не заполняли дольше %s. Нажмите 'Новое Письмо', чтобы начать заново.", state.Subject, formatWait(timeout))
+		}
+		msg := tgbotapi.NewMessage(userID, text)
+		msg.ReplyMarkup = newInitialKeyboard()
+		if _, err := bot.Send(msg); err != nil {
+			slog.Warn("Ошибка уведомления об удалении черновика", "user_id", userID, "error", err)
+		}
+	})
+	return expired
+}
+
+// later returns the later of the two times.
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// runSessionJanitor discards idle drafts and expired broadcast confirmations every
+// SESSION_SWEEP_INTERVAL until stop is closed. The timeout is read on every pass, so /reload changes it at once.
+func (h *Handler) runSessionJanitor(stop <-chan struct{}) {
+	secrets := h.secrets
+	started := time.Now()
+	ticker := time.NewTicker(SESSION_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			timeout, _ := snapshotSettings(secrets).IdleTimeout() // Checked by validate
+			if timeout > 0 {
+				h.expireIdleDrafts(timeout, started, now)
+			}
+			h.sweepBroadcasts(now)
+		}
+	}
+}
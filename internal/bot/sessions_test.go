@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireIdleDrafts(t *testing.T) {
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	now := time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC)
+	started := now.Add(-2 * time.Hour)
+	handler.States.Update(1, func(s *UserState) {
+		*s = UserState{State: "await_body", Subject: "Отчёт", Touched: now.Add(-31 * time.Minute)}
+	})
+	handler.States.Update(2, func(s *UserState) { *s = UserState{State: "await_body", Touched: now.Add(-10 * time.Minute)} })
+	handler.States.Update(3, func(s *UserState) { *s = UserState{State: "initial"} })
+	// Saved before the timeout existed
+	handler.States.Update(4, func(s *UserState) { *s = UserState{State: "await_subject"} })
+
+	// Drafts are not idle while the bot is down
+	if n := handler.expireIdleDrafts(30*time.Minute, now.Add(-20*time.Minute), now); n != 0 {
+		t.Errorf("expired %d drafts the janitor started 20 minutes ago", n)
+	}
+	if n := handler.expireIdleDrafts(30*time.Minute, started, now); n != 2 {
+		t.Errorf("expired %d drafts, want the idle one and the one saved before the timeout", n)
+	}
+	for userID, want := range map[int64]string{1: "initial", 2: "await_body", 3: "initial", 4: "initial"} {
+		if state, _ := handler.States.Get(userID); state.State != want || state.Subject != "" && want == "initial" {
+			t.Errorf("state of %d after expiry %+v, want %s", userID, state, want)
+		}
+	}
+	if got, want := bot.texts(), "Черновик письма «Отчёт» удалён: его не заполняли дольше 30 мин."; !strings.Contains(got, want) || strings.Count(got, "удалён") != 2 {
+		t.Errorf("notices = %q, want one per discarded draft with %q", got, want)
+	}
+}
+
+func TestWizardTouchesDraft(t *testing.T) {
+	var steps []string
+	handler, _, _ := newWizardHandler(t, wizardSecrets(), &steps)
+	old := time.Now().Add(-time.Hour)
+	handler.States.Update(wizardUser, func(s *UserState) { *s = UserState{State: "await_subject", Touched: old} })
+	handler.HandleUpdate(context.Background(), textAction("Отчёт за май").update())
+	if state, _ := handler.States.Get(wizardUser); !state.Touched.After(old) {
+		t.Errorf("a wizard step did not touch the draft")
+	}
+
+	handler.States.Update(wizardUser, func(s *UserState) { s.Touched = old })
+	handler.HandleUpdate(context.Background(), textAction("/notify").update())
+	if state, _ := handler.States.Get(wizardUser); !state.Touched.After(old) {
+		t.Errorf("a command did not touch the draft")
+	}
+
+	handler.HandleUpdate(context.Background(), textAction("/cancel").update())
+	if state, _ := handler.States.Get(wizardUser); !state.Touched.IsZero() {
+		t.Errorf("touched a reset state: %+v", state)
+	}
+}
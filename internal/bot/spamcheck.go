@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// MAIL_TESTER_ADDRESS is the seed address format of mail-tester.com: username and test ID.
+	MAIL_TESTER_ADDRESS = "%s-%s@srv1.mail-tester.com"
+	// MAIL_TESTER_REPORT_URL is the JSON report of a mail-tester.com test.
+	MAIL_TESTER_REPORT_URL = "https://www.mail-tester.com/%s-%s&format=json"
+	// SPAM_CHECK_POLL_INTERVAL is the pause between report requests while mail-tester processes the email.
+	SPAM_CHECK_POLL_INTERVAL = 15 * time.Second
+	// SPAM_CHECK_TIMEOUT is how long to wait for the report before giving up.
+	SPAM_CHECK_TIMEOUT = 3 * time.Minute
+)
+
+// SpamReport is the part of the mail-tester.com JSON report shown to users.
+type SpamReport struct {
+	Status        bool    `json:"status"` // False until the test email has been received and analysed
+	Mark          float64 `json:"mark"`
+	DisplayedMark string  `json:"displayedMark"`
+	Title         string  `json:"title"`
+	SpamAssassin  struct {
+		Rules map[string]struct {
+			Score       float64 `json:"score"`
+			Description string  `json:"description"`
+		} `json:"rules"`
+	} `json:"spamAssassin"`
+}
+
+// startSpamCheck sends the user's draft to a mail-tester.com seed address and reports
+// the spam score back to the chat once the analysis is ready.
+func (h *Handler) startSpamCheck(ctx context.Context, message *tgbotapi.Message, state UserState) {
+	bot, secrets := h.bot, h.secrets
+	if secrets.MailTesterUsername == "" {
+		bot.Send(newReply(message, "Проверка спам-рейтинга не настроена."))
+		return
+	}
+	if state.Subject == "" || state.Body == "" {
+		bot.Send(newReply(message, "Сначала введите тему и текст письма, затем отправьте /spamcheck."))
+		return
+	}
+	// The test letter is a real send, so it is taken from the same allowance
+	if !allowSend(bot, secrets, message, message.From) {
+		return
+	}
+	// The test letter is the one that would be sent
+	state = normalizeDraft(normalizeRules(), state)
+
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		slog.ErrorContext(ctx, "Ошибка генерации ID проверки", "error", err)
+		bot.Send(newReply(message, "Не удалось начать проверку."))
+		return
+	}
+	testID := hex.EncodeToString(buf)
+	address := fmt.Sprintf(MAIL_TESTER_ADDRESS, secrets.MailTesterUsername, testID)
+
+	senderName := choose(state.SenderName, strings.TrimSpace(message.From.FirstName+" "+message.From.LastName))
+	result, err := h.sendEmail(ctx, address, secrets.SenderEmail, state.Subject, state.EmailBody(), senderName)
+	if text, sent := describeSendResult(ctx, message.From.LanguageCode, result, err); !sent {
+		bot.Send(newReply(message, text))
+		return
+	}
+	bot.Send(newReply(message, "Тестовое письмо отправлено на проверку, результат придёт через пару минут. Можно продолжать заполнять письмо."))
+
+	// The report is polled after the update is handled, when /reload may change the settings
+	username := secrets.MailTesterUsername
+	go func() {
+		report, err := waitForSpamReport(ctx, username, testID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Ошибка получения отчёта mail-tester", "test_id", testID, "error", err)
+			bot.Send(newReply(message, fmt.Sprintf("Не удалось получить результат проверки: %v", err)))
+			return
+		}
+		bot.Send(newReply(message, formatSpamReport(report)))
+	}()
+}
+
+// waitForSpamReport polls mail-tester.com until the test report is ready or the timeout expires.
+func waitForSpamReport(ctx context.Context, username, testID string) (*SpamReport, error) {
+	reportURL := fmt.Sprintf(MAIL_TESTER_REPORT_URL, username, testID)
+	deadline := time.Now().Add(SPAM_CHECK_TIMEOUT)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(SPAM_CHECK_POLL_INTERVAL):
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reportURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания запроса: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			slog.WarnContext(ctx, "Ошибка запроса к mail-tester", "test_id", testID, "error", err)
+			continue
+		}
+		var report SpamReport
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		if err != nil {
+			slog.WarnContext(ctx, "Ошибка декодирования отчёта mail-tester", "test_id", testID, "error", err)
+			continue
+		}
+		if report.Status {
+			return &report, nil
+		}
+	}
+	return nil, fmt.Errorf("отчёт не готов за %s", SPAM_CHECK_TIMEOUT)
+}
+
+// formatSpamReport renders the spam score and the rules that lowered it.
+func formatSpamReport(report *SpamReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Спам-рейтинг: %s", choose(report.DisplayedMark, fmt.Sprintf("%.1f/10", report.Mark)))
+	if report.Title != "" {
+		fmt.Fprintf(&sb, "\n%s", report.Title)
+	}
+
+	type issue struct {
+		name  string
+		score float64
+		text  string
+	}
+	var issues []issue
+	for name, rule := range report.SpamAssassin.Rules {
+		// Positive SpamAssassin scores push the email towards spam
+		if rule.Score > 0 {
+			issues = append(issues, issue{name, rule.Score, rule.Description})
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].score > issues[j].score })
+	if len(issues) > 0 {
+		sb.WriteString("\n\nЗамечания:")
+		for _, is := range issues {
+			fmt.Fprintf(&sb, "\n• %s (%+.1f): %s", is.name, is.score, is.text)
+		}
+	}
+	return sb.String()
+}
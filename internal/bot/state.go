@@ -0,0 +1,12 @@
+package bot
+
+import "botmailtest/internal/state"
+
+// The drafts and the stores keeping them live in the state package; the handlers
+// use them under their own names.
+type (
+	UserState       = state.UserState
+	Invite          = state.Invite
+	DraftAttachment = state.DraftAttachment
+	StateStore      = state.StateStore
+)
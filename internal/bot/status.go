@@ -0,0 +1,146 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// STATUS_LOOKUP_WINDOW is how many of the user's recent emails /status looks the ID up in.
+const STATUS_LOOKUP_WINDOW = 200
+
+// EmailStatus is one entry of the Unisender checkEmail result.
+type EmailStatus struct {
+	ID     mailer.UnisenderID `json:"id"`
+	Status string             `json:"status"`
+}
+
+// emailStatusNames translates Unisender delivery statuses for users. Statuses not
+// listed here are shown by their prefix: ok_ as delivered, err_ as not delivered.
+var emailStatusNames = map[string]string{
+	"not_sent":            "ещё не отправлено",
+	"ok_sent":             "отправлено, ожидает доставки",
+	"ok_delivered":        "доставлено",
+	"ok_read":             "доставлено и прочитано",
+	"ok_link_visited":     "прочитано, получатель перешёл по ссылке",
+	"ok_unsubscribed":     "получатель отписался",
+	"ok_spam_folder":      "доставлено в папку «Спам»",
+	"ok_fbl":              "получатель пометил письмо как спам",
+	"err_will_retry":      "временная ошибка, доставка будет повторена",
+	"err_user_unknown":    "не доставлено: адрес не существует",
+	"err_user_inactive":   "не доставлено: ящик отключён",
+	"err_mailbox_full":    "не доставлено: ящик переполнен",
+	"err_spam_rejected":   "отклонено как спам",
+	"err_spam_folder":     "отклонено как спам",
+	"err_domain_inactive": "не доставлено: домен не принимает почту",
+	"err_blacklisted":     "не доставлено: адрес в чёрном списке",
+	"err_unsubscribed":    "не отправлено: получатель ранее отписался",
+}
+
+// describeEmailStatus translates a delivery status.
+func describeEmailStatus(status string) string {
+	if name, ok := emailStatusNames[status]; ok {
+		return name
+	}
+	switch {
+	case strings.HasPrefix(status, "ok_"):
+		return "доставлено (" + status + ")"
+	case strings.HasPrefix(status, "err_"):
+		return "не доставлено (" + status + ")"
+	}
+	return status
+}
+
+// checkEmailStatus asks Unisender for the delivery status of the emails with the given IDs.
+func checkEmailStatus(ctx context.Context, apiKey string, ids []string) ([]EmailStatus, error) {
+	var result struct {
+		Statuses []EmailStatus `json:"statuses"`
+	}
+	if err := mailer.CallUnisender(ctx, apiKey, "checkEmail", url.Values{"email_id": {strings.Join(ids, ",")}}, &result); err != nil {
+		return nil, err
+	}
+	return result.Statuses, nil
+}
+
+// formatEmailStatus renders the statuses of a letter for a chat message.
+func formatEmailStatus(entry SentEmail, statuses []EmailStatus) string {
+	lines := []string{fmt.Sprintf("Статус письма «%s» → %s:", entry.Subject, entry.Recipient)}
+	if len(statuses) == 0 {
+		lines = append(lines, "Unisender пока не знает о письме, попробуйте позже.")
+	}
+	for _, status := range statuses {
+		lines = append(lines, fmt.Sprintf("ID %s: %s", status.ID, describeEmailStatus(status.Status)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// statusTrackable reports whether checkEmail can tell the delivery status of the
+// entry: the provider reports delivery statuses and the letter got IDs back.
+func statusTrackable(secrets *Secrets, entry SentEmail) bool {
+	return mailer.CapabilitiesOf(secrets.EmailProvider).DeliveryStatus && entry.MessageID != ""
+}
+
+// statusButton builds the inline button checking the delivery status of a history entry.
+func statusButton(entryID uint64) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData("Проверить статус", fmt.Sprintf("status:%d", entryID))
+}
+
+// reportEmailStatus looks up the delivery status of the entry and describes it.
+func reportEmailStatus(ctx context.Context, secrets *Secrets, entry SentEmail) string {
+	statuses, err := checkEmailStatus(ctx, secrets.UnisenderAPIKey, strings.Split(entry.MessageID, ", "))
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка проверки статуса письма", "history_id", entry.ID, "error", err)
+		return fmt.Sprintf("Не удалось получить статус письма: %v", err)
+	}
+	return formatEmailStatus(entry, statuses)
+}
+
+// handleStatusCallback reports the delivery status of the letter the confirmation is about.
+func (h *Handler) handleStatusCallback(ctx context.Context, query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	id, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil || query.Message == nil {
+		return "Кнопка устарела."
+	}
+	entry, found := h.History.Get(id)
+	if !found || !entry.involves(query.From.ID) || !statusTrackable(secrets, entry) {
+		return "Кнопка устарела."
+	}
+	bot.Send(newReply(query.Message, reportEmailStatus(ctx, secrets, entry)))
+	return ""
+}
+
+// handleStatusCommand replies to /status <id> with the delivery status of one of
+// the user's letters, given the ID from the send confirmation.
+func (h *Handler) handleStatusCommand(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	id := strings.TrimSpace(message.CommandArguments())
+	if id == "" {
+		bot.Send(newReply(message, "Укажите ID письма из подтверждения отправки: /status <id>"))
+		return
+	}
+	if !mailer.CapabilitiesOf(secrets.EmailProvider).DeliveryStatus {
+		bot.Send(newReply(message, "Статус доставки доступен только при отправке через Unisender."))
+		return
+	}
+	// Only the user's own letters are looked up, the ID alone does not grant access
+	recent := h.History.Recent(message.From.ID, STATUS_LOOKUP_WINDOW)
+	i := slices.IndexFunc(recent, func(entry SentEmail) bool {
+		return slices.Contains(strings.Split(entry.MessageID, ", "), id)
+	})
+	if i < 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Письма с ID %s нет среди ваших последних писем.", id)))
+		return
+	}
+	entry := recent[i]
+	entry.MessageID = id // Only the asked copy, not every recipient of the letter
+	bot.Send(newReply(message, reportEmailStatus(ctx, secrets, entry)))
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDescribeEmailStatus(t *testing.T) {
+	tests := map[string]string{
+		"ok_delivered":      "доставлено",
+		"err_spam_rejected": "отклонено как спам",
+		"ok_new_status":     "доставлено (ok_new_status)",
+		"err_new_status":    "не доставлено (err_new_status)",
+	}
+	for status, want := range tests {
+		if got := describeEmailStatus(status); got != want {
+			t.Errorf("describeEmailStatus(%q) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	calls, sender := serveUnisender(t, []int{http.StatusOK},
+		[]string{`{"result":{"statuses":[{"id":"36422782","status":"ok_spam_folder"}]}}`})
+	telegram, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", UnisenderAPIKey: "key"}
+	handler := NewHandler(bot, sender, secrets, MemoryStores())
+	handler.History.Record(&SentEmail{UserID: wizardUser, Recipient: "a@example.com", Subject: "Отчёт", MessageID: "36422781, 36422782", Status: HISTORY_SENT})
+
+	handler.HandleUpdate(context.Background(), textAction("/status 99").update())
+	if calls.Load() != 0 {
+		t.Error("status of a letter not in the user's history was requested")
+	}
+	handler.HandleUpdate(context.Background(), textAction("/status 36422782").update())
+	if _, ok := telegram.find(wizardUser, "ID 36422782: доставлено в папку «Спам»"); !ok {
+		t.Errorf("no status report:\n%s", telegram.transcript(wizardUser))
+	}
+}
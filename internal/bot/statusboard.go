@@ -0,0 +1,178 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// STATUS_BOARD_INTERVAL is how often the status board message is updated.
+const STATUS_BOARD_INTERVAL = time.Minute
+
+// sendingNow counts the emails being sent right now, for the status board.
+var sendingNow atomic.Int64
+
+// providerHealth tracks how the sends through the email provider went, for the
+// status board. Letters the provider rejected as a whole count as failures too,
+// as they are as often a bad API key as a bad letter.
+type providerHealth struct {
+	mu            sync.Mutex
+	lastOK        time.Time
+	lastFailure   time.Time
+	lastError     string
+	failuresInRow int
+}
+
+// providerStatus is the health of the configured email provider since the start.
+var providerStatus = &providerHealth{}
+
+// record notes the outcome of a send. Sends cancelled by the bot itself say
+// nothing about the provider and are skipped.
+func (h *providerHealth) record(err error, now time.Time) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.lastOK, h.failuresInRow = now, 0
+		return
+	}
+	h.lastFailure, h.lastError = now, err.Error()
+	h.failuresInRow++
+}
+
+// describe tells whether sends go through, with addresses in the last error masked.
+func (h *providerHealth) describe(loc *time.Location) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.failuresInRow > 0:
+		reason := []rune(NewRedactor(nil, true).Redact(h.lastError))
+		if len(reason) > STATS_ERROR_LENGTH {
+			reason = append(reason[:STATS_ERROR_LENGTH], []rune("…")...)
+		}
+		return fmt.Sprintf("ошибки, неудачных отправок подряд: %d, последняя в %s: %s",
+			h.failuresInRow, h.lastFailure.In(loc).Format(SCHEDULE_CLOCK_LAYOUT), string(reason))
+	case !h.lastOK.IsZero():
+		return "работает, последняя успешная отправка в " + h.lastOK.In(loc).Format(SCHEDULE_CLOCK_LAYOUT)
+	}
+	return "отправок с запуска бота не было"
+}
+
+// renderStatusBoard describes the bot for the status board: its queues, the last
+// send and the provider health. Subjects and addresses are left out, as the board
+// is meant for a shared screen.
+func (h *Handler) renderStatusBoard(bot *tgbotapi.BotAPI, queued int, now time.Time) string {
+	secrets := h.secrets
+	loc := secrets.Location()
+	now = now.In(loc)
+	lines := []string{
+		fmt.Sprintf("Состояние бота @%s, обновлено в %s", bot.Self.UserName, now.Format(SCHEDULE_CLOCK_LAYOUT)),
+		"",
+		fmt.Sprintf("Очередь: сообщений ждут обработки %d, писем отправляется %d, ждут очереди к почтовому сервису %d.",
+			queued, sendingNow.Load(), providerSlots.stats().Waiting),
+	}
+
+	jobs := slices.DeleteFunc(h.Scheduled.All(), func(job ScheduledEmail) bool { return !job.sendsLetter() })
+	planned := fmt.Sprintf("Запланировано писем: %d", len(jobs))
+	if len(jobs) > 0 {
+		planned += ", ближайшее — " + jobs[0].SendAt.In(loc).Format(SCHEDULE_TIME_LAYOUT)
+	}
+	lines = append(lines, planned+".")
+
+	day := h.History.Since(now.Add(-24 * time.Hour))
+	failed := 0
+	for _, e := range day {
+		if e.Status == HISTORY_FAILED {
+			failed++
+		}
+	}
+	if len(day) > 0 {
+		last := day[0]
+		lines = append(lines, fmt.Sprintf("Последняя отправка: %s, %s.", last.SentAt.In(loc).Format(SCHEDULE_CLOCK_LAYOUT), describeHistoryStatus(last.Status)))
+	} else {
+		lines = append(lines, "Последняя отправка: за сутки писем не было.")
+	}
+	lines = append(lines,
+		fmt.Sprintf("За сутки: писем %d, с ошибкой %d.", len(day), failed),
+		fmt.Sprintf("Почтовый сервис (%s): %s.", choose(secrets.EmailProvider, mailer.EMAIL_PROVIDER_UNISENDER), providerStatus.describe(loc)),
+	)
+	return strings.Join(lines, "\n")
+}
+
+// describeHistoryStatus names the outcome of a send for the status board.
+func describeHistoryStatus(status string) string {
+	switch status {
+	case HISTORY_PARTIAL:
+		return "отправлено не всем"
+	case HISTORY_FAILED:
+		return "с ошибкой"
+	}
+	return "отправлено"
+}
+
+// statusBoard is the message in status_board_chat_id that is edited in place.
+type statusBoard struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	messageID int
+}
+
+// show puts the text on the board, posting and pinning a new message the first time
+// or when the old one was deleted.
+func (b *statusBoard) show(text string) {
+	if b.messageID != 0 {
+		_, err := b.bot.Send(tgbotapi.NewEditMessageText(b.chatID, b.messageID, text))
+		if err == nil || isNotModified(err) {
+			return
+		}
+		if !strings.Contains(err.Error(), "message to edit not found") {
+			slog.Warn("Ошибка обновления табло состояния", "chat_id", b.chatID, "error", err)
+			return
+		}
+	}
+	msg := tgbotapi.NewMessage(b.chatID, text)
+	msg.DisableNotification = true
+	sent, err := b.bot.Send(msg)
+	if err != nil {
+		slog.Error("Ошибка отправки табло состояния", "chat_id", b.chatID, "error", err)
+		return
+	}
+	b.messageID = sent.MessageID
+	// Pinning needs admin rights in groups and channels; the board works without it
+	pin := tgbotapi.PinChatMessageConfig{ChatID: b.chatID, MessageID: sent.MessageID, DisableNotification: true}
+	if _, err := b.bot.Request(pin); err != nil {
+		slog.Debug("Табло состояния не закреплено", "chat_id", b.chatID, "error", err)
+	}
+}
+
+// runStatusBoard keeps the status board up to date every interval until stop is
+// closed, then marks it stopped. queued reports the updates waiting for workers.
+func (h *Handler) runStatusBoard(stop <-chan struct{}, bot *tgbotapi.BotAPI, queued func() int, interval time.Duration) {
+	secrets := h.secrets
+	board := &statusBoard{bot: bot, chatID: secrets.StatusBoardChatID}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		text := h.snapshot().renderStatusBoard(bot, queued(), time.Now())
+		board.show(text)
+		select {
+		case <-stop:
+			loc := snapshotSettings(secrets).Location()
+			board.show(fmt.Sprintf("Бот @%s остановлен в %s.", bot.Self.UserName, time.Now().In(loc).Format(SCHEDULE_TIME_LAYOUT)))
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+func TestProviderHealth(t *testing.T) {
+	at := time.Date(2026, 5, 10, 12, 30, 0, 0, time.UTC)
+	h := &providerHealth{}
+	if got := h.describe(time.UTC); got != "отправок с запуска бота не было" {
+		t.Errorf("fresh: %q", got)
+	}
+	h.record(nil, at)
+	if got := h.describe(time.UTC); got != "работает, последняя успешная отправка в 12:30" {
+		t.Errorf("after a success: %q", got)
+	}
+	h.record(context.Canceled, at.Add(time.Minute))
+	h.record(errors.New("connection refused"), at.Add(time.Minute))
+	h.record(fmt.Errorf("адрес ivan@example.com: %w", errors.New("timeout")), at.Add(2*time.Minute))
+	got := h.describe(time.UTC)
+	if !strings.HasPrefix(got, "ошибки, неудачных отправок подряд: 2, последняя в 12:32: адрес ") || strings.Contains(got, "ivan@example.com") {
+		t.Errorf("after failures: %q", got)
+	}
+	h.record(nil, at.Add(3*time.Minute))
+	if got := h.describe(time.UTC); !strings.HasPrefix(got, "работает") {
+		t.Errorf("after recovery: %q", got)
+	}
+}
+
+// boardBot returns a bot on a fake Telegram and a handler with empty stores for
+// the status board.
+func boardBot(t *testing.T) (*fakeTelegram, *tgbotapi.BotAPI, *Handler) {
+	telegram, bot := newTestBot(t)
+	defaultStatus := providerStatus
+	t.Cleanup(func() { providerStatus = defaultStatus })
+	providerStatus = &providerHealth{}
+	secrets := &Secrets{EmailProvider: mailer.EMAIL_PROVIDER_SMTP, Timezone: "UTC", StatusBoardChatID: -100}
+	return telegram, bot, NewHandler(bot, nil, secrets, MemoryStores())
+}
+
+func TestRenderStatusBoard(t *testing.T) {
+	_, bot, handler := boardBot(t)
+	now := time.Date(2026, 5, 10, 12, 30, 0, 0, time.UTC)
+	for _, entry := range []SentEmail{
+		{UserID: 1, Subject: "Позавчера", SentAt: now.Add(-48 * time.Hour), Status: HISTORY_SENT},
+		{UserID: 1, Subject: "Сбой", SentAt: now.Add(-2 * time.Hour), Status: HISTORY_FAILED},
+		{UserID: 2, Subject: "Секретный отчёт", Recipient: "boss@example.com", SentAt: now.Add(-time.Hour), Status: HISTORY_PARTIAL},
+	} {
+		handler.History.Record(&entry)
+	}
+	handler.Scheduled.Add(&ScheduledEmail{UserID: 1, SendAt: now.Add(26 * time.Hour)})
+	handler.Scheduled.Add(&ScheduledEmail{UserID: 1, SendAt: now.Add(3 * time.Hour)})
+	providerStatus.record(nil, now.Add(-time.Hour))
+
+	got := handler.renderStatusBoard(bot, 3, now)
+	for _, want := range []string{
+		"обновлено в 12:30",
+		"Очередь: сообщений ждут обработки 3, писем отправляется 0, ждут очереди к почтовому сервису 0.",
+		"Запланировано писем: 2, ближайшее — 10.05.2026 15:30.",
+		"Последняя отправка: 11:30, отправлено не всем.",
+		"За сутки: писем 2, с ошибкой 1.",
+		"Почтовый сервис (smtp): работает, последняя успешная отправка в 11:30.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Секретный") || strings.Contains(got, "boss@") {
+		t.Errorf("board shows letter details:\n%s", got)
+	}
+}
+
+func TestRunStatusBoard(t *testing.T) {
+	telegram, bot, handler := boardBot(t)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.runStatusBoard(stop, bot, func() int { return 0 }, 10*time.Millisecond)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+
+	first, ok := telegram.find(-100, "Состояние бота")
+	if !ok {
+		t.Fatalf("no board posted:\n%s", telegram.transcript(-100))
+	}
+	stopped, ok := telegram.find(-100, "остановлен")
+	if !ok || stopped.ID != first.ID {
+		t.Errorf("board was not edited in place to say the bot stopped:\n%s", telegram.transcript(-100))
+	}
+	// Every update edits the one message
+	for {
+		m, ok := telegram.find(-100, "")
+		if !ok {
+			break
+		}
+		if m.ID != first.ID {
+			t.Errorf("board posted again as #%d:\n%s", m.ID, telegram.transcript(-100))
+		}
+	}
+}
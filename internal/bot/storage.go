@@ -0,0 +1,168 @@
+package bot
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/config"
+
+	"botmailtest/internal/state"
+)
+
+// Storage backends selectable with storage_backend in secrets.json. The database
+// itself is opened by state.Open and shared by all persistent stores.
+const (
+	STORAGE_BOLT   = "bolt"   // Persistent bbolt database file (default)
+	STORAGE_MEMORY = "memory" // Process memory, lost on restart
+	// DEFAULT_STORAGE_FILE is the database file used when storage_file is not set.
+	DEFAULT_STORAGE_FILE = "bot_data.db"
+)
+
+// Stores are where the bot keeps users' data. main opens them with OpenStores
+// and hands them to NewHandler.
+type Stores struct {
+	States         StateStore    // The drafts in progress
+	Contacts       ContactStore  // The address books
+	History        HistoryStore  // The sent-mail history
+	Templates      TemplateStore // The saved templates
+	Scheduled      ScheduleStore // The letters waiting to be sent
+	Access         AccessStore   // The /allow and /deny decisions
+	NotifySettings NotifyStore   // The chats' notification settings
+	Surveys        SurveyStore   // The survey answers of all users
+	SeenVersions   SeenVersions  // The releases announced to each user
+}
+
+// MemoryStores returns stores that keep everything in process memory.
+func MemoryStores() *Stores {
+	return &Stores{
+		States:         state.NewShardedStateStore(),
+		Contacts:       &memoryContactStore{contacts: make(map[int64][]Contact)},
+		History:        &memoryHistoryStore{},
+		Templates:      &memoryTemplateStore{templates: make(map[int64][]Template)},
+		Scheduled:      &memoryScheduleStore{jobs: make(map[int64]ScheduledEmail)},
+		Access:         &memoryAccessStore{decisions: make(map[int64]bool)},
+		NotifySettings: &memoryNotifyStore{chats: make(map[int64]ChatNotifications)},
+		Surveys:        &memorySurveyStore{},
+		SeenVersions:   &memorySeenVersions{versions: make(map[int64]string)},
+	}
+}
+
+// OpenStores opens the backend selected by storage_backend. The returned closer
+// releases the database once the bot is done with it.
+func OpenStores(secrets *Secrets) (*Stores, io.Closer, error) {
+	switch choose(secrets.StorageBackend, STORAGE_BOLT) {
+	case STORAGE_BOLT:
+		db, err := state.Open(choose(secrets.StorageFile, DEFAULT_STORAGE_FILE), secrets.StorageOptions)
+		if err != nil {
+			return nil, nil, err
+		}
+		stores, err := openBoltStores(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return stores, db, nil
+	case STORAGE_MEMORY:
+		slog.Warn("Состояния пользователей хранятся в памяти и будут потеряны при перезапуске")
+		return MemoryStores(), io.NopCloser(nil), nil
+	default:
+		return nil, nil, fmt.Errorf("Неизвестное хранилище %q, допустимы %s и %s", secrets.StorageBackend, STORAGE_BOLT, STORAGE_MEMORY)
+	}
+}
+
+// openBoltStores upgrades the database to the current schema and opens every
+// persistent store in it, creating the tables it is missing.
+func openBoltStores(db *bolt.DB) (*Stores, error) {
+	if _, err := state.Migrate(db); err != nil {
+		return nil, err
+	}
+	var stores Stores
+	var err error
+	if stores.States, err = state.NewBoltStateStore(db); err != nil {
+		return nil, err
+	}
+	if stores.SeenVersions, err = newBoltSeenVersions(db); err != nil {
+		return nil, err
+	}
+	if stores.Contacts, err = newBoltContactStore(db); err != nil {
+		return nil, err
+	}
+	if stores.History, err = newBoltHistoryStore(db); err != nil {
+		return nil, err
+	}
+	if stores.Templates, err = newBoltTemplateStore(db); err != nil {
+		return nil, err
+	}
+	if stores.Scheduled, err = newBoltScheduleStore(db); err != nil {
+		return nil, err
+	}
+	if stores.Access, err = newBoltAccessStore(db); err != nil {
+		return nil, err
+	}
+	if stores.NotifySettings, err = newBoltNotifyStore(db); err != nil {
+		return nil, err
+	}
+	if stores.Surveys, err = newBoltSurveyStore(db); err != nil {
+		return nil, err
+	}
+	return &stores, nil
+}
+
+// RunMigrate implements the migrate subcommand: it upgrades the database of a
+// stopped bot to the current release ahead of starting it, which serve otherwise
+// does on start. It returns the process exit code.
+func RunMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Только показать версию схемы хранилища")
+	flags := config.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	secrets, err := flags.Resolve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if choose(secrets.StorageBackend, STORAGE_BOLT) != STORAGE_BOLT {
+		fmt.Fprintln(os.Stderr, "Данные хранятся в памяти бота, обновлять на диске нечего.")
+		return 1
+	}
+	path := choose(secrets.StorageFile, DEFAULT_STORAGE_FILE)
+	// The running bot holds the database lock, so this waits for lock_timeout and fails
+	db, err := state.Open(path, secrets.StorageOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\nОстановите бота перед обновлением хранилища.\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	previous, err := state.SchemaVersion(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *dryRun {
+		if previous == state.SCHEMA_VERSION {
+			fmt.Printf("Хранилище %s в актуальном состоянии (схема %d).\n", path, previous)
+		} else {
+			fmt.Printf("Хранилище %s: схема %d, эта версия бота использует %d.\n", path, previous, state.SCHEMA_VERSION)
+		}
+		return 0
+	}
+	if _, err := openBoltStores(db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if previous == state.SCHEMA_VERSION {
+		fmt.Printf("Хранилище %s уже в актуальном состоянии (схема %d).\n", path, previous)
+	} else {
+		fmt.Printf("Хранилище %s обновлено: схема %d → %d.\n", path, previous, state.SCHEMA_VERSION)
+	}
+	return 0
+}
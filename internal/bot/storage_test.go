@@ -0,0 +1,44 @@
+package bot
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+func TestOpenBoltStoresMigrates(t *testing.T) {
+	db, err := state.Open(filepath.Join(t.TempDir(), "bot.db"), state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version, _ := state.SchemaVersion(db); version != 0 {
+		t.Fatalf("new database at schema %d, want 0", version)
+	}
+	stores, err := openBoltStores(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := state.SchemaVersion(db); version != state.SCHEMA_VERSION {
+		t.Errorf("migrated database at schema %d, want %d", version, state.SCHEMA_VERSION)
+	}
+	if _, ok := stores.History.(*boltHistoryStore); !ok {
+		t.Errorf("history is %T, want the database store", stores.History)
+	}
+	// Opening again is a no-op
+	if _, err := openBoltStores(db); err != nil {
+		t.Errorf("second open: %v", err)
+	}
+
+	// A database from a newer release is refused
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("meta")).Put([]byte("schema_version"), []byte("99"))
+	})
+	if _, err := openBoltStores(db); err == nil || !strings.Contains(err.Error(), "более новой версией") {
+		t.Errorf("newer schema opened: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SurveyStore counts the answers to the post-send satisfaction survey.
+type SurveyStore interface {
+	// Record counts one answer.
+	Record(positive bool)
+	// Snapshot returns the answer counts so far.
+	Snapshot() (positive, negative int)
+}
+
+// memorySurveyStore is a SurveyStore kept in process memory.
+type memorySurveyStore struct {
+	mu       sync.Mutex
+	positive int
+	negative int
+}
+
+func (s *memorySurveyStore) Record(positive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if positive {
+		s.positive++
+	} else {
+		s.negative++
+	}
+}
+
+func (s *memorySurveyStore) Snapshot() (positive, negative int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.positive, s.negative
+}
+
+// surveyBucket holds the answer counters under surveyPositiveKey and surveyNegativeKey.
+var (
+	surveyBucket      = []byte("survey")
+	surveyPositiveKey = []byte("positive")
+	surveyNegativeKey = []byte("negative")
+)
+
+// boltSurveyStore is a SurveyStore persisted in the bbolt database.
+type boltSurveyStore struct {
+	db *bolt.DB
+}
+
+// newBoltSurveyStore creates the survey bucket in the given database.
+func newBoltSurveyStore(db *bolt.DB) (*boltSurveyStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(surveyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы опроса: %w", err)
+	}
+	return &boltSurveyStore{db: db}, nil
+}
+
+func (b *boltSurveyStore) Record(positive bool) {
+	key := surveyNegativeKey
+	if positive {
+		key = surveyPositiveKey
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(surveyBucket)
+		return bucket.Put(key, binary.BigEndian.AppendUint64(nil, surveyCounter(bucket, key)+1))
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения ответа на опрос", "error", err)
+	}
+}
+
+func (b *boltSurveyStore) Snapshot() (positive, negative int) {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(surveyBucket)
+		positive, negative = int(surveyCounter(bucket, surveyPositiveKey)), int(surveyCounter(bucket, surveyNegativeKey))
+		return nil
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения ответов на опрос", "error", err)
+	}
+	return positive, negative
+}
+
+// surveyCounter reads a counter of the survey bucket, 0 when it was never written.
+func surveyCounter(bucket *bolt.Bucket, key []byte) uint64 {
+	if data := bucket.Get(key); len(data) == 8 {
+		return binary.BigEndian.Uint64(data)
+	}
+	return 0
+}
+
+// describeSurvey summarizes the answers for /stats, or returns "" before the first one.
+func (h *Handler) describeSurvey() string {
+	positive, negative := h.Surveys.Snapshot()
+	total := positive + negative
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Опрос после отправки: довольны %d%% (%d из %d ответов).", positive*100/total, positive, total)
+}
+
+// maybeAskSatisfaction asks about the send experience for a sampled share of successful sends.
+func maybeAskSatisfaction(bot BotAPI, secrets *Secrets, chatID int64) {
+	if secrets.SurveyRate <= 0 || rand.Float64() >= secrets.SurveyRate {
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, "Всё прошло хорошо?")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("👍", "survey:up"),
+		tgbotapi.NewInlineKeyboardButtonData("👎", "survey:down"),
+	))
+	bot.Send(msg)
+}
+
+// handleSurveyCallback records a survey answer and replaces the question with a thank-you note.
+func (h *Handler) handleSurveyCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil || (payload != "up" && payload != "down") {
+		return "Кнопка устарела."
+	}
+	positive := payload == "up"
+	h.Surveys.Record(positive)
+	slog.Info("Ответ на опрос", "positive", positive, "user_id", query.From.ID)
+
+	// Editing the text drops the buttons, so the same message cannot be answered twice
+	bot.Send(tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, "Спасибо за отзыв!"))
+	return ""
+}
@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"botmailtest/internal/state"
+)
+
+func TestStatsShowSatisfactionRate(t *testing.T) {
+	const admin = 9
+	secrets := wizardSecrets()
+	secrets.AdminUserIDs = []int64{admin}
+	var steps []string
+	handler, bot, _ := newWizardHandler(t, secrets, &steps)
+	stats := func() {
+		update := textAction("/stats").update()
+		update.Message.From.ID, update.Message.Chat.ID = admin, admin
+		handler.HandleUpdate(context.Background(), update)
+	}
+
+	stats()
+	if strings.Contains(bot.texts(), "Опрос") {
+		t.Errorf("/stats shows a survey without answers:\n%s", bot.texts())
+	}
+	for _, answer := range []string{"survey:up", "survey:down", "survey:up", "survey:maybe"} {
+		handler.HandleUpdate(context.Background(), tapAction(answer).update())
+	}
+	stats()
+	if want := "Опрос после отправки: довольны 66% (2 из 3 ответов)."; !strings.Contains(bot.texts(), want) {
+		t.Errorf("/stats does not say %q:\n%s", want, bot.texts())
+	}
+}
+
+func TestBoltSurveyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	db, err := state.Open(path, state.StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBoltSurveyStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Record(true)
+	store.Record(false)
+	store.Record(true)
+	db.Close()
+
+	// The answers survive a restart
+	if db, err = state.Open(path, state.StorageOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if store, err = newBoltSurveyStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if positive, negative := store.Snapshot(); positive != 2 || negative != 1 {
+		t.Errorf("Snapshot = %d, %d, want 2, 1", positive, negative)
+	}
+}
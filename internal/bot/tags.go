@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// tagsKeyboard builds a toggle button per configured tag, the chosen ones checked,
+// and the button finishing the step. Buttons refer to tags by their position, as
+// callback data is limited to 64 bytes.
+func tagsKeyboard(secrets *Secrets, chosen []string) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, name := range secrets.TagNames() {
+		label := name
+		if slices.Contains(chosen, name) {
+			label = "✓ " + name
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, "tags:toggle:"+strconv.Itoa(i)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Готово", "tags:done")))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// promptTags moves the draft to the tags step and shows the tag buttons.
+func promptTags(bot BotAPI, secrets *Secrets, message *tgbotapi.Message, state *UserState) {
+	state.State = "await_tags"
+	msg := newReply(message, "Отметьте метки письма и нажмите «Готово». Метки определяют получателей копий и префикс темы. "+
+		"Можно также ввести названия через запятую или «-», чтобы обойтись без меток.")
+	msg.ReplyMarkup = tagsKeyboard(secrets, state.Tags)
+	bot.Send(msg)
+}
+
+// acceptTags takes the tags typed as text at the tags step and shows the preview.
+func acceptTags(bot BotAPI, secrets *Secrets, message *tgbotapi.Message, state *UserState, text string) {
+	var tags []string
+	if text != "-" {
+		names := secrets.TagNames()
+		for _, typed := range strings.Split(text, ",") {
+			typed = strings.TrimSpace(typed)
+			i := slices.IndexFunc(names, func(name string) bool { return strings.EqualFold(name, typed) })
+			if i < 0 {
+				bot.Send(newReply(message, fmt.Sprintf("Неизвестная метка «%s». Доступны: %s.", typed, strings.Join(names, ", "))))
+				return
+			}
+			if !slices.Contains(tags, names[i]) {
+				tags = append(tags, names[i])
+			}
+		}
+	}
+	state.Tags = tags
+	showPreview(bot, message, state)
+}
+
+// handleTagsCallback toggles a tag of the draft or finishes the tags step.
+func (h *Handler) handleTagsCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot, secrets := h.bot, h.secrets
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	chatID := query.Message.Chat.ID
+	names := secrets.TagNames()
+	action, arg, _ := strings.Cut(payload, ":")
+
+	var draft UserState
+	var current bool
+	h.States.Update(query.From.ID, func(s *UserState) {
+		if current = s.State == "await_tags"; !current {
+			return
+		}
+		if i, err := strconv.Atoi(arg); action == "toggle" && err == nil && i >= 0 && i < len(names) {
+			if j := slices.Index(s.Tags, names[i]); j >= 0 {
+				s.Tags = slices.Delete(slices.Clone(s.Tags), j, j+1)
+			} else {
+				s.Tags = append(slices.Clone(s.Tags), names[i])
+			}
+		}
+		draft = *s
+	})
+	if !current {
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		return "Метки уже выбраны."
+	}
+
+	switch action {
+	case "toggle":
+		bot.Request(tgbotapi.NewEditMessageReplyMarkup(chatID, query.Message.MessageID, tagsKeyboard(secrets, draft.Tags)))
+		return ""
+	case "done":
+		removeInlineKeyboard(bot, chatID, query.Message.MessageID)
+		showPreview(bot, query.Message, &draft)
+		h.States.Update(query.From.ID, func(s *UserState) { *s = draft })
+		return ""
+	}
+	return "Кнопка устарела."
+}
+
+// routeByTags applies the rules of the draft's tags to the subject and recipients,
+// and returns the addresses the tags copy the letter to. explicit tells whether
+// the recipients were typed by the user rather than the default, which the
+// recipients of a tag replace.
+func routeByTags(secrets *Secrets, tags []string, subject string, recipients []string, explicit bool) (string, []string, []string) {
+	var prefixes, routed, copies []string
+	for _, name := range tags {
+		rule, ok := secrets.TagRules[name]
+		if !ok {
+			continue // The tag was removed from the config after the draft was made
+		}
+		if rule.SubjectPrefix != "" && !strings.Contains(subject, rule.SubjectPrefix) {
+			prefixes = append(prefixes, rule.SubjectPrefix)
+		}
+		routed = append(routed, rule.Recipients...)
+		copies = append(copies, rule.CC...)
+	}
+	if len(prefixes) > 0 {
+		subject = strings.Join(prefixes, " ") + " " + subject
+	}
+	if len(routed) > 0 && !explicit {
+		recipients = nil
+	}
+
+	var all []string
+	for _, address := range slices.Concat(recipients, routed) {
+		if !slices.ContainsFunc(all, func(a string) bool { return strings.EqualFold(a, address) }) {
+			all = append(all, address)
+		}
+	}
+	return subject, all, copies
+}
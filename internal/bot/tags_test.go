@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"botmailtest/internal/mailer"
+)
+
+var testTagRules = map[string]TagRule{
+	"финансы": {Recipients: []string{"finance@example.com"}, SubjectPrefix: "[Финансы]"},
+	"срочно":  {CC: []string{"boss@example.com"}, SubjectPrefix: "[Срочно]"},
+}
+
+func TestRouteByTags(t *testing.T) {
+	secrets := &Secrets{TagRules: testTagRules}
+	tests := []struct {
+		tags          []string
+		recipients    []string
+		explicit      bool
+		subject       string
+		wantRecipient []string
+		wantCopies    []string
+	}{
+		{nil, []string{"target@example.com"}, false, "Отчёт", []string{"target@example.com"}, nil},
+		{[]string{"финансы"}, []string{"target@example.com"}, false, "[Финансы] Отчёт", []string{"finance@example.com"}, nil},
+		{[]string{"финансы"}, []string{"a@example.com"}, true, "[Финансы] Отчёт", []string{"a@example.com", "finance@example.com"}, nil},
+		{[]string{"срочно", "финансы"}, []string{"BOSS@example.com"}, true, "[Срочно] [Финансы] Отчёт", []string{"BOSS@example.com", "finance@example.com"}, []string{"boss@example.com"}},
+		{[]string{"удалена"}, []string{"target@example.com"}, false, "Отчёт", []string{"target@example.com"}, nil},
+	}
+	for _, tt := range tests {
+		subject, recipients, copies := routeByTags(secrets, tt.tags, "Отчёт", tt.recipients, tt.explicit)
+		if subject != tt.subject || !reflect.DeepEqual(recipients, tt.wantRecipient) || !reflect.DeepEqual(copies, tt.wantCopies) {
+			t.Errorf("routeByTags(%q, %q) = %q, %q, %q; want %q, %q, %q", tt.tags, tt.recipients, subject, recipients, copies, tt.subject, tt.wantRecipient, tt.wantCopies)
+		}
+	}
+}
+
+func TestTagsStepRoutesLetter(t *testing.T) {
+	_, bot := newTestBot(t)
+	secrets := &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", EmailProvider: mailer.EMAIL_PROVIDER_SMTP, TagRules: testTagRules}
+	var steps []string
+	sender := &recordingSender{t: t, steps: &steps}
+	handler := NewHandler(bot, sender, secrets, MemoryStores())
+
+	for _, action := range []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction(DEFAULT_RECIPIENT_BUTTON_TEXT),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт"), textAction("Отчёт за месяц."), textAction("Иван"),
+		tapAction("tags:toggle:1"), tapAction("tags:toggle:0"), tapAction("tags:toggle:1"), tapAction("tags:done"),
+		tapAction("confirm:send"),
+	} {
+		steps = append(steps, action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+	}
+
+	// Tags are sorted, so 0 is "срочно" and 1 is "финансы", which was toggled off again
+	if want := []string{"[Срочно] Отчёт"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Errorf("sent %q, want %q", sender.subjects, want)
+	}
+	if sent := handler.History.Recent(wizardUser, 1); len(sent) != 1 || sent[0].Recipient != "target@example.com" || !slices.Equal(sent[0].CC, []string{"boss@example.com"}) {
+		t.Errorf("history = %+v, want the default recipient and the copy", sent)
+	}
+}
@@ -0,0 +1,213 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_TEMP_DIR is where downloaded attachments are kept when temp_dir is not set.
+	// Each bot instance needs its own directory, as startup empties it.
+	DEFAULT_TEMP_DIR = "attachments_tmp"
+	// DEFAULT_TEMP_QUOTA is the default limit of disk space taken by attachments at once.
+	DEFAULT_TEMP_QUOTA = 500 * 1024 * 1024
+	// TEMP_FILE_PATTERN names the files of the store, so sweeps remove nothing else.
+	TEMP_FILE_PATTERN = "attachment-*"
+	// TEMP_FILE_TTL is how long an attachment is kept for a retry offer no one tapped.
+	TEMP_FILE_TTL = 24 * time.Hour
+	// TEMP_SWEEP_INTERVAL is how often attachments older than TEMP_FILE_TTL are removed.
+	TEMP_SWEEP_INTERVAL = time.Hour
+)
+
+// errTempQuota is returned by writes that would take the store over its quota.
+var errTempQuota = errors.New("временное хранилище вложений заполнено, попробуйте позже")
+
+// TempStore keeps downloaded attachments on disk until the letter is sent, so a large
+// file costs disk space rather than memory. All files together may take at most quota
+// bytes. Files are removed once sent, by the periodic sweep if forgotten, and on the
+// next start if the bot crashed while holding them.
+type TempStore struct {
+	dir   string
+	quota int64
+
+	mu    sync.Mutex
+	used  int64
+	files map[string]int64 // Path -> bytes written
+}
+
+// tempFiles is where attachments are downloaded to, replaced by serve with the
+// directory and quota from secrets.json.
+var tempFiles = newTempStore(filepath.Join(os.TempDir(), "botmailtest-attachments"), DEFAULT_TEMP_QUOTA)
+
+// newTempStore creates a store in dir; nothing is touched on disk until it is used.
+func newTempStore(dir string, quota int64) *TempStore {
+	return &TempStore{dir: dir, quota: quota, files: make(map[string]int64)}
+}
+
+// configureTempStore sets up the store from secrets.json and removes the files a
+// previous run left behind.
+func configureTempStore(secrets *Secrets) error {
+	quota := int64(secrets.TempQuota)
+	if quota <= 0 {
+		quota = DEFAULT_TEMP_QUOTA
+	}
+	store := newTempStore(choose(secrets.TempDir, DEFAULT_TEMP_DIR), quota)
+	removed, err := store.sweep()
+	if err != nil {
+		return fmt.Errorf("ошибка очистки временных вложений: %w", err)
+	}
+	if removed > 0 {
+		slog.Info("Удалены временные вложения, оставшиеся от прошлого запуска", "count", removed)
+	}
+	tempFiles = store
+	return nil
+}
+
+// sweep creates the directory and removes every file of the store in it. It runs
+// before any file is created, so whatever it finds was left by a crash.
+func (s *TempStore) sweep() (int, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return 0, err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(s.dir, TEMP_FILE_PATTERN))
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range leftovers {
+		if err := os.Remove(path); err != nil {
+			return 0, err
+		}
+	}
+	return len(leftovers), nil
+}
+
+// expireEvery removes files older than ttl every interval, for as long as the bot runs.
+func (s *TempStore) expireEvery(interval, ttl time.Duration) {
+	for range time.Tick(interval) {
+		if removed := s.expire(ttl); removed > 0 {
+			slog.Info("Удалены устаревшие временные вложения", "count", removed)
+		}
+	}
+}
+
+// expire removes the files last written more than ttl ago.
+func (s *TempStore) expire(ttl time.Duration) int {
+	s.mu.Lock()
+	var expired []string
+	for path := range s.files {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > ttl {
+			expired = append(expired, path)
+		}
+	}
+	s.mu.Unlock()
+	for _, path := range expired {
+		s.remove(path)
+	}
+	return len(expired)
+}
+
+// create opens a new empty file in the store.
+func (s *TempStore) create() (*tempFile, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(s.dir, TEMP_FILE_PATTERN)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.files[f.Name()] = 0
+	s.mu.Unlock()
+	return &tempFile{file: f, store: s}, nil
+}
+
+// remove deletes a file of the store and frees its quota. Paths the store did not
+// create, such as files of a local Bot API server, are left alone.
+func (s *TempStore) remove(path string) {
+	s.mu.Lock()
+	size, ok := s.files[path]
+	delete(s.files, path)
+	s.used -= size
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Ошибка удаления временного вложения", "path", path, "error", err)
+	}
+}
+
+// usage returns the bytes taken by the files of the store and how many there are.
+func (s *TempStore) usage() (used int64, files int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used, len(s.files)
+}
+
+// account adds n bytes written to path, refusing them if the quota would be exceeded.
+func (s *TempStore) account(path string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+n > s.quota {
+		return errTempQuota
+	}
+	s.used += n
+	s.files[path] += n
+	return nil
+}
+
+// tempFile is a file of a TempStore whose writes count against the quota. The
+// *os.File is not embedded, as its ReadFrom would let io.Copy write past the quota.
+type tempFile struct {
+	file  *os.File
+	store *TempStore
+}
+
+// Name returns the path of the file.
+func (f *tempFile) Name() string {
+	return f.file.Name()
+}
+
+// Write implements io.Writer.
+func (f *tempFile) Write(p []byte) (int, error) {
+	if err := f.store.account(f.Name(), int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(p)
+	if n < len(p) {
+		f.store.account(f.Name(), int64(n-len(p)))
+	}
+	return n, err
+}
+
+// Close closes the file, which stays in the store until removed.
+func (f *tempFile) Close() error {
+	return f.file.Close()
+}
+
+// reset empties the file to be written again from the start.
+func (f *tempFile) reset() error {
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.store.mu.Lock()
+	f.store.used -= f.store.files[f.Name()]
+	f.store.files[f.Name()] = 0
+	f.store.mu.Unlock()
+	return nil
+}
+
+// discard closes and removes the file, for downloads that failed.
+func (f *tempFile) discard() {
+	f.file.Close()
+	f.store.remove(f.Name())
+}
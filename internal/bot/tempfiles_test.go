@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestTempStoreQuota(t *testing.T) {
+	store := newTempStore(t.TempDir(), 10)
+	first, err := store.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := first.Write([]byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := second.Write([]byte("12345")); !errors.Is(err, errTempQuota) {
+		t.Fatalf("write over the quota: err = %v", err)
+	}
+
+	store.remove(first.Name())
+	if _, err := second.Write([]byte("12345")); err != nil {
+		t.Fatalf("write after freeing the quota: %v", err)
+	}
+	if used, files := store.usage(); used != 5 || files != 1 {
+		t.Errorf("usage = %d bytes in %d files, want 5 in 1", used, files)
+	}
+	if _, err := os.Stat(first.Name()); !os.IsNotExist(err) {
+		t.Errorf("removed file still exists: %v", err)
+	}
+}
+
+func TestTempStoreSweepRemovesOnlyItsFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"attachment-1", "attachment-2", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := newTempStore(dir, DEFAULT_TEMP_QUOTA).sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if removed != 2 || len(left) != 1 || filepath.Base(left[0]) != "notes.txt" {
+		t.Errorf("removed %d, left %q; want 2 removed and notes.txt left", removed, left)
+	}
+}
+
+func TestTempStoreExpire(t *testing.T) {
+	store := newTempStore(t.TempDir(), DEFAULT_TEMP_QUOTA)
+	old, _ := store.create()
+	old.Close()
+	fresh, _ := store.create()
+	fresh.Close()
+	past := time.Now().Add(-2 * TEMP_FILE_TTL)
+	os.Chtimes(old.Name(), past, past)
+
+	if removed := store.expire(TEMP_FILE_TTL); removed != 1 {
+		t.Errorf("expired %d files, want 1", removed)
+	}
+	if _, files := store.usage(); files != 1 {
+		t.Errorf("%d files left, want 1", files)
+	}
+}
+
+// serveTelegramFile starts a Bot API server offering data as the file "file" and
+// returns a bot and secrets using it. Downloads support ranges like the real server.
+func serveTelegramFile(t *testing.T, data []byte) (*tgbotapi.BotAPI, *Secrets) {
+	t.Helper()
+	bot, serverURL := newBotOn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/file/"):
+			http.ServeContent(w, r, "report.pdf", time.Time{}, bytes.NewReader(data))
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			reply(w, tgbotapi.User{ID: 1, IsBot: true, UserName: "test_bot"})
+		case strings.HasSuffix(r.URL.Path, "/getFile"):
+			reply(w, tgbotapi.File{FileID: "file", FileSize: len(data), FilePath: "documents/report.pdf"})
+		default:
+			reply(w, true)
+		}
+	}))
+	return bot, &Secrets{BotToken: "123:TEST", BotFileEndpoint: serverURL + "/file/bot%s/%s", MaxAttachmentSize: 1 << 30}
+}
+
+func TestDownloadTelegramFileToDisk(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), DOWNLOAD_CHUNK_SIZE/4)
+	bot, secrets := serveTelegramFile(t, data)
+	defaultStore := tempFiles
+	t.Cleanup(func() { tempFiles = defaultStore })
+	tempFiles = newTempStore(t.TempDir(), DEFAULT_TEMP_QUOTA)
+
+	attachment, err := downloadTelegramFile(context.Background(), bot, secrets, "file", "report.pdf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Data != nil || attachment.Path == "" {
+		t.Fatalf("attachment %q is not on disk", attachment.Name)
+	}
+	contents, err := attachment.ReadAll()
+	if err != nil || !bytes.Equal(contents, data) {
+		t.Fatalf("downloaded %d bytes (err %v), want %d", len(contents), err, len(data))
+	}
+	if used, _ := tempFiles.usage(); used != int64(len(data)) {
+		t.Errorf("quota use = %d, want %d", used, len(data))
+	}
+
+	releaseAttachments([]Attachment{attachment})
+	if used, files := tempFiles.usage(); used != 0 || files != 0 || attachment.Available() {
+		t.Errorf("after release: %d bytes in %d files, file available = %v", used, files, attachment.Available())
+	}
+}
+
+func TestDownloadTelegramFileOverQuota(t *testing.T) {
+	bot, secrets := serveTelegramFile(t, make([]byte, 3*DOWNLOAD_CHUNK_SIZE))
+	defaultStore := tempFiles
+	t.Cleanup(func() { tempFiles = defaultStore })
+	dir := t.TempDir()
+	tempFiles = newTempStore(dir, 2*DOWNLOAD_CHUNK_SIZE)
+
+	if _, err := downloadTelegramFile(context.Background(), bot, secrets, "file", "report.pdf", nil); !errors.Is(err, errTempQuota) {
+		t.Fatalf("err = %v, want the quota error", err)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("%d files left after a failed download", len(left))
+	}
+}
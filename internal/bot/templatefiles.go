@@ -0,0 +1,239 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// TEMPLATE_FILE_SUFFIX ends the names of exported templates; a document named
+	// so is imported instead of being offered for sending.
+	TEMPLATE_FILE_SUFFIX = ".template.json"
+	// TEMPLATE_FILE_FORMAT marks a JSON file as an exported template.
+	TEMPLATE_FILE_FORMAT = "botmail-template"
+	// TEMPLATE_FILE_VERSION is the newest file layout this build reads and the one it writes.
+	TEMPLATE_FILE_VERSION = 1
+	// MAX_TEMPLATE_FILE_SIZE keeps imports from downloading anything but a letter.
+	MAX_TEMPLATE_FILE_SIZE = 256 * 1024
+	// MAX_TEMPLATE_NAME_LENGTH is how many characters an imported template name may have.
+	MAX_TEMPLATE_NAME_LENGTH = 64
+)
+
+// templateFile is the portable form of a template, shared between users and deployments.
+type templateFile struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Template
+}
+
+// encodeTemplateFile renders the template as an indented JSON file.
+func encodeTemplateFile(template Template) ([]byte, error) {
+	return json.MarshalIndent(templateFile{Format: TEMPLATE_FILE_FORMAT, Version: TEMPLATE_FILE_VERSION, Template: template}, "", "  ")
+}
+
+// decodeTemplateFile parses an exported template and checks it could have been
+// saved in this bot: the subject and body pass the field rules of this deployment.
+// The message of a returned error is shown to the user as is.
+func decodeTemplateFile(data []byte) (Template, error) {
+	var file templateFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Format != TEMPLATE_FILE_FORMAT || file.Version < 1 {
+		return Template{}, errors.New("Это не файл шаблона: выгрузите шаблон командой /exporttemplate Название.")
+	}
+	if file.Version > TEMPLATE_FILE_VERSION {
+		return Template{}, fmt.Errorf("Шаблон выгружен более новой версией бота (формат %d), обновите бота.", file.Version)
+	}
+
+	t := file.Template
+	t.Name = strings.TrimSpace(t.Name)
+	for _, s := range []string{t.Name, t.Subject, t.Body, t.BodyHTML} {
+		if !utf8.ValidString(s) {
+			return Template{}, errors.New("Файл шаблона повреждён: текст не в UTF-8.")
+		}
+	}
+	switch {
+	case t.Name == "" || strings.ContainsAny(t.Name, "\r\n"):
+		return Template{}, errors.New("В файле шаблона нет названия.")
+	case utf8.RuneCountInString(t.Name) > MAX_TEMPLATE_NAME_LENGTH:
+		return Template{}, fmt.Errorf("Название шаблона длиннее %d символов.", MAX_TEMPLATE_NAME_LENGTH)
+	case strings.TrimSpace(t.Subject) == "":
+		return Template{}, errors.New("В шаблоне нет темы письма.")
+	case strings.ContainsAny(t.Subject, "\r\n"):
+		return Template{}, errors.New("Тема письма в шаблоне должна быть одной строкой.")
+	}
+	switch t.BodyFormat {
+	case "", BODY_FORMAT_TEXT:
+	case BODY_FORMAT_HTML:
+		// The body itself is the HTML, a rendered copy is only kept for text letters
+		t.BodyHTML = ""
+	default:
+		return Template{}, fmt.Errorf("Неизвестный формат текста в шаблоне: %s.", t.BodyFormat)
+	}
+	if err := validateField(FieldSubject, t.Subject); err != nil {
+		return Template{}, fmt.Errorf("Тема шаблона не подходит: %w", err)
+	}
+	if t.Body != "" {
+		if err := validateField(FieldBody, t.Body); err != nil {
+			return Template{}, fmt.Errorf("Текст шаблона не подходит: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// templateFileName builds the file name for an export from the template name,
+// replacing characters file systems reject. The suffix marks it for import.
+func templateFileName(name string) string {
+	base := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	return base + TEMPLATE_FILE_SUFFIX
+}
+
+// isTemplateFile reports whether the document looks like an exported template.
+func isTemplateFile(doc *tgbotapi.Document) bool {
+	return strings.HasSuffix(strings.ToLower(doc.FileName), TEMPLATE_FILE_SUFFIX)
+}
+
+// copyName returns the name with the smallest number suffix not used by the list,
+// as in "Отчёт (2)".
+func copyName(list []Template, name string) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if !slices.ContainsFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, candidate) }) {
+			return candidate
+		}
+	}
+}
+
+// handleExportTemplateCommand sends a template as a file, given as "/exporttemplate Название".
+func (h *Handler) handleExportTemplateCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	name := strings.TrimSpace(message.CommandArguments())
+	if name == "" {
+		bot.Send(newReply(message, "Использование: /exporttemplate Название. Полученный файл можно переслать коллеге, чтобы он загрузил шаблон в своего бота."))
+		return
+	}
+	list := h.Templates.List(message.From.ID)
+	i := slices.IndexFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, name) })
+	if i < 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Шаблон «%s» не найден.", name)))
+		return
+	}
+	data, err := encodeTemplateFile(list[i])
+	if err != nil {
+		slog.Error("Ошибка выгрузки шаблона", "user_id", message.From.ID, "error", err)
+		bot.Send(newReply(message, "Не удалось выгрузить шаблон."))
+		return
+	}
+	doc := tgbotapi.NewDocument(message.Chat.ID, tgbotapi.FileBytes{Name: templateFileName(list[i].Name), Bytes: data})
+	doc.Caption = fmt.Sprintf("Шаблон «%s». Чтобы загрузить его, отправьте этот файл боту.", list[i].Name)
+	if _, err := bot.Send(doc); err != nil {
+		slog.Error("Ошибка отправки файла шаблона", "user_id", message.From.ID, "error", err)
+	}
+}
+
+// importTemplateFile downloads an uploaded template file and saves the template,
+// asking first when one with the same name exists.
+func (h *Handler) importTemplateFile(ctx context.Context, message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	doc := message.Document
+	if doc.FileSize > MAX_TEMPLATE_FILE_SIZE {
+		bot.Send(newReply(message, fmt.Sprintf("Файл шаблона слишком большой: не больше %d КБ.", MAX_TEMPLATE_FILE_SIZE/1024)))
+		return
+	}
+	attachment, err := downloadTelegramFile(ctx, bot, secrets, doc.FileID, doc.FileName, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка загрузки файла шаблона", "error", err)
+		bot.Send(newReply(message, "Не удалось загрузить файл шаблона, попробуйте ещё раз."))
+		return
+	}
+	data, err := attachment.ReadAll()
+	releaseAttachments([]Attachment{attachment})
+	if err != nil || len(data) > MAX_TEMPLATE_FILE_SIZE {
+		slog.ErrorContext(ctx, "Ошибка чтения файла шаблона", "size", len(data), "error", err)
+		bot.Send(newReply(message, "Не удалось прочитать файл шаблона."))
+		return
+	}
+	template, err := decodeTemplateFile(bytes.TrimPrefix(data, []byte("\ufeff")))
+	if err != nil {
+		bot.Send(newReply(message, err.Error()))
+		return
+	}
+
+	userID := message.From.ID
+	list := h.Templates.List(userID)
+	if !slices.ContainsFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, template.Name) }) {
+		h.saveImportedTemplate(message, userID, list, template)
+		return
+	}
+	h.pendingImportsMu.Lock()
+	h.pendingImports[userID] = template
+	h.pendingImportsMu.Unlock()
+	msg := newReply(message, fmt.Sprintf("Шаблон «%s» уже есть. Заменить его или сохранить загруженный под названием «%s»?", template.Name, copyName(list, template.Name)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Заменить", "tplimport:replace"),
+			tgbotapi.NewInlineKeyboardButtonData("Сохранить копию", "tplimport:copy"),
+		),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Отмена", "tplimport:cancel")),
+	)
+	bot.Send(msg)
+}
+
+// saveImportedTemplate stores an imported template unless the user has no room
+// for a new one, and reports the result.
+func (h *Handler) saveImportedTemplate(message *tgbotapi.Message, userID int64, list []Template, template Template) {
+	bot := h.bot
+	replacing := slices.ContainsFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, template.Name) })
+	if len(list) >= MAX_TEMPLATES && !replacing {
+		bot.Send(newReply(message, fmt.Sprintf("Можно хранить не больше %d шаблонов. Удалите ненужные: /deltemplate Название", MAX_TEMPLATES)))
+		return
+	}
+	h.Templates.Save(userID, template)
+	text := fmt.Sprintf("Шаблон «%s» загружен, он есть в /templates.", template.Name)
+	if names := template.placeholders(); len(names) > 0 {
+		text += " Поля для заполнения: " + strings.Join(names, ", ") + "."
+	}
+	bot.Send(newReply(message, text))
+}
+
+// handleTemplateImportCallback resolves a name collision of an imported template.
+func (h *Handler) handleTemplateImportCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	h.pendingImportsMu.Lock()
+	template, ok := h.pendingImports[userID]
+	delete(h.pendingImports, userID)
+	h.pendingImportsMu.Unlock()
+	removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+	if !ok {
+		return "Загрузка устарела, отправьте файл заново."
+	}
+
+	list := h.Templates.List(userID)
+	switch payload {
+	case "replace":
+	case "copy":
+		template.Name = copyName(list, template.Name)
+	case "cancel":
+		return "Шаблон не загружен"
+	default:
+		return "Кнопка устарела."
+	}
+	h.saveImportedTemplate(query.Message, userID, list, template)
+	return ""
+}
@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateFileRoundTrip(t *testing.T) {
+	template := Template{Name: "Отчёт", Subject: "Отчёт за {{месяц}}", Body: "Во вложении.", BodyHTML: "<b>Во вложении.</b>"}
+	data, err := encodeTemplateFile(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeTemplateFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != template {
+		t.Errorf("decoded %+v, want %+v", got, template)
+	}
+}
+
+func TestDecodeTemplateFileRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name, data, want string
+	}{
+		{"not JSON", `Отчёт`, "не файл шаблона"},
+		{"other JSON", `{"name": "Отчёт", "subject": "Тема"}`, "не файл шаблона"},
+		{"newer version", `{"format": "botmail-template", "version": 2, "name": "Отчёт", "subject": "Тема"}`, "более новой версией"},
+		{"no name", `{"format": "botmail-template", "version": 1, "name": " ", "subject": "Тема"}`, "нет названия"},
+		{"long name", `{"format": "botmail-template", "version": 1, "name": "` + strings.Repeat("я", 65) + `", "subject": "Тема"}`, "длиннее 64"},
+		{"no subject", `{"format": "botmail-template", "version": 1, "name": "Отчёт", "body": "Текст"}`, "нет темы"},
+		{"header injection", `{"format": "botmail-template", "version": 1, "name": "Отчёт", "subject": "Тема\r\nBcc: x@example.com"}`, "одной строкой"},
+		{"unknown format", `{"format": "botmail-template", "version": 1, "name": "Отчёт", "subject": "Тема", "body_format": "rtf"}`, "Неизвестный формат"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeTemplateFile([]byte(tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTemplateFileAppliesFieldRules(t *testing.T) {
+	defer func(saved map[Field][]Validator) { ruleValidators = saved }(ruleValidators)
+	if err := registerFieldRules(map[Field][]FieldRule{FieldSubject: {{Pattern: `^\[ACME\]`, Message: "Тема должна начинаться с [ACME]."}}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := decodeTemplateFile([]byte(`{"format": "botmail-template", "version": 1, "name": "Отчёт", "subject": "Отчёт"}`))
+	if err == nil || !strings.Contains(err.Error(), "[ACME]") {
+		t.Errorf("error = %v, want the subject rule", err)
+	}
+}
+
+func TestTemplateCopyName(t *testing.T) {
+	list := []Template{{Name: "Отчёт"}, {Name: "отчёт (2)"}}
+	if got := copyName(list, "Отчёт"); got != "Отчёт (3)" {
+		t.Errorf("copyName = %q, want %q", got, "Отчёт (3)")
+	}
+	if got := templateFileName(`Отчёт: май/июнь`); got != "Отчёт_ май_июнь.template.json" {
+		t.Errorf("templateFileName = %q", got)
+	}
+}
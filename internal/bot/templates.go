@@ -0,0 +1,375 @@
+package bot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+// MAX_TEMPLATES is how many templates a user can keep; each one is a button under /templates.
+const MAX_TEMPLATES = 30
+
+// placeholderPattern matches {{name}} placeholders in template subjects and bodies.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([^{}]{1,40}?)\s*\}\}`)
+
+// Template is a saved letter to start new ones from. Its subject and body may hold
+// {{name}} placeholders the user is asked to fill in.
+type Template struct {
+	Name       string `json:"name"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+	BodyFormat string `json:"body_format,omitempty"`
+	BodyHTML   string `json:"body_html,omitempty"`
+}
+
+// TemplateStore keeps the templates of every user.
+type TemplateStore interface {
+	// List returns the user's templates sorted by name.
+	List(userID int64) []Template
+	// Save stores a template, replacing one with the same name.
+	Save(userID int64, template Template)
+	// Remove deletes the template with the given name and reports whether it existed.
+	Remove(userID int64, name string) bool
+	// Range calls fn with the templates of every user who has any.
+	Range(fn func(userID int64, templates []Template))
+}
+
+// saveTemplate inserts or replaces a template, keeping the list sorted by name.
+func saveTemplate(list []Template, template Template) []Template {
+	list = slices.DeleteFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, template.Name) })
+	list = append(list, template)
+	slices.SortFunc(list, func(a, b Template) int { return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) })
+	return list
+}
+
+// removeTemplate deletes a template by name and reports whether it was found.
+func removeTemplate(list []Template, name string) ([]Template, bool) {
+	n := len(list)
+	list = slices.DeleteFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, name) })
+	return list, len(list) < n
+}
+
+// memoryTemplateStore is a TemplateStore kept in process memory.
+type memoryTemplateStore struct {
+	mu        sync.Mutex
+	templates map[int64][]Template
+}
+
+func (m *memoryTemplateStore) List(userID int64) []Template {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.templates[userID])
+}
+
+func (m *memoryTemplateStore) Save(userID int64, template Template) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.templates[userID] = saveTemplate(m.templates[userID], template)
+}
+
+func (m *memoryTemplateStore) Remove(userID int64, name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list, removed := removeTemplate(m.templates[userID], name)
+	m.templates[userID] = list
+	return removed
+}
+
+func (m *memoryTemplateStore) Range(fn func(userID int64, templates []Template)) {
+	m.mu.Lock()
+	copies := make(map[int64][]Template, len(m.templates))
+	for userID, list := range m.templates {
+		if len(list) > 0 {
+			copies[userID] = slices.Clone(list)
+		}
+	}
+	m.mu.Unlock()
+	// fn runs without the lock, so it may use the store
+	for userID, list := range copies {
+		fn(userID, list)
+	}
+}
+
+// templatesBucket holds each user's JSON-encoded template list keyed by user ID.
+var templatesBucket = []byte("templates")
+
+// boltTemplateStore is a TemplateStore persisted in the bbolt database.
+type boltTemplateStore struct {
+	db *bolt.DB
+}
+
+// newBoltTemplateStore creates the templates bucket in the given database.
+func newBoltTemplateStore(db *bolt.DB) (*boltTemplateStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(templatesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы шаблонов: %w", err)
+	}
+	return &boltTemplateStore{db: db}, nil
+}
+
+func (b *boltTemplateStore) List(userID int64) []Template {
+	var list []Template
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(templatesBucket).Get(state.Int64Key(userID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &list)
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения шаблонов пользователя", "user_id", userID, "error", err)
+	}
+	return list
+}
+
+// update rewrites the user's template list inside a write transaction.
+func (b *boltTemplateStore) update(userID int64, fn func([]Template) []Template) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(templatesBucket)
+		key := state.Int64Key(userID)
+		var list []Template
+		if data := bucket.Get(key); data != nil {
+			if err := json.Unmarshal(data, &list); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(fn(list))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения шаблонов пользователя", "user_id", userID, "error", err)
+	}
+}
+
+func (b *boltTemplateStore) Save(userID int64, template Template) {
+	b.update(userID, func(list []Template) []Template { return saveTemplate(list, template) })
+}
+
+func (b *boltTemplateStore) Remove(userID int64, name string) bool {
+	var removed bool
+	b.update(userID, func(list []Template) []Template {
+		list, removed = removeTemplate(list, name)
+		return list
+	})
+	return removed
+}
+
+// Range calls fn with every stored template list. Lists that cannot be decoded are skipped.
+func (b *boltTemplateStore) Range(fn func(userID int64, templates []Template)) {
+	lists := make(map[int64][]Template)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(templatesBucket).ForEach(func(k, v []byte) error {
+			var list []Template
+			if err := json.Unmarshal(v, &list); err != nil {
+				slog.Error("Ошибка чтения шаблонов", "key", fmt.Sprintf("%x", k), "error", err)
+				return nil
+			}
+			if len(list) > 0 {
+				lists[int64(binary.BigEndian.Uint64(k))] = list
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения шаблонов", "error", err)
+	}
+	// fn runs outside the transaction, so it may use the store
+	for userID, list := range lists {
+		fn(userID, list)
+	}
+}
+
+// rememberComposed records a sent draft as the one /savetemplate saves.
+func (h *Handler) rememberComposed(userID int64, state *UserState) {
+	h.lastComposedMu.Lock()
+	defer h.lastComposedMu.Unlock()
+	h.lastComposed[userID] = Template{Subject: state.Subject, Body: state.Body, BodyFormat: state.BodyFormat, BodyHTML: state.BodyHTML}
+}
+
+// placeholders returns the distinct placeholder names of the template in the order
+// they first appear, subject first.
+func (t Template) placeholders() []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(t.Subject+"\n"+t.Body, -1) {
+		if !slices.Contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// fillPlaceholder replaces the placeholder in the draft's subject and body with value.
+// The HTML forms of the body get the value escaped, so it shows as typed.
+func fillPlaceholder(state *UserState, name, value string) {
+	replace := func(s, value string) string {
+		return placeholderPattern.ReplaceAllStringFunc(s, func(match string) string {
+			if placeholderPattern.FindStringSubmatch(match)[1] != name {
+				return match
+			}
+			return value
+		})
+	}
+	state.Subject = replace(state.Subject, value)
+	if state.BodyFormat == BODY_FORMAT_HTML {
+		state.Body = replace(state.Body, html.EscapeString(value))
+		return
+	}
+	state.Body = replace(state.Body, value)
+	state.BodyHTML = replace(state.BodyHTML, html.EscapeString(value))
+}
+
+// handleSaveTemplateCommand saves the draft at the preview, or else the last sent
+// letter, as a template given as "/savetemplate Название".
+func (h *Handler) handleSaveTemplateCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	name := strings.TrimSpace(message.CommandArguments())
+	if name == "" {
+		bot.Send(newReply(message, "Использование: /savetemplate Название. Сохраняется письмо на предпросмотре или последнее отправленное."))
+		return
+	}
+	userID := message.From.ID
+	var template Template
+	if state, _ := h.States.Get(userID); state.State == "await_confirm" {
+		template = Template{Subject: state.Subject, Body: state.Body, BodyFormat: state.BodyFormat, BodyHTML: state.BodyHTML}
+	} else {
+		h.lastComposedMu.Lock()
+		template = h.lastComposed[userID]
+		h.lastComposedMu.Unlock()
+	}
+	if template.Subject == "" {
+		bot.Send(newReply(message, "Нет письма для сохранения: составьте письмо и дойдите до предпросмотра или отправьте его."))
+		return
+	}
+	list := h.Templates.List(userID)
+	if len(list) >= MAX_TEMPLATES && !slices.ContainsFunc(list, func(t Template) bool { return strings.EqualFold(t.Name, name) }) {
+		bot.Send(newReply(message, fmt.Sprintf("Можно хранить не больше %d шаблонов. Удалите ненужные: /deltemplate Название", MAX_TEMPLATES)))
+		return
+	}
+
+	template.Name = name
+	h.Templates.Save(userID, template)
+	text := fmt.Sprintf("Шаблон «%s» сохранён.", name)
+	if names := template.placeholders(); len(names) > 0 {
+		text += " Поля для заполнения: " + strings.Join(names, ", ") + "."
+	} else {
+		text += " Чтобы при выборе шаблона бот спрашивал значения, добавьте в тему или текст поля вида {{имя}}."
+	}
+	bot.Send(newReply(message, text))
+}
+
+// handleDeleteTemplateCommand removes a template given as "/deltemplate Название".
+func (h *Handler) handleDeleteTemplateCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	name := strings.TrimSpace(message.CommandArguments())
+	if name == "" {
+		bot.Send(newReply(message, "Использование: /deltemplate Название"))
+		return
+	}
+	if !h.Templates.Remove(message.From.ID, name) {
+		bot.Send(newReply(message, fmt.Sprintf("Шаблон «%s» не найден.", name)))
+		return
+	}
+	bot.Send(newReply(message, fmt.Sprintf("Шаблон «%s» удалён.", name)))
+}
+
+// handleTemplatesCommand lists the user's templates as buttons that start a letter.
+func (h *Handler) handleTemplatesCommand(message *tgbotapi.Message) {
+	bot := h.bot
+	list := h.Templates.List(message.From.ID)
+	if len(list) == 0 {
+		bot.Send(newReply(message, "Шаблонов пока нет. Составьте письмо и сохраните его: /savetemplate Название"))
+		return
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, t := range list {
+		// An index keeps the data within Telegram's 64-byte limit, names may be longer
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(t.Name+" — "+t.Subject, fmt.Sprintf("template:%d", i)),
+		))
+	}
+	msg := newReply(message, "Выберите шаблон, чтобы начать письмо по нему.\n\nУдалить: /deltemplate Название\nВыгрузить в файл: /exporttemplate Название")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	bot.Send(msg)
+}
+
+// handleTemplateCallback starts a new letter from the tapped template, replacing
+// any draft in progress, and asks for its placeholders first.
+func (h *Handler) handleTemplateCallback(query *tgbotapi.CallbackQuery, payload string) string {
+	bot := h.bot
+	if query.Message == nil {
+		return "Кнопка устарела."
+	}
+	userID := query.From.ID
+	list := h.Templates.List(userID)
+	i, err := strconv.Atoi(payload)
+	if err != nil || i < 0 || i >= len(list) {
+		removeInlineKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+		return "Шаблон не найден, откройте /templates заново."
+	}
+	t := list[i]
+
+	state := UserState{
+		Subject:      t.Subject,
+		Body:         t.Body,
+		BodyFormat:   t.BodyFormat,
+		BodyHTML:     t.BodyHTML,
+		Template:     t.Name,
+		Placeholders: t.placeholders(),
+	}
+	if len(state.Placeholders) > 0 {
+		state.State = "await_placeholder"
+		msg := newReply(query.Message, fmt.Sprintf("Письмо по шаблону «%s».\nВведите значение поля «%s».", t.Name, state.Placeholders[0]))
+		msg.ReplyMarkup = newCancelKeyboard()
+		bot.Send(msg)
+	} else {
+		h.startTemplateRecipient(query.Message, userID, &state)
+	}
+	h.States.Update(userID, func(s *UserState) { *s = state })
+	return "Шаблон «" + t.Name + "»"
+}
+
+// acceptPlaceholder fills the placeholder being asked with the user's text and asks
+// for the next one, or moves on to the recipient once all are filled.
+func (h *Handler) acceptPlaceholder(message *tgbotapi.Message, userID int64, state *UserState, text string) {
+	bot := h.bot
+	if len(state.Placeholders) == 0 {
+		h.startTemplateRecipient(message, userID, state)
+		return
+	}
+	fillPlaceholder(state, state.Placeholders[0], text)
+	state.Placeholders = state.Placeholders[1:]
+	if len(state.Placeholders) > 0 {
+		bot.Send(newReply(message, fmt.Sprintf("Введите значение поля «%s».", state.Placeholders[0])))
+		return
+	}
+	h.startTemplateRecipient(message, userID, state)
+}
+
+// startTemplateRecipient asks for the recipient of a letter whose subject and body
+// came from a template.
+func (h *Handler) startTemplateRecipient(message *tgbotapi.Message, userID int64, state *UserState) {
+	bot := h.bot
+	state.State = "await_recipient"
+	msg := newReply(message, fmt.Sprintf("Тема: %s\nВведите адрес получателя. Несколько адресов укажите через запятую.", state.Subject))
+	msg.ReplyMarkup = newRecipientKeyboard()
+	bot.Send(msg)
+	h.offerContacts(message, userID)
+}
@@ -0,0 +1,43 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplatePlaceholders(t *testing.T) {
+	template := Template{Subject: "Отчёт за {{месяц}}", Body: "Здравствуйте, {{ имя }}!\nОтчёт за {{месяц}} во вложении. {{}} {не поле}"}
+	if got, want := template.placeholders(), []string{"месяц", "имя"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("placeholders = %q, want %q", got, want)
+	}
+}
+
+func TestFillPlaceholderEscapesHTML(t *testing.T) {
+	text := UserState{Subject: "Для {{кого}}", Body: "Привет, {{кого}}", BodyHTML: "Привет, <b>{{кого}}</b>"}
+	fillPlaceholder(&text, "кого", "A&B")
+	if text.Subject != "Для A&B" || text.Body != "Привет, A&B" || text.BodyHTML != "Привет, <b>A&amp;B</b>" {
+		t.Errorf("text mode filled as %+v", text)
+	}
+	custom := UserState{Body: "<p>{{кого}}</p>", BodyFormat: BODY_FORMAT_HTML}
+	fillPlaceholder(&custom, "кого", "<script>")
+	if custom.Body != "<p>&lt;script&gt;</p>" {
+		t.Errorf("HTML mode filled as %q", custom.Body)
+	}
+}
+
+func TestWizardSendsFromTemplate(t *testing.T) {
+	handler, sender := runWizard(t, []wizardAction{
+		textAction("/start"), textAction(NEW_LETTER_BUTTON_TEXT), textAction("a@example.com"),
+		tapAction("copies:cc"), tapAction("copies:bcc"),
+		textAction("Отчёт за {{месяц}}"), textAction("Отчёт во вложении."), textAction("Иван"),
+		textAction("/savetemplate Отчёт"), tapAction("confirm:cancel"),
+		tapAction("template:0"), textAction("май"), textAction("b@example.com"), tapAction("copies:cc"), tapAction("copies:bcc"), textAction("Иван"),
+		tapAction("confirm:send"),
+	})
+	if want := []string{"Отчёт за май"}; !reflect.DeepEqual(sender.subjects, want) {
+		t.Errorf("sent %q, want %q", sender.subjects, want)
+	}
+	if list := handler.Templates.List(wizardUser); len(list) != 1 || list[0].Subject != "Отчёт за {{месяц}}" {
+		t.Errorf("saved templates = %+v", list)
+	}
+}
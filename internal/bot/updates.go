@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// WEBHOOK_SHUTDOWN_TIMEOUT bounds how long the webhook server waits for in-flight requests on stop.
+const WEBHOOK_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// UpdateSource delivers Telegram updates to the handler loop, so polling and
+// webhook modes share the same processing.
+type UpdateSource interface {
+	// Updates starts receiving and returns the channel updates arrive on.
+	Updates() (tgbotapi.UpdatesChannel, error)
+	// Stop stops receiving and closes the channel.
+	Stop()
+}
+
+// pollingSource receives updates with getUpdates long polling.
+type pollingSource struct {
+	bot *tgbotapi.BotAPI
+}
+
+func (p *pollingSource) Updates() (tgbotapi.UpdatesChannel, error) {
+	// getUpdates is refused while a webhook is set, e.g. after running in webhook mode
+	if _, err := p.bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("ошибка удаления вебхука: %w", err)
+	}
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60 // Long polling timeout
+	return p.bot.GetUpdatesChan(u), nil
+}
+
+func (p *pollingSource) Stop() {
+	p.bot.StopReceivingUpdates()
+}
+
+// webhookSource registers a Telegram webhook and receives updates with an embedded HTTP server.
+type webhookSource struct {
+	bot        *tgbotapi.BotAPI
+	webhookURL string // Public URL Telegram posts to; its path should contain a hard to guess secret
+	listenAddr string
+	certFile   string // TLS certificate, plain HTTP behind a proxy when empty
+	keyFile    string
+	selfSigned bool // Upload certFile to Telegram so it trusts a self-signed certificate
+	server     *http.Server
+	updates    chan tgbotapi.Update
+}
+
+func (w *webhookSource) Updates() (tgbotapi.UpdatesChannel, error) {
+	link, err := url.Parse(w.webhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный адрес вебхука: %w", err)
+	}
+	webhook := tgbotapi.WebhookConfig{URL: link}
+	if w.selfSigned {
+		webhook.Certificate = tgbotapi.FilePath(w.certFile)
+	}
+	if _, err := w.bot.Request(webhook); err != nil {
+		return nil, fmt.Errorf("ошибка регистрации вебхука: %w", err)
+	}
+
+	w.updates = make(chan tgbotapi.Update, w.bot.Buffer)
+	mux := http.NewServeMux()
+	mux.HandleFunc(choose(link.Path, "/"), func(rw http.ResponseWriter, r *http.Request) {
+		update, err := w.bot.HandleUpdate(r)
+		if err != nil {
+			slog.Warn("Некорректный запрос вебхука", "remote_addr", r.RemoteAddr, "error", err)
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.updates <- *update
+	})
+	if path := choose(link.Path, "/"); path != "/" {
+		// Only Telegram knows the webhook path, requests elsewhere are scanners
+		mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+			slog.Warn("Запрос к серверу вебхука не по адресу вебхука", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			noteHTTPProbe(PROBE_WEBHOOK, r)
+			http.NotFound(rw, r)
+		})
+	}
+	w.server = &http.Server{Addr: w.listenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		var err error
+		if w.certFile != "" {
+			err = w.server.ListenAndServeTLS(w.certFile, w.keyFile)
+		} else {
+			err = w.server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Ошибка сервера вебхука", "error", err)
+		}
+	}()
+	slog.Info("Вебхук зарегистрирован", "listen_addr", w.listenAddr)
+	return w.updates, nil
+}
+
+func (w *webhookSource) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	// Shutdown waits for running handlers, so nothing writes to the channel after it returns
+	if err := w.server.Shutdown(ctx); err != nil {
+		slog.Error("Ошибка остановки сервера вебхука", "error", err)
+	}
+	close(w.updates)
+}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MAX_RECIPIENTS is how many addresses a single letter can be sent to.
+const MAX_RECIPIENTS = 10
+
+const (
+	FieldSubject    Field = "subject"
+	FieldBody       Field = "body"
+	FieldRecipient  Field = "recipient"
+	FieldSenderName Field = "sender_name"
+	FieldPreheader  Field = "preheader"
+)
+
+// Validator checks a value entered for a wizard field. The message of a
+// returned error is shown to the user as is, so it should be user-facing text.
+type Validator func(value string) error
+
+var (
+	// validators maps each field to the rules registered in code, applied in order.
+	validators = make(map[Field][]Validator)
+	// ruleValidators maps each field to the rules compiled from field_rules, which
+	// /reload replaces without touching those registered in code.
+	ruleValidators = make(map[Field][]Validator)
+)
+
+// RegisterValidator adds a validation rule for the given field. Rules run in
+// registration order before the wizard advances to the next step, ahead of the
+// field_rules of secrets.json.
+func RegisterValidator(field Field, v Validator) {
+	validators[field] = append(validators[field], v)
+}
+
+// validateField runs all rules for the field and returns the first failure.
+func validateField(field Field, value string) error {
+	configMu.RLock()
+	sets := [...][]Validator{validators[field], ruleValidators[field]}
+	configMu.RUnlock()
+	for _, set := range sets {
+		for _, v := range set {
+			if err := v(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// registerFieldRules compiles rules from the configuration and puts them in place
+// of the rules compiled before. They are left as they were if any rule is invalid.
+func registerFieldRules(rules map[Field][]FieldRule) error {
+	compiled := make(map[Field][]Validator)
+	for field, fieldRules := range rules {
+		switch field {
+		case FieldSubject, FieldBody, FieldRecipient, FieldSenderName, FieldPreheader:
+		default:
+			return fmt.Errorf("неизвестное поле в правилах проверки: %s", field)
+		}
+		for _, rule := range fieldRules {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("ошибка в правиле проверки поля %s: %w", field, err)
+			}
+			message := rule.Message
+			if message == "" {
+				message = fmt.Sprintf("Значение не соответствует шаблону %s.", rule.Pattern)
+			}
+			compiled[field] = append(compiled[field], func(value string) error {
+				if !re.MatchString(value) {
+					return errors.New(message)
+				}
+				return nil
+			})
+		}
+	}
+	ruleValidators = compiled
+	return nil
+}
+
+// parseRecipients splits a comma-separated list of addresses, checks the format of
+// each and applies the recipient rules. Duplicates are dropped.
+func parseRecipients(text string) ([]string, error) {
+	var recipients []string
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		address, err := mail.ParseAddress(part)
+		if err != nil {
+			return nil, fmt.Errorf("Некорректный адрес: %s", part)
+		}
+		if err := validateField(FieldRecipient, address.Address); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(recipients, address.Address) {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("Введите хотя бы один адрес получателя.")
+	}
+	if len(recipients) > MAX_RECIPIENTS {
+		return nil, fmt.Errorf("Можно указать не больше %d получателей.", MAX_RECIPIENTS)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRecipients(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want []string
+		err  string
+	}{
+		{text: "a@example.com", want: []string{"a@example.com"}},
+		{text: " a@example.com, Иван <b@example.com>,, a@example.com ", want: []string{"a@example.com", "b@example.com"}},
+		{text: "a@example.com, not an address", err: "Некорректный адрес: not an address"},
+		{text: " , ", err: "хотя бы один адрес"},
+		{text: strings.Repeat("a@example.com,", MAX_RECIPIENTS) + "z@example.com", want: []string{"a@example.com", "z@example.com"}},
+		{text: "a0@x.ru,a1@x.ru,a2@x.ru,a3@x.ru,a4@x.ru,a5@x.ru,a6@x.ru,a7@x.ru,a8@x.ru,a9@x.ru,a10@x.ru", err: "не больше 10 получателей"},
+	} {
+		got, err := parseRecipients(tt.text)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRecipients(%q) error = %v, want %q", tt.text, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parseRecipients(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+}
+
+func TestFieldRules(t *testing.T) {
+	defer func(saved map[Field][]Validator) { ruleValidators = saved }(ruleValidators)
+	err := registerFieldRules(map[Field][]FieldRule{
+		FieldRecipient: {{Pattern: `@example\.com$`, Message: "Только адреса example.com."}},
+		FieldBody:      {{Pattern: `\S`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRecipients("a@example.com, b@example.org"); err == nil || err.Error() != "Только адреса example.com." {
+		t.Errorf("recipient rule: %v", err)
+	}
+	if err := validateField(FieldBody, " "); err == nil || err.Error() != `Значение не соответствует шаблону \S.` {
+		t.Errorf("rule without a message: %v", err)
+	}
+	if err := validateField(FieldSubject, ""); err != nil {
+		t.Errorf("a field without rules was rejected: %v", err)
+	}
+
+	// Invalid rules leave the previous ones in place
+	for _, rules := range []map[Field][]FieldRule{
+		{"signature": {{Pattern: "."}}},
+		{FieldSubject: {{Pattern: "("}}},
+	} {
+		if err := registerFieldRules(rules); err == nil {
+			t.Errorf("registerFieldRules(%v) accepted invalid rules", rules)
+		}
+	}
+	if validateField(FieldBody, " ") == nil {
+		t.Errorf("invalid rules replaced the registered ones")
+	}
+}
+
+func TestRegisteredValidatorsRunFirst(t *testing.T) {
+	defer func(saved, savedRules map[Field][]Validator) { validators, ruleValidators = saved, savedRules }(validators, ruleValidators)
+	validators = make(map[Field][]Validator)
+	RegisterValidator(FieldSenderName, func(value string) error {
+		if value == "admin" {
+			return errors.New("Имя зарезервировано.")
+		}
+		return nil
+	})
+	if err := registerFieldRules(map[Field][]FieldRule{FieldSenderName: {{Pattern: `^[А-Яа-я]+$`, Message: "Только кириллица."}}}); err != nil {
+		t.Fatal(err)
+	}
+	for value, want := range map[string]string{"admin": "Имя зарезервировано.", "Ivan": "Только кириллица.", "Иван": ""} {
+		var got string
+		if err := validateField(FieldSenderName, value); err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Errorf("validateField(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
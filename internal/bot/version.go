@@ -0,0 +1,201 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+
+	"botmailtest/internal/state"
+)
+
+// version is the release version, set by SetRelease.
+var version = "dev"
+
+// FEATURE_ANNOUNCE_UPDATES enables telling users about new features after an upgrade.
+const FEATURE_ANNOUNCE_UPDATES = "announce_updates"
+
+// changelog is the contents of CHANGELOG.md, set by SetRelease.
+var changelog string
+
+// SetRelease sets the version and changelog shown by /version and in update
+// announcements. main passes them in: the version is injected into it at build
+// time and the changelog is embedded from the repository root.
+func SetRelease(v, notes string) {
+	version, changelog = v, notes
+}
+
+// changelogFlag matches the optional feature flag tag at the start of a changelog entry.
+var changelogFlag = regexp.MustCompile(`^\[([\w-]+)\]\s*`)
+
+// ChangelogEntry is one line of a release section, optionally tied to a feature flag.
+type ChangelogEntry struct {
+	Flag string
+	Text string
+}
+
+// changelogSection returns the entries listed under "## <release>". An unknown
+// release, such as a dev build, gets the latest section.
+func changelogSection(release string) []ChangelogEntry {
+	var entries []ChangelogEntry
+	found, inSection := false, false
+	for _, line := range strings.Split(changelog, "\n") {
+		line = strings.TrimSpace(line)
+		if heading, ok := strings.CutPrefix(line, "## "); ok {
+			if inSection {
+				break
+			}
+			inSection = heading == release
+			found = found || inSection
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if text, ok := strings.CutPrefix(line, "- "); ok {
+			entry := ChangelogEntry{Text: text}
+			if m := changelogFlag.FindStringSubmatch(text); m != nil {
+				entry.Flag, entry.Text = m[1], text[len(m[0]):]
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if !found && changelogLatest() != release {
+		return changelogSection(changelogLatest())
+	}
+	return entries
+}
+
+// changelogLatest returns the newest release listed in the changelog.
+func changelogLatest() string {
+	for _, line := range strings.Split(changelog, "\n") {
+		if heading, ok := strings.CutPrefix(strings.TrimSpace(line), "## "); ok {
+			return heading
+		}
+	}
+	return ""
+}
+
+// buildInfo describes the running binary: version, Go version and VCS revision when known.
+func buildInfo() string {
+	lines := []string{"Версия: " + version, "Go: " + runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings := make(map[string]string)
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		if revision := settings["vcs.revision"]; revision != "" {
+			if len(revision) > 12 {
+				revision = revision[:12]
+			}
+			if settings["vcs.modified"] == "true" {
+				revision += " (изменён)"
+			}
+			lines = append(lines, "Коммит: "+revision)
+		}
+		if built := settings["vcs.time"]; built != "" {
+			lines = append(lines, "Время коммита: "+built)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleVersionCommand shows build info and the changelog of the running release.
+func handleVersionCommand(bot BotAPI, message *tgbotapi.Message) {
+	text := buildInfo()
+	if entries := changelogSection(version); len(entries) > 0 {
+		text += "\n\nИзменения:"
+		for _, entry := range entries {
+			text += "\n• " + entry.Text
+		}
+	}
+	bot.Send(newReply(message, text))
+}
+
+// SeenVersions remembers the last release each user has been told about.
+type SeenVersions interface {
+	// Swap records version for the user and returns the previously recorded one.
+	Swap(userID int64, version string) string
+}
+
+// memorySeenVersions is a SeenVersions kept in process memory.
+type memorySeenVersions struct {
+	mu       sync.Mutex
+	versions map[int64]string
+}
+
+func (m *memorySeenVersions) Swap(userID int64, version string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.versions[userID]
+	m.versions[userID] = version
+	return previous
+}
+
+// seenVersionsBucket holds the last announced release keyed by user ID.
+var seenVersionsBucket = []byte("seen_versions")
+
+// boltSeenVersions is a SeenVersions persisted in the bbolt database.
+type boltSeenVersions struct {
+	db *bolt.DB
+}
+
+// newBoltSeenVersions creates the seen versions bucket in the given database.
+func newBoltSeenVersions(db *bolt.DB) (*boltSeenVersions, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(seenVersionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы версий: %w", err)
+	}
+	return &boltSeenVersions{db: db}, nil
+}
+
+func (b *boltSeenVersions) Swap(userID int64, version string) string {
+	var previous string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(seenVersionsBucket)
+		key := state.Int64Key(userID)
+		previous = string(bucket.Get(key))
+		if previous == version {
+			return nil
+		}
+		return bucket.Put(key, []byte(version))
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения версии для пользователя", "user_id", userID, "error", err)
+	}
+	return previous
+}
+
+// announceUpdate tells a returning user what is new once per release, if
+// announcements are enabled. Entries tagged with a feature flag are only
+// mentioned when that flag is on. New users and dev builds are not announced to.
+func (h *Handler) announceUpdate(message *tgbotapi.Message) {
+	bot, secrets := h.bot, h.secrets
+	if !secrets.Features[FEATURE_ANNOUNCE_UPDATES] || version == "dev" {
+		return
+	}
+	previous := h.SeenVersions.Swap(message.From.ID, version)
+	if previous == "" || previous == version {
+		return
+	}
+	var lines []string
+	for _, entry := range changelogSection(version) {
+		if entry.Flag == "" || secrets.Features[entry.Flag] {
+			lines = append(lines, "• "+entry.Text)
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	text := fmt.Sprintf("Бот обновлён до версии %s. Что нового:\n%s", version, strings.Join(lines, "\n"))
+	bot.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+}
@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+const (
+	// WATCHDOG_RESTART_STRIKES is how many checks in a row must find a threshold
+	// crossed before a restart, so a burst of large attachments does not cause one.
+	WATCHDOG_RESTART_STRIKES = 3
+)
+
+// errWatchdogRestart is the cause serve is stopped with when the watchdog asks for a restart.
+var errWatchdogRestart = errors.New("перезапуск по сигналу сторожа памяти")
+
+// watchdog checks memory against the thresholds, reporting a leak once when it is
+// first seen and asking for a restart if it persists.
+type watchdog struct {
+	settings WatchdogSettings
+	sample   func(collect bool) (heapBytes uint64, goroutines int) // collect runs a GC first
+	alert    func(text string)
+	restart  func()
+	strikes  int // Consecutive checks over a threshold
+}
+
+// newWatchdog creates a watchdog sampling the Go runtime.
+func newWatchdog(settings WatchdogSettings, alert func(string), restart func()) *watchdog {
+	return &watchdog{settings: settings, sample: sampleRuntime, alert: alert, restart: restart}
+}
+
+// sampleRuntime returns the heap in use and the goroutine count.
+func sampleRuntime(collect bool) (uint64, int) {
+	if collect {
+		runtime.GC()
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc, runtime.NumGoroutine()
+}
+
+// run checks every interval until stop is closed or a restart was requested.
+func (w *watchdog) run(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if w.check() {
+				return
+			}
+		}
+	}
+}
+
+// check samples the runtime once and reports whether a restart was requested.
+func (w *watchdog) check() bool {
+	problems := w.problems(w.sample(false))
+	if len(problems) > 0 {
+		// Garbage not yet collected is no leak, so confirm after a collection
+		problems = w.problems(w.sample(true))
+	}
+	if len(problems) == 0 {
+		if w.strikes > 0 {
+			slog.Info("Сторож памяти: показатели вернулись в норму")
+		}
+		w.strikes = 0
+		return false
+	}
+
+	w.strikes++
+	summary := strings.Join(problems, ", ")
+	if w.strikes == 1 {
+		slog.Warn("Сторож памяти: превышены пороги", "problems", summary, "goroutines", goroutineDump())
+		w.alert("Сторож памяти: превышены пороги: " + summary + ". Дамп горутин записан в лог.")
+	}
+	if w.settings.Restart && w.strikes >= WATCHDOG_RESTART_STRIKES {
+		slog.Warn("Сторож памяти: пороги превышены несколько проверок подряд, бот перезапускается", "strikes", w.strikes)
+		w.alert(fmt.Sprintf("Сторож памяти: пороги превышены %d проверок подряд (%s), бот перезапустится после завершения отправок.", w.strikes, summary))
+		w.restart()
+		return true
+	}
+	return false
+}
+
+// problems describes the thresholds the sample crosses.
+func (w *watchdog) problems(heapBytes uint64, goroutines int) []string {
+	var problems []string
+	const mb = 1 << 20
+	if w.settings.MaxHeapMB > 0 && heapBytes > uint64(w.settings.MaxHeapMB)*mb {
+		problems = append(problems, fmt.Sprintf("куча %d МБ при пороге %d МБ", heapBytes/mb, w.settings.MaxHeapMB))
+	}
+	if w.settings.MaxGoroutines > 0 && goroutines > w.settings.MaxGoroutines {
+		problems = append(problems, fmt.Sprintf("горутин %d при пороге %d", goroutines, w.settings.MaxGoroutines))
+	}
+	return problems
+}
+
+// goroutineDump returns the stacks of all goroutines, identical ones counted together.
+func goroutineDump() string {
+	var b bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&b, 1)
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWatchdogAlertsOnceAndRestarts(t *testing.T) {
+	heap, goroutines := uint64(10<<20), 10
+	var alerts []string
+	restarts := 0
+	w := &watchdog{
+		settings: WatchdogSettings{MaxHeapMB: 100, MaxGoroutines: 50, Restart: true},
+		sample:   func(bool) (uint64, int) { return heap, goroutines },
+		alert:    func(text string) { alerts = append(alerts, text) },
+		restart:  func() { restarts++ },
+	}
+
+	if w.check() || len(alerts) != 0 {
+		t.Fatalf("alerted below the thresholds: %q", alerts)
+	}
+	goroutines = 80
+	for i := 1; i < WATCHDOG_RESTART_STRIKES; i++ {
+		if w.check() {
+			t.Fatalf("restart requested after %d checks", i)
+		}
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "горутин 80") {
+		t.Errorf("alerts = %q, want one about goroutines", alerts)
+	}
+	if !w.check() || restarts != 1 {
+		t.Errorf("no restart after %d checks over the threshold", WATCHDOG_RESTART_STRIKES)
+	}
+}
+
+func TestWatchdogIgnoresCollectableGarbage(t *testing.T) {
+	var alerts []string
+	w := &watchdog{
+		settings: WatchdogSettings{MaxHeapMB: 100, Restart: true},
+		sample: func(collect bool) (uint64, int) {
+			if collect {
+				return 50 << 20, 10
+			}
+			return 500 << 20, 10
+		},
+		alert:   func(text string) { alerts = append(alerts, text) },
+		restart: func() { t.Error("restarted over garbage") },
+	}
+	for range WATCHDOG_RESTART_STRIKES {
+		w.check()
+	}
+	if len(alerts) != 0 {
+		t.Errorf("alerts = %q, want none", alerts)
+	}
+}
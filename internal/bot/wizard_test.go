@@ -0,0 +1,213 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"botmailtest/internal/mailer"
+)
+
+// wizardUser is the Telegram user the state machine tests act as.
+const wizardUser = 5
+
+// wizardStates lists every state a user can be left in between updates.
+var wizardStates = map[string]bool{
+	"": true, "initial": true,
+	"await_recipient": true, "await_cc": true, "await_bcc": true, "await_subject": true, "await_body": true, "await_sender": true,
+	"await_preheader": true, "await_confirm": true, "await_placeholder": true, "await_schedule": true,
+	"await_tags":         true,
+	"await_invite_title": true, "await_invite_time": true, "await_invite_duration": true, "await_invite_location": true,
+}
+
+// wizardAction is one thing a user can do: send a text, a command or a file, or tap a button.
+type wizardAction struct {
+	name   string
+	update func() tgbotapi.Update
+}
+
+func textAction(text string) wizardAction {
+	return wizardAction{name: fmt.Sprintf("text %.20q", text), update: func() tgbotapi.Update {
+		message := &tgbotapi.Message{
+			MessageID: 1,
+			From:      &tgbotapi.User{ID: wizardUser, FirstName: "Test"},
+			Chat:      &tgbotapi.Chat{ID: wizardUser, Type: "private"},
+			Text:      text,
+		}
+		if strings.HasPrefix(text, "/") {
+			command, _, _ := strings.Cut(text, " ")
+			message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Length: len(command)}}
+		}
+		return tgbotapi.Update{Message: message}
+	}}
+}
+
+func tapAction(data string) wizardAction {
+	return wizardAction{name: "tap " + data, update: func() tgbotapi.Update {
+		return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "1",
+			From:    &tgbotapi.User{ID: wizardUser, FirstName: "Test"},
+			Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: wizardUser, Type: "private"}},
+			Data:    data,
+		}}
+	}}
+}
+
+func fileAction(caption string) wizardAction {
+	return wizardAction{name: fmt.Sprintf("file with caption %q", caption), update: func() tgbotapi.Update {
+		update := textAction("").update()
+		update.Message.Document = &tgbotapi.Document{FileID: "file", FileName: "report.pdf", FileSize: 100}
+		update.Message.Caption = caption
+		return update
+	}}
+}
+
+// wizardActions is the vocabulary random sequences are drawn from.
+var wizardActions = []wizardAction{
+	textAction(NEW_LETTER_BUTTON_TEXT), textAction(CANCEL_BUTTON_TEXT), textAction(DEFAULT_RECIPIENT_BUTTON_TEXT),
+	textAction("a@example.com"), textAction("a@example.com, reject@example.com"), textAction("not an address"),
+	textAction("Тема"), textAction("Иван"), textAction(""), textAction("-"), textAction(strings.Repeat("я", 5000)),
+	textAction("/start"), textAction("/cancel"), textAction("/version"), textAction("/contacts"),
+	textAction("/addcontact Аня anya@example.com"), textAction("/invite"), textAction("/spamcheck"),
+	fileAction(""), fileAction("Текст письма"),
+	tapAction("confirm:send"), tapAction("confirm:edit"), tapAction("confirm:cancel"), tapAction("confirm:spamcheck"),
+	tapAction("confirm:edit_recipient"), tapAction("confirm:edit_subject"), tapAction("confirm:edit_preheader"),
+	tapAction("confirm:edit_body"), tapAction("confirm:edit_sender"), tapAction("confirm:"),
+	tapAction("contact:0"), tapAction("contact:x"), tapAction("subject:0"), tapAction("retry:1"),
+	tapAction("followup:1"), tapAction("remind:1:3:tg"), tapAction("pin:"), tapAction("garbage"),
+	tapAction("format:html"), tapAction("format:text"), tapAction("format:x"),
+	textAction("/templates"), textAction("/savetemplate Отчёт"), textAction("/deltemplate Отчёт"), textAction("Отчёт за {{месяц}}"),
+	tapAction("template:0"), tapAction("template:5"),
+	tapAction("confirm:later"), tapAction("schedule:in:60"), tapAction("schedule:tomorrow"), tapAction("schedule:back"),
+	tapAction("schedule:cancel:1"), textAction("/scheduled"), textAction("23:59"),
+	textAction("/recurring add daily 09:00"), textAction("/recurring list"), textAction("/recurring delete 1"),
+	textAction("/history"), tapAction("history:1"), tapAction("history:x"), textAction("/resend 1"), textAction("/resend x"),
+	textAction("/status 1"), tapAction("status:1"), tapAction("status:x"),
+	tapAction("confirm:edit_tags"), tapAction("tags:toggle:0"), tapAction("tags:done"),
+	textAction("/onbehalf"), textAction("/onbehalf 1"), tapAction("behalf:ask:1"), tapAction("behalf:approve:1"),
+	tapAction("behalf:reject:1"), tapAction("behalf:x"),
+	textAction("/history purge --before 2030-01-01"), tapAction("history:purge:1"), tapAction("history:purge_cancel:x"),
+	textAction("/checkdomain"),
+	textAction("b@example.com, c@example.com"), tapAction("copies:cc"), tapAction("copies:bcc"), tapAction("copies:x"),
+}
+
+// recordingSender is an EmailSender that checks every letter is complete and
+// rejects addresses starting with "reject".
+type recordingSender struct {
+	t        testing.TB
+	steps    *[]string
+	sent     int
+	subjects []string // Of the letters sent, in order
+	copies   []Copies // Of the letters sent, in order
+}
+
+func (s *recordingSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	if targetEmail == "" || senderEmail == "" || subject == "" || senderName == "" || (body == "" && len(attachments) == 0) {
+		s.t.Fatalf("sent an incomplete letter to %q: subject %q, sender %q, body %q, %d attachments after:\n%s",
+			targetEmail, subject, senderName, body, len(attachments), strings.Join(*s.steps, "\n"))
+	}
+	s.sent++
+	s.subjects = append(s.subjects, subject)
+	s.copies = append(s.copies, copies)
+	var result SendEmailResponse
+	for i, address := range append(strings.Split(targetEmail, ","), copies.Addresses()...) {
+		r := SendEmailResult{Index: i, Email: address, ID: "1"}
+		if strings.HasPrefix(address, "reject") {
+			r = SendEmailResult{Index: i, Email: address, Errors: []mailer.RecipientError{{Code: "invalid", Message: "rejected"}}}
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// newWizardHandler resets the stores and returns a Handler that replies through a
+// fake bot and sends letters through a recording sender. steps, listed when a
+// letter is incomplete, are the actions taken so far.
+func newWizardHandler(t testing.TB, secrets *Secrets, steps *[]string) (*Handler, *fakeBot, *recordingSender) {
+	bot := &fakeBot{}
+	sender := &recordingSender{t: t, steps: steps}
+	return NewHandler(bot, sender, secrets, MemoryStores()), bot, sender
+}
+
+// wizardSecrets configures the bot for the state machine tests. The recording sender
+// stands in for the provider; not naming Unisender keeps its API calls, such as
+// delivery status checks, from leaving the test.
+func wizardSecrets() *Secrets {
+	return &Secrets{TargetEmail: "target@example.com", SenderEmail: "sender@example.com", EmailProvider: mailer.EMAIL_PROVIDER_SMTP}
+}
+
+// runWizard feeds the actions to a Handler one by one, checking after each that
+// the user is left in a known state and that a preview is only shown for a complete draft.
+// It returns the handler, for the stores it left, and the sender, which recorded the letters sent.
+func runWizard(t testing.TB, actions []wizardAction) (*Handler, *recordingSender) {
+	var steps []string
+	handler, _, sender := newWizardHandler(t, wizardSecrets(), &steps)
+
+	for _, action := range actions {
+		steps = append(steps, "  "+action.name)
+		handler.HandleUpdate(context.Background(), action.update())
+
+		state, _ := handler.States.Get(wizardUser)
+		if !wizardStates[state.State] {
+			t.Fatalf("left in unknown state %q after:\n%s", state.State, strings.Join(steps, "\n"))
+		}
+		if state.State == "await_confirm" && (state.Subject == "" || state.SenderName == "" || state.Body == "" && len(state.Attachments) == 0) {
+			t.Fatalf("preview of an incomplete draft %+v after:\n%s", state, strings.Join(steps, "\n"))
+		}
+	}
+	return handler, sender
+}
+
+// decodeActions turns fuzzer input into an action sequence, one byte per action.
+func decodeActions(data []byte) []wizardAction {
+	actions := make([]wizardAction, len(data))
+	for i, b := range data {
+		actions[i] = wizardActions[int(b)%len(wizardActions)]
+	}
+	return actions
+}
+
+// happyPath is /start, new letter, recipient, no copies, subject, body, sender and send.
+var happyPath = []byte{11, 0, 3, 79, 80, 6, 6, 7, 20}
+
+func TestWizardHappyPathSends(t *testing.T) {
+	if _, sender := runWizard(t, decodeActions(happyPath)); sender.sent != 1 {
+		t.Errorf("sent %d letters, want 1", sender.sent)
+	}
+}
+
+func TestWizardRandomSequences(t *testing.T) {
+	sequences, length := 200, 40
+	if testing.Short() {
+		sequences = 20
+	}
+	for i := range sequences {
+		random := rand.New(rand.NewPCG(uint64(i), 0))
+		actions := make([]wizardAction, length)
+		for j := range actions {
+			actions[j] = wizardActions[random.IntN(len(wizardActions))]
+		}
+		runWizard(t, actions)
+	}
+}
+
+// FuzzWizard explores action sequences beyond the random ones:
+//
+//	go test -fuzz FuzzWizard -fuzztime 1m
+func FuzzWizard(f *testing.F) {
+	f.Add(happyPath)
+	// Editing every field from the preview, then sending
+	f.Add([]byte{11, 0, 4, 79, 80, 6, 18, 19, 7, 25, 6, 26, 9, 27, 19, 28, 7, 24, 3, 79, 80, 20, 33})
+	// Copies to two addresses, then removing them from the preview
+	f.Add([]byte{11, 0, 3, 78, 78, 6, 6, 7, 24, 3, 9, 9, 20})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 100 {
+			t.Skip("sequence too long")
+		}
+		runWizard(t, decodeActions(data))
+	})
+}
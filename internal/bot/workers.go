@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// WORKER_QUEUE_SIZE is how many updates of one user may wait for that user's
+	// worker; further ones are refused until the worker catches up.
+	WORKER_QUEUE_SIZE = 16
+	// WORKER_IDLE_TIMEOUT is how long a worker waits for the next update before exiting.
+	WORKER_IDLE_TIMEOUT = 5 * time.Minute
+	// BUSY_TEXT answers an update dropped because the user's queue is full.
+	BUSY_TEXT = "Бот ещё обрабатывает ваши предыдущие сообщения. Повторите чуть позже."
+)
+
+// dispatcher hands updates to per-user worker goroutines, so a slow Unisender
+// call in one conversation does not hold up the others while each user's
+// updates are still processed in order.
+type dispatcher struct {
+	handle  func(update tgbotapi.Update)
+	mu      sync.Mutex
+	workers map[int64]chan tgbotapi.Update
+	running sync.WaitGroup
+}
+
+// newDispatcher creates a dispatcher that processes updates with handle.
+func newDispatcher(handle func(update tgbotapi.Update)) *dispatcher {
+	return &dispatcher{handle: handle, workers: make(map[int64]chan tgbotapi.Update)}
+}
+
+// Dispatch queues the update for its user's worker, starting the worker if needed.
+// It never waits: when the user's queue is full it drops the update and returns
+// false, so one flooding user cannot hold up the others or the shutdown.
+func (d *dispatcher) Dispatch(update tgbotapi.Update) bool {
+	var userID int64 // Updates without a sender share one worker
+	if user := update.SentFrom(); user != nil {
+		userID = user.ID
+	}
+
+	// The lock is held while queueing so an idle worker cannot exit in between;
+	// the send below does not block, so the lock is held only briefly
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue, exists := d.workers[userID]
+	if !exists {
+		queue = make(chan tgbotapi.Update, WORKER_QUEUE_SIZE)
+		d.workers[userID] = queue
+		d.running.Add(1)
+		go d.work(userID, queue)
+	}
+	select {
+	case queue <- update:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pending returns how many updates are waiting for their workers.
+func (d *dispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := 0
+	for _, queue := range d.workers {
+		pending += len(queue)
+	}
+	return pending
+}
+
+// work processes the user's updates until the queue is closed or stays empty
+// for WORKER_IDLE_TIMEOUT.
+func (d *dispatcher) work(userID int64, queue chan tgbotapi.Update) {
+	defer d.running.Done()
+	idle := time.NewTimer(WORKER_IDLE_TIMEOUT)
+	defer idle.Stop()
+	for {
+		select {
+		case update, ok := <-queue:
+			if !ok {
+				return
+			}
+			d.handle(update)
+			idle.Reset(WORKER_IDLE_TIMEOUT)
+		case <-idle.C:
+			d.mu.Lock()
+			if len(queue) > 0 {
+				d.mu.Unlock()
+				idle.Reset(WORKER_IDLE_TIMEOUT)
+				continue
+			}
+			delete(d.workers, userID)
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close stops accepting updates. Workers finish the updates already queued and exit;
+// Wait reports when they are done.
+func (d *dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for userID, queue := range d.workers {
+		close(queue)
+		delete(d.workers, userID)
+	}
+}
+
+// refuseBusy tells the user their update was dropped because their earlier ones
+// are still being processed.
+func refuseBusy(bot BotAPI, update tgbotapi.Update) {
+	var userID int64
+	if user := update.SentFrom(); user != nil {
+		userID = user.ID
+	}
+	slog.Warn("Очередь пользователя переполнена, сообщение отброшено", "user_id", userID)
+	if query := update.CallbackQuery; query != nil {
+		bot.Request(tgbotapi.NewCallback(query.ID, BUSY_TEXT))
+		return
+	}
+	if chat := update.FromChat(); chat != nil {
+		bot.Send(tgbotapi.NewMessage(chat.ID, BUSY_TEXT))
+	}
+}
+
+// Wait waits up to timeout for the workers to exit and reports whether they did.
+func (d *dispatcher) Wait(timeout time.Duration) bool {
+	return waitGroupTimeout(&d.running, timeout)
+}
@@ -0,0 +1,135 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// messageFrom builds a message update sent by the given user.
+func messageFrom(userID int64, text string) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: userID}, Text: text}}
+}
+
+func TestDispatcherKeepsOrderPerUser(t *testing.T) {
+	const updates = 100
+
+	var mu sync.Mutex
+	var got []string
+	d := newDispatcher(func(update tgbotapi.Update) {
+		mu.Lock()
+		got = append(got, update.Message.Text)
+		mu.Unlock()
+	})
+	for i := range updates {
+		// A full queue refuses the update; the test waits for room instead
+		for !d.Dispatch(messageFrom(1, string(rune('A'+i%26)))) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	d.Close()
+	if !d.Wait(time.Second) {
+		t.Fatal("workers did not finish after Close")
+	}
+
+	if len(got) != updates {
+		t.Fatalf("handled %d updates, want %d", len(got), updates)
+	}
+	for i, text := range got {
+		if want := string(rune('A' + i%26)); text != want {
+			t.Fatalf("update %d is %q, want %q", i, text, want)
+		}
+	}
+}
+
+func TestDispatcherSlowUserDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan int64, 1)
+	d := newDispatcher(func(update tgbotapi.Update) {
+		if update.Message.From.ID == 1 {
+			<-release // A slow provider call
+		}
+		handled <- update.Message.From.ID
+	})
+	defer func() {
+		close(release)
+		d.Close()
+		d.Wait(time.Second)
+	}()
+
+	d.Dispatch(messageFrom(1, "slow"))
+	d.Dispatch(messageFrom(2, "fast"))
+
+	select {
+	case userID := <-handled:
+		if userID != 2 {
+			t.Errorf("first handled update is from user %d, want 2", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update of user 2 waited for user 1")
+	}
+}
+
+func TestDispatcherFullQueueDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan int64, WORKER_QUEUE_SIZE+2)
+	d := newDispatcher(func(update tgbotapi.Update) {
+		if update.Message.From.ID == 1 {
+			<-release // A slow provider call
+		}
+		handled <- update.Message.From.ID
+	})
+	defer func() {
+		close(release)
+		d.Close()
+		d.Wait(time.Second)
+	}()
+
+	// The worker takes the first update, the next ones fill the queue
+	queued := 0
+	for range WORKER_QUEUE_SIZE + 5 {
+		if d.Dispatch(messageFrom(1, "flood")) {
+			queued++
+		}
+	}
+	if queued < WORKER_QUEUE_SIZE || queued > WORKER_QUEUE_SIZE+1 {
+		t.Errorf("queued %d updates of the flooding user, want the queue size", queued)
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- d.Dispatch(messageFrom(2, "fast"))
+		d.Pending()
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("update of user 2 was refused")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispatch for user 2 waited for the full queue of user 1")
+	}
+	select {
+	case userID := <-handled:
+		if userID != 2 {
+			t.Errorf("first handled update is from user %d, want 2", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update of user 2 waited for user 1")
+	}
+}
+
+func TestRefuseBusy(t *testing.T) {
+	bot := &fakeBot{}
+	refuseBusy(bot, messageFrom(1, "flood"))
+	update := messageFrom(1, "flood")
+	update.Message.Chat = &tgbotapi.Chat{ID: 1}
+	refuseBusy(bot, update)
+	refuseBusy(bot, tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{ID: "1", From: &tgbotapi.User{ID: 1}}})
+	if got := strings.Count(bot.texts(), BUSY_TEXT); got != 2 {
+		t.Errorf("busy replies = %d, want for the message in a chat and the button:\n%s", got, bot.texts())
+	}
+}
@@ -0,0 +1,274 @@
+// Package config loads the bot settings from secrets.json and the command line
+// and checks them, so every subcommand starts from the same validated Secrets.
+package config
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"botmailtest/internal/mailer"
+	"botmailtest/internal/state"
+)
+
+const (
+	SECRETS_FILE = "secrets.json"
+	// DEFAULT_LOG_FILE is the log file used when neither a flag nor secrets.json sets one.
+	DEFAULT_LOG_FILE = "bot_errors.log"
+	// DEFAULT_LOG_LEVEL is the level of the bot log when neither --log-level nor log_level is set.
+	DEFAULT_LOG_LEVEL = "info"
+	// MAX_ATTACHMENT_SIZE is the largest file the cloud Bot API lets bots download.
+	// A local Bot API server allows more, see Secrets.AttachmentLimit.
+	MAX_ATTACHMENT_SIZE = 20 * 1024 * 1024
+	// FEATURE_PPROF enables the profiling endpoints on the internal debug server.
+	FEATURE_PPROF = "pprof"
+)
+
+// Secrets holds the API keys, tokens, and other configuration details.
+type Secrets struct {
+	BotToken        string `json:"bot_token"`
+	UnisenderAPIKey string `json:"unisender_api_key"`
+	TargetEmail     string `json:"target_email"` // Target email address
+	SenderEmail     string `json:"sender_email"` // Verified sender email in Unisender
+	LogFile         string `json:"log_file"`     // File for logging errors
+	LogLevel        string `json:"log_level"`    // debug, info (default), warn or error
+
+	LogRotation LogRotation `json:"log_rotation"` // Size limit, retention and compression of the log file
+
+	AdminUserIDs     []int64          `json:"admin_user_ids"`    // Telegram users allowed to run admin commands
+	AllowedUserIDs   []int64          `json:"allowed_user_ids"`  // Users allowed to send; everyone when not set
+	AdminChatID      int64            `json:"admin_chat_id"`     // Chat receiving service notifications such as start and stop
+	Features         map[string]bool  `json:"features"`          // Feature flags, e.g. announce_updates
+	FailureInjection bool             `json:"failure_injection"` // Allow /fail to force failures, for staging only
+	DebugAddr        string           `json:"debug_addr"`        // Debug server address for features.pprof, 127.0.0.1:6060 by default
+	DebugToken       string           `json:"debug_token"`       // Token the debug server requires, as a bearer token or basic auth password
+	Watchdog         WatchdogSettings `json:"watchdog"`          // Memory and goroutine thresholds, with an optional restart
+
+	StatusBoardChatID int64 `json:"status_board_chat_id"` // Chat or channel showing a status board updated every minute, for an office screen
+
+	StorageBackend string               `json:"storage_backend"` // "bolt" (default) or "memory"
+	StorageFile    string               `json:"storage_file"`    // bbolt database file, bot_data.db by default
+	StorageOptions state.StorageOptions `json:"storage_options"` // bbolt tuning
+	BackupKey      string               `json:"backup_key"`      // Passphrase encrypting the archives of /exportdata, which is off without it
+
+	// Local Bot API server settings, e.g. "http://localhost:8081/bot%s/%s" and
+	// "http://localhost:8081/file/bot%s/%s"; the cloud API is used when empty.
+	BotAPIEndpoint    string `json:"bot_api_endpoint"`
+	BotFileEndpoint   string `json:"bot_file_endpoint"`
+	MaxAttachmentSize int    `json:"max_attachment_size"` // Bytes, defaults to the 20 MB cloud limit
+	TempDir           string `json:"temp_dir"`            // Directory for downloaded attachments, attachments_tmp by default
+	TempQuota         int    `json:"temp_quota"`          // Bytes all downloaded attachments may take at once, 500 MB by default
+
+	LogEmails bool `json:"log_emails"` // Write email addresses to logs unmasked
+
+	Fingerprint bool `json:"fingerprint"` // Mark every letter with an invisible ID /trace finds the send by
+
+	TelegramDebug    bool   `json:"telegram_debug"`     // Log every Bot API request and response
+	TelegramLogLevel string `json:"telegram_log_level"` // Level of the Telegram library entries, see TelegramLevel
+
+	SurveyRate float64 `json:"survey_rate"` // Share of successful sends followed by a satisfaction survey, 0..1
+	Timezone   string  `json:"timezone"`    // IANA timezone users enter dates in, server local time by default
+
+	SessionTimeout string `json:"session_timeout"` // Idle time after which a draft is discarded, e.g. "30m"; 30m by default, never when "0"
+
+	MailTesterUsername string `json:"mail_tester_username"` // mail-tester.com account for /spamcheck
+
+	EmailProvider string                 `json:"email_provider"` // "unisender" (default), "smtp" or "mailgun"
+	SMTP          mailer.SMTPSettings    `json:"smtp"`           // SMTP server used when email_provider is "smtp"
+	Mailgun       mailer.MailgunSettings `json:"mailgun"`        // Mailgun domain used when email_provider is "mailgun"
+	SendRetry     mailer.RetryPolicy     `json:"send_retry"`     // Retries of sendEmail after network and server errors
+
+	SendConcurrency int `json:"send_concurrency"` // Letters handed to the provider at once, unlimited when 0
+
+	FieldRules    map[Field][]FieldRule   `json:"field_rules"`    // Custom validation rules for wizard fields
+	LanguageRules map[string]LanguageRule `json:"language_rules"` // Subject tags and recipients by body language ("ru", "en")
+	TagRules      map[string]TagRule      `json:"tag_rules"`      // Recipients, copies and subject prefixes by importance tag
+	Aliases       map[string][]string     `json:"aliases"`        // Shared recipient names usable instead of addresses, e.g. "бухгалтерия"
+	Delegations   []Delegation            `json:"delegations"`    // Assistants who may send letters on behalf of managers
+	RateLimit     RateLimit               `json:"rate_limit"`     // Letters per hour per user and per day for the whole bot
+	Normalize     NormalizeRules          `json:"normalize"`      // Clean-ups of the subject and body before sending
+	GuestMode     GuestMode               `json:"guest_mode"`     // Letters of users without access, sent after an administrator approves each
+	Probes        ProbeSettings           `json:"probes"`         // Daily summary of access attempts and banning of persistent ones
+
+	ReplyTemplates map[string]map[string]string `json:"reply_templates"` // Reply wording overrides: locale -> event -> template
+}
+
+// Load reads configuration details from a JSON file.
+func Load(filename string) (*Secrets, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		// If secrets file is not found, it's not necessarily an error if using command line args
+		slog.Warn("Файл секретов не найден или ошибка чтения, используются аргументы командной строки", "file", filename, "error", err)
+		return &Secrets{}, nil // Return empty secrets struct, validation will happen later
+	}
+
+	var secrets Secrets
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("ошибка разбора файла %s: %w", filename, err)
+	}
+
+	return &secrets, nil
+}
+
+// Flags holds the command-line overrides of secrets.json shared by subcommands.
+type Flags struct {
+	botToken        *string
+	unisenderAPIKey *string
+	targetEmail     *string
+	senderEmail     *string
+	logFile         *string
+	logLevel        *string
+}
+
+// AddFlags defines the configuration flags on a subcommand's flag set.
+func AddFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		botToken:        fs.String("bot-token", "", "Токен Telegram бота"),
+		unisenderAPIKey: fs.String("unisender-api-key", "", "API ключ Unisender"),
+		targetEmail:     fs.String("target-email", "", "Email получателя"),
+		senderEmail:     fs.String("sender-email", "", "Email отправителя"),
+		logFile:         fs.String("log-file", "", "Файл для логов (по умолчанию "+DEFAULT_LOG_FILE+")"),
+		logLevel:        fs.String("log-level", "", "Уровень логирования: debug, info, warn или error (по умолчанию "+DEFAULT_LOG_LEVEL+")"),
+	}
+}
+
+// Resolve loads secrets.json and applies the command-line overrides on top of it.
+func (f *Flags) Resolve() (*Secrets, error) {
+	secrets, err := Load(SECRETS_FILE)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use command-line arguments if provided, otherwise use secrets from file
+	secrets.BotToken = cmp.Or(*f.botToken, secrets.BotToken)
+	secrets.UnisenderAPIKey = cmp.Or(*f.unisenderAPIKey, secrets.UnisenderAPIKey)
+	secrets.TargetEmail = cmp.Or(*f.targetEmail, secrets.TargetEmail)
+	secrets.SenderEmail = cmp.Or(*f.senderEmail, secrets.SenderEmail)
+	secrets.LogFile = cmp.Or(*f.logFile, secrets.LogFile, DEFAULT_LOG_FILE)
+	secrets.LogLevel = cmp.Or(*f.logLevel, secrets.LogLevel, DEFAULT_LOG_LEVEL)
+	return secrets, nil
+}
+
+// Validate checks that the settings required to run the bot are present.
+func (s *Secrets) Validate() error {
+	var errs []error
+	if s.BotToken == "" {
+		errs = append(errs, errors.New("Не указан токен Telegram бота. Используйте аргумент --bot-token или файл secrets.json."))
+	}
+	if err := s.ValidateProvider(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.validateDebug(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.Watchdog.CheckInterval(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseLogLevel(cmp.Or(s.LogLevel, DEFAULT_LOG_LEVEL)); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.LogRotation.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.TelegramLevel(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.validateAliases(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.validateDelegations(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.RateLimit.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.SendConcurrency < 0 {
+		errs = append(errs, errors.New("Параметр send_concurrency не может быть отрицательным."))
+	}
+	if err := s.Normalize.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.validateGuestMode(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Probes.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.IdleTimeout(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.TargetEmail == "" {
+		errs = append(errs, errors.New("Не указан email получателя. Используйте аргумент --target-email или файл secrets.json."))
+	}
+	if s.SenderEmail == "" {
+		errs = append(errs, errors.New("Не указан email отправителя. Используйте аргумент --sender-email или файл secrets.json."))
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateProvider checks the settings the selected email provider needs.
+func (s *Secrets) ValidateProvider() error {
+	_, err := mailer.New(s.EmailProvider, s.UnisenderAPIKey, s.SMTP, s.Mailgun)
+	return err
+}
+
+// validateDebug checks that profiling is never exposed without a token.
+func (s *Secrets) validateDebug() error {
+	if s.Features[FEATURE_PPROF] && s.DebugToken == "" {
+		return errors.New("Для профилирования (features.pprof) нужен debug_token.")
+	}
+	return nil
+}
+
+// ParseLogLevel parses a level name: debug, info, warn or error.
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("неизвестный уровень логирования %q, допустимы debug, info, warn и error", name)
+	}
+	return level, nil
+}
+
+// TelegramLevel returns the level of the Telegram library entries: telegram_log_level
+// when set, otherwise debug with telegram_debug on and warn without it.
+func (s *Secrets) TelegramLevel() (slog.Level, error) {
+	switch {
+	case s.TelegramLogLevel != "":
+		return ParseLogLevel(s.TelegramLogLevel)
+	case s.TelegramDebug:
+		return slog.LevelDebug, nil
+	}
+	return slog.LevelWarn, nil
+}
+
+// Location returns the configured timezone, falling back to the server's local time.
+func (s *Secrets) Location() *time.Location {
+	if s.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		slog.Warn("Неизвестный часовой пояс, используется местное время сервера", "timezone", s.Timezone, "error", err)
+		return time.Local
+	}
+	return loc
+}
+
+// AttachmentLimit returns the configured attachment size limit or the cloud Bot API default.
+func (s *Secrets) AttachmentLimit() int {
+	if s.MaxAttachmentSize > 0 {
+		return s.MaxAttachmentSize
+	}
+	return MAX_ATTACHMENT_SIZE
+}
+
+// IsAdmin reports whether the user is listed in admin_user_ids.
+func (s *Secrets) IsAdmin(userID int64) bool {
+	return slices.Contains(s.AdminUserIDs, userID)
+}
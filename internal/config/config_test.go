@@ -0,0 +1,201 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SECRETS_FILE)
+	data := `{"bot_token": "123:TEST", "email_provider": "smtp", "smtp": {"host": "smtp.example.com"}, "rate_limit": {"per_hour": 5}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets.BotToken != "123:TEST" || secrets.SMTP.Host != "smtp.example.com" || secrets.RateLimit.PerHour != 5 {
+		t.Errorf("Load = %+v", secrets)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("malformed file loaded")
+	}
+	// Without the file everything comes from the flags
+	if secrets, err := Load(filepath.Join(t.TempDir(), SECRETS_FILE)); err != nil || secrets.BotToken != "" {
+		t.Errorf("Load of a missing file = %+v, %v", secrets, err)
+	}
+}
+
+func TestValidateReportsEverySetting(t *testing.T) {
+	secrets := &Secrets{BotToken: "123:TEST", UnisenderAPIKey: "key", TargetEmail: "office@example.com", SenderEmail: "bot@example.com"}
+	if err := secrets.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	secrets.RateLimit.PerHour = -1
+	secrets.Delegations = []Delegation{{ManagerID: 1}}
+	secrets.SendConcurrency = -1
+	err := secrets.Validate()
+	if err == nil {
+		t.Fatal("broken settings passed validation")
+	}
+	if got := len(err.(interface{ Unwrap() []error }).Unwrap()); got != 3 {
+		t.Errorf("Validate reported %d problems, want 3: %v", got, err)
+	}
+}
+
+func TestTelegramLogLevel(t *testing.T) {
+	tests := []struct {
+		secrets Secrets
+		want    slog.Level
+	}{
+		{Secrets{}, slog.LevelWarn},
+		{Secrets{TelegramDebug: true}, slog.LevelDebug},
+		{Secrets{TelegramDebug: true, TelegramLogLevel: "info"}, slog.LevelInfo},
+		{Secrets{TelegramLogLevel: "ERROR"}, slog.LevelError},
+	}
+	for _, tt := range tests {
+		if got, err := tt.secrets.TelegramLevel(); err != nil || got != tt.want {
+			t.Errorf("TelegramLevel(%+v) = %v, %v; want %v", tt.secrets, got, err, tt.want)
+		}
+	}
+	if _, err := (&Secrets{TelegramLogLevel: "verbose"}).TelegramLevel(); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestPprofNeedsToken(t *testing.T) {
+	secrets := &Secrets{Features: map[string]bool{FEATURE_PPROF: true}}
+	if secrets.validateDebug() == nil {
+		t.Error("pprof enabled without debug_token passed validation")
+	}
+	secrets.DebugToken = "s3cret"
+	if err := secrets.validateDebug(); err != nil {
+		t.Errorf("validateDebug: %v", err)
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	for _, tt := range []struct {
+		limit RateLimit
+		ok    bool
+	}{
+		{RateLimit{}, true},
+		{RateLimit{PerHour: 5, Burst: 10, DailyCap: 100}, true},
+		{RateLimit{DailyCap: 100}, true},
+		{RateLimit{PerHour: -1}, false},
+		{RateLimit{Burst: 3}, false},
+	} {
+		if err := tt.limit.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v", tt.limit, err)
+		}
+	}
+}
+
+func TestNormalizeRulesValidate(t *testing.T) {
+	for _, tt := range []struct {
+		params []string
+		ok     bool
+	}{
+		{nil, true},
+		{[]string{"utm_*", "fbclid", "ref"}, true},
+		{[]string{""}, false},
+		{[]string{"*"}, false},
+		{[]string{"utm_*_id"}, false},
+		{[]string{"ref=tg"}, false},
+	} {
+		rules := NormalizeRules{StripTrackingParams: true, TrackingParams: tt.params}
+		if err := rules.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%q) = %v", tt.params, err)
+		}
+	}
+}
+
+func TestGuestModeValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		secrets Secrets
+		ok      bool
+	}{
+		{"off", Secrets{}, true},
+		{"on", Secrets{AdminUserIDs: []int64{1}, AllowedUserIDs: []int64{2}, GuestMode: GuestMode{Enabled: true}}, true},
+		{"no admins", Secrets{AllowedUserIDs: []int64{2}, GuestMode: GuestMode{Enabled: true}}, false},
+		{"open bot", Secrets{AdminUserIDs: []int64{1}, GuestMode: GuestMode{Enabled: true}}, false},
+		{"negative", Secrets{AdminUserIDs: []int64{1}, AllowedUserIDs: []int64{}, GuestMode: GuestMode{Enabled: true, PromoteAfter: -1}}, false},
+	} {
+		if err := tt.secrets.validateGuestMode(); (err == nil) != tt.ok {
+			t.Errorf("%s: validateGuestMode() = %v", tt.name, err)
+		}
+	}
+	if got := (GuestMode{}).PromotionThreshold(); got != DEFAULT_GUEST_PROMOTE_AFTER {
+		t.Errorf("default PromotionThreshold() = %d", got)
+	}
+}
+
+func TestProbeSettingsValidate(t *testing.T) {
+	for _, tt := range []struct {
+		settings ProbeSettings
+		ok       bool
+	}{
+		{ProbeSettings{}, true},
+		{ProbeSettings{SummaryAt: "18:30", BanAfter: 20}, true},
+		{ProbeSettings{SummaryAt: "6 pm"}, false},
+		{ProbeSettings{SummaryAt: "25:00"}, false},
+		{ProbeSettings{BanAfter: -1}, false},
+	} {
+		if err := tt.settings.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v", tt.settings, err)
+		}
+	}
+	if hour, minute, _ := (ProbeSettings{}).SummaryClock(); hour != 9 || minute != 0 {
+		t.Errorf("default SummaryClock() = %d:%d", hour, minute)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", DEFAULT_SESSION_TIMEOUT, true},
+		{"45m", 45 * time.Minute, true},
+		{"0", 0, true},
+		{"-1m", 0, false},
+		{"полчаса", 0, false},
+	} {
+		secrets := &Secrets{SessionTimeout: tt.value}
+		if got, err := secrets.IdleTimeout(); got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("IdleTimeout(%q) = %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestAliasesValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		aliases map[string][]string
+		ok      bool
+	}{
+		{"none", nil, true},
+		{"valid", map[string][]string{"бухгалтерия": {"accounting@example.com", "Главбух <chief@example.com>"}}, true},
+		{"no addresses", map[string][]string{"бухгалтерия": nil}, false},
+		{"bad address", map[string][]string{"бухгалтерия": {"accounting"}}, false},
+		{"comma in name", map[string][]string{"бухгалтерия, склад": {"accounting@example.com"}}, false},
+		{"blank name", map[string][]string{" ": {"accounting@example.com"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Secrets{Aliases: tc.aliases}).validateAliases()
+			if (err == nil) != tc.ok {
+				t.Errorf("validateAliases = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
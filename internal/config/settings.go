@@ -0,0 +1,283 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_WATCHDOG_INTERVAL is how often the watchdog samples memory when
+// watchdog.interval is not set.
+const DEFAULT_WATCHDOG_INTERVAL = time.Minute
+
+// LogRotation configures rotation of the log file from log_rotation in secrets.json.
+type LogRotation struct {
+	MaxSizeMB  int  `json:"max_size_mb"`  // Size the file is rotated at, 100 MB by default
+	MaxBackups int  `json:"max_backups"`  // Rotated files kept, all when 0
+	MaxAgeDays int  `json:"max_age_days"` // Rotated files older than this are removed, never when 0
+	Compress   bool `json:"compress"`     // Gzip rotated files
+}
+
+// Validate checks that the limits are not negative.
+func (r LogRotation) Validate() error {
+	if r.MaxSizeMB < 0 || r.MaxBackups < 0 || r.MaxAgeDays < 0 {
+		return errors.New("Параметры log_rotation не могут быть отрицательными.")
+	}
+	return nil
+}
+
+// WatchdogSettings configure the memory watchdog from watchdog in secrets.json.
+// The watchdog runs when at least one threshold is set.
+type WatchdogSettings struct {
+	MaxHeapMB     int    `json:"max_heap_mb"`    // Heap in use after a GC that counts as a leak
+	MaxGoroutines int    `json:"max_goroutines"` // Goroutine count that counts as a leak
+	Interval      string `json:"interval"`       // How often to check, e.g. "30s"; 1m by default
+	Restart       bool   `json:"restart"`        // Drain and restart the bot once a leak persists
+}
+
+// Enabled reports whether any threshold is set.
+func (w WatchdogSettings) Enabled() bool {
+	return w.MaxHeapMB > 0 || w.MaxGoroutines > 0
+}
+
+// CheckInterval parses Interval, falling back to DEFAULT_WATCHDOG_INTERVAL.
+func (w WatchdogSettings) CheckInterval() (time.Duration, error) {
+	if w.Interval == "" {
+		return DEFAULT_WATCHDOG_INTERVAL, nil
+	}
+	interval, err := time.ParseDuration(w.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("некорректный watchdog.interval %q", w.Interval)
+	}
+	return interval, nil
+}
+
+// Field identifies a wizard field that user input is collected for.
+type Field string
+
+// FieldRule is a regular-expression validation rule configured in secrets.json.
+type FieldRule struct {
+	Pattern string `json:"pattern"` // Value must match this regular expression
+	Message string `json:"message"` // Text shown to the user when it does not
+}
+
+// LanguageRule configures how emails written in a given language are tagged and routed.
+type LanguageRule struct {
+	SubjectTag  string `json:"subject_tag"`  // Prepended to the subject, e.g. "[RU]"
+	TargetEmail string `json:"target_email"` // Replaces the default recipient when set
+}
+
+// TagRule configures how letters with an importance tag are routed.
+type TagRule struct {
+	// Recipients replace the default recipient, or are added to the addresses the user typed
+	Recipients    []string `json:"recipients"`
+	CC            []string `json:"cc"`             // Always get a copy of the letter
+	SubjectPrefix string   `json:"subject_prefix"` // Prepended to the subject, e.g. "[Срочно]"
+}
+
+// TagNames returns the configured tags in a stable order for the buttons.
+func (s *Secrets) TagNames() []string {
+	names := make([]string, 0, len(s.TagRules))
+	for name := range s.TagRules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// AliasNames returns the configured recipient aliases in a stable order for the buttons.
+func (s *Secrets) AliasNames() []string {
+	names := make([]string, 0, len(s.Aliases))
+	for name := range s.Aliases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateAliases checks that every alias is a name that can be typed among
+// comma-separated recipients and stands for valid addresses.
+func (s *Secrets) validateAliases() error {
+	for _, name := range s.AliasNames() {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, ",@") {
+			return fmt.Errorf("Псевдоним %q в aliases не может быть пустым или содержать запятую и @.", name)
+		}
+		if len(s.Aliases[name]) == 0 {
+			return fmt.Errorf("Для псевдонима «%s» в aliases не указано ни одного адреса.", name)
+		}
+		for _, address := range s.Aliases[name] {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return fmt.Errorf("Некорректный адрес псевдонима «%s» в aliases: %s", name, address)
+			}
+		}
+	}
+	return nil
+}
+
+// Delegation lets assistants send letters on behalf of a manager, each one
+// approved by the manager. It is configured in delegations in secrets.json.
+type Delegation struct {
+	ManagerID   int64   `json:"manager_id"`
+	ManagerName string  `json:"manager_name"` // Shown to the assistants
+	Assistants  []int64 `json:"assistants"`   // Telegram users who may ask
+}
+
+// ManagerLabel names the manager for the assistant.
+func (d Delegation) ManagerLabel() string {
+	return cmp.Or(d.ManagerName, "ID "+strconv.FormatInt(d.ManagerID, 10))
+}
+
+// validateDelegations checks that every delegation names a manager and assistants.
+func (s *Secrets) validateDelegations() error {
+	for i, d := range s.Delegations {
+		if d.ManagerID == 0 || len(d.Assistants) == 0 {
+			return fmt.Errorf("В delegations[%d] нужны manager_id и хотя бы один помощник в assistants.", i)
+		}
+		if slices.Contains(d.Assistants, d.ManagerID) {
+			return fmt.Errorf("В delegations[%d] руководитель %d указан своим же помощником.", i, d.ManagerID)
+		}
+	}
+	return nil
+}
+
+// ManagersOf returns the delegations the user is an assistant in.
+func (s *Secrets) ManagersOf(userID int64) []Delegation {
+	var managers []Delegation
+	for _, d := range s.Delegations {
+		if slices.Contains(d.Assistants, userID) {
+			managers = append(managers, d)
+		}
+	}
+	return managers
+}
+
+// RateLimit configures how many letters may be sent, from rate_limit in secrets.json.
+// Both limits are token buckets: the allowance is spent by sends and regained
+// evenly over the period.
+type RateLimit struct {
+	PerHour  int `json:"per_hour"`  // Letters each user may send per hour, unlimited when 0
+	Burst    int `json:"burst"`     // Letters a user may send in a row, per_hour by default
+	DailyCap int `json:"daily_cap"` // Letters all users together may send per day, unlimited when 0
+}
+
+// Validate checks that the limits are not negative and burst has a pace to refill at.
+func (r RateLimit) Validate() error {
+	if r.PerHour < 0 || r.Burst < 0 || r.DailyCap < 0 {
+		return errors.New("Параметры rate_limit не могут быть отрицательными.")
+	}
+	if r.Burst > 0 && r.PerHour == 0 {
+		return errors.New("Параметр rate_limit.burst задаётся вместе с rate_limit.per_hour.")
+	}
+	return nil
+}
+
+// NormalizeRules are the clean-ups applied to the subject and body of a letter
+// before it is sent. The preview shows what they change, and the user can turn
+// them off for a single letter.
+type NormalizeRules struct {
+	CollapseWhitespace   bool     `json:"collapse_whitespace"`    // Trim lines, collapse runs of spaces and of blank lines
+	StripTrackingParams  bool     `json:"strip_tracking_params"`  // Remove tracking parameters from the query of links
+	TrackingParams       []string `json:"tracking_params"`        // Parameters removed from links, "utm_*" matches a prefix; a common list when empty
+	FixPunctuationSpaces bool     `json:"fix_punctuation_spaces"` // Remove spaces before punctuation and double spaces after it
+}
+
+// Enabled reports whether any rule is turned on.
+func (n NormalizeRules) Enabled() bool {
+	return n.CollapseWhitespace || n.StripTrackingParams || n.FixPunctuationSpaces
+}
+
+// Validate checks that the listed tracking parameters are names or prefixes.
+func (n NormalizeRules) Validate() error {
+	for _, param := range n.TrackingParams {
+		name := strings.TrimSuffix(param, "*")
+		if name == "" || strings.ContainsAny(name, "*=&?# ") {
+			return fmt.Errorf("Некорректный параметр в normalize.tracking_params: %q. Укажите имя параметра или префикс со звёздочкой, например utm_*.", param)
+		}
+	}
+	return nil
+}
+
+// DEFAULT_GUEST_PROMOTE_AFTER is how many approved letters make the approval card
+// offer to open access to the guest when guest_mode.promote_after is not set.
+const DEFAULT_GUEST_PROMOTE_AFTER = 3
+
+// GuestMode lets users outside allowed_user_ids compose letters, each of which an
+// administrator approves before it is sent, from guest_mode in secrets.json.
+type GuestMode struct {
+	Enabled      bool `json:"enabled"`
+	PromoteAfter int  `json:"promote_after"` // Approved letters after which the card offers access, 3 by default
+}
+
+// PromotionThreshold returns how many approved letters make the guest eligible for access.
+func (g GuestMode) PromotionThreshold() int {
+	return cmp.Or(g.PromoteAfter, DEFAULT_GUEST_PROMOTE_AFTER)
+}
+
+// validateGuestMode checks that there is someone to approve guest letters and
+// someone to be a guest.
+func (s *Secrets) validateGuestMode() error {
+	switch {
+	case !s.GuestMode.Enabled:
+		return nil
+	case s.GuestMode.PromoteAfter < 0:
+		return errors.New("Параметр guest_mode.promote_after не может быть отрицательным.")
+	case len(s.AdminUserIDs) == 0:
+		return errors.New("Для guest_mode нужен хотя бы один администратор в admin_user_ids: он одобряет письма гостей.")
+	case s.AllowedUserIDs == nil:
+		return errors.New("Для guest_mode нужен список allowed_user_ids: без него бот открыт всем и гостей нет.")
+	}
+	return nil
+}
+
+// DEFAULT_PROBE_SUMMARY_AT is the time of the daily access attempts summary when
+// probes.summary_at is not set.
+const DEFAULT_PROBE_SUMMARY_AT = "09:00"
+
+// ProbeSettings configures the report on access attempts, from probes in secrets.json:
+// messages from users without access and requests with a wrong debug_token.
+type ProbeSettings struct {
+	SummaryAt string `json:"summary_at"` // Time of day the summary goes to admin_chat_id, 09:00 by default
+	BanAfter  int    `json:"ban_after"`  // Attempts a day after which a user or address is ignored, never when 0
+}
+
+// SummaryClock parses SummaryAt as hours and minutes in the bot's time zone.
+func (p ProbeSettings) SummaryClock() (hour, minute int, err error) {
+	at, err := time.Parse("15:04", cmp.Or(p.SummaryAt, DEFAULT_PROBE_SUMMARY_AT))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Некорректное время probes.summary_at %q, укажите его как 09:00.", p.SummaryAt)
+	}
+	return at.Hour(), at.Minute(), nil
+}
+
+// Validate checks the summary time and that the ban threshold is not negative.
+func (p ProbeSettings) Validate() error {
+	if _, _, err := p.SummaryClock(); err != nil {
+		return err
+	}
+	if p.BanAfter < 0 {
+		return errors.New("Параметр probes.ban_after не может быть отрицательным.")
+	}
+	return nil
+}
+
+// DEFAULT_SESSION_TIMEOUT is how long a draft may stay untouched when
+// session_timeout is not set.
+const DEFAULT_SESSION_TIMEOUT = 30 * time.Minute
+
+// IdleTimeout parses SessionTimeout, falling back to DEFAULT_SESSION_TIMEOUT.
+// Zero means drafts are never discarded.
+func (s *Secrets) IdleTimeout() (time.Duration, error) {
+	if s.SessionTimeout == "" {
+		return DEFAULT_SESSION_TIMEOUT, nil
+	}
+	timeout, err := time.ParseDuration(s.SessionTimeout)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Некорректный session_timeout %q, укажите его как 30m или 0, чтобы не удалять черновики.", s.SessionTimeout)
+	}
+	return timeout, nil
+}
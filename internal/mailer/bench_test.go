@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// memoryTransport answers Unisender requests from memory, so benchmarks measure
+// the mailer rather than the network.
+type memoryTransport struct{}
+
+func (memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	body := `{"result":[{"index":0,"email":"office@example.com","id":"1"}]}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// reportBufferReuse adds the share of mailer buffers taken from the pool rather
+// than allocated to the benchmark results.
+func reportBufferReuse(b *testing.B, taken, allocated int64) {
+	taken, allocated = bufferStats.taken.Load()-taken, bufferStats.allocated.Load()-allocated
+	if taken > 0 {
+		b.ReportMetric(100*float64(taken-min(allocated, taken))/float64(taken), "%reused")
+	}
+}
+
+// letterBodies are an everyday letter and the large HTML of a mail merge.
+var letterBodies = []struct {
+	name string
+	body string
+}{
+	{"2KB", strings.Repeat("<p>Текст письма с <b>разметкой</b>.</p>\n", 50)},
+	{"1MB", strings.Repeat("<tr><td>Строка таблицы рассылки</td><td>user@example.com</td></tr>\n", 12000)},
+}
+
+func BenchmarkUnisenderRequest(b *testing.B) {
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = memoryTransport{}
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { http.DefaultTransport = defaultTransport; log.SetOutput(output) })
+	sender := &UnisenderSender{APIKey: "api-key"}
+	ctx := context.Background()
+
+	for _, letter := range letterBodies {
+		b.Run(letter.name, func(b *testing.B) {
+			taken, allocated := bufferStats.taken.Load(), bufferStats.allocated.Load()
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := sender.SendEmail(ctx, "office@example.com", Copies{}, "me@example.com", "Отчёт за май", letter.body, "Иван"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportBufferReuse(b, taken, allocated)
+		})
+	}
+}
+
+func BenchmarkSMTPMessage(b *testing.B) {
+	attachment := Attachment{Name: "report.pdf", Data: make([]byte, 256<<10)}
+	for _, letter := range letterBodies {
+		b.Run(letter.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := writeMessage(io.Discard, "1@example.com", "me@example.com", "Иван", []string{"office@example.com"}, nil, "Отчёт за май", letter.body, []Attachment{attachment}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
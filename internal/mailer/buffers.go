@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// MAX_POOLED_BUFFER_SIZE is the largest buffer returned to the pool. A buffer grown
+// by one huge letter is left to the GC rather than kept alive for small ones.
+const MAX_POOLED_BUFFER_SIZE = 4 << 20
+
+// bufferPool holds the buffers mailers encode requests and messages into. Large HTML
+// bodies grow several times when encoded, and without reuse every send of a merge
+// allocated those megabytes anew.
+var bufferPool = sync.Pool{New: func() any {
+	bufferStats.allocated.Add(1)
+	return new(bytes.Buffer)
+}}
+
+// bufferStats counts pool use, shown by /memstats to verify buffers are reused.
+var bufferStats struct {
+	taken     atomic.Int64 // Buffers handed out
+	allocated atomic.Int64 // Buffers created because the pool was empty
+	dropped   atomic.Int64 // Buffers not returned for being too large
+}
+
+// BufferCounts is a snapshot of the buffer pool counters.
+type BufferCounts struct {
+	Taken, Allocated, Dropped int64
+}
+
+// BufferStats returns the buffer pool counters.
+func BufferStats() BufferCounts {
+	return BufferCounts{Taken: bufferStats.taken.Load(), Allocated: bufferStats.allocated.Load(), Dropped: bufferStats.dropped.Load()}
+}
+
+// getBuffer takes an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	bufferStats.taken.Add(1)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to the pool. The caller must not use it afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > MAX_POOLED_BUFFER_SIZE {
+		bufferStats.dropped.Add(1)
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// pooledBody is a request body read from a pooled buffer. The transport may close
+// the body after the request returns, so the buffer goes back to the pool on Close
+// rather than when the caller is done.
+type pooledBody struct {
+	*bytes.Reader
+	once sync.Once
+	buf  *bytes.Buffer
+}
+
+// newPooledBody makes a request body of the buffer's contents.
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+// Close returns the buffer to the pool; later calls do nothing.
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putBuffer(b.buf) })
+	return nil
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"bytes"
+	"mime/multipart"
+	"regexp"
+	"strings"
+	"testing"
+
+	"botmailtest/internal/testutil"
+)
+
+// The golden files in testdata/golden hold letters exactly as the mailers hand them
+// on, so a change to what recipients get shows up as a diff in review. After an
+// intended change, rewrite them with UPDATE_GOLDEN=1 go test ./... and check the diff.
+
+var (
+	datePattern     = regexp.MustCompile(`(?m)^Date: .*$`)
+	boundaryPattern = regexp.MustCompile(`boundary=([0-9a-f]+)`)
+)
+
+// stableMessage replaces the parts of a rendered letter that change on every send,
+// the date and the MIME boundary, and turns CRLF into plain line ends for the file.
+func stableMessage(message string) string {
+	message = datePattern.ReplaceAllString(message, "Date: <date>\r")
+	if m := boundaryPattern.FindStringSubmatch(message); m != nil {
+		message = strings.ReplaceAll(message, m[1], "BOUNDARY")
+	}
+	return strings.ReplaceAll(message, "\r\n", "\n")
+}
+
+// goldenLetter is one letter rendered by every golden test.
+type goldenLetter struct {
+	name        string
+	senderName  string
+	to          []string
+	copies      Copies
+	subject     string
+	body        string
+	attachments []Attachment
+}
+
+var goldenLetters = []goldenLetter{
+	{
+		name:       "plain",
+		senderName: "Иван Петров",
+		to:         []string{"office@example.com"},
+		subject:    "Отчёт за май",
+		body:       "<p>Добрый день!</p>\n<p>Отчёт во вложении.</p>",
+	},
+	{
+		name:       "copies",
+		senderName: `Отдел "Продажи"`,
+		to:         []string{"a@example.com", "b@example.com"},
+		copies:     Copies{CC: []string{"boss@example.com"}, BCC: []string{"archive@example.com"}},
+		subject:    "[Срочно] Встреча в 15:00",
+		body:       `<div style="display:none;max-height:0;overflow:hidden;mso-hide:all">Коротко</div><p><b>Встреча</b> переносится.</p>`,
+	},
+	{
+		name:       "attachments",
+		senderName: "Bot",
+		to:         []string{"office@example.com"},
+		subject:    "Report",
+		body:       strings.Repeat("<p>Длинная строка письма, которая не помещается в одну строку base64.</p>", 3),
+		attachments: []Attachment{
+			{Name: "отчёт.txt", Data: []byte("Итоги месяца\n")},
+			{Name: "report.pdf", Data: []byte("%PDF-1.4\n%%EOF\n")},
+		},
+	},
+}
+
+func TestSMTPMessageGolden(t *testing.T) {
+	for _, letter := range goldenLetters {
+		t.Run(letter.name, func(t *testing.T) {
+			var message strings.Builder
+			err := writeMessage(&message, "0123456789abcdef@example.com", "sender@example.com", letter.senderName,
+				letter.to, letter.copies.CC, letter.subject, letter.body, letter.attachments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bare := strings.Count(message.String(), "\n") - strings.Count(message.String(), "\r\n"); bare != 0 {
+				t.Errorf("%d lines end without CR", bare)
+			}
+			testutil.CheckGolden(t, "smtp_"+letter.name+".eml", stableMessage(message.String()))
+		})
+	}
+}
+
+func TestMailgunFormGolden(t *testing.T) {
+	for _, letter := range goldenLetters {
+		t.Run(letter.name, func(t *testing.T) {
+			var request bytes.Buffer
+			form := multipart.NewWriter(&request)
+			form.SetBoundary("BOUNDARY")
+			err := writeMailgunForm(form, "sender@example.com", letter.senderName, letter.to, letter.copies,
+				letter.subject, letter.body, letter.attachments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckGolden(t, "mailgun_"+letter.name+".txt", stableMessage(request.String()))
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MAX_IDLE_CONNS_PER_HOST is how many idle connections to one API are kept open.
+	// The default of 2 made concurrent sends to the same provider reconnect each time.
+	MAX_IDLE_CONNS_PER_HOST = 16
+	// IDLE_CONN_TIMEOUT is how long an unused connection is kept for the next send.
+	IDLE_CONN_TIMEOUT = 90 * time.Second
+	// TLS_SESSION_CACHE_SIZE is how many TLS sessions are kept for resumption, which
+	// saves a round trip when a connection has to be opened again.
+	TLS_SESSION_CACHE_SIZE = 64
+)
+
+// connStats counts how requests to the email providers got their connections,
+// shown by /netstats to verify that bursts of sends reuse them.
+var connStats struct {
+	opened  atomic.Int64 // New connections
+	reused  atomic.Int64 // Idle or multiplexed connections used again
+	resumed atomic.Int64 // New connections that resumed a TLS session
+	http2   atomic.Int64 // New connections that negotiated HTTP/2
+}
+
+// ConnCounts is a snapshot of the connection counters.
+type ConnCounts struct {
+	Opened, Reused, Resumed, HTTP2 int64
+}
+
+// ConnStats returns the connection counters.
+func ConnStats() ConnCounts {
+	return ConnCounts{Opened: connStats.opened.Load(), Reused: connStats.reused.Load(), Resumed: connStats.resumed.Load(), HTTP2: connStats.http2.Load()}
+}
+
+// ConfigureHTTPTransport tunes http.DefaultTransport, which the provider clients,
+// file downloads and the Bot API client all use, for keep-alive and resumption.
+// It must run before anything wraps the transport, such as failure injection.
+func ConfigureHTTPTransport() {
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		http.DefaultTransport = tuneTransport(transport)
+	}
+}
+
+// tuneTransport returns a copy of the transport with pooling, TLS session
+// resumption and HTTP/2 enabled.
+func tuneTransport(base *http.Transport) *http.Transport {
+	transport := base.Clone()
+	transport.MaxIdleConns = max(transport.MaxIdleConns, 4*MAX_IDLE_CONNS_PER_HOST)
+	transport.MaxIdleConnsPerHost = MAX_IDLE_CONNS_PER_HOST
+	transport.IdleConnTimeout = IDLE_CONN_TIMEOUT
+	// A custom TLS config turns off HTTP/2 unless it is asked for explicitly
+	transport.ForceAttemptHTTP2 = true
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(TLS_SESSION_CACHE_SIZE)
+	return transport
+}
+
+// traceConnections returns a context whose requests are counted in connStats.
+func traceConnections(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				connStats.reused.Add(1)
+			} else {
+				connStats.opened.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			if state.DidResume {
+				connStats.resumed.Add(1)
+			}
+			if state.NegotiatedProtocol == "h2" {
+				connStats.http2.Add(1)
+			}
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTunedTransportReusesConnections(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	transport := tuneTransport(server.Client().Transport.(*http.Transport))
+	client := &http.Client{Transport: transport}
+
+	get := func() string {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(traceConnections(context.Background()), http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		proto, _ := io.ReadAll(resp.Body)
+		return string(proto)
+	}
+
+	opened, reused, resumed, http2 := connStats.opened.Load(), connStats.reused.Load(), connStats.resumed.Load(), connStats.http2.Load()
+	for range 3 {
+		if proto := get(); proto != "HTTP/2.0" {
+			t.Fatalf("request went over %s, want HTTP/2.0", proto)
+		}
+	}
+	if got := connStats.opened.Load() - opened; got != 1 {
+		t.Errorf("3 sequential requests opened %d connections, want 1", got)
+	}
+	if got := connStats.reused.Load() - reused; got != 2 {
+		t.Errorf("reused %d connections, want 2", got)
+	}
+	if got := connStats.http2.Load() - http2; got != 1 {
+		t.Errorf("%d connections negotiated HTTP/2, want 1", got)
+	}
+
+	// A connection opened again resumes the cached TLS session
+	transport.CloseIdleConnections()
+	get()
+	if got := connStats.resumed.Load() - resumed; got != 1 {
+		t.Errorf("%d TLS sessions resumed, want 1", got)
+	}
+}
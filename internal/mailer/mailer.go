@@ -0,0 +1,121 @@
+// Package mailer delivers letters through the email provider selected in
+// secrets.json: the Unisender API, an SMTP server or the Mailgun API. It knows
+// nothing of Telegram, so the bot reaches it only through EmailSender.
+package mailer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// Email providers selectable with email_provider in secrets.json.
+const (
+	EMAIL_PROVIDER_UNISENDER = "unisender" // Unisender API (default)
+	EMAIL_PROVIDER_SMTP      = "smtp"      // Any SMTP server, no Unisender account needed
+	EMAIL_PROVIDER_MAILGUN   = "mailgun"   // Mailgun API, for regions Unisender does not serve
+)
+
+// EmailSender delivers letters. targetEmail may list several comma-separated
+// addresses, and copies adds the CC and BCC ones. The response has one result per
+// address, the recipients first and then copies.Addresses, so a partly rejected
+// letter is reported the same way whichever provider sent it.
+type EmailSender interface {
+	SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error)
+}
+
+// Copies are the addresses a letter is copied to besides its recipients.
+type Copies struct {
+	CC  []string // Listed in the letter for everyone to see
+	BCC []string // Not listed, so the other recipients do not learn of them
+}
+
+// Addresses returns the CC addresses followed by the BCC ones.
+func (c Copies) Addresses() []string {
+	return slices.Concat(c.CC, c.BCC)
+}
+
+// Capabilities are what the wizard has to know about a provider before offering
+// an option. Every provider sends HTML, attachments and blind copies, and the bot
+// schedules letters itself, so those need no flag.
+type Capabilities struct {
+	ListedCopies   bool // CC addresses are listed in the letter; otherwise each copy is a letter of its own
+	DeliveryStatus bool // The delivery status can be looked up by the message ID
+}
+
+// CapabilitiesOf returns the capabilities of the provider selected by
+// email_provider, the default one when it is empty.
+func CapabilitiesOf(provider string) Capabilities {
+	switch cmp.Or(provider, EMAIL_PROVIDER_UNISENDER) {
+	case EMAIL_PROVIDER_UNISENDER:
+		return Capabilities{DeliveryStatus: true}
+	default:
+		return Capabilities{ListedCopies: true}
+	}
+}
+
+// ProviderError is a letter the provider rejected as a whole, as opposed to a
+// request that failed on the way.
+type ProviderError interface {
+	error
+	Provider() string // Provider name shown to the user
+}
+
+// New creates the sender selected by email_provider, checking the settings it needs.
+func New(provider, unisenderAPIKey string, smtp SMTPSettings, mailgun MailgunSettings) (EmailSender, error) {
+	switch cmp.Or(provider, EMAIL_PROVIDER_UNISENDER) {
+	case EMAIL_PROVIDER_UNISENDER:
+		if unisenderAPIKey == "" {
+			return nil, errors.New("Не указан API ключ Unisender. Используйте аргумент --unisender-api-key или файл secrets.json.")
+		}
+		return &UnisenderSender{APIKey: unisenderAPIKey}, nil
+	case EMAIL_PROVIDER_SMTP:
+		return NewSMTPSender(smtp)
+	case EMAIL_PROVIDER_MAILGUN:
+		return NewMailgunSender(mailgun)
+	default:
+		return nil, fmt.Errorf("неизвестный почтовый провайдер %q, допустимы %s, %s и %s", provider, EMAIL_PROVIDER_UNISENDER, EMAIL_PROVIDER_SMTP, EMAIL_PROVIDER_MAILGUN)
+	}
+}
+
+// Attachment is a file attached to an outgoing email.
+type Attachment struct {
+	Name string // File name shown to the recipient
+	Data []byte // Raw file contents, for small files the bot generates
+	Path string // File holding the contents instead of Data, such as a downloaded Telegram file
+	// FileID is the Telegram file the contents came from, so the letter can be sent
+	// again later from the history; empty for files the bot generates
+	FileID string
+}
+
+// Open returns a reader of the contents. Mailers that can stream read attachments
+// through it as they write the letter instead of copying them into the request.
+func (a Attachment) Open() (io.ReadCloser, error) {
+	if a.Path != "" {
+		return os.Open(a.Path)
+	}
+	return io.NopCloser(bytes.NewReader(a.Data)), nil
+}
+
+// ReadAll returns the contents, for mailers that need them in one piece.
+func (a Attachment) ReadAll() ([]byte, error) {
+	if a.Path != "" {
+		return os.ReadFile(a.Path)
+	}
+	return a.Data, nil
+}
+
+// Available reports whether the contents can still be read, which downloaded files
+// stop being once the bot removes them.
+func (a Attachment) Available() bool {
+	if a.Path == "" {
+		return true
+	}
+	_, err := os.Stat(a.Path)
+	return err == nil
+}
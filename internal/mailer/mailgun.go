@@ -0,0 +1,159 @@
+package mailer
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// Base URLs of the Mailgun API by region; the sending domain and method are appended.
+const (
+	MAILGUN_API_URL    = "https://api.mailgun.net/v3/"
+	MAILGUN_EU_API_URL = "https://api.eu.mailgun.net/v3/"
+)
+
+// MailgunSettings configures Mailgun from mailgun in secrets.json.
+type MailgunSettings struct {
+	Domain string `json:"domain"`  // Sending domain verified in Mailgun, e.g. mg.example.com
+	APIKey string `json:"api_key"` // Private API key
+	Region string `json:"region"`  // "us" (default) or "eu", where the domain was created
+}
+
+// MailgunAPIError is a letter Mailgun refused as a whole, e.g. for a bad address
+// or a domain it does not know.
+type MailgunAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+// Provider implements ProviderError.
+func (e *MailgunAPIError) Provider() string {
+	return "Mailgun"
+}
+
+// Error implements the error interface.
+func (e *MailgunAPIError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// MailgunSender sends letters through the messages method of the Mailgun API.
+// Mailgun accepts or refuses a letter for all recipients at once, so a success
+// reports every recipient as accepted under the same message ID.
+type MailgunSender struct {
+	settings MailgunSettings
+	baseURL  string
+}
+
+// NewMailgunSender validates the settings and picks the API of the region.
+func NewMailgunSender(settings MailgunSettings) (*MailgunSender, error) {
+	if settings.Domain == "" || settings.APIKey == "" {
+		return nil, errors.New("Не указан домен или API ключ Mailgun: задайте mailgun.domain и mailgun.api_key в secrets.json.")
+	}
+	switch settings.Region {
+	case "", "us":
+		return &MailgunSender{settings: settings, baseURL: MAILGUN_API_URL}, nil
+	case "eu":
+		return &MailgunSender{settings: settings, baseURL: MAILGUN_EU_API_URL}, nil
+	default:
+		return nil, fmt.Errorf("неизвестный регион mailgun.region %q, допустимы us и eu", settings.Region)
+	}
+}
+
+// SendEmail implements EmailSender.
+func (s *MailgunSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	recipients := splitAddresses(targetEmail)
+
+	// The form is written into a pipe while the transport sends it, so attachments
+	// are read as they are uploaded instead of being copied into the request
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMailgunForm(form, senderEmail, senderName, recipients, copies, subject, body, attachments))
+	}()
+
+	req, err := http.NewRequestWithContext(traceConnections(ctx), http.MethodPost, s.baseURL+s.settings.Domain+"/messages", pr)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", s.settings.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка запроса к Mailgun", "error", err)
+		return nil, fmt.Errorf("ошибка HTTP запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	response := getBuffer()
+	defer putBuffer(response)
+	if _, err := response.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	slog.DebugContext(ctx, "Ответ от Mailgun", "status", resp.StatusCode, "response", response.String())
+
+	// Errors come as {"message": "..."}, though 401 is plain text
+	var decoded struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(response.Bytes(), &decoded)
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, &ProviderHTTPError{Provider: "Mailgun", StatusCode: resp.StatusCode, Status: resp.Status}
+	case resp.StatusCode != http.StatusOK:
+		return nil, &MailgunAPIError{StatusCode: resp.StatusCode, Message: cmp.Or(decoded.Message, strings.TrimSpace(response.String()))}
+	}
+
+	// Mailgun accepts or refuses the letter as a whole
+	id := UnisenderID(strings.Trim(decoded.ID, "<>"))
+	addresses := slices.Concat(recipients, copies.Addresses())
+	result := make(SendEmailResponse, len(addresses))
+	for i, address := range addresses {
+		result[i] = SendEmailResult{Index: i, Email: address, ID: id}
+	}
+	return result, nil
+}
+
+// writeMailgunForm writes the fields of the messages method to form and closes it.
+// Writing stops with an error once the request is abandoned and the pipe closed.
+func writeMailgunForm(form *multipart.Writer, senderEmail, senderName string, recipients []string, copies Copies, subject, body string, attachments []Attachment) error {
+	form.WriteField("from", (&mail.Address{Name: senderName, Address: senderEmail}).String())
+	for _, recipient := range recipients {
+		form.WriteField("to", recipient)
+	}
+	for _, address := range copies.CC {
+		form.WriteField("cc", address)
+	}
+	for _, address := range copies.BCC {
+		form.WriteField("bcc", address)
+	}
+	form.WriteField("subject", subject)
+	if err := form.WriteField("html", body); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		part, err := form.CreateFormFile("attachment", a.Name)
+		if err != nil {
+			return err
+		}
+		err = copyAttachment(part, a, func(w io.Writer, r io.Reader) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+// serveMailgun starts a server answering the messages method with status and body,
+// and a sender for the domain mg.example.com pointed at it.
+func serveMailgun(t *testing.T, status int, body string, inspect func(*http.Request)) *MailgunSender {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/mg.example.com/messages" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if user, password, _ := r.BasicAuth(); user != "api" || password != "key" {
+			t.Errorf("basic auth = %q, %q; want api, key", user, password)
+		}
+		if inspect != nil {
+			inspect(r)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	sender, err := NewMailgunSender(MailgunSettings{Domain: "mg.example.com", APIKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.baseURL = server.URL + "/"
+	return sender
+}
+
+func TestMailgunSenderAcceptsAllRecipients(t *testing.T) {
+	sender := serveMailgun(t, http.StatusOK, `{"id":"<20260501.1@mg.example.com>","message":"Queued. Thank you."}`, func(r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+		if to := r.MultipartForm.Value["to"]; !reflect.DeepEqual(to, []string{"office@example.com", "boss@example.com"}) {
+			t.Errorf("to = %q", to)
+		}
+		if cc, bcc := r.MultipartForm.Value["cc"], r.MultipartForm.Value["bcc"]; !reflect.DeepEqual(cc, []string{"team@example.com"}) || !reflect.DeepEqual(bcc, []string{"archive@example.com"}) {
+			t.Errorf("cc = %q, bcc = %q", cc, bcc)
+		}
+		if from, err := mail.ParseAddress(r.FormValue("from")); err != nil || from.Name != "Иван" || from.Address != "me@example.com" {
+			t.Errorf("from = %q", r.FormValue("from"))
+		}
+		if files := r.MultipartForm.File["attachment"]; len(files) != 1 || files[0].Filename != "report.pdf" {
+			t.Errorf("attachments = %+v", files)
+		}
+	})
+
+	result, err := sender.SendEmail(context.Background(), "office@example.com, boss@example.com",
+		Copies{CC: []string{"team@example.com"}, BCC: []string{"archive@example.com"}}, "me@example.com", "Отчёт", "<p>Текст</p>", "Иван",
+		Attachment{Name: "report.pdf", Data: []byte("%PDF")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SendEmailResponse{
+		{Index: 0, Email: "office@example.com", ID: "20260501.1@mg.example.com"},
+		{Index: 1, Email: "boss@example.com", ID: "20260501.1@mg.example.com"},
+		{Index: 2, Email: "team@example.com", ID: "20260501.1@mg.example.com"},
+		{Index: 3, Email: "archive@example.com", ID: "20260501.1@mg.example.com"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+func TestMailgunSenderErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		retryable bool
+		message   string // Shown to the user for errors the API reports
+	}{
+		{"bad request", http.StatusBadRequest, `{"message":"'to' parameter is not a valid address"}`, false, "'to' parameter is not a valid address"},
+		{"wrong key", http.StatusUnauthorized, "Forbidden", false, "Forbidden"},
+		{"server error", http.StatusServiceUnavailable, "", true, ""},
+		{"rate limited", http.StatusTooManyRequests, "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := serveMailgun(t, tt.status, tt.body, nil)
+			_, err := sender.SendEmail(context.Background(), "office@example.com", Copies{}, "me@example.com", "s", "b", "n")
+			if err == nil || isRetryable(err) != tt.retryable {
+				t.Fatalf("err = %v, want retryable = %v", err, tt.retryable)
+			}
+			var apiErr *MailgunAPIError
+			if tt.message != "" && (!errors.As(err, &apiErr) || apiErr.Message != tt.message) {
+				t.Errorf("err = %v, want API error %q", err, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults of the send retry policy, used for fields not set in send_retry.
+const (
+	DEFAULT_SEND_ATTEMPTS    = 3
+	DEFAULT_SEND_BACKOFF     = time.Second
+	DEFAULT_SEND_MAX_BACKOFF = 10 * time.Second
+	DEFAULT_SEND_JITTER      = 0.2
+)
+
+// RetryPolicy configures how sends are retried after transient failures, from
+// send_retry in secrets.json. The delay doubles after each attempt up to MaxBackoff
+// and is randomised by Jitter, so bots restarted together do not retry in step.
+type RetryPolicy struct {
+	Attempts   int      `json:"attempts"`    // Total attempts including the first one; 1 disables retries
+	Backoff    string   `json:"backoff"`     // Delay before the second attempt, e.g. "1s"
+	MaxBackoff string   `json:"max_backoff"` // Upper bound of the delay, e.g. "10s"
+	Jitter     *float64 `json:"jitter"`      // Random spread of the delay, 0..1; 0.2 means ±20%
+}
+
+// retryPolicy is a validated RetryPolicy.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	jitter     float64
+}
+
+// sendRetry is the policy WithRetries follows, set by ConfigureRetry. A reload
+// may replace it while sends are retried, hence sendRetryMu.
+var (
+	sendRetryMu sync.RWMutex
+	sendRetry   = retryPolicy{
+		attempts:   DEFAULT_SEND_ATTEMPTS,
+		backoff:    DEFAULT_SEND_BACKOFF,
+		maxBackoff: DEFAULT_SEND_MAX_BACKOFF,
+		jitter:     DEFAULT_SEND_JITTER,
+	}
+)
+
+// parse validates the policy and fills in defaults.
+func (p RetryPolicy) parse() (retryPolicy, error) {
+	policy := retryPolicy{attempts: DEFAULT_SEND_ATTEMPTS, backoff: DEFAULT_SEND_BACKOFF, maxBackoff: DEFAULT_SEND_MAX_BACKOFF, jitter: DEFAULT_SEND_JITTER}
+	if p.Attempts < 0 {
+		return policy, fmt.Errorf("некорректное число попыток send_retry.attempts: %d", p.Attempts)
+	}
+	if p.Attempts > 0 {
+		policy.attempts = p.Attempts
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"backoff", p.Backoff, &policy.backoff},
+		{"max_backoff", p.MaxBackoff, &policy.maxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration < 0 {
+			return policy, fmt.Errorf("некорректная задержка send_retry.%s %q", d.name, d.value)
+		}
+		*d.to = duration
+	}
+	if policy.maxBackoff < policy.backoff {
+		return policy, fmt.Errorf("send_retry.max_backoff (%s) меньше backoff (%s)", policy.maxBackoff, policy.backoff)
+	}
+	if p.Jitter != nil {
+		if *p.Jitter < 0 || *p.Jitter > 1 {
+			return policy, fmt.Errorf("send_retry.jitter должен быть от 0 до 1, указано %v", *p.Jitter)
+		}
+		policy.jitter = *p.Jitter
+	}
+	return policy, nil
+}
+
+// ConfigureRetry validates the configured policy and makes it the one sends follow.
+func ConfigureRetry(p RetryPolicy) error {
+	policy, err := p.parse()
+	if err != nil {
+		return err
+	}
+	sendRetryMu.Lock()
+	sendRetry = policy
+	sendRetryMu.Unlock()
+	return nil
+}
+
+// delay returns the randomised wait before the given attempt (2 for the first retry).
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 2; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	if p.jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// ProviderHTTPError is a provider response with an HTTP status meaning "try again
+// later", such as a 502 from a proxy in front of the API or a 429.
+type ProviderHTTPError struct {
+	Provider   string
+	StatusCode int
+	Status     string
+}
+
+// Error implements the error interface.
+func (e *ProviderHTTPError) Error() string {
+	return e.Provider + " ответил " + e.Status
+}
+
+// AttemptsError is a send that failed after more than one attempt.
+type AttemptsError struct {
+	Attempts int
+	Err      error // Error of the last attempt
+}
+
+// Error implements the error interface.
+func (e *AttemptsError) Error() string {
+	return fmt.Sprintf("%v (попыток: %d)", e.Err, e.Attempts)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *AttemptsError) Unwrap() error {
+	return e.Err
+}
+
+// isRetryable reports whether a failed call may succeed if repeated. Errors reported
+// by the provider itself (wrong key, invalid sender and the like) are permanent;
+// network errors, server errors and rate limiting are transient.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// Our own context ended: the bot is stopping or the caller gave up
+		return false
+	}
+	var httpErr *ProviderHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		// SMTP replies 4xx for temporary conditions such as greylisting, 5xx for permanent ones
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr)
+}
+
+// WithRetries runs call under the send retry policy and returns the number of
+// attempts made. A failure after several attempts is wrapped in *AttemptsError.
+//
+// A request that timed out may still have reached the provider, so a retried send can
+// occasionally be delivered twice; losing the letter is considered worse.
+func WithRetries(ctx context.Context, name string, call func() error) (int, error) {
+	sendRetryMu.RLock()
+	policy := sendRetry
+	sendRetryMu.RUnlock()
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= policy.attempts || !isRetryable(err) {
+			if err != nil && attempt > 1 {
+				err = &AttemptsError{Attempts: attempt, Err: err}
+			}
+			return attempt, err
+		}
+
+		wait := policy.delay(attempt + 1)
+		slog.WarnContext(ctx, "Попытка не удалась, будет повтор", "operation", name, "attempt", attempt, "attempts", policy.attempts, "retry_in", wait.Round(time.Millisecond), "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, &AttemptsError{Attempts: attempt, Err: err}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package mailer
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection security modes of the SMTP server.
+const (
+	SMTP_STARTTLS = "starttls" // Plain connection upgraded with STARTTLS, port 587 by default
+	SMTP_TLS      = "tls"      // TLS from the start, port 465 by default
+	SMTP_NONE     = "none"     // No encryption, port 25 by default; for a relay on localhost
+)
+
+// SMTP_DIAL_TIMEOUT bounds connecting to the SMTP server.
+const SMTP_DIAL_TIMEOUT = 15 * time.Second
+
+// SMTPSettings configures the SMTP server from smtp in secrets.json.
+type SMTPSettings struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`     // Depends on security when not set
+	Username string `json:"username"` // No authentication when empty
+	Password string `json:"password"`
+	Security string `json:"security"` // "starttls" (default), "tls" or "none"
+}
+
+// SMTPSender sends letters through an SMTP server. Each recipient is offered to the
+// server separately, so addresses it refuses are reported like Unisender rejections.
+type SMTPSender struct {
+	settings SMTPSettings
+}
+
+// NewSMTPSender validates the settings and fills in the default port.
+func NewSMTPSender(settings SMTPSettings) (*SMTPSender, error) {
+	if settings.Host == "" {
+		return nil, errors.New("Не указан SMTP сервер: задайте smtp.host в secrets.json.")
+	}
+	settings.Security = cmp.Or(settings.Security, SMTP_STARTTLS)
+	defaultPort := map[string]int{SMTP_STARTTLS: 587, SMTP_TLS: 465, SMTP_NONE: 25}[settings.Security]
+	if defaultPort == 0 {
+		return nil, fmt.Errorf("неизвестный режим smtp.security %q, допустимы %s, %s и %s", settings.Security, SMTP_STARTTLS, SMTP_TLS, SMTP_NONE)
+	}
+	if settings.Port == 0 {
+		settings.Port = defaultPort
+	}
+	return &SMTPSender{settings: settings}, nil
+}
+
+// SendEmail implements EmailSender. Permanent refusals of single recipients (5xx)
+// end up in the results; temporary ones fail the whole send so it can be retried.
+// Copies are offered to the server like the recipients, only the CC ones are
+// written into the letter.
+func (s *SMTPSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	to := splitAddresses(targetEmail)
+	recipients := slices.Concat(to, copies.Addresses())
+	messageID, err := newMessageID(senderEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	client, closeConn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	if err := client.Mail(senderEmail); err != nil {
+		return nil, fmt.Errorf("SMTP сервер не принял отправителя: %w", err)
+	}
+	result := make(SendEmailResponse, len(recipients))
+	accepted := 0
+	for i, recipient := range recipients {
+		result[i] = SendEmailResult{Index: i, Email: recipient}
+		err := client.Rcpt(recipient)
+		var protoErr *textproto.Error
+		switch {
+		case err == nil:
+			accepted++
+		case errors.As(err, &protoErr) && protoErr.Code >= 500:
+			result[i].Errors = []RecipientError{{Code: strconv.Itoa(protoErr.Code), Message: protoErr.Msg}}
+		default:
+			return nil, fmt.Errorf("SMTP сервер не принял получателя %s: %w", recipient, err)
+		}
+	}
+	if accepted == 0 {
+		client.Quit()
+		return result, nil
+	}
+
+	// The letter is encoded straight into the connection, so attachments are never
+	// held in memory in full, let alone twice for their base64 form
+	w, err := client.Data()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка передачи письма: %w", err)
+	}
+	if err := writeMessage(w, messageID, senderEmail, senderName, to, copies.CC, subject, body, attachments); err != nil {
+		// The data is left unterminated, so the server drops the partial letter
+		// when the connection is closed
+		return nil, fmt.Errorf("ошибка передачи письма: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("SMTP сервер не принял письмо: %w", err)
+	}
+	client.Quit()
+
+	for i := range result {
+		if result[i].Accepted() {
+			result[i].ID = UnisenderID(messageID)
+		}
+	}
+	return result, nil
+}
+
+// Check connects and authenticates without sending anything, for check-config --online.
+func (s *SMTPSender) Check(ctx context.Context) error {
+	client, closeConn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	return client.Quit()
+}
+
+// connect opens an authenticated session. net/smtp knows nothing of contexts, so
+// the connection is closed when ctx ends, which aborts whatever is in progress.
+func (s *SMTPSender) connect(ctx context.Context) (*smtp.Client, func(), error) {
+	host := s.settings.Host
+	address := net.JoinHostPort(host, strconv.Itoa(s.settings.Port))
+	dialer := net.Dialer{Timeout: SMTP_DIAL_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка подключения к SMTP серверу %s: %w", address, err)
+	}
+	if s.settings.Security == SMTP_TLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	closeConn := func() {
+		stop()
+		conn.Close()
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		closeConn()
+		return nil, nil, fmt.Errorf("ошибка подключения к SMTP серверу %s: %w", address, err)
+	}
+	if s.settings.Security == SMTP_STARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			closeConn()
+			return nil, nil, fmt.Errorf("SMTP сервер %s не поддерживает STARTTLS", address)
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			closeConn()
+			return nil, nil, fmt.Errorf("ошибка STARTTLS: %w", err)
+		}
+	}
+	if s.settings.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted connection
+		// unless the server is on localhost
+		if err := client.Auth(smtp.PlainAuth("", s.settings.Username, s.settings.Password, host)); err != nil {
+			closeConn()
+			return nil, nil, fmt.Errorf("ошибка авторизации на SMTP сервере: %w", err)
+		}
+	}
+	return client, closeConn, nil
+}
+
+// writeMessage writes an HTML letter with optional attachments to w as a MIME
+// message, reading each attachment as it goes.
+func writeMessage(w io.Writer, messageID, senderEmail, senderName string, to, cc []string, subject, body string, attachments []Attachment) error {
+	header := textproto.MIMEHeader{}
+	header.Set("From", (&mail.Address{Name: senderName, Address: senderEmail}).String())
+	header.Set("To", strings.Join(to, ", "))
+	header.Set("Cc", strings.Join(cc, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-Id", "<"+messageID+">")
+	header.Set("Mime-Version", "1.0")
+
+	if len(attachments) == 0 {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "base64")
+		writeHeader(w, header)
+		return writeBase64(w, body)
+	}
+
+	// The writer only emits parts, so the top-level header can go first
+	parts := multipart.NewWriter(w)
+	header.Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+	writeHeader(w, header)
+
+	part, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeBase64(part, body); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		// Text types come with a charset, which FormatMediaType takes as a parameter only
+		contentType, params, err := mime.ParseMediaType(cmp.Or(mime.TypeByExtension(filepath.Ext(a.Name)), "application/octet-stream"))
+		if err != nil {
+			contentType, params = "application/octet-stream", map[string]string{}
+		}
+		params["name"] = a.Name
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, params)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyAttachment(part, a, copyBase64); err != nil {
+			return err
+		}
+	}
+	return parts.Close()
+}
+
+// writeHeader writes header fields followed by the blank line that ends them.
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Cc", "Subject", "Date", "Message-Id", "Mime-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+		}
+	}
+	io.WriteString(w, "\r\n")
+}
+
+// writeBase64 writes data base64-encoded in lines of 76 characters, as MIME requires.
+// Each 57-byte chunk encodes to exactly one line, so nothing but the line is buffered
+// and a string body is not copied into a byte slice first.
+func writeBase64[T string | []byte](w io.Writer, data T) error {
+	var chunk [57]byte
+	var line [78]byte
+	for len(data) > 0 {
+		n := copy(chunk[:], data)
+		data = data[n:]
+		encoded := base64.StdEncoding.EncodedLen(n)
+		base64.StdEncoding.Encode(line[:encoded], chunk[:n])
+		line[encoded], line[encoded+1] = '\r', '\n'
+		if _, err := w.Write(line[:encoded+2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BASE64_READ_SIZE is how much of an attachment copyBase64 reads at a time. It is a
+// multiple of 57 so that only the very last line can be short.
+const BASE64_READ_SIZE = 57 * 512
+
+// copyBase64 is writeBase64 for data read from r, holding only BASE64_READ_SIZE
+// bytes of it at a time.
+func copyBase64(w io.Writer, r io.Reader) error {
+	chunk := make([]byte, BASE64_READ_SIZE)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err := writeBase64(w, chunk[:n]); err != nil {
+			return err
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// copyAttachment opens the attachment and writes its contents to w with encode.
+func copyAttachment(w io.Writer, a Attachment, encode func(io.Writer, io.Reader) error) error {
+	r, err := a.Open()
+	if err != nil {
+		return fmt.Errorf("вложение «%s»: %w", a.Name, err)
+	}
+	defer r.Close()
+	if err := encode(w, r); err != nil {
+		return fmt.Errorf("вложение «%s»: %w", a.Name, err)
+	}
+	return nil
+}
+
+// splitAddresses splits a comma-separated list of addresses, dropping empty ones.
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// newMessageID generates a unique Message-ID in the sender's domain.
+func newMessageID(senderEmail string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	_, domain, _ := strings.Cut(senderEmail, "@")
+	return hex.EncodeToString(random) + "@" + cmp.Or(domain, "localhost"), nil
+}
@@ -0,0 +1,169 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts one session, refuses recipients at the rejected domain
+// and returns the received message on the channel.
+func fakeSMTPServer(t *testing.T, rejectedDomain string) (int, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 fake")
+			case strings.HasPrefix(command, "RCPT") && strings.Contains(command, strings.ToUpper(rejectedDomain)):
+				reply("550 5.1.1 No such user")
+			case strings.HasPrefix(command, "DATA"):
+				reply("354 Go ahead")
+				var message strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					message.WriteString(line)
+				}
+				received <- message.String()
+				reply("250 Queued")
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestSMTPSenderReportsRejectedRecipients(t *testing.T) {
+	port, received := fakeSMTPServer(t, "nowhere.example")
+	sender, err := NewSMTPSender(SMTPSettings{Host: "127.0.0.1", Port: port, Security: SMTP_NONE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sender.SendEmail(context.Background(), "office@example.com, ghost@nowhere.example",
+		Copies{CC: []string{"team@example.com"}, BCC: []string{"archive@example.com"}}, "me@example.com",
+		"Отчёт за май", "<p>Привет</p>", "Иван", Attachment{Name: "отчёт.txt", Data: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, rejected := result.Split()
+	if len(accepted) != 3 || accepted[0].Email != "office@example.com" || accepted[2].Email != "archive@example.com" || accepted[0].ID == "" {
+		t.Errorf("accepted = %+v", accepted)
+	}
+	if len(rejected) != 1 || rejected[0].Email != "ghost@nowhere.example" || rejected[0].Errors[0].Code != "550" {
+		t.Errorf("rejected = %+v", rejected)
+	}
+
+	raw := <-received
+	message, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc := message.Header.Get("Cc"); cc != "team@example.com" || strings.Contains(raw, "archive@") {
+		t.Errorf("Cc = %q, want only the CC copy listed in the letter", cc)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if subject != "Отчёт за май" {
+		t.Errorf("subject = %q", subject)
+	}
+	if id := message.Header.Get("Message-Id"); id != "<"+string(accepted[0].ID)+">" {
+		t.Errorf("Message-Id = %q, result ID = %q", id, accepted[0].ID)
+	}
+	_, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	var names []string
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+		names = append(names, part.FileName())
+	}
+	if len(names) != 2 || names[1] != "отчёт.txt" {
+		t.Errorf("parts = %q, want the body and отчёт.txt", names)
+	}
+}
+
+func TestNewSMTPSenderDefaults(t *testing.T) {
+	for security, port := range map[string]int{"": 587, SMTP_TLS: 465, SMTP_NONE: 25} {
+		sender, err := NewSMTPSender(SMTPSettings{Host: "smtp.example.com", Security: security})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sender.settings.Port != port {
+			t.Errorf("security %q: port = %d, want %d", security, sender.settings.Port, port)
+		}
+	}
+	if _, err := NewSMTPSender(SMTPSettings{Host: "smtp.example.com", Security: "ssl"}); err == nil {
+		t.Error("unknown security mode accepted")
+	}
+}
+
+func TestCopyBase64MatchesEncoding(t *testing.T) {
+	for _, size := range []int{0, 1, 57, BASE64_READ_SIZE - 1, BASE64_READ_SIZE, 3*BASE64_READ_SIZE + 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		var streamed, whole bytes.Buffer
+		if err := copyBase64(&streamed, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		writeBase64(&whole, data)
+		if streamed.String() != whole.String() {
+			t.Errorf("%d bytes: streamed encoding differs from encoding at once", size)
+		}
+	}
+}
+
+// TestWriteMessageStreamsAttachments checks a large attachment is encoded without
+// being copied, which is what keeps the memory of a send near the attachment size.
+func TestWriteMessageStreamsAttachments(t *testing.T) {
+	attachment := Attachment{Name: "archive.zip", Data: make([]byte, 16<<20)}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := writeMessage(io.Discard, "1@example.com", "me@example.com", "Иван", []string{"office@example.com"}, nil, "Архив", "<p>Архив</p>", []Attachment{attachment}); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("writing a 16 MB attachment allocated %d bytes", allocated)
+	}
+}
@@ -0,0 +1,317 @@
+package mailer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// UNISENDER_API_URL is the base URL of the Unisender API, method names are appended to it.
+const UNISENDER_API_URL = "https://api.unisender.com/ru/api/"
+
+// UnisenderResponse is the envelope shared by all Unisender API responses.
+type UnisenderResponse struct {
+	Result   json.RawMessage    `json:"result"`          // Method-specific payload
+	Error    string             `json:"error,omitempty"` // Top-level error message
+	Code     string             `json:"code,omitempty"`  // Top-level error code, e.g. "invalid_api_key"
+	Warnings []UnisenderWarning `json:"warnings,omitempty"`
+}
+
+// UnisenderWarning is a non-fatal remark attached to a successful response.
+type UnisenderWarning struct {
+	Warning string `json:"warning"`
+}
+
+// UnisenderAPIError is a request rejected by Unisender as a whole.
+type UnisenderAPIError struct {
+	Code    string
+	Message string
+}
+
+// Provider implements ProviderError.
+func (e *UnisenderAPIError) Provider() string {
+	return "Unisender"
+}
+
+// Error implements the error interface.
+func (e *UnisenderAPIError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// RecipientError describes why a single recipient of sendEmail was rejected.
+type RecipientError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// UnisenderID is an identifier Unisender returns either as a JSON string or a number.
+type UnisenderID string
+
+// UnmarshalJSON accepts both "123" and 123.
+func (id *UnisenderID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = UnisenderID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("некорректный идентификатор %s: %w", data, err)
+	}
+	*id = UnisenderID(n.String())
+	return nil
+}
+
+// SendEmailResult is the outcome of sendEmail for one recipient. A recipient was
+// accepted when it has an ID and no errors.
+type SendEmailResult struct {
+	Index  int              `json:"index"`
+	Email  string           `json:"email"`
+	ID     UnisenderID      `json:"id"`
+	Errors []RecipientError `json:"errors"`
+}
+
+// Accepted reports whether Unisender took the email for delivery to this recipient.
+func (r SendEmailResult) Accepted() bool {
+	return len(r.Errors) == 0
+}
+
+// SendEmailResponse is the result of the sendEmail method, one entry per recipient.
+type SendEmailResponse []SendEmailResult
+
+// UnmarshalJSON decodes the per-recipient result array. Older API versions returned
+// a bare array of message IDs, which is accepted as well.
+func (r *SendEmailResponse) UnmarshalJSON(data []byte) error {
+	var results []SendEmailResult
+	if err := json.Unmarshal(data, &results); err == nil {
+		*r = results
+		return nil
+	}
+
+	var ids []UnisenderID
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return fmt.Errorf("неожиданный формат результата sendEmail: %s", data)
+	}
+	*r = make(SendEmailResponse, len(ids))
+	for i, id := range ids {
+		(*r)[i] = SendEmailResult{Index: i, ID: id}
+	}
+	return nil
+}
+
+// Split separates accepted recipients from rejected ones.
+func (r SendEmailResponse) Split() (accepted, rejected []SendEmailResult) {
+	for _, result := range r {
+		if result.Accepted() {
+			accepted = append(accepted, result)
+		} else {
+			rejected = append(rejected, result)
+		}
+	}
+	return accepted, rejected
+}
+
+// DescribeRejected lists rejected recipients with their error messages.
+func DescribeRejected(rejected []SendEmailResult) string {
+	lines := make([]string, 0, len(rejected))
+	for _, result := range rejected {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			messages = append(messages, cmp.Or(e.Message, e.Code))
+		}
+		recipient := cmp.Or(result.Email, "#"+strconv.Itoa(result.Index))
+		lines = append(lines, recipient+": "+strings.Join(messages, "; "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// UnisenderList is one entry of the getLists result.
+type UnisenderList struct {
+	ID    UnisenderID `json:"id"`
+	Title string      `json:"title"`
+}
+
+// UnisenderSender sends letters through the sendEmail method of the Unisender API.
+type UnisenderSender struct {
+	APIKey string
+}
+
+// SendEmail implements EmailSender. sendEmail knows nothing of copies, so every CC
+// and BCC address gets the letter in a call of its own once the recipients have
+// theirs. A copy that fails is reported as a rejected address rather than failing
+// the send: that would have it retried, and the recipients would get it twice.
+func (s *UnisenderSender) SendEmail(ctx context.Context, targetEmail string, copies Copies, senderEmail, subject, body, senderName string, attachments ...Attachment) (SendEmailResponse, error) {
+	result, err := s.send(ctx, targetEmail, senderEmail, subject, body, senderName, attachments)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range copies.Addresses() {
+		copyResult, err := s.send(ctx, address, senderEmail, subject, body, senderName, attachments)
+		if err != nil {
+			slog.WarnContext(ctx, "Ошибка отправки копии письма", "error", err)
+			copyResult = SendEmailResponse{{Errors: []RecipientError{{Message: err.Error()}}}}
+		}
+		for _, r := range copyResult {
+			r.Index, r.Email = len(result), cmp.Or(r.Email, address)
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+// send calls sendEmail for the comma-separated addresses.
+func (s *UnisenderSender) send(ctx context.Context, targetEmail, senderEmail, subject, body, senderName string, attachments []Attachment) (SendEmailResponse, error) {
+	data := url.Values{
+		"sender_name":    {senderName},
+		"sender_email":   {senderEmail},
+		"email":          {targetEmail},
+		"subject":        {subject},
+		"body":           {body},
+		"list_id":        {"1"},
+		"error_checking": {"1"},
+	}
+	// Unisender expects raw file contents keyed by file name
+	for _, a := range attachments {
+		contents, err := a.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("вложение «%s»: %w", a.Name, err)
+		}
+		data.Set("attachments["+a.Name+"]", string(contents))
+	}
+
+	var result SendEmailResponse
+	if err := CallUnisender(ctx, s.APIKey, "sendEmail", data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CallUnisender invokes an Unisender API method and decodes the "result" field of the
+// response into result. Requests rejected by the API are returned as *UnisenderAPIError.
+func CallUnisender(ctx context.Context, apiKey, method string, params url.Values, result any) error {
+	params.Set("format", "json")
+	params.Set("api_key", apiKey)
+
+	form := getBuffer()
+	encodeForm(form, params)
+	body := newPooledBody(form)
+	req, err := http.NewRequestWithContext(traceConnections(ctx), http.MethodPost, UNISENDER_API_URL+method, body)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Ошибка запроса к Unisender", "method", method, "error", err)
+		return fmt.Errorf("ошибка HTTP запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	response := getBuffer()
+	defer putBuffer(response)
+	if _, err := response.ReadFrom(resp.Body); err != nil {
+		return fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	slog.DebugContext(ctx, "Ответ от Unisender", "method", method, "response", response.String())
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		// Proxies and overloaded servers answer with error pages, not the JSON envelope
+		return &ProviderHTTPError{Provider: "Unisender", StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return decodeUnisenderResponse(response.Bytes(), result)
+}
+
+// encodeForm writes params to buf like url.Values.Encode, growing buf once to the
+// exact size. Letter bodies make up most of a request and grow several times when
+// escaped, so Encode's per-value copies and buffer doubling dominated sending.
+func encodeForm(buf *bytes.Buffer, params url.Values) {
+	keys := make([]string, 0, len(params))
+	size := 0
+	for key, values := range params {
+		keys = append(keys, key)
+		for _, value := range values {
+			size += escapedLen(key) + escapedLen(value) + 2 // "=" and "&"
+		}
+	}
+	slices.Sort(keys)
+
+	buf.Grow(size)
+	form := buf.AvailableBuffer()
+	for _, key := range keys {
+		for _, value := range params[key] {
+			if len(form) > 0 {
+				form = append(form, '&')
+			}
+			form = appendQueryEscape(form, key)
+			form = append(form, '=')
+			form = appendQueryEscape(form, value)
+		}
+	}
+	buf.Write(form)
+}
+
+// keepUnescaped reports whether a byte stays as is in a form value.
+func keepUnescaped(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// escapedLen returns the length of s escaped by appendQueryEscape.
+func escapedLen(s string) int {
+	n := len(s)
+	for i := 0; i < len(s); i++ {
+		if !keepUnescaped(s[i]) && s[i] != ' ' {
+			n += 2
+		}
+	}
+	return n
+}
+
+// appendQueryEscape appends s escaped like url.QueryEscape.
+func appendQueryEscape(dst []byte, s string) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case keepUnescaped(c):
+			dst = append(dst, c)
+		case c == ' ':
+			dst = append(dst, '+')
+		default:
+			dst = append(dst, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	return dst
+}
+
+// decodeUnisenderResponse decodes a raw Unisender API response into result.
+func decodeUnisenderResponse(data []byte, result any) error {
+	var envelope UnisenderResponse
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("ошибка декодирования ответа: %w", err)
+	}
+	if envelope.Error != "" {
+		return &UnisenderAPIError{Code: envelope.Code, Message: envelope.Error}
+	}
+	for _, w := range envelope.Warnings {
+		slog.Warn("Предупреждение Unisender", "warning", w.Warning)
+	}
+	if err := json.Unmarshal(envelope.Result, result); err != nil {
+		return fmt.Errorf("ошибка разбора результата: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"botmailtest/internal/testutil"
+)
+
+// loadPayload reads a captured Unisender response from testdata.
+func loadPayload(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "unisender", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeSendEmailResponse(t *testing.T) {
+	tests := []struct {
+		payload  string
+		want     SendEmailResponse
+		accepted int
+		rejected int
+	}{
+		{
+			payload:  "send_email_success.json",
+			want:     SendEmailResponse{{Index: 0, Email: "office@example.com", ID: "36422781"}},
+			accepted: 1,
+		},
+		{
+			payload: "send_email_partial.json",
+			want: SendEmailResponse{
+				{Index: 0, Email: "office@example.com", ID: "36422782"},
+				{Index: 1, Email: "broken@example", Errors: []RecipientError{{Code: "invalid_arg", Message: "Email address is invalid: broken@example"}}},
+			},
+			accepted: 1,
+			rejected: 1,
+		},
+		{
+			payload: "send_email_rejected.json",
+			want: SendEmailResponse{
+				{Index: 0, Email: "unsubscribed@example.com", Errors: []RecipientError{{Code: "unsubscribed", Message: "Recipient has unsubscribed"}}},
+			},
+			rejected: 1,
+		},
+		{
+			payload:  "send_email_legacy_ids.json",
+			want:     SendEmailResponse{{Index: 0, ID: "36422783"}},
+			accepted: 1,
+		},
+		{
+			payload:  "send_email_warnings.json",
+			want:     SendEmailResponse{{Index: 0, Email: "office@example.com", ID: "36422784"}},
+			accepted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			var got SendEmailResponse
+			if err := decodeUnisenderResponse(loadPayload(t, tt.payload), &got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			accepted, rejected := got.Split()
+			if len(accepted) != tt.accepted || len(rejected) != tt.rejected {
+				t.Errorf("Split() = %d accepted, %d rejected; want %d, %d", len(accepted), len(rejected), tt.accepted, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestDecodeUnisenderError(t *testing.T) {
+	var result SendEmailResponse
+	err := decodeUnisenderResponse(loadPayload(t, "error_invalid_api_key.json"), &result)
+
+	var apiErr *UnisenderAPIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want *UnisenderAPIError", err)
+	}
+	if apiErr.Code != "invalid_api_key" || apiErr.Message != "AK100310-02 Invalid API key" {
+		t.Errorf("got %+v", apiErr)
+	}
+}
+
+func TestDecodeLists(t *testing.T) {
+	var lists []UnisenderList
+	if err := decodeUnisenderResponse(loadPayload(t, "get_lists.json"), &lists); err != nil {
+		t.Fatal(err)
+	}
+	want := []UnisenderList{{ID: "1", Title: "Новые клиенты"}, {ID: "2", Title: "Партнёры"}}
+	if !reflect.DeepEqual(lists, want) {
+		t.Errorf("got %+v, want %+v", lists, want)
+	}
+}
+
+// serveUnisender routes Unisender calls to a server answering each call with the
+// next of the given status codes and bodies, repeating the last one, and retries
+// sends without waiting.
+func serveUnisender(t *testing.T, statuses []int, bodies []string) *atomic.Int32 {
+	t.Helper()
+	calls := testutil.ServeUnisender(t, UNISENDER_API_URL, statuses, bodies)
+	defaultPolicy := sendRetry
+	sendRetry = retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+	t.Cleanup(func() { sendRetry = defaultPolicy })
+	return calls
+}
+
+func TestSendEmailRetries(t *testing.T) {
+	const success = `{"result":[{"index":0,"email":"office@example.com","id":"1"}]}`
+	tests := []struct {
+		name     string
+		statuses []int
+		bodies   []string
+		attempts int
+		sent     bool
+	}{
+		{"server error then success", []int{500, 200}, []string{"Internal Server Error", success}, 2, true},
+		{"rate limited then success", []int{429, 502, 200}, []string{"", "", success}, 3, true},
+		{"api error is permanent", []int{200}, []string{`{"error":"Invalid API key","code":"invalid_api_key"}`}, 1, false},
+		{"server error every time", []int{503}, []string{""}, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := serveUnisender(t, tt.statuses, tt.bodies)
+			sender := &UnisenderSender{APIKey: "key"}
+			attempts, err := WithRetries(context.Background(), "sendEmail", func() error {
+				_, err := sender.SendEmail(context.Background(), "office@example.com", Copies{}, "me@example.com", "s", "b", "n")
+				return err
+			})
+			if attempts != tt.attempts || int(calls.Load()) != tt.attempts {
+				t.Errorf("attempts = %d, calls = %d, want %d", attempts, calls.Load(), tt.attempts)
+			}
+			if (err == nil) != tt.sent {
+				t.Fatalf("err = %v, want sent = %v", err, tt.sent)
+			}
+			var attemptsErr *AttemptsError
+			if err != nil && errors.As(err, &attemptsErr) != (tt.attempts > 1) {
+				t.Errorf("err = %v, attempt count reported only after retries", err)
+			}
+		})
+	}
+}
+
+func TestUnisenderSendsCopiesSeparately(t *testing.T) {
+	calls := serveUnisender(t, []int{200, 200, 200}, []string{
+		`{"result":[{"index":0,"email":"office@example.com","id":"1"}]}`,
+		`{"result":[{"index":0,"email":"team@example.com","id":"2"}]}`,
+		`{"error":"Email address is invalid","code":"invalid_arg"}`,
+	})
+	sender := &UnisenderSender{APIKey: "key"}
+	result, err := sender.SendEmail(context.Background(), "office@example.com",
+		Copies{CC: []string{"team@example.com"}, BCC: []string{"broken@example"}}, "me@example.com", "s", "b", "n")
+	if err != nil || calls.Load() != 3 {
+		t.Fatalf("err = %v after %d calls, want one call per copy and no error", err, calls.Load())
+	}
+	want := SendEmailResponse{
+		{Index: 0, Email: "office@example.com", ID: "1"},
+		{Index: 1, Email: "team@example.com", ID: "2"},
+		{Index: 2, Email: "broken@example", Errors: []RecipientError{{Message: "Email address is invalid (invalid_arg)"}}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+func TestRetryDelayDoublesUpToMax(t *testing.T) {
+	policy := retryPolicy{attempts: 6, backoff: time.Second, maxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := policy.delay(i + 2); got != w {
+			t.Errorf("delay before attempt %d = %s, want %s", i+2, got, w)
+		}
+	}
+}
+
+func TestEncodeFormMatchesEncode(t *testing.T) {
+	params := url.Values{
+		"body":                   {"<p>Привет, мир!</p>\n& 100% ~ok"},
+		"email":                  {"a@example.com,b@example.com"},
+		"attachments[отчёт.pdf]": {"\x00\xff binary"},
+		"list_id":                {"1", "2"},
+		"empty":                  {""},
+	}
+	var buf bytes.Buffer
+	encodeForm(&buf, params)
+	if got, want := buf.String(), params.Encode(); got != want {
+		t.Errorf("encodeForm = %q\nEncode     = %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// statesBucket holds JSON-encoded UserState values keyed by user ID.
+var statesBucket = []byte("states")
+
+// BoltStateStore is a StateStore persisted in a bbolt database, so drafts survive restarts.
+// bbolt serializes write transactions, which makes Update atomic across users.
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStateStore creates a state store in the given database.
+func NewBoltStateStore(db *bolt.DB) (*BoltStateStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания таблицы состояний: %w", err)
+	}
+	return &BoltStateStore{db: db}, nil
+}
+
+// Get returns the user's stored state and whether it exists.
+func (s *BoltStateStore) Get(userID int64) (UserState, bool) {
+	var state UserState
+	var exists bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if err := Fault(); err != nil {
+			return err
+		}
+		data := tx.Bucket(statesBucket).Get(Int64Key(userID))
+		if data == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(data, &state)
+	})
+	if err != nil {
+		// A corrupt entry is treated as missing so the user can start over
+		slog.Error("Ошибка чтения состояния пользователя", "user_id", userID, "error", err)
+		return UserState{}, false
+	}
+	return state, exists
+}
+
+// Update calls fn with the user's state inside a write transaction and stores the result.
+func (s *BoltStateStore) Update(userID int64, fn func(state *UserState)) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := Fault(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket(statesBucket)
+		key := Int64Key(userID)
+
+		var state UserState
+		if data := bucket.Get(key); data != nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				slog.Error("Ошибка чтения состояния пользователя, состояние сброшено", "user_id", userID, "error", err)
+				state = UserState{}
+			}
+		}
+		fn(&state)
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		slog.Error("Ошибка сохранения состояния пользователя", "user_id", userID, "error", err)
+	}
+}
+
+// Delete removes the user's state.
+func (s *BoltStateStore) Delete(userID int64) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).Delete(Int64Key(userID))
+	})
+	if err != nil {
+		slog.Error("Ошибка удаления состояния пользователя", "user_id", userID, "error", err)
+	}
+}
+
+// Range calls fn with every stored state. Entries that cannot be decoded are skipped.
+func (s *BoltStateStore) Range(fn func(userID int64, state UserState)) {
+	states := make(map[int64]UserState)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).ForEach(func(k, v []byte) error {
+			var state UserState
+			if err := json.Unmarshal(v, &state); err != nil {
+				slog.Error("Ошибка чтения состояния", "key", fmt.Sprintf("%x", k), "error", err)
+				return nil
+			}
+			states[int64(binary.BigEndian.Uint64(k))] = state
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Ошибка чтения состояний", "error", err)
+	}
+	// fn runs outside the transaction, so it may use the store
+	for userID, state := range states {
+		fn(userID, state)
+	}
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SCHEMA_VERSION is the layout of the stored entries this release reads and writes.
+// A change that old releases or old entries cannot cope with raises it and adds a
+// step to migrations.
+const SCHEMA_VERSION = 1
+
+// metaBucket holds facts about the database itself, such as its schema version.
+var metaBucket = []byte("meta")
+
+var schemaVersionKey = []byte("schema_version")
+
+// migrations[i] upgrades a database from schema version i to i+1 inside one write
+// transaction. Tables missing from older databases are created by the stores.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: the version is recorded; the entries are unchanged
+	func(tx *bolt.Tx) error { return nil },
+}
+
+// SchemaVersion returns the schema version recorded in the database, 0 for a
+// database written before versions were recorded.
+func SchemaVersion(db *bolt.DB) (int, error) {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = readSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+func readSchemaVersion(tx *bolt.Tx) (int, error) {
+	bucket := tx.Bucket(metaBucket)
+	if bucket == nil {
+		return 0, nil
+	}
+	data := bucket.Get(schemaVersionKey)
+	if data == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("некорректная версия схемы хранилища %q", data)
+	}
+	return version, nil
+}
+
+// Migrate upgrades the database to SCHEMA_VERSION and returns the version it had.
+// A database written by a newer release is left alone with an error, since this
+// one would misread its entries.
+func Migrate(db *bolt.DB) (int, error) {
+	var previous int
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if previous, err = readSchemaVersion(tx); err != nil {
+			return err
+		}
+		if previous > SCHEMA_VERSION {
+			return fmt.Errorf("хранилище записано более новой версией бота (схема %d, поддерживается %d)", previous, SCHEMA_VERSION)
+		}
+		for _, migrate := range migrations[previous:] {
+			if err := migrate(tx); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(schemaVersionKey, []byte(strconv.Itoa(SCHEMA_VERSION)))
+	})
+	if err != nil {
+		return previous, fmt.Errorf("ошибка обновления хранилища: %w", err)
+	}
+	return previous, nil
+}
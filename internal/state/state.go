@@ -0,0 +1,64 @@
+// Package state keeps the drafts users compose in the wizard: the UserState of
+// each conversation and the stores holding it, in memory or in the bbolt database.
+package state
+
+import "time"
+
+// Body formats chosen with the buttons under the body prompt.
+const (
+	BODY_FORMAT_TEXT = "text" // Plain text, Telegram formatting converted to HTML (default)
+	BODY_FORMAT_HTML = "html" // HTML written by the user, sent as is
+)
+
+// UserState holds the current state of interaction for a user.
+type UserState struct {
+	State      string   // Current step in the email sending process
+	Subject    string   // Email subject
+	Body       string   // Email body as the user typed it
+	BodyFormat string   // BODY_FORMAT_TEXT (default) or BODY_FORMAT_HTML
+	BodyHTML   string   // Body converted to HTML with its Telegram formatting, in text mode
+	SenderName string   // Sender's name
+	Recipients []string // Addresses typed by the user, empty for the default recipient
+	CC         []string // Addresses getting a copy, listed in the letter
+	BCC        []string // Addresses getting a copy the other recipients do not see
+	Preheader  string   // Optional text shown after the subject in inbox lists
+	Invite     Invite   // Meeting details when composing an invitation
+	Editing    bool     // A field is being changed from the preview, return there after it
+	// Template is the name of the template the draft was started from, whose subject
+	// and body are already set; Placeholders lists its fields still to be filled
+	Template     string
+	Placeholders []string
+	// Attachments are files sent during the body step, downloaded when the letter is sent
+	Attachments []DraftAttachment
+	Tags        []string // Importance tags chosen at the tags step, keys of tag_rules
+	OnBehalfOf  int64    // Manager who approved sending the draft on their behalf
+	ApprovedBy  int64    // Administrator who approved the letter of a guest
+	KeepAsTyped bool     // The normalize rules are turned off for this letter
+	// Touched is when the user last worked on the draft; the janitor discards
+	// drafts left untouched for longer than session_timeout
+	Touched time.Time
+}
+
+// EmailBody returns the body as it is sent: the HTML converted from the text, or
+// the user's own HTML in HTML mode.
+func (s *UserState) EmailBody() string {
+	if s.BodyFormat == BODY_FORMAT_HTML || s.BodyHTML == "" {
+		return s.Body
+	}
+	return s.BodyHTML
+}
+
+// Invite holds the details of a meeting invitation being composed.
+type Invite struct {
+	Start    time.Time
+	Duration time.Duration
+	Location string
+}
+
+// DraftAttachment is a Telegram file attached to a letter in the wizard. Only the
+// file ID is kept in the state; the contents are downloaded when the letter is sent.
+type DraftAttachment struct {
+	FileID   string
+	FileName string
+	FileSize int
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DEFAULT_LOCK_TIMEOUT is how long opening the database waits for the file lock.
+// A short timeout makes a second bot instance fail fast instead of hanging.
+const DEFAULT_LOCK_TIMEOUT = time.Second
+
+// StorageOptions tunes the bbolt database from storage_options in secrets.json.
+// bbolt has a single writer and lock-free readers, so unlike SQLite there is no
+// journal mode or connection pool to configure.
+type StorageOptions struct {
+	LockTimeout     string `json:"lock_timeout"`      // Wait for the file lock, e.g. "5s"; 1s by default
+	NoSync          bool   `json:"no_sync"`           // Skip fsync on commit: faster writes, recent ones may be lost on power failure
+	InitialMmapSize int    `json:"initial_mmap_size"` // Bytes mapped up front, so growing the file does not block readers
+}
+
+// Fault is called at the start of every state transaction and fails it with the
+// error it returns; failure injection sets it to simulate a hung database.
+var Fault = func() error { return nil }
+
+// lockTimeout parses LockTimeout, falling back to DEFAULT_LOCK_TIMEOUT.
+func (o StorageOptions) lockTimeout() (time.Duration, error) {
+	if o.LockTimeout == "" {
+		return DEFAULT_LOCK_TIMEOUT, nil
+	}
+	timeout, err := time.ParseDuration(o.LockTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("некорректный lock_timeout %q", o.LockTimeout)
+	}
+	return timeout, nil
+}
+
+// Validate checks the options without opening the database.
+func (o StorageOptions) Validate() error {
+	_, err := o.lockTimeout()
+	return err
+}
+
+// Open opens (creating if needed) the bbolt database file shared by persistent stores.
+func Open(path string, options StorageOptions) (*bolt.DB, error) {
+	timeout, err := options.lockTimeout()
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, InitialMmapSize: options.InitialMmapSize})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия хранилища %s: %w", path, err)
+	}
+	db.NoSync = options.NoSync
+	return db, nil
+}
+
+// Int64Key encodes an ID as a big-endian key, so keys sort in numeric order.
+// The other stores sharing the database use it too.
+func Int64Key(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// STATE_SHARDS is the number of independently locked partitions of the state store.
+const STATE_SHARDS = 32
+
+// StateStore keeps the conversation state of every user. Implementations must be
+// safe for concurrent use.
+type StateStore interface {
+	// Get returns a copy of the user's state and whether it exists.
+	Get(userID int64) (UserState, bool)
+	// Update calls fn with the user's state while holding its lock, creating an
+	// empty state first if the user has none. fn must not call back into the store.
+	Update(userID int64, fn func(state *UserState))
+	// Delete removes the user's state.
+	Delete(userID int64)
+	// Range calls fn with a copy of every stored state.
+	Range(fn func(userID int64, state UserState))
+}
+
+// stateShard is one partition of ShardedStateStore.
+type stateShard struct {
+	mu     sync.Mutex
+	states map[int64]*UserState
+}
+
+// ShardedStateStore is an in-memory StateStore split into mutex-protected shards,
+// so users in different shards never contend for the same lock.
+type ShardedStateStore struct {
+	seed   maphash.Seed
+	shards [STATE_SHARDS]stateShard
+}
+
+// NewShardedStateStore creates an empty in-memory state store.
+func NewShardedStateStore() *ShardedStateStore {
+	s := &ShardedStateStore{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].states = make(map[int64]*UserState)
+	}
+	return s
+}
+
+// shard returns the partition holding the user's state.
+func (s *ShardedStateStore) shard(userID int64) *stateShard {
+	return &s.shards[maphash.Comparable(s.seed, userID)%STATE_SHARDS]
+}
+
+// Get returns a copy of the user's state and whether it exists.
+func (s *ShardedStateStore) Get(userID int64) (UserState, bool) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	state, exists := shard.states[userID]
+	if !exists {
+		return UserState{}, false
+	}
+	return *state, true
+}
+
+// Update calls fn with the user's state while holding the shard lock.
+func (s *ShardedStateStore) Update(userID int64, fn func(state *UserState)) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	state, exists := shard.states[userID]
+	if !exists {
+		state = &UserState{}
+		shard.states[userID] = state
+	}
+	fn(state)
+}
+
+// Delete removes the user's state.
+func (s *ShardedStateStore) Delete(userID int64) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.states, userID)
+}
+
+// Range calls fn with a copy of every stored state, one shard at a time.
+func (s *ShardedStateStore) Range(fn func(userID int64, state UserState)) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		copies := make(map[int64]UserState, len(shard.states))
+		for userID, state := range shard.states {
+			copies[userID] = *state
+		}
+		shard.mu.Unlock()
+
+		// fn runs without the lock, so it may use the store
+		for userID, state := range copies {
+			fn(userID, state)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShardedStateStoreGetReturnsCopy(t *testing.T) {
+	store := NewShardedStateStore()
+	store.Update(1, func(s *UserState) { s.State = "await_body" })
+
+	state, exists := store.Get(1)
+	if !exists || state.State != "await_body" {
+		t.Fatalf("Get(1) = %+v, %v; want await_body, true", state, exists)
+	}
+
+	state.State = "initial"
+	if got, _ := store.Get(1); got.State != "await_body" {
+		t.Errorf("modifying a copy changed the stored state to %q", got.State)
+	}
+}
+
+func TestShardedStateStoreDelete(t *testing.T) {
+	store := NewShardedStateStore()
+	store.Update(1, func(s *UserState) { s.State = "initial" })
+	store.Delete(1)
+
+	if _, exists := store.Get(1); exists {
+		t.Error("state exists after Delete")
+	}
+	store.Delete(2) // Deleting a missing user must not panic
+}
+
+// TestShardedStateStoreConcurrentUpdates is meant to be run with -race.
+func TestShardedStateStoreConcurrentUpdates(t *testing.T) {
+	const users, workers, updates = 64, 8, 100
+
+	store := NewShardedStateStore()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				for userID := int64(0); userID < users; userID++ {
+					store.Update(userID, func(s *UserState) { s.Body += "x" })
+					store.Get(userID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strings.Repeat("x", workers*updates)
+	for userID := int64(0); userID < users; userID++ {
+		if state, _ := store.Get(userID); state.Body != want {
+			t.Fatalf("user %d got %d updates, want %d", userID, len(state.Body), workers*updates)
+		}
+	}
+}
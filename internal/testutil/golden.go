@@ -0,0 +1,52 @@
+// Package testutil holds the helpers the tests of several packages share: golden
+// file comparison and a stand-in for the Unisender API. Only tests import it.
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// CheckGolden compares got with testdata/golden/name, or writes it there when
+// UPDATE_GOLDEN is set.
+func CheckGolden(t testing.TB, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run with UPDATE_GOLDEN=1 to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s changed; if that was intended, run with UPDATE_GOLDEN=1 and review the diff:\n%s", path, LineDiff(string(want), got))
+	}
+}
+
+// LineDiff lists the lines that differ between the golden file and the output.
+func LineDiff(want, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var diff []string
+	for i := range max(len(wantLines), len(gotLines)) {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			diff = append(diff, "- "+w, "+ "+g)
+		}
+	}
+	return strings.Join(diff, "\n")
+}
@@ -0,0 +1,55 @@
+package testutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// ServeUnisender routes calls to the Unisender API at apiURL to a server answering
+// each call with the next of the given status codes and bodies, repeating the last
+// one. It returns the number of calls made so far.
+func ServeUnisender(t testing.TB, apiURL string, statuses []int, bodies []string) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := min(int(calls.Add(1)), len(statuses)) - 1
+		w.WriteHeader(statuses[i])
+		fmt.Fprint(w, bodies[i])
+	}))
+	t.Cleanup(server.Close)
+	Reroute(t, apiURL, server.URL+"/")
+	return &calls
+}
+
+// Reroute points the requests the default transport makes for the from URL prefix
+// at the to prefix instead, until the test ends. The mailers call providers through
+// the default transport, so this is how the tests reach their fakes.
+func Reroute(t testing.TB, from, to string) {
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = &rerouteTransport{from: from, to: to, next: defaultTransport}
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+}
+
+// rerouteTransport sends requests for one URL prefix to another server.
+type rerouteTransport struct {
+	from, to string
+	next     http.RoundTripper
+}
+
+func (t *rerouteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rest, ok := strings.CutPrefix(req.URL.String(), t.from); ok {
+		target, err := url.Parse(t.to + rest)
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.URL = target
+		req.Host = target.Host
+	}
+	return t.next.RoundTrip(req)
+}